@@ -0,0 +1,231 @@
+// Package acmeclient obtains certificates from an ACME (RFC 8555) server,
+// such as Let's Encrypt or certmanager acme-serve, so that they can be
+// uploaded to a store.
+package acmeclient
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+)
+
+// LetsEncrypt is the directory URL of the Let's Encrypt production
+// environment.
+const LetsEncrypt = acme.LetsEncryptURL
+
+// Challenge types which can be solved.
+const (
+	ChallengeHTTP01 = "http-01"
+	ChallengeDNS01  = "dns-01"
+)
+
+// Solver provisions the response to a challenge, proving control over a
+// domain.
+type Solver interface {
+	// Present provisions the key authorization for the challenge token on
+	// domain.
+	Present(ctx context.Context, domain, token, keyAuthorization string) error
+
+	// CleanUp removes what was provisioned by Present.
+	CleanUp(ctx context.Context, domain, token, keyAuthorization string) error
+}
+
+// Option configures Issue.
+type Option func(*options)
+
+type options struct {
+	solvers    map[string]Solver
+	httpClient *http.Client
+	accountKey crypto.Signer
+	certKey    crypto.Signer
+	contact    []string
+}
+
+// WithSolver sets the solver used for a challenge type, ChallengeHTTP01 or
+// ChallengeDNS01. When the server offers several challenges with a solver,
+// the first offered one is used.
+func WithSolver(challengeType string, solver Solver) Option {
+	return func(o *options) {
+		o.solvers[challengeType] = solver
+	}
+}
+
+// WithHTTPClient sets the client used to talk to the ACME server, e.g. to
+// trust the CA of a private ACME server.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = client
+	}
+}
+
+// WithAccountKey sets the key of the ACME account. By default, a new account
+// is registered with a generated key.
+func WithAccountKey(key crypto.Signer) Option {
+	return func(o *options) {
+		o.accountKey = key
+	}
+}
+
+// WithCertKey sets the key of the issued certificate. By default, a new 2048
+// bit RSA key is generated.
+func WithCertKey(key crypto.Signer) Option {
+	return func(o *options) {
+		o.certKey = key
+	}
+}
+
+// WithContact sets the contact URLs of the ACME account, e.g.
+// mailto:admin@example.com.
+func WithContact(contact ...string) Option {
+	return func(o *options) {
+		o.contact = contact
+	}
+}
+
+// Issue obtains a certificate for domains from the ACME server found at
+// directoryURL. The first domain is used as the common name.
+//
+// The returned CA certificates are the chain provided by the server, leaf
+// first, which typically does not include the root.
+func Issue(
+	ctx context.Context,
+	directoryURL string,
+	domains []string,
+	opts ...Option,
+) (cert *x509.Certificate, caCerts []*x509.Certificate, key crypto.Signer, err error) {
+	if len(domains) == 0 {
+		return nil, nil, nil, errors.New("at least one domain is required")
+	}
+
+	o := options{solvers: make(map[string]Solver)}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(o.solvers) == 0 {
+		return nil, nil, nil, errors.New("at least one solver is required")
+	}
+	if o.accountKey == nil {
+		o.accountKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if o.certKey == nil {
+		o.certKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	client := &acme.Client{
+		Key:          o.accountKey,
+		HTTPClient:   o.httpClient,
+		DirectoryURL: directoryURL,
+	}
+
+	// Register account
+	_, err = client.Register(ctx, &acme.Account{Contact: o.contact}, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, nil, nil, fmt.Errorf("failed to register ACME account, err: %w", err)
+	}
+
+	// Create order and complete its authorizations
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create order, err: %w", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := authorize(ctx, client, authzURL, o.solvers); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("order was not ready, err: %w", err)
+	}
+
+	// Finalize order
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, o.certKey)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create CSR, err: %w", err)
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to finalize order, err: %w", err)
+	}
+
+	certs := make([]*x509.Certificate, 0, len(der))
+	for _, b := range der {
+		c, err := x509.ParseCertificate(b)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to parse issued certificate, err: %w", err)
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, nil, nil, errors.New("server returned no certificates")
+	}
+
+	return certs[0], certs[1:], o.certKey, nil
+}
+
+// authorize completes the authorization found at authzURL with the first
+// offered challenge for which there is a solver.
+func authorize(ctx context.Context, client *acme.Client, authzURL string, solvers map[string]Solver) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("failed to get authorization, err: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	domain := authz.Identifier.Value
+
+	var chal *acme.Challenge
+	var solver Solver
+	for _, c := range authz.Challenges {
+		if s, ok := solvers[c.Type]; ok {
+			chal, solver = c, s
+			break
+		}
+	}
+	if chal == nil {
+		offered := make([]string, 0, len(authz.Challenges))
+		for _, c := range authz.Challenges {
+			offered = append(offered, c.Type)
+		}
+		return fmt.Errorf("no solver for the challenges offered for %v: %v", domain, offered)
+	}
+
+	// The key authorization is the same for all challenge types, it is
+	// only provisioned differently
+	keyAuth, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+	if err := solver.Present(ctx, domain, chal.Token, keyAuth); err != nil {
+		return fmt.Errorf("failed to present %v challenge for %v, err: %w", chal.Type, domain, err)
+	}
+	defer func() {
+		_ = solver.CleanUp(context.Background(), domain, chal.Token, keyAuth)
+	}()
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("failed to accept %v challenge for %v, err: %w", chal.Type, domain, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authzURL); err != nil {
+		return fmt.Errorf("authorization for %v failed, err: %w", domain, err)
+	}
+	return nil
+}
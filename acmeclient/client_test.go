@@ -0,0 +1,175 @@
+package acmeclient
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sebnyberg/certmanager/acmeserver"
+)
+
+// newTestACMEServer starts an in-process ACME server and returns its
+// directory URL and the options needed to trust it.
+func newTestACMEServer(t *testing.T, opts ...acmeserver.Option) (*x509.Certificate, string, []Option) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := acmeserver.New(caCert, nil, key, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewTLSServer(srv)
+	t.Cleanup(ts.Close)
+	return caCert, ts.URL + "/directory", []Option{WithHTTPClient(ts.Client())}
+}
+
+func freePort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func TestIssue_HTTP01(t *testing.T) {
+	port := freePort(t)
+	solverAddr := "127.0.0.1:" + port
+
+	// Resolve the domain to the solver
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr != net.JoinHostPort("app.example.com", port) {
+			return nil, fmt.Errorf("unexpected address %v", addr)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, solverAddr)
+	}
+	validator := acmeserver.HTTP01Validator{Port: port, Client: &http.Client{Transport: transport}}
+	caCert, directoryURL, opts := newTestACMEServer(t,
+		acmeserver.WithValidator(acmeserver.ChallengeHTTP01, validator),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	solver := &HTTP01Solver{Addr: solverAddr}
+	opts = append(opts, WithSolver(ChallengeHTTP01, solver))
+	cert, _, key, err := Issue(ctx, directoryURL, []string{"app.example.com"}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cert.CheckSignatureFrom(caCert); err != nil {
+		t.Errorf("certificate was not signed by the CA, err: %v", err)
+	}
+	if !cert.PublicKey.(*rsa.PublicKey).Equal(key.Public()) {
+		t.Errorf("certificate does not match the returned key")
+	}
+	if solver.srv != nil {
+		t.Errorf("solver server was not stopped")
+	}
+}
+
+func TestIssue_DNS01Hook(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "hook.log")
+	hookPath := filepath.Join(dir, "hook.sh")
+	hook := fmt.Sprintf("#!/bin/sh\necho \"$1 $2 $3\" >> %v\n", logPath)
+	if err := os.WriteFile(hookPath, []byte(hook), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server validates the challenge by checking what the hook was
+	// called with
+	validator := acmeserver.ValidatorFunc(func(ctx context.Context, domain, token, keyAuthorization string) error {
+		b, err := os.ReadFile(logPath)
+		if err != nil {
+			return err
+		}
+		want := fmt.Sprintf("present _acme-challenge.%v. %v", domain, dns01Value(keyAuthorization))
+		if !strings.Contains(string(b), want) {
+			return errors.New("record not found")
+		}
+		return nil
+	})
+	_, directoryURL, opts := newTestACMEServer(t,
+		acmeserver.WithValidator(acmeserver.ChallengeHTTP01, nil),
+		acmeserver.WithValidator(acmeserver.ChallengeDNS01, validator),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opts = append(opts, WithSolver(ChallengeDNS01, DNS01HookSolver{Command: hookPath}))
+	domains := []string{"example.com", "*.example.com"}
+	cert, _, _, err := Issue(ctx, directoryURL, domains, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(domains, cert.DNSNames); diff != "" {
+		t.Errorf("DNSNames mismatch (-want +got):\n%s", diff)
+	}
+
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "cleanup _acme-challenge.example.com."); n != 2 {
+		t.Errorf("want 2 cleanups, got %v:\n%s", n, b)
+	}
+}
+
+func TestIssue_noSolver(t *testing.T) {
+	_, directoryURL, opts := newTestACMEServer(t,
+		acmeserver.WithTrustAll(),
+		acmeserver.WithValidator(acmeserver.ChallengeDNS01, nil),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opts = append(opts, WithSolver(ChallengeDNS01, DNS01HookSolver{Command: "true"}))
+	_, _, _, err := Issue(ctx, directoryURL, []string{"example.com"}, opts...)
+	if err == nil || !strings.Contains(err.Error(), "no solver") {
+		t.Fatalf("want no solver error, got %v", err)
+	}
+}
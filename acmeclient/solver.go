@@ -0,0 +1,139 @@
+package acmeclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP01Solver solves http-01 challenges by serving key authorizations from
+// a standalone HTTP server, which is started while challenges are pending.
+//
+// The server must be reachable by the ACME server on port 80 of the domain,
+// e.g. through a port-forward or a load balancer rule.
+type HTTP01Solver struct {
+	// Addr to listen on, defaults to ":80".
+	Addr string
+
+	mu     sync.Mutex
+	tokens map[string]string
+	srv    *http.Server
+}
+
+func (s *HTTP01Solver) Present(ctx context.Context, domain, token, keyAuthorization string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.srv == nil {
+		addr := s.Addr
+		if addr == "" {
+			addr = ":80"
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %v, err: %w", addr, err)
+		}
+		s.srv = &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+		go func(srv *http.Server) {
+			_ = srv.Serve(ln)
+		}(s.srv)
+	}
+	if s.tokens == nil {
+		s.tokens = make(map[string]string)
+	}
+	s.tokens[token] = keyAuthorization
+	return nil
+}
+
+func (s *HTTP01Solver) CleanUp(ctx context.Context, domain, token, keyAuthorization string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.tokens, token)
+	if len(s.tokens) > 0 || s.srv == nil {
+		return nil
+	}
+	err := s.srv.Close()
+	s.srv = nil
+	return err
+}
+
+func (s *HTTP01Solver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+	if token == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	keyAuth, ok := s.tokens[token]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(keyAuth))
+}
+
+// DNS01HookSolver solves dns-01 challenges by running a hook command which
+// creates or removes the TXT record with the DNS provider. The command is
+// run as:
+//
+//	<command> present <fqdn> <value>
+//	<command> cleanup <fqdn> <value>
+//
+// where fqdn is the record name, e.g. _acme-challenge.example.com., and value
+// is the content of the TXT record.
+type DNS01HookSolver struct {
+	// Command to run.
+	Command string
+
+	// PropagationDelay is how long to wait after the record has been
+	// created before the ACME server is asked to look it up.
+	PropagationDelay time.Duration
+}
+
+func (s DNS01HookSolver) Present(ctx context.Context, domain, token, keyAuthorization string) error {
+	if err := s.run(ctx, "present", domain, keyAuthorization); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(s.PropagationDelay):
+		return nil
+	}
+}
+
+func (s DNS01HookSolver) CleanUp(ctx context.Context, domain, token, keyAuthorization string) error {
+	return s.run(ctx, "cleanup", domain, keyAuthorization)
+}
+
+func (s DNS01HookSolver) run(ctx context.Context, action string, domain string, keyAuthorization string) error {
+	if s.Command == "" {
+		return errors.New("no DNS hook command provided")
+	}
+	fqdn := "_acme-challenge." + domain + "."
+	out, err := exec.CommandContext(ctx, s.Command, action, fqdn, dns01Value(keyAuthorization)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("DNS hook '%v %v' failed, err: %w, output: %s", s.Command, action, err, out)
+	}
+	return nil
+}
+
+// dns01Value returns the content of the TXT record for a dns-01 challenge,
+// see RFC 8555 section 8.4.
+func dns01Value(keyAuthorization string) string {
+	digest := sha256.Sum256([]byte(keyAuthorization))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
@@ -0,0 +1,182 @@
+package acmeserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// jws is a JSON Web Signature in flattened JSON serialization, see RFC 8555
+// section 6.2.
+type jws struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// jwsHeader is the protected header of a JWS sent by an ACME client.
+type jwsHeader struct {
+	Alg   string          `json:"alg"`
+	Nonce string          `json:"nonce"`
+	URL   string          `json:"url"`
+	JWK   json.RawMessage `json:"jwk,omitempty"`
+	KID   string          `json:"kid,omitempty"`
+}
+
+// jwk is a JSON Web Key, see RFC 7517. Only RSA and EC keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// parseJWS decodes the protected header and payload of a JWS without
+// verifying its signature.
+func parseJWS(data []byte) (msg jws, header jwsHeader, payload []byte, err error) {
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return jws{}, jwsHeader{}, nil, fmt.Errorf("failed to parse JWS, err: %v", err)
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(msg.Protected)
+	if err != nil {
+		return jws{}, jwsHeader{}, nil, fmt.Errorf("failed to decode protected header, err: %v", err)
+	}
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return jws{}, jwsHeader{}, nil, fmt.Errorf("failed to parse protected header, err: %v", err)
+	}
+	payload, err = base64.RawURLEncoding.DecodeString(msg.Payload)
+	if err != nil {
+		return jws{}, jwsHeader{}, nil, fmt.Errorf("failed to decode payload, err: %v", err)
+	}
+	return msg, header, payload, nil
+}
+
+// verifyJWS verifies the signature of msg with the provided public key.
+func verifyJWS(msg jws, alg string, pub crypto.PublicKey) error {
+	sig, err := base64.RawURLEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to decode signature, err: %v", err)
+	}
+	signed := []byte(msg.Protected + "." + msg.Payload)
+
+	switch alg {
+	case "RS256":
+		pub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("RS256 requires an RSA key")
+		}
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+	case "ES256", "ES384":
+		pub, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%v requires an EC key", alg)
+		}
+		var digest []byte
+		if alg == "ES256" {
+			d := sha256.Sum256(signed)
+			digest = d[:]
+		} else {
+			d := sha512.Sum384(signed)
+			digest = d[:]
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported signature algorithm '%v'", alg)
+}
+
+// parseJWK parses a JSON Web Key into a public key.
+func parseJWK(data []byte) (crypto.PublicKey, error) {
+	var k jwk
+	if err := json.Unmarshal(data, &k); err != nil {
+		return nil, fmt.Errorf("failed to parse JWK, err: %v", err)
+	}
+
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus, err: %v", err)
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%v'", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC x coordinate, err: %v", err)
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC y coordinate, err: %v", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%v'", k.Kty)
+}
+
+// jwkThumbprint computes the base64url-encoded JWK thumbprint of a public key,
+// see RFC 7638.
+func jwkThumbprint(pub crypto.PublicKey) (string, error) {
+	var canonical string
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		canonical = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`,
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		)
+	case *ecdsa.PublicKey:
+		p := pub.Curve.Params()
+		size := (p.BitSize + 7) / 8
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`,
+			p.Name,
+			base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size))),
+			base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size))),
+		)
+	default:
+		return "", fmt.Errorf("unsupported key type %T", pub)
+	}
+	digest := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(digest[:]), nil
+}
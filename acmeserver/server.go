@@ -0,0 +1,943 @@
+// Package acmeserver implements an ACME (RFC 8555) server which issues
+// certificates signed by a private certificate authority (CA), so that
+// standard ACME clients such as certbot, lego or Caddy can obtain
+// certificates from it.
+//
+// State is kept in memory. Accounts, orders and issued certificates are lost
+// when the server restarts, which ACME clients handle by registering again.
+package acmeserver
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+)
+
+const (
+	// nonceTTL is how long a nonce may be used after it has been issued.
+	nonceTTL = time.Hour
+
+	// orderTTL is how long an order may be pending before it expires.
+	orderTTL = 24 * time.Hour
+
+	// validationTimeout caps the time spent validating a single challenge.
+	validationTimeout = 30 * time.Second
+
+	// maxRequestSize caps the size of request bodies.
+	maxRequestSize = 1 << 20
+)
+
+// Object statuses, see RFC 8555 section 7.1.6.
+const (
+	statusPending     = "pending"
+	statusProcessing  = "processing"
+	statusReady       = "ready"
+	statusValid       = "valid"
+	statusInvalid     = "invalid"
+	statusDeactivated = "deactivated"
+)
+
+// Server is an ACME server. It implements http.Handler and should be served
+// over HTTPS at the root path. The directory is found at /directory.
+type Server struct {
+	caCert     *x509.Certificate
+	caChain    []*x509.Certificate
+	caKey      crypto.Signer
+	validity   time.Duration
+	policy     certmanager.Policy
+	validators map[string]Validator
+
+	mu            sync.Mutex
+	nonces        map[string]time.Time
+	accounts      map[string]*account
+	accountsByKey map[string]*account
+	orders        map[string]*order
+	authzs        map[string]*authorization
+	challenges    map[string]*challenge
+	certs         map[string]*issuedCert
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithValidator sets the validator used for a challenge type, e.g.
+// ChallengeHTTP01 or ChallengeDNS01. Setting a nil validator disables the
+// challenge type.
+func WithValidator(challengeType string, v Validator) Option {
+	return func(s *Server) {
+		if v == nil {
+			delete(s.validators, challengeType)
+			return
+		}
+		s.validators[challengeType] = v
+	}
+}
+
+// WithTrustAll accepts all challenges without validating them. See TrustAll.
+func WithTrustAll() Option {
+	return func(s *Server) {
+		for challengeType := range s.validators {
+			s.validators[challengeType] = TrustAll
+		}
+	}
+}
+
+// WithValidity sets how long issued certificates are valid, 90 days by
+// default. Certificates never outlive the CA.
+func WithValidity(d time.Duration) Option {
+	return func(s *Server) {
+		s.validity = d
+	}
+}
+
+// WithPolicy restricts which certificates may be issued. Orders for names
+// which are not allowed by the policy are rejected.
+func WithPolicy(p certmanager.Policy) Option {
+	return func(s *Server) {
+		s.policy = p
+	}
+}
+
+// New creates a new ACME server which issues certificates signed by caCert.
+// caCerts is the chain of caCert, as returned by certmanager.GetCert, with or
+// without its root.
+//
+// By default, http-01 and dns-01 challenges are validated with
+// HTTP01Validator and DNS01Validator.
+func New(caCert *x509.Certificate, caCerts []*x509.Certificate, caKey crypto.Signer, opts ...Option) (*Server, error) {
+	caChain, _, err := certmanager.BuildPartialChain(caCert, caCerts)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		caCert:   caCert,
+		caChain:  caChain,
+		caKey:    caKey,
+		validity: 90 * 24 * time.Hour,
+		validators: map[string]Validator{
+			ChallengeHTTP01: HTTP01Validator{},
+			ChallengeDNS01:  DNS01Validator{},
+		},
+		nonces:        make(map[string]time.Time),
+		accounts:      make(map[string]*account),
+		accountsByKey: make(map[string]*account),
+		orders:        make(map[string]*order),
+		authzs:        make(map[string]*authorization),
+		challenges:    make(map[string]*challenge),
+		certs:         make(map[string]*issuedCert),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type account struct {
+	id         string
+	key        crypto.PublicKey
+	thumbprint string
+	status     string
+	contact    []string
+	orderIDs   []string
+}
+
+type order struct {
+	id          string
+	accountID   string
+	status      string
+	expires     time.Time
+	identifiers []identifier
+	authzIDs    []string
+	certID      string
+	err         *problem
+}
+
+type authorization struct {
+	id           string
+	orderID      string
+	identifier   identifier
+	wildcard     bool
+	status       string
+	expires      time.Time
+	challengeIDs []string
+}
+
+type challenge struct {
+	id        string
+	authzID   string
+	typ       string
+	token     string
+	status    string
+	validated time.Time
+	err       *problem
+}
+
+type issuedCert struct {
+	accountID string
+	chain     []byte
+}
+
+// request is an authenticated ACME request.
+type request struct {
+	base    string
+	account *account
+	jwk     crypto.PublicKey
+	payload []byte
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	base := baseURL(r)
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "directory" && r.Method == http.MethodGet:
+		s.handleDirectory(w, base)
+		return
+	case path == "new-nonce" && (r.Method == http.MethodHead || r.Method == http.MethodGet):
+		w.Header().Set("Replay-Nonce", s.newNonce())
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	case r.Method != http.MethodPost:
+		writeProblem(w, http.StatusMethodNotAllowed, "malformed", "method not allowed")
+		return
+	}
+
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Add("Link", fmt.Sprintf("<%v/directory>;rel=\"index\"", base))
+
+	req, ok := s.authenticate(w, r, base, path == "new-account" || path == "revoke-cert")
+	if !ok {
+		return
+	}
+
+	switch {
+	case path == "new-account":
+		s.handleNewAccount(w, req)
+	case len(parts) == 2 && parts[0] == "account":
+		s.handleAccount(w, req, parts[1])
+	case len(parts) == 3 && parts[0] == "account" && parts[2] == "orders":
+		s.handleAccountOrders(w, req, parts[1])
+	case path == "new-order":
+		s.handleNewOrder(w, req)
+	case len(parts) == 2 && parts[0] == "order":
+		s.handleOrder(w, req, parts[1])
+	case len(parts) == 3 && parts[0] == "order" && parts[2] == "finalize":
+		s.handleFinalize(w, req, parts[1])
+	case len(parts) == 2 && parts[0] == "authz":
+		s.handleAuthz(w, req, parts[1])
+	case len(parts) == 2 && parts[0] == "challenge":
+		s.handleChallenge(w, req, parts[1])
+	case len(parts) == 2 && parts[0] == "cert":
+		s.handleCert(w, req, parts[1])
+	case path == "revoke-cert", path == "key-change":
+		writeProblem(w, http.StatusForbidden, "unauthorized", path+" is not supported by this server")
+	default:
+		writeProblem(w, http.StatusNotFound, "malformed", "resource not found")
+	}
+}
+
+func (s *Server) handleDirectory(w http.ResponseWriter, base string) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"newNonce":   base + "/new-nonce",
+		"newAccount": base + "/new-account",
+		"newOrder":   base + "/new-order",
+		"revokeCert": base + "/revoke-cert",
+		"keyChange":  base + "/key-change",
+	})
+}
+
+// authenticate reads and verifies the JWS in the request body. If allowJWK is
+// true, the request may be signed with a new key provided in the header,
+// otherwise it must be signed with the key of an existing account.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request, base string, allowJWK bool) (*request, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", "failed to read request body")
+		return nil, false
+	}
+	msg, header, payload, err := parseJWS(body)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return nil, false
+	}
+	if header.URL != base+r.URL.Path {
+		writeProblem(w, http.StatusUnauthorized, "unauthorized", "url in protected header does not match the request URL")
+		return nil, false
+	}
+	if !s.consumeNonce(header.Nonce) {
+		writeProblem(w, http.StatusBadRequest, "badNonce", "invalid or expired nonce")
+		return nil, false
+	}
+
+	req := &request{base: base, payload: payload}
+	var pub crypto.PublicKey
+	switch {
+	case len(header.JWK) > 0 && header.KID == "":
+		if !allowJWK {
+			writeProblem(w, http.StatusBadRequest, "malformed", "request must be signed with an account key (kid)")
+			return nil, false
+		}
+		pub, err = parseJWK(header.JWK)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, "badPublicKey", err.Error())
+			return nil, false
+		}
+		req.jwk = pub
+	case header.KID != "" && len(header.JWK) == 0:
+		id := strings.TrimPrefix(header.KID, base+"/account/")
+		var status string
+		s.mu.Lock()
+		acct, ok := s.accounts[id]
+		if ok {
+			status, pub = acct.status, acct.key
+		}
+		s.mu.Unlock()
+		if !ok || header.KID != base+"/account/"+id {
+			writeProblem(w, http.StatusBadRequest, "accountDoesNotExist", "account does not exist")
+			return nil, false
+		}
+		if status != statusValid {
+			writeProblem(w, http.StatusUnauthorized, "unauthorized", "account is not valid")
+			return nil, false
+		}
+		req.account = acct
+	default:
+		writeProblem(w, http.StatusBadRequest, "malformed", "exactly one of jwk and kid must be provided")
+		return nil, false
+	}
+
+	if err := verifyJWS(msg, header.Alg, pub); err != nil {
+		writeProblem(w, http.StatusBadRequest, "badSignatureAlgorithm", err.Error())
+		return nil, false
+	}
+
+	return req, true
+}
+
+func (s *Server) handleNewAccount(w http.ResponseWriter, req *request) {
+	var payload struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", "invalid account payload")
+		return
+	}
+	if req.jwk == nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", "new accounts must be signed with a jwk")
+		return
+	}
+	thumbprint, err := jwkThumbprint(req.jwk)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "badPublicKey", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if acct, ok := s.accountsByKey[thumbprint]; ok {
+		w.Header().Set("Location", req.base+"/account/"+acct.id)
+		writeJSON(w, http.StatusOK, s.accountResponse(req.base, acct))
+		return
+	}
+	if payload.OnlyReturnExisting {
+		writeProblem(w, http.StatusBadRequest, "accountDoesNotExist", "account does not exist")
+		return
+	}
+
+	acct := &account{
+		id:         newID(),
+		key:        req.jwk,
+		thumbprint: thumbprint,
+		status:     statusValid,
+		contact:    payload.Contact,
+	}
+	s.accounts[acct.id] = acct
+	s.accountsByKey[thumbprint] = acct
+
+	w.Header().Set("Location", req.base+"/account/"+acct.id)
+	writeJSON(w, http.StatusCreated, s.accountResponse(req.base, acct))
+}
+
+func (s *Server) handleAccount(w http.ResponseWriter, req *request, id string) {
+	if req.account.id != id {
+		writeProblem(w, http.StatusUnauthorized, "unauthorized", "account does not belong to the requester")
+		return
+	}
+
+	var payload struct {
+		Contact []string `json:"contact"`
+		Status  string   `json:"status"`
+	}
+	if len(req.payload) > 0 {
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			writeProblem(w, http.StatusBadRequest, "malformed", "invalid account payload")
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if payload.Contact != nil {
+		req.account.contact = payload.Contact
+	}
+	if payload.Status == statusDeactivated {
+		req.account.status = statusDeactivated
+	}
+	writeJSON(w, http.StatusOK, s.accountResponse(req.base, req.account))
+}
+
+func (s *Server) handleAccountOrders(w http.ResponseWriter, req *request, id string) {
+	if req.account.id != id {
+		writeProblem(w, http.StatusUnauthorized, "unauthorized", "account does not belong to the requester")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orders := make([]string, 0, len(req.account.orderIDs))
+	for _, orderID := range req.account.orderIDs {
+		orders = append(orders, req.base+"/order/"+orderID)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"orders": orders})
+}
+
+func (s *Server) handleNewOrder(w http.ResponseWriter, req *request) {
+	var payload struct {
+		Identifiers []identifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", "invalid order payload")
+		return
+	}
+	if len(payload.Identifiers) == 0 {
+		writeProblem(w, http.StatusBadRequest, "malformed", "order must contain at least one identifier")
+		return
+	}
+	names := make([]string, 0, len(payload.Identifiers))
+	for _, id := range payload.Identifiers {
+		if err := validateIdentifier(id); err != nil {
+			writeProblem(w, http.StatusBadRequest, "rejectedIdentifier", err.Error())
+			return
+		}
+		names = append(names, id.Value)
+	}
+	if err := s.policy.Check(&x509.Certificate{DNSNames: names}); err != nil {
+		writeProblem(w, http.StatusForbidden, "rejectedIdentifier", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	o := &order{
+		id:          newID(),
+		accountID:   req.account.id,
+		status:      statusPending,
+		expires:     now.Add(orderTTL),
+		identifiers: payload.Identifiers,
+	}
+	for _, id := range payload.Identifiers {
+		authz := &authorization{
+			id:         newID(),
+			orderID:    o.id,
+			identifier: id,
+			status:     statusPending,
+			expires:    o.expires,
+		}
+		if strings.HasPrefix(id.Value, "*.") {
+			authz.wildcard = true
+			authz.identifier.Value = strings.TrimPrefix(id.Value, "*.")
+		}
+
+		// Wildcard names can only be validated through DNS
+		challengeTypes := make([]string, 0, len(s.validators))
+		for challengeType := range s.validators {
+			if authz.wildcard && challengeType != ChallengeDNS01 {
+				continue
+			}
+			challengeTypes = append(challengeTypes, challengeType)
+		}
+		if len(challengeTypes) == 0 {
+			writeProblem(w, http.StatusBadRequest, "rejectedIdentifier", "no challenge type can validate "+id.Value)
+			return
+		}
+		sort.Strings(challengeTypes)
+
+		for _, challengeType := range challengeTypes {
+			ch := &challenge{
+				id:      newID(),
+				authzID: authz.id,
+				typ:     challengeType,
+				token:   newID(),
+				status:  statusPending,
+			}
+			s.challenges[ch.id] = ch
+			authz.challengeIDs = append(authz.challengeIDs, ch.id)
+		}
+		s.authzs[authz.id] = authz
+		o.authzIDs = append(o.authzIDs, authz.id)
+	}
+	s.orders[o.id] = o
+	req.account.orderIDs = append(req.account.orderIDs, o.id)
+
+	w.Header().Set("Location", req.base+"/order/"+o.id)
+	writeJSON(w, http.StatusCreated, s.orderResponse(req.base, o))
+}
+
+func (s *Server) handleOrder(w http.ResponseWriter, req *request, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[id]
+	if !ok || o.accountID != req.account.id {
+		writeProblem(w, http.StatusNotFound, "malformed", "order not found")
+		return
+	}
+	s.expireOrder(o)
+	writeJSON(w, http.StatusOK, s.orderResponse(req.base, o))
+}
+
+func (s *Server) handleFinalize(w http.ResponseWriter, req *request, id string) {
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", "invalid finalize payload")
+		return
+	}
+	csrDER, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "badCSR", "failed to decode CSR")
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "badCSR", "failed to parse CSR")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[id]
+	if !ok || o.accountID != req.account.id {
+		writeProblem(w, http.StatusNotFound, "malformed", "order not found")
+		return
+	}
+	s.expireOrder(o)
+	if o.status != statusReady {
+		writeProblem(w, http.StatusForbidden, "orderNotReady", fmt.Sprintf("order is %v, not %v", o.status, statusReady))
+		return
+	}
+	if err := matchCSR(csr, o.identifiers); err != nil {
+		writeProblem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+
+	cert, err := certmanager.SignCSR(s.caCert, s.caKey, csr, time.Now().Add(s.validity), certmanager.WithPolicy(s.policy))
+	if err != nil {
+		errType, status := "badCSR", http.StatusBadRequest
+		if errors.Is(err, certmanager.ErrPolicyViolation) {
+			errType, status = "rejectedIdentifier", http.StatusForbidden
+		}
+		o.status = statusInvalid
+		o.err = &problem{Type: problemType(errType), Detail: err.Error(), Status: status}
+		writeProblem(w, status, errType, err.Error())
+		return
+	}
+
+	// Chain should contain leaf -> issuer -> intermediary, without the root
+	certs := append([]*x509.Certificate{cert}, s.caChain...)
+	var chain []byte
+	for _, c := range certs {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+
+	certID := newID()
+	s.certs[certID] = &issuedCert{accountID: req.account.id, chain: chain}
+	o.certID = certID
+	o.status = statusValid
+
+	w.Header().Set("Location", req.base+"/order/"+o.id)
+	writeJSON(w, http.StatusOK, s.orderResponse(req.base, o))
+}
+
+func (s *Server) handleAuthz(w http.ResponseWriter, req *request, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	authz, ok := s.authzs[id]
+	if !ok || s.orders[authz.orderID].accountID != req.account.id {
+		writeProblem(w, http.StatusNotFound, "malformed", "authorization not found")
+		return
+	}
+
+	var payload struct {
+		Status string `json:"status"`
+	}
+	if len(req.payload) > 0 {
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			writeProblem(w, http.StatusBadRequest, "malformed", "invalid authorization payload")
+			return
+		}
+	}
+	if payload.Status == statusDeactivated {
+		authz.status = statusDeactivated
+		s.updateOrder(s.orders[authz.orderID])
+	}
+
+	writeJSON(w, http.StatusOK, s.authzResponse(req.base, authz))
+}
+
+func (s *Server) handleChallenge(w http.ResponseWriter, req *request, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch, ok := s.challenges[id]
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "malformed", "challenge not found")
+		return
+	}
+	authz := s.authzs[ch.authzID]
+	if s.orders[authz.orderID].accountID != req.account.id {
+		writeProblem(w, http.StatusNotFound, "malformed", "challenge not found")
+		return
+	}
+
+	// A POST-as-GET only returns the challenge, an empty object starts the
+	// validation
+	if len(req.payload) > 0 && ch.status == statusPending && authz.status == statusPending {
+		ch.status = statusProcessing
+		keyAuth := ch.token + "." + req.account.thumbprint
+		go s.validate(ch, authz, s.validators[ch.typ], keyAuth)
+	}
+
+	w.Header().Add("Link", fmt.Sprintf("<%v/authz/%v>;rel=\"up\"", req.base, authz.id))
+	writeJSON(w, http.StatusOK, s.challengeResponse(req.base, ch))
+}
+
+func (s *Server) handleCert(w http.ResponseWriter, req *request, id string) {
+	s.mu.Lock()
+	c, ok := s.certs[id]
+	s.mu.Unlock()
+	if !ok || c.accountID != req.account.id {
+		writeProblem(w, http.StatusNotFound, "malformed", "certificate not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(c.chain)
+}
+
+// validate validates a challenge and updates the authorization and order
+// accordingly.
+func (s *Server) validate(ch *challenge, authz *authorization, v Validator, keyAuth string) {
+	s.mu.Lock()
+	domain, token := authz.identifier.Value, ch.token
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), validationTimeout)
+	defer cancel()
+	var err error
+	if v == nil {
+		err = fmt.Errorf("challenge type %v is not supported", ch.typ)
+	} else {
+		err = v.Validate(ctx, domain, token, keyAuth)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		ch.status = statusInvalid
+		ch.err = &problem{Type: problemType("incorrectResponse"), Detail: err.Error(), Status: http.StatusForbidden}
+		authz.status = statusInvalid
+	} else {
+		ch.status = statusValid
+		ch.validated = time.Now()
+		authz.status = statusValid
+	}
+	// The order may have been pruned during validation
+	if o, ok := s.orders[authz.orderID]; ok {
+		s.updateOrder(o)
+	}
+}
+
+// updateOrder moves a pending order to ready once all its authorizations are
+// valid, or to invalid if any of them failed.
+func (s *Server) updateOrder(o *order) {
+	if o.status != statusPending {
+		return
+	}
+	ready := true
+	for _, authzID := range o.authzIDs {
+		switch s.authzs[authzID].status {
+		case statusValid:
+		case statusPending:
+			ready = false
+		default:
+			o.status = statusInvalid
+			return
+		}
+	}
+	if ready {
+		o.status = statusReady
+	}
+}
+
+// expireOrder invalidates the order if it has expired before being issued.
+func (s *Server) expireOrder(o *order) {
+	if o.status != statusValid && o.status != statusInvalid && time.Now().After(o.expires) {
+		o.status = statusInvalid
+	}
+}
+
+func (s *Server) accountResponse(base string, acct *account) interface{} {
+	return map[string]interface{}{
+		"status":  acct.status,
+		"contact": acct.contact,
+		"orders":  base + "/account/" + acct.id + "/orders",
+	}
+}
+
+func (s *Server) orderResponse(base string, o *order) interface{} {
+	authzs := make([]string, 0, len(o.authzIDs))
+	for _, authzID := range o.authzIDs {
+		authzs = append(authzs, base+"/authz/"+authzID)
+	}
+	resp := map[string]interface{}{
+		"status":         o.status,
+		"expires":        o.expires.UTC().Format(time.RFC3339),
+		"identifiers":    o.identifiers,
+		"authorizations": authzs,
+		"finalize":       base + "/order/" + o.id + "/finalize",
+	}
+	if o.certID != "" {
+		resp["certificate"] = base + "/cert/" + o.certID
+	}
+	if o.err != nil {
+		resp["error"] = o.err
+	}
+	return resp
+}
+
+func (s *Server) authzResponse(base string, authz *authorization) interface{} {
+	challenges := make([]interface{}, 0, len(authz.challengeIDs))
+	for _, challengeID := range authz.challengeIDs {
+		challenges = append(challenges, s.challengeResponse(base, s.challenges[challengeID]))
+	}
+	resp := map[string]interface{}{
+		"identifier": authz.identifier,
+		"status":     authz.status,
+		"expires":    authz.expires.UTC().Format(time.RFC3339),
+		"challenges": challenges,
+	}
+	if authz.wildcard {
+		resp["wildcard"] = true
+	}
+	return resp
+}
+
+func (s *Server) challengeResponse(base string, ch *challenge) interface{} {
+	resp := map[string]interface{}{
+		"type":   ch.typ,
+		"url":    base + "/challenge/" + ch.id,
+		"status": ch.status,
+		"token":  ch.token,
+	}
+	if !ch.validated.IsZero() {
+		resp["validated"] = ch.validated.UTC().Format(time.RFC3339)
+	}
+	if ch.err != nil {
+		resp["error"] = ch.err
+	}
+	return resp
+}
+
+func (s *Server) newNonce() string {
+	nonce := newID()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.nonces[nonce] = now.Add(nonceTTL)
+
+	// Prune expired state once in a while
+	if len(s.nonces)%1024 == 0 {
+		s.prune(now)
+	}
+	return nonce
+}
+
+// prune removes expired nonces, and expired orders along with their
+// authorizations, challenges and certificates. Issued certificates can thus
+// be downloaded until the order would have expired. s.mu must be held.
+func (s *Server) prune(now time.Time) {
+	for n, expires := range s.nonces {
+		if now.After(expires) {
+			delete(s.nonces, n)
+		}
+	}
+
+	pruned := make(map[string]bool)
+	for id, o := range s.orders {
+		if !now.After(o.expires) {
+			continue
+		}
+		for _, authzID := range o.authzIDs {
+			for _, challengeID := range s.authzs[authzID].challengeIDs {
+				delete(s.challenges, challengeID)
+			}
+			delete(s.authzs, authzID)
+		}
+		delete(s.certs, o.certID)
+		delete(s.orders, id)
+		pruned[id] = true
+	}
+	if len(pruned) == 0 {
+		return
+	}
+	for _, acct := range s.accounts {
+		orderIDs := acct.orderIDs[:0]
+		for _, id := range acct.orderIDs {
+			if !pruned[id] {
+				orderIDs = append(orderIDs, id)
+			}
+		}
+		acct.orderIDs = orderIDs
+	}
+}
+
+func (s *Server) consumeNonce(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires, ok := s.nonces[nonce]
+	delete(s.nonces, nonce)
+	return ok && time.Now().Before(expires)
+}
+
+// validateIdentifier checks that id is a DNS name which may be requested.
+// IP addresses must use the ip identifier type (RFC 8738), which is not
+// supported.
+func validateIdentifier(id identifier) error {
+	if id.Type != "dns" {
+		return fmt.Errorf("identifier type '%v' is not supported", id.Type)
+	}
+	name := strings.TrimPrefix(id.Value, "*.")
+	if name == "" || strings.ContainsAny(name, "*/: []") {
+		return fmt.Errorf("invalid DNS name '%v'", id.Value)
+	}
+	if net.ParseIP(name) != nil {
+		return fmt.Errorf("'%v' is an IP address, not a DNS name", id.Value)
+	}
+	return nil
+}
+
+// matchCSR checks that the names requested by the CSR are exactly the
+// identifiers of the order.
+func matchCSR(csr *x509.CertificateRequest, identifiers []identifier) error {
+	if len(csr.IPAddresses) > 0 || len(csr.URIs) > 0 || len(csr.EmailAddresses) > 0 {
+		return fmt.Errorf("CSR may only contain DNS names")
+	}
+
+	want := make(map[string]bool)
+	for _, id := range identifiers {
+		want[strings.ToLower(id.Value)] = true
+	}
+	got := make(map[string]bool)
+	for _, name := range csr.DNSNames {
+		got[strings.ToLower(name)] = true
+	}
+	if cn := csr.Subject.CommonName; cn != "" {
+		if !want[strings.ToLower(cn)] {
+			return fmt.Errorf("CSR common name %v is not part of the order", cn)
+		}
+		got[strings.ToLower(cn)] = true
+	}
+
+	if len(got) != len(want) {
+		return fmt.Errorf("CSR names do not match the order identifiers")
+	}
+	for name := range got {
+		if !want[name] {
+			return fmt.Errorf("CSR name %v is not part of the order", name)
+		}
+	}
+	return nil
+}
+
+// problem is an ACME error, see RFC 8555 section 6.7.
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func problemType(typ string) string {
+	return "urn:ietf:params:acme:error:" + typ
+}
+
+func writeProblem(w http.ResponseWriter, statusCode int, typ string, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(problem{
+		Type:   problemType(typ),
+		Detail: detail,
+		Status: statusCode,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func baseURL(r *http.Request) string {
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	return scheme + "://" + r.Host
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
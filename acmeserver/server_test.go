@@ -0,0 +1,276 @@
+package acmeserver
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sebnyberg/certmanager"
+	"golang.org/x/crypto/acme"
+)
+
+func newTestServer(t *testing.T, caCert *x509.Certificate, caKey crypto.Signer, opts ...Option) *Server {
+	t.Helper()
+	srv, err := New(caCert, nil, caKey, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func newTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// newTestClient starts srv and registers a new account with it.
+func newTestClient(t *testing.T, srv *Server) *acme.Client {
+	t.Helper()
+	ts := httptest.NewTLSServer(srv)
+	t.Cleanup(ts.Close)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &acme.Client{
+		Key:          key,
+		HTTPClient:   ts.Client(),
+		DirectoryURL: ts.URL + "/directory",
+	}
+	if _, err := client.Register(context.Background(), &acme.Account{}, acme.AcceptTOS); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// issue runs the full ACME flow for domains and returns the issued chain.
+func issue(ctx context.Context, client *acme.Client, challengeType string, domains []string, csrDomains []string) ([][]byte, error) {
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		return nil, err
+	}
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return nil, err
+		}
+		var chal *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == challengeType {
+				chal = c
+			}
+		}
+		if chal == nil {
+			return nil, errors.New("no " + challengeType + " challenge offered")
+		}
+		if _, err := client.Accept(ctx, chal); err != nil {
+			return nil, err
+		}
+		if _, err := client.WaitAuthorization(ctx, authzURL); err != nil {
+			return nil, err
+		}
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: csrDomains,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	return der, err
+}
+
+func TestServer(t *testing.T) {
+	caCert, caKey := newTestCA(t)
+	failAll := ValidatorFunc(func(ctx context.Context, domain, token, keyAuthorization string) error {
+		return errors.New("nope")
+	})
+
+	for _, tc := range []struct {
+		name          string
+		opts          []Option
+		challengeType string
+		domains       []string
+		csrDomains    []string
+		wantErr       string
+	}{
+		{"trust all", []Option{WithTrustAll()}, ChallengeHTTP01, []string{"a.example.com", "b.example.com"}, []string{"a.example.com", "b.example.com"}, ""},
+		{"wildcard", []Option{WithTrustAll()}, ChallengeDNS01, []string{"*.example.com"}, []string{"*.example.com"}, ""},
+		{"wildcard http-01", []Option{WithTrustAll()}, ChallengeHTTP01, []string{"*.example.com"}, []string{"*.example.com"}, "no http-01 challenge offered"},
+		{"failed validation", []Option{WithValidator(ChallengeDNS01, failAll)}, ChallengeDNS01, []string{"a.example.com"}, []string{"a.example.com"}, "nope"},
+		{"csr mismatch", []Option{WithTrustAll()}, ChallengeHTTP01, []string{"a.example.com"}, []string{"b.example.com"}, "badCSR"},
+		{"ip address", []Option{WithTrustAll()}, ChallengeHTTP01, []string{"127.0.0.1"}, []string{"127.0.0.1"}, "rejectedIdentifier"},
+		{"policy name", []Option{WithTrustAll(), WithPolicy(certmanager.Policy{AllowedNames: []string{"*.example.com"}})}, ChallengeHTTP01, []string{"a.example.org"}, []string{"a.example.org"}, "rejectedIdentifier"},
+		{"policy wildcard", []Option{WithTrustAll(), WithPolicy(certmanager.Policy{DenyWildcards: true})}, ChallengeDNS01, []string{"*.example.com"}, []string{"*.example.com"}, "rejectedIdentifier"},
+		{"policy validity", []Option{WithTrustAll(), WithPolicy(certmanager.Policy{MaxValidity: time.Minute})}, ChallengeHTTP01, []string{"a.example.com"}, []string{"a.example.com"}, "rejectedIdentifier"},
+		{"policy allowed", []Option{WithTrustAll(), WithValidity(time.Minute), WithPolicy(certmanager.Policy{AllowedNames: []string{"*.example.com"}, DenyWildcards: true, MaxValidity: time.Minute})}, ChallengeHTTP01, []string{"a.example.com"}, []string{"a.example.com"}, ""},
+		{"unsupported challenge", []Option{WithTrustAll(), WithValidator(ChallengeDNS01, nil)}, ChallengeDNS01, []string{"a.example.com"}, []string{"a.example.com"}, "no dns-01 challenge offered"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			client := newTestClient(t, newTestServer(t, caCert, caKey, tc.opts...))
+			chain, err := issue(ctx, client, tc.challengeType, tc.domains, tc.csrDomains)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("want err containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cert, err := x509.ParseCertificate(chain[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.domains, cert.DNSNames); diff != "" {
+				t.Errorf("DNSNames mismatch (-want +got):\n%s", diff)
+			}
+			if err := cert.CheckSignatureFrom(caCert); err != nil {
+				t.Errorf("certificate was not signed by the CA, err: %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_HTTP01(t *testing.T) {
+	caCert, caKey := newTestCA(t)
+
+	// The challenge server maps tokens to key authorizations
+	var client *acme.Client
+	challengeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+		keyAuth, err := client.HTTP01ChallengeResponse(token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(keyAuth))
+	}))
+	defer challengeSrv.Close()
+	_, port, err := net.SplitHostPort(challengeSrv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Resolve the domain to the challenge server
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr != net.JoinHostPort("app.example.com", port) {
+			return nil, fmt.Errorf("unexpected address %v", addr)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, challengeSrv.Listener.Addr().String())
+	}
+	validator := HTTP01Validator{Port: port, Client: &http.Client{Transport: transport}}
+
+	srv := newTestServer(t, caCert, caKey, WithValidator(ChallengeHTTP01, validator))
+	client = newTestClient(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := issue(ctx, client, ChallengeHTTP01, []string{"app.example.com"}, []string{"app.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_badNonce(t *testing.T) {
+	caCert, caKey := newTestCA(t)
+	srv := newTestServer(t, caCert, caKey)
+	if srv.consumeNonce("unknown") {
+		t.Fatal("unknown nonce was accepted")
+	}
+	nonce := srv.newNonce()
+	if !srv.consumeNonce(nonce) {
+		t.Fatal("nonce was rejected")
+	}
+	if srv.consumeNonce(nonce) {
+		t.Fatal("nonce was accepted twice")
+	}
+}
+
+func TestServer_prune(t *testing.T) {
+	caCert, caKey := newTestCA(t)
+	srv := newTestServer(t, caCert, caKey, WithTrustAll())
+	client := newTestClient(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := issue(ctx, client, ChallengeHTTP01, []string{"a.example.com"}, []string{"a.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if len(srv.orders) != 1 || len(srv.authzs) != 1 || len(srv.challenges) == 0 || len(srv.certs) != 1 {
+		t.Fatalf("want state for 1 order, got %v orders, %v authzs, %v challenges and %v certs",
+			len(srv.orders), len(srv.authzs), len(srv.challenges), len(srv.certs))
+	}
+	srv.prune(time.Now())
+	if len(srv.orders) != 1 {
+		t.Fatal("order was pruned before it expired")
+	}
+
+	srv.prune(time.Now().Add(orderTTL + time.Minute))
+	if len(srv.orders) != 0 || len(srv.authzs) != 0 || len(srv.challenges) != 0 || len(srv.certs) != 0 {
+		t.Errorf("want no state, got %v orders, %v authzs, %v challenges and %v certs",
+			len(srv.orders), len(srv.authzs), len(srv.challenges), len(srv.certs))
+	}
+	for _, acct := range srv.accounts {
+		if len(acct.orderIDs) != 0 {
+			t.Errorf("want pruned orders removed from account, got %v", acct.orderIDs)
+		}
+	}
+	if len(srv.nonces) != 0 {
+		t.Errorf("want expired nonces pruned, got %v", len(srv.nonces))
+	}
+}
@@ -0,0 +1,115 @@
+package acmeserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Challenge types supported by the server.
+const (
+	ChallengeHTTP01 = "http-01"
+	ChallengeDNS01  = "dns-01"
+)
+
+// Validator validates that an ACME client controls an identifier.
+type Validator interface {
+	// Validate returns nil if the client has provisioned the key
+	// authorization for the challenge token on domain.
+	Validate(ctx context.Context, domain, token, keyAuthorization string) error
+}
+
+// ValidatorFunc is an adapter to allow the use of ordinary functions as
+// validators.
+type ValidatorFunc func(ctx context.Context, domain, token, keyAuthorization string) error
+
+func (f ValidatorFunc) Validate(ctx context.Context, domain, token, keyAuthorization string) error {
+	return f(ctx, domain, token, keyAuthorization)
+}
+
+// TrustAll accepts every challenge without contacting the client. It should
+// only be used on internal networks where any client may be trusted to
+// request certificates for any name.
+var TrustAll Validator = ValidatorFunc(func(ctx context.Context, domain, token, keyAuthorization string) error {
+	return nil
+})
+
+// HTTP01Validator validates http-01 challenges by fetching the key
+// authorization from http://{domain}/.well-known/acme-challenge/{token}.
+type HTTP01Validator struct {
+	// Port to connect to, defaults to 80.
+	Port string
+
+	// Client used to fetch the key authorization, defaults to a client
+	// with a 10 second timeout.
+	Client *http.Client
+}
+
+func (v HTTP01Validator) Validate(ctx context.Context, domain, token, keyAuthorization string) error {
+	port := v.Port
+	if port == "" {
+		port = "80"
+	}
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	url := fmt.Sprintf("http://%v/.well-known/acme-challenge/%v", net.JoinHostPort(domain, port), token)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %v, err: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %v returned status code %v", url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return fmt.Errorf("failed to read response from %v, err: %w", url, err)
+	}
+	if strings.TrimSpace(string(body)) != keyAuthorization {
+		return fmt.Errorf("key authorization returned by %v did not match", url)
+	}
+	return nil
+}
+
+// DNS01Validator validates dns-01 challenges by looking up the TXT record
+// _acme-challenge.{domain}.
+type DNS01Validator struct {
+	// Resolver used for lookups, defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+}
+
+func (v DNS01Validator) Validate(ctx context.Context, domain, token, keyAuthorization string) error {
+	resolver := v.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	name := "_acme-challenge." + domain
+	records, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to look up TXT record %v, err: %w", name, err)
+	}
+
+	digest := sha256.Sum256([]byte(keyAuthorization))
+	want := base64.RawURLEncoding.EncodeToString(digest[:])
+	for _, r := range records {
+		if r == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("no TXT record %v matched the key authorization", name)
+}
@@ -0,0 +1,443 @@
+// Package agent keeps certificates on disk fresh. An Agent periodically
+// checks the certificates listed in its config, renews those which are about
+// to expire, writes them atomically with the configured permissions and
+// notifies the processes which use them, e.g. by sending SIGHUP.
+package agent
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"github.com/sebnyberg/certmanager/issueserver"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// defaultValidity is the validity of certificates issued with a CA from the
+// store, unless configured.
+const defaultValidity = 30 * 24 * time.Hour
+
+// Agent keeps the certificates of its config fresh.
+type Agent struct {
+	conf   Config
+	store  *certmanager.Store
+	logger *log.Logger
+	now    func() time.Time
+}
+
+// Option configures an Agent.
+type Option func(*Agent)
+
+// WithStore sets the store used to fetch certificates and CAs. By default,
+// the store shared by the package-level functions of certmanager is used.
+func WithStore(s *certmanager.Store) Option {
+	return func(a *Agent) {
+		a.store = s
+	}
+}
+
+// WithLogger logs renewals and errors to l, log.Default() by default.
+func WithLogger(l *log.Logger) Option {
+	return func(a *Agent) {
+		a.logger = l
+	}
+}
+
+// New creates an agent for the config.
+func New(conf Config, opts ...Option) (*Agent, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	a := &Agent{
+		conf:   conf,
+		logger: log.Default(),
+		now:    time.Now,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a, nil
+}
+
+// Run checks all certificates every check interval until ctx is done.
+// Failures are logged and retried on the next check.
+func (a *Agent) Run(ctx context.Context) error {
+	interval := a.conf.CheckInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_ = a.CheckAll(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckAll checks every certificate once, renewing those which are due, and
+// returns an error if any of them failed.
+func (a *Agent) CheckAll(ctx context.Context) error {
+	var failed []string
+	for _, c := range a.conf.Certificates {
+		if err := a.check(ctx, c); err != nil {
+			a.logger.Printf("certificate %v: %v", c.Name, err)
+			failed = append(failed, c.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to check certificates: %v", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// check renews the certificate if it is due, and ensures that its files
+// have the configured permissions.
+func (a *Agent) check(ctx context.Context, c Certificate) error {
+	current, err := loadCurrent(c)
+	if err != nil {
+		a.logger.Printf("certificate %v: replacing unreadable certificate, err: %v", c.Name, err)
+		current = nil
+	}
+	if current != nil && !a.due(c, current.Leaf) {
+		return fixAttrs(c)
+	}
+
+	issued, err := a.obtain(ctx, c, current)
+	if err != nil {
+		return err
+	}
+	if current != nil && issued.chain[0].Equal(current.Leaf) {
+		// Only happens for certificates downloaded from the store
+		a.logger.Printf("certificate %v: due for renewal, but the store has not been updated yet", c.Name)
+		return fixAttrs(c)
+	}
+
+	if err := write(c, issued); err != nil {
+		return err
+	}
+	leaf := issued.chain[0]
+	a.logger.Printf("certificate %v: renewed, serial %x expires at %v", c.Name, leaf.SerialNumber, leaf.NotAfter.Format(time.RFC3339))
+
+	return reload(ctx, c)
+}
+
+// due reports whether the certificate should be renewed, either because it
+// is about to expire or because the configured names have changed.
+func (a *Agent) due(c Certificate, leaf *x509.Certificate) bool {
+	renewBefore := c.RenewBefore
+	if renewBefore == 0 {
+		renewBefore = leaf.NotAfter.Sub(leaf.NotBefore) / 3
+	}
+	if !a.now().Before(leaf.NotAfter.Add(-renewBefore)) {
+		return true
+	}
+	return c.StoreURL == "" && !namesMatch(c, leaf)
+}
+
+func namesMatch(c Certificate, leaf *x509.Certificate) bool {
+	if leaf.Subject.CommonName != c.CommonName {
+		return false
+	}
+	var got []string
+	got = append(got, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		got = append(got, ip.String())
+	}
+	for _, uri := range leaf.URIs {
+		got = append(got, uri.String())
+	}
+	want := append([]string{}, c.SANs...)
+	sort.Strings(got)
+	sort.Strings(want)
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if !strings.EqualFold(got[i], want[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// issued is a newly obtained certificate.
+type issued struct {
+	// chain is the certificate followed by its intermediates
+	chain   []*x509.Certificate
+	caCerts []*x509.Certificate
+	key     crypto.Signer
+}
+
+// obtain fetches or issues a new certificate from the configured source.
+func (a *Agent) obtain(ctx context.Context, c Certificate, current *tls.Certificate) (*issued, error) {
+	switch {
+	case c.StoreURL != "":
+		return a.download(ctx, c)
+	case c.CAURL != "":
+		return a.issueWithCA(ctx, c)
+	default:
+		return a.request(ctx, c, current)
+	}
+}
+
+func (a *Agent) download(ctx context.Context, c Certificate) (*issued, error) {
+	password, err := readSecretFile(c.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, caCerts, key, err := a.getCertSigner(ctx, c.StoreURL, password)
+	if err != nil {
+		return nil, err
+	}
+
+	// Chain should contain cert -> intermediary, without the root
+	chain, root, err := certmanager.BuildPartialChain(cert, caCerts)
+	if err != nil {
+		return nil, err
+	}
+	return &issued{chain: chain, caCerts: rootCerts(root), key: key}, nil
+}
+
+func (a *Agent) issueWithCA(ctx context.Context, c Certificate) (*issued, error) {
+	password, err := readSecretFile(c.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	caCert, caCertChain, caKey, err := a.getCertSigner(ctx, c.CAURL, password)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, _, key, err := newCSR(c)
+	if err != nil {
+		return nil, err
+	}
+	validity := c.Validity
+	if validity == 0 {
+		validity = defaultValidity
+	}
+	cert, err := certmanager.SignCSR(caCert, caKey, csr, a.now().Add(validity))
+	if err != nil {
+		return nil, err
+	}
+
+	// Chain should contain cert -> issuer -> intermediary, without the root
+	chain, root, err := certmanager.BuildPartialChain(caCert, caCertChain)
+	if err != nil {
+		return nil, err
+	}
+	chain = append([]*x509.Certificate{cert}, chain...)
+	return &issued{chain: chain, caCerts: rootCerts(root), key: key}, nil
+}
+
+// rootCerts returns the root as the CA certificates to write, or none for
+// chains stored without their root.
+func rootCerts(root *x509.Certificate) []*x509.Certificate {
+	if root == nil {
+		return nil
+	}
+	return []*x509.Certificate{root}
+}
+
+func (a *Agent) request(ctx context.Context, c Certificate, current *tls.Certificate) (*issued, error) {
+	token, err := readSecretFile(c.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf := &tls.Config{}
+	if c.IssuerCAFile != "" {
+		caPEM, err := os.ReadFile(c.IssuerCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read issuer CA, err: %v", err)
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %v", c.IssuerCAFile)
+		}
+	}
+	if token == "" {
+		// Renew with the current certificate
+		if current == nil || a.now().After(current.Leaf.NotAfter) {
+			return nil, errors.New("a token is required since there is no valid certificate to authenticate with")
+		}
+		tlsConf.Certificates = []tls.Certificate{*current}
+	}
+	httpClient := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConf},
+	}
+
+	_, csrPEM, key, err := newCSR(c)
+	if err != nil {
+		return nil, err
+	}
+	req := issueserver.IssueRequest{CSR: string(csrPEM)}
+	if c.Validity > 0 {
+		req.Validity = c.Validity.String()
+	}
+	resp, err := issueserver.Request(ctx, httpClient, c.IssuerURL, token, req)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := parseCerts([]byte(resp.Certificate))
+	if err != nil || len(chain) == 0 {
+		return nil, fmt.Errorf("invalid certificate in response, err: %v", err)
+	}
+	caCerts, err := parseCerts([]byte(resp.CACertificates))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA certificates in response, err: %v", err)
+	}
+	return &issued{chain: chain, caCerts: caCerts, key: key}, nil
+}
+
+func (a *Agent) getCertSigner(ctx context.Context, url, password string) (*x509.Certificate, []*x509.Certificate, crypto.Signer, error) {
+	if a.store != nil {
+		return a.store.GetCertSigner(ctx, url, password)
+	}
+	return certmanager.GetCertSigner(ctx, url, password)
+}
+
+// newCSR generates a key and a CSR for the configured names.
+func newCSR(c Certificate) (*x509.CertificateRequest, []byte, crypto.Signer, error) {
+	tmpl := &x509.CertificateRequest{Subject: pkix.Name{CommonName: c.CommonName}}
+	for _, san := range c.SANs {
+		switch {
+		case strings.Contains(san, "://"):
+			uri, err := url.Parse(san)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("invalid URI SAN '%v'", san)
+			}
+			tmpl.URIs = append(tmpl.URIs, uri)
+		case net.ParseIP(san) != nil:
+			tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(san))
+		default:
+			tmpl.DNSNames = append(tmpl.DNSNames, san)
+		}
+	}
+
+	var key crypto.Signer
+	var err error
+	if c.KeyType == KeyTypeEC {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create CSR, err: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return csr, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), key, nil
+}
+
+// loadCurrent loads the certificate on disk, or returns nil if there is
+// none.
+func loadCurrent(c Certificate) (*tls.Certificate, error) {
+	var cert tls.Certificate
+	var err error
+	switch c.Format {
+	case "", FormatPEM:
+		cert, err = tls.LoadX509KeyPair(c.CertPath, c.KeyPath)
+	case FormatBundle:
+		var data []byte
+		data, err = os.ReadFile(c.CertPath)
+		if err == nil {
+			cert, err = tls.X509KeyPair(data, data)
+		}
+	case FormatPKCS12:
+		cert, err = loadPKCS12(c)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func loadPKCS12(c Certificate) (tls.Certificate, error) {
+	data, err := os.ReadFile(c.CertPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	password, err := readSecretFile(c.PKCS12PasswordFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, cert, caCerts, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tlsCert := tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+	for _, caCert := range caCerts {
+		tlsCert.Certificate = append(tlsCert.Certificate, caCert.Raw)
+	}
+	return tlsCert, nil
+}
+
+// readSecretFile returns the trimmed contents of a file holding a password
+// or token, or an empty string if path is empty.
+func readSecretFile(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %v, err: %v", path, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func parseCerts(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
@@ -0,0 +1,278 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"github.com/sebnyberg/certmanager/issueserver"
+)
+
+// newTestIssuer starts a certmanager serve API with a client authenticated by
+// the token "secret", and writes its CA and the token to dir.
+func newTestIssuer(t *testing.T, dir string) (url, caFile, tokenFile string) {
+	t.Helper()
+	caCert, caKey, err := certmanager.GenSelfSignedCA("test-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := []issueserver.Client{{
+		Name:      "agent",
+		TokenHash: issueserver.HashToken("secret"),
+		Policy:    certmanager.Policy{AllowedNames: []string{"*.example.com"}},
+	}}
+	srv, err := issueserver.New(caCert, nil, caKey, clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCert, serverKey, err := certmanager.GenSignedCert(caCert, caKey, "localhost", []string{"localhost"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsCert, err := certmanager.TLSCertificate([]*x509.Certificate{serverCert}, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(srv)
+	ts.TLS = srv.TLSConfig(tlsCert)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	caFile = filepath.Join(dir, "issuer-ca.pem")
+	tokenFile = filepath.Join(dir, "token")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Replace(ts.URL, "127.0.0.1", "localhost", 1), caFile, tokenFile
+}
+
+func TestAgent(t *testing.T) {
+	dir := t.TempDir()
+	issuerURL, caFile, tokenFile := newTestIssuer(t, dir)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	c := Certificate{
+		Name:         "web",
+		IssuerURL:    issuerURL,
+		TokenFile:    tokenFile,
+		IssuerCAFile: caFile,
+		CommonName:   "web.example.com",
+		SANs:         []string{"web.example.com"},
+		KeyType:      KeyTypeEC,
+		CertPath:     filepath.Join(dir, "out", "web.crt"),
+		KeyPath:      filepath.Join(dir, "out", "web.key"),
+		CAPath:       filepath.Join(dir, "out", "ca.crt"),
+		Mode:         "0640",
+		Reload: Reload{
+			Command: []string{"sh", "-c", `echo "$CERT_NAME $CERT_PATH" >> ` + filepath.Join(dir, "reloads")}},
+	}
+	var logs bytes.Buffer
+	a, err := New(Config{Certificates: []Certificate{c}}, WithLogger(log.New(&logs, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// First check issues the certificate and runs the reload hook
+	if err := a.CheckAll(ctx); err != nil {
+		t.Fatalf("check failed, err: %v, logs: %v", err, logs.String())
+	}
+	first := loadLeaf(t, c)
+	if first.Subject.CommonName != "web.example.com" {
+		t.Errorf("want certificate for web.example.com, got %v", first.Subject.CommonName)
+	}
+	for _, path := range []string{c.CertPath, c.KeyPath, c.CAPath} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0640 {
+			t.Errorf("want mode 0640 for %v, got %v", path, fi.Mode().Perm())
+		}
+	}
+	if got := readFile(t, filepath.Join(dir, "reloads")); got != "web "+c.CertPath+"\n" {
+		t.Errorf("want reload hook to run once, got %q", got)
+	}
+
+	// The certificate is not renewed while it is fresh, but modes are fixed
+	if err := os.Chmod(c.KeyPath, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.CheckAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !loadLeaf(t, c).Equal(first) {
+		t.Error("want certificate to be kept while it is fresh")
+	}
+	if fi, _ := os.Stat(c.KeyPath); fi.Mode().Perm() != 0640 {
+		t.Errorf("want mode of key to be restored, got %v", fi.Mode().Perm())
+	}
+
+	// Once due, the certificate is renewed
+	a.now = func() time.Time { return first.NotAfter.Add(-time.Minute) }
+	if err := a.CheckAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if second := loadLeaf(t, c); second.SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Error("want certificate to be renewed when due")
+	}
+	if got := strings.Count(readFile(t, filepath.Join(dir, "reloads")), "\n"); got != 2 {
+		t.Errorf("want reload hook to run twice, got %v", got)
+	}
+}
+
+func TestAgent_formats(t *testing.T) {
+	dir := t.TempDir()
+	issuerURL, caFile, tokenFile := newTestIssuer(t, dir)
+	passwordFile := filepath.Join(dir, "pkcs12-password")
+	if err := os.WriteFile(passwordFile, []byte("changeit"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, c := range []Certificate{
+		{Name: "bundle", Format: FormatBundle, CertPath: filepath.Join(dir, "bundle.pem")},
+		{Name: "pkcs12", Format: FormatPKCS12, CertPath: filepath.Join(dir, "cert.p12"), PKCS12PasswordFile: passwordFile},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			c.IssuerURL = issuerURL
+			c.TokenFile = tokenFile
+			c.IssuerCAFile = caFile
+			c.SANs = []string{c.Name + ".example.com"}
+			a, err := New(Config{Certificates: []Certificate{c}}, WithLogger(log.New(io.Discard, "", 0)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.CheckAll(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if got := loadLeaf(t, c).DNSNames; len(got) != 1 || got[0] != c.Name+".example.com" {
+				t.Errorf("want certificate for %v.example.com, got %v", c.Name, got)
+			}
+			if fi, _ := os.Stat(c.CertPath); fi.Mode().Perm() != 0600 {
+				t.Errorf("want mode 0600, got %v", fi.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestConfig_validate(t *testing.T) {
+	valid := Certificate{Name: "web", IssuerURL: "https://localhost", CommonName: "web.example.com", CertPath: "web.crt", KeyPath: "web.key"}
+	for _, tc := range []struct {
+		name    string
+		modify  func(c *Certificate)
+		wantErr string
+	}{
+		{"valid", func(c *Certificate) {}, ""},
+		{"no name", func(c *Certificate) { c.Name = "" }, "name is required"},
+		{"two sources", func(c *Certificate) { c.CAURL = "https://myvault.vault.azure.net/secrets/ca" }, "exactly one"},
+		{"no names", func(c *Certificate) { c.CommonName = "" }, "commonName or sans"},
+		{"no key path", func(c *Certificate) { c.KeyPath = "" }, "keyPath is required"},
+		{"key path for bundle", func(c *Certificate) { c.Format = FormatBundle }, "keyPath must not be set"},
+		{"invalid format", func(c *Certificate) { c.Format = "der" }, "format must be"},
+		{"invalid mode", func(c *Certificate) { c.Mode = "rw" }, "invalid mode"},
+		{"signal without pid file", func(c *Certificate) { c.Reload.Signal = "HUP" }, "requires a pidFile"},
+		{"invalid signal", func(c *Certificate) { c.Reload.PIDFile = "nginx.pid"; c.Reload.Signal = "SIGFOO" }, "unsupported signal"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := valid
+			tc.modify(&c)
+			err := Config{Certificates: []Certificate{c}}.validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("want err containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	data := `checkInterval: 5m
+certificates:
+  - name: nginx
+    caUrl: https://myvault.vault.azure.net/secrets/myca
+    commonName: www.example.com
+    sans: [www.example.com, 10.0.0.1]
+    validity: 720h
+    certPath: /etc/nginx/tls/www.crt
+    keyPath: /etc/nginx/tls/www.key
+    reload:
+      pidFile: /run/nginx.pid
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if conf.CheckInterval != 5*time.Minute {
+		t.Errorf("want check interval 5m, got %v", conf.CheckInterval)
+	}
+	c := conf.Certificates[0]
+	if c.Validity != 720*time.Hour || len(c.SANs) != 2 || c.Reload.PIDFile != "/run/nginx.pid" {
+		t.Errorf("unexpected certificate %+v", c)
+	}
+}
+
+func loadLeaf(t *testing.T, c Certificate) *x509.Certificate {
+	t.Helper()
+	cert, err := loadCurrent(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert == nil {
+		t.Fatal("want certificate on disk")
+	}
+	if _, err := tls.X509KeyPair(certPEM(cert), keyPEM(t, cert)); err != nil {
+		t.Fatalf("key does not match certificate, err: %v", err)
+	}
+	return cert.Leaf
+}
+
+func certPEM(cert *tls.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+}
+
+func keyPEM(t *testing.T, cert *tls.Certificate) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
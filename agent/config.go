@@ -0,0 +1,222 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats.
+const (
+	// FormatPEM writes the certificate chain, key and CA certificates to
+	// separate PEM files.
+	FormatPEM = "pem"
+
+	// FormatBundle writes the certificate chain followed by the key to a
+	// single PEM file, e.g. for HAProxy.
+	FormatBundle = "bundle"
+
+	// FormatPKCS12 writes the certificate chain and key to a PKCS#12 file.
+	FormatPKCS12 = "pkcs12"
+)
+
+// Key types of keys generated by the agent.
+const (
+	KeyTypeRSA = "rsa"
+	KeyTypeEC  = "ec"
+)
+
+// Config lists the certificates kept fresh by an Agent.
+type Config struct {
+	// CheckInterval is how often certificates are checked, one minute by
+	// default.
+	CheckInterval time.Duration `yaml:"checkInterval"`
+
+	Certificates []Certificate `yaml:"certificates"`
+}
+
+// Certificate is a certificate kept fresh on disk.
+//
+// The certificate is obtained from exactly one source: downloaded from
+// StoreURL, issued locally by the CA at CAURL, or requested from the
+// certmanager serve API at IssuerURL.
+type Certificate struct {
+	// Name identifies the certificate in logs and hooks.
+	Name string `yaml:"name"`
+
+	// StoreURL is the URL of a certificate in the store which is renewed by
+	// other means, e.g. acme-issue. It is downloaded again when due.
+	StoreURL string `yaml:"storeUrl"`
+
+	// CAURL is the URL of a CA in the store which signs the certificate.
+	CAURL string `yaml:"caUrl"`
+
+	// PasswordFile contains the password of the certificate at StoreURL or
+	// the CA at CAURL, if any.
+	PasswordFile string `yaml:"passwordFile"`
+
+	// IssuerURL is the URL of a certmanager serve API, e.g.
+	// https://certs.example.com:8444. The agent authenticates with the
+	// token in TokenFile, or with the current certificate if there is no
+	// token.
+	IssuerURL string `yaml:"issuerUrl"`
+	TokenFile string `yaml:"tokenFile"`
+
+	// IssuerCAFile contains the CA certificates which verify the server at
+	// IssuerURL. The system roots are used if empty.
+	IssuerCAFile string `yaml:"issuerCaFile"`
+
+	// CommonName, SANs and KeyType (rsa or ec) of certificates from CAURL
+	// or IssuerURL. SANs of the form spiffe://trust-domain/path are added
+	// as URI SANs.
+	CommonName string   `yaml:"commonName"`
+	SANs       []string `yaml:"sans"`
+	KeyType    string   `yaml:"keyType"`
+
+	// Validity is how long certificates from CAURL or IssuerURL are valid,
+	// 30 days for CAURL by default. IssuerURL uses the maximum of the
+	// server by default.
+	Validity time.Duration `yaml:"validity"`
+
+	// RenewBefore is how long before expiry the certificate is renewed, a
+	// third of its lifetime by default.
+	RenewBefore time.Duration `yaml:"renewBefore"`
+
+	// Format is the output format, pem (default), bundle or pkcs12.
+	Format string `yaml:"format"`
+
+	// CertPath is where the certificate chain is written. KeyPath is where
+	// the key is written for the pem format. CAPath is where the CA
+	// certificates are written, if set.
+	CertPath string `yaml:"certPath"`
+	KeyPath  string `yaml:"keyPath"`
+	CAPath   string `yaml:"caPath"`
+
+	// PKCS12PasswordFile contains the password used to encrypt the pkcs12
+	// format, if any.
+	PKCS12PasswordFile string `yaml:"pkcs12PasswordFile"`
+
+	// Mode, e.g. "0640", Owner and Group of written files. By default keys
+	// are only readable by the owner, and files are owned by the agent.
+	Mode  string `yaml:"mode"`
+	Owner string `yaml:"owner"`
+	Group string `yaml:"group"`
+
+	// Reload runs after the certificate has been renewed.
+	Reload Reload `yaml:"reload"`
+}
+
+// Reload notifies the users of a certificate that it has been renewed.
+type Reload struct {
+	// PIDFile contains the process ID which is sent Signal, SIGHUP by
+	// default.
+	PIDFile string `yaml:"pidFile"`
+	Signal  string `yaml:"signal"`
+
+	// Command is run with the environment variables CERT_NAME, CERT_PATH,
+	// KEY_PATH and CA_PATH set, e.g. ["systemctl", "reload", "nginx"].
+	Command []string `yaml:"command"`
+}
+
+// LoadConfig reads a YAML config file.
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read config, err: %v", err)
+	}
+	var conf Config
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return Config{}, fmt.Errorf("failed to parse config, err: %v", err)
+	}
+	return conf, nil
+}
+
+func (c Config) validate() error {
+	if c.CheckInterval < 0 {
+		return errors.New("check interval must not be negative")
+	}
+	if len(c.Certificates) == 0 {
+		return errors.New("no certificates configured")
+	}
+	names := make(map[string]bool)
+	for _, cert := range c.Certificates {
+		if err := cert.validate(); err != nil {
+			return fmt.Errorf("invalid certificate '%v', err: %v", cert.Name, err)
+		}
+		if names[cert.Name] {
+			return fmt.Errorf("certificate name '%v' is used more than once", cert.Name)
+		}
+		names[cert.Name] = true
+	}
+	return nil
+}
+
+func (c Certificate) validate() error {
+	if c.Name == "" {
+		return errors.New("name is required")
+	}
+
+	var sources int
+	for _, url := range []string{c.StoreURL, c.CAURL, c.IssuerURL} {
+		if url != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return errors.New("exactly one of storeUrl, caUrl and issuerUrl is required")
+	}
+	if c.StoreURL == "" && c.CommonName == "" && len(c.SANs) == 0 {
+		return errors.New("commonName or sans is required")
+	}
+	if c.KeyType != "" && c.KeyType != KeyTypeRSA && c.KeyType != KeyTypeEC {
+		return fmt.Errorf("key type must be %v or %v", KeyTypeRSA, KeyTypeEC)
+	}
+	if c.Validity < 0 || c.RenewBefore < 0 {
+		return errors.New("validity and renewBefore must not be negative")
+	}
+
+	if c.CertPath == "" {
+		return errors.New("certPath is required")
+	}
+	switch c.Format {
+	case "", FormatPEM:
+		if c.KeyPath == "" {
+			return errors.New("keyPath is required for the pem format")
+		}
+	case FormatBundle, FormatPKCS12:
+		if c.KeyPath != "" {
+			return fmt.Errorf("keyPath must not be set for the %v format", c.Format)
+		}
+	default:
+		return fmt.Errorf("format must be %v, %v or %v", FormatPEM, FormatBundle, FormatPKCS12)
+	}
+
+	if _, err := c.mode(); err != nil {
+		return err
+	}
+	if c.Reload.Signal != "" && c.Reload.PIDFile == "" {
+		return errors.New("reload signal requires a pidFile")
+	}
+	if c.Reload.Signal != "" {
+		if _, err := parseSignal(c.Reload.Signal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mode returns the configured file mode, or zero if not set.
+func (c Certificate) mode() (os.FileMode, error) {
+	if c.Mode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(c.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode '%v', e.g. 0640", c.Mode)
+	}
+	return os.FileMode(mode), nil
+}
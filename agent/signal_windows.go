@@ -0,0 +1,11 @@
+package agent
+
+import "syscall"
+
+// signals are the signals which can be sent to reload a process.
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTERM": syscall.SIGTERM,
+}
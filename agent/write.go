@@ -0,0 +1,270 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// outputFile is a file written by the agent.
+type outputFile struct {
+	path string
+	data []byte
+	mode os.FileMode
+}
+
+// outputs returns the files to write for a certificate.
+func outputs(c Certificate, res *issued) ([]outputFile, error) {
+	var chainPEM []byte
+	for _, cert := range res.chain {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(res.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode key, err: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	var files []outputFile
+	switch c.Format {
+	case "", FormatPEM:
+		files = append(files,
+			outputFile{path: c.KeyPath, data: keyPEM, mode: 0600},
+			outputFile{path: c.CertPath, data: chainPEM, mode: 0644},
+		)
+	case FormatBundle:
+		files = append(files, outputFile{path: c.CertPath, data: append(chainPEM, keyPEM...), mode: 0600})
+	case FormatPKCS12:
+		password, err := readSecretFile(c.PKCS12PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		pfx, err := pkcs12.Encode(rand.Reader, res.key, res.chain[0], res.chain[1:], password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode PKCS#12, err: %v", err)
+		}
+		files = append(files, outputFile{path: c.CertPath, data: pfx, mode: 0600})
+	}
+
+	if c.CAPath != "" {
+		var caPEM []byte
+		for _, cert := range res.caCerts {
+			caPEM = append(caPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+		files = append(files, outputFile{path: c.CAPath, data: caPEM, mode: 0644})
+	}
+
+	mode, err := c.mode()
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		for i := range files {
+			files[i].mode = mode
+		}
+	}
+	return files, nil
+}
+
+// write writes the files of a certificate. Each file is first written to a
+// temporary file in the same directory, which is renamed once all files have
+// been written, so that readers never see a partially written file.
+func write(c Certificate, res *issued) error {
+	files, err := outputs(c, res)
+	if err != nil {
+		return err
+	}
+	uid, gid, err := lookupOwner(c)
+	if err != nil {
+		return err
+	}
+
+	tmpPaths := make([]string, 0, len(files))
+	defer func() {
+		for _, path := range tmpPaths {
+			_ = os.Remove(path)
+		}
+	}()
+	for _, f := range files {
+		tmpPath, err := writeTemp(f, uid, gid)
+		if err != nil {
+			return err
+		}
+		tmpPaths = append(tmpPaths, tmpPath)
+	}
+	for i, f := range files {
+		if err := os.Rename(tmpPaths[i], f.path); err != nil {
+			return fmt.Errorf("failed to replace %v, err: %v", f.path, err)
+		}
+	}
+	tmpPaths = nil
+	return nil
+}
+
+func writeTemp(f outputFile, uid, gid int) (string, error) {
+	dir := filepath.Dir(f.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	path := tmp.Name()
+	err = tmp.Chmod(f.mode)
+	if err == nil && (uid != -1 || gid != -1) {
+		err = tmp.Chown(uid, gid)
+	}
+	if err == nil {
+		_, err = tmp.Write(f.data)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return "", fmt.Errorf("failed to write %v, err: %v", f.path, err)
+	}
+	return path, nil
+}
+
+// fixAttrs restores the configured mode and ownership of the files of a
+// certificate, e.g. after they were changed by hand.
+func fixAttrs(c Certificate) error {
+	mode, err := c.mode()
+	if err != nil {
+		return err
+	}
+	uid, gid, err := lookupOwner(c)
+	if err != nil {
+		return err
+	}
+	if mode == 0 && uid == -1 && gid == -1 {
+		return nil
+	}
+	for _, path := range []string{c.CertPath, c.KeyPath, c.CAPath} {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if mode != 0 && fi.Mode().Perm() != mode {
+			if err := os.Chmod(path, mode); err != nil {
+				return err
+			}
+		}
+		if uid != -1 || gid != -1 {
+			if err := os.Chown(path, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lookupOwner returns the configured user and group IDs, or -1 if not set.
+func lookupOwner(c Certificate) (uid int, gid int, err error) {
+	uid, gid = -1, -1
+	if c.Owner != "" {
+		u, err := user.Lookup(c.Owner)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to look up owner, err: %v", err)
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, fmt.Errorf("owner %v has no numeric user ID", c.Owner)
+		}
+	}
+	if c.Group != "" {
+		g, err := user.LookupGroup(c.Group)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to look up group, err: %v", err)
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, fmt.Errorf("group %v has no numeric group ID", c.Group)
+		}
+	}
+	return uid, gid, nil
+}
+
+// reload runs the reload hooks of a renewed certificate.
+func reload(ctx context.Context, c Certificate) error {
+	if c.Reload.PIDFile != "" {
+		if err := signalPID(c.Reload.PIDFile, c.Reload.Signal); err != nil {
+			return err
+		}
+	}
+
+	if len(c.Reload.Command) > 0 {
+		cmd := exec.CommandContext(ctx, c.Reload.Command[0], c.Reload.Command[1:]...)
+		cmd.Env = append(os.Environ(),
+			"CERT_NAME="+c.Name,
+			"CERT_PATH="+c.CertPath,
+			"KEY_PATH="+c.KeyPath,
+			"CA_PATH="+c.CAPath,
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("reload command failed, err: %v, output: %s", err, out)
+		}
+	}
+	return nil
+}
+
+func signalPID(pidFile string, signalName string) error {
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return fmt.Errorf("failed to read PID file, err: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid PID in %v", pidFile)
+	}
+	sig, err := parseSignal(signalName)
+	if err != nil {
+		return err
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := p.Signal(sig); err != nil {
+		return fmt.Errorf("failed to send %v to process %v, err: %v", sig, pid, err)
+	}
+	return nil
+}
+
+// parseSignal parses a signal name such as SIGHUP or HUP. SIGHUP is returned
+// if name is empty.
+func parseSignal(name string) (syscall.Signal, error) {
+	if name == "" {
+		return syscall.SIGHUP, nil
+	}
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := signals[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported signal '%v'", name)
+	}
+	return sig, nil
+}
@@ -2,98 +2,193 @@ package certmanager
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
+	"crypto"
+	"crypto/sha1"
 	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/url"
 	"os"
+	"path"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
 	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/azure/auth"
 	"github.com/Azure/go-autorest/autorest/azure/cli"
 	pkcs12 "software.sslmate.com/src/go-pkcs12"
 )
 
-func newAzureKVClient() (keyvault.BaseClient, error) {
-	kv := keyvault.New()
+// Sources of credentials used to authenticate against Key Vault.
+const (
+	credentialSourceCLI = "Azure CLI"
+	credentialSourceEnv = "environment (AZURE_CLIENT_ID, AZURE_TENANT_ID, AZURE_CLIENT_SECRET)"
+)
 
-	var err error
+func newAzureKVClient() (kv keyvault.BaseClient, credentialSource string, err error) {
+	kv = keyvault.New()
 
 	// Retrieve access credentials
+	credentialSource = credentialSourceCLI
 	kv.Authorizer, err = newAzureCLIAuthorizer()
 	if err != nil {
+		credentialSource = credentialSourceEnv
 		kv.Authorizer, err = newAzureEnvAuthorizer()
 		if err != nil {
-			return kv, appendErr("failed to authenticate against Azure", err)
+			return kv, "", appendErr("failed to authenticate against Azure", err)
 		}
 	}
 
-	return kv, nil
+	return kv, credentialSource, nil
 }
 
 func getAzureKVCert(
 	ctx context.Context,
+	kv keyvault.BaseClient,
 	urlStr string,
 	certPassword string,
-) (cert *x509.Certificate, caCerts []*x509.Certificate, key *rsa.PrivateKey, err error) {
-	kv, err := newAzureKVClient()
-	if err != nil {
-		return nil, nil, nil, err
-	}
-
+	opts getCertOptions,
+) (cert *x509.Certificate, caCerts []*x509.Certificate, key crypto.Signer, err error) {
 	// Parse URL provided by caller
 	baseURL, secretName, secretVersion, err := parseAzureSecretURL(urlStr)
 	if err != nil {
 		return nil, nil, nil, appendErr("failed to parse secret URL", err)
 	}
 
+	// Resolve version
+	switch opts.version {
+	case "", VersionLatest:
+	case VersionLatestEnabled, VersionLatestValid:
+		if secretVersion != "" {
+			return nil, nil, nil, fmt.Errorf("cannot select version '%v', URL is pinned to version %v", opts.version, secretVersion)
+		}
+		versions, err := getAzureKVCertVersions(ctx, kv, baseURL, secretName)
+		if err != nil {
+			return nil, nil, nil, appendErr("failed to list certificate versions", err)
+		}
+		v, err := selectCertVersion(versions, opts.version, time.Now())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		secretVersion = v.Version
+	default:
+		if secretVersion != "" && secretVersion != opts.version {
+			return nil, nil, nil, fmt.Errorf("cannot select version '%v', URL is pinned to version %v", opts.version, secretVersion)
+		}
+		secretVersion = opts.version
+	}
+
 	// Retrieve secret and validate content type
 	bundle, err := kv.GetSecret(ctx, baseURL, secretName, secretVersion)
+	if secretVersion == "" && azureKVSecretDisabled(bundle, err) {
+		// The latest version was disabled, e.g. by a rollback
+		bundle, err = getAzureKVLatestEnabledSecret(ctx, kv, baseURL, secretName, err)
+	}
 	if err != nil {
-		return nil, nil, nil, appendErr("failed to retrieve secret", err)
+		return nil, nil, nil, appendErr("failed to retrieve secret", newStoreError("GetSecret", err))
 	}
-	expectedContentType := "application/x-pkcs12"
-	if len(*bundle.ContentType) == 0 || *bundle.ContentType != expectedContentType {
-		return nil, nil, nil, fmt.Errorf("invalid secret content type '%v', should be '%v'", *bundle.ContentType, expectedContentType)
+	if bundle.Value == nil {
+		return nil, nil, nil, errors.New("secret has no value")
+	}
+	var contentType string
+	if bundle.ContentType != nil {
+		contentType = *bundle.ContentType
+	}
+
+	switch contentType {
+	case contentTypePKCS12:
+		// Decode contents from base64
+		pfx, err := base64.StdEncoding.DecodeString(*bundle.Value)
+		if err != nil {
+			return nil, nil, nil, appendErr("failed to base64-decode secret", err)
+		}
+
+		// Decode pfx to x509.Certificate and private key
+		keyIface, cert, caCerts, err := pkcs12.DecodeChain(pfx, certPassword)
+		if err != nil {
+			if errors.Is(err, pkcs12.ErrIncorrectPassword) {
+				err = ErrInvalidPassword
+			}
+			return nil, nil, nil, appendErr("failed to parse pkcs12", err)
+		}
+		key, ok := keyIface.(crypto.Signer)
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("unsupported private key type %T", keyIface)
+		}
+		return cert, caCerts, key, nil
+	case contentTypePEM:
+		cert, caCerts, key, err := decodePEMBundle([]byte(*bundle.Value))
+		if err != nil {
+			return nil, nil, nil, appendErr("failed to parse PEM bundle", err)
+		}
+		return cert, caCerts, key, nil
 	}
 
-	// Decode contents from base64
-	pfx, err := base64.StdEncoding.DecodeString(*bundle.Value)
+	return nil, nil, nil, fmt.Errorf("%w '%v', should be '%v' or '%v'", ErrInvalidContentType, contentType, contentTypePKCS12, contentTypePEM)
+}
+
+// getAzureKVCertificates retrieves the certificates of a secret without
+// requiring a key, e.g. a PEM trust bundle or the chain of a CA.
+func getAzureKVCertificates(ctx context.Context, kv keyvault.BaseClient, urlStr, certPassword string) ([]*x509.Certificate, error) {
+	baseURL, secretName, secretVersion, err := parseAzureSecretURL(urlStr)
 	if err != nil {
-		return nil, nil, nil, appendErr("failed to base64-decode secret", err)
+		return nil, appendErr("failed to parse secret URL", err)
 	}
 
-	// Decode pfx to x509.Certificate and rsa.PublicKey
-	keyIface, cert, caCerts, err := pkcs12.DecodeChain(pfx, certPassword)
+	bundle, err := kv.GetSecret(ctx, baseURL, secretName, secretVersion)
 	if err != nil {
-		return nil, nil, nil, appendErr("failed to parse pkcs12", err)
+		return nil, appendErr("failed to retrieve secret", newStoreError("GetSecret", err))
+	}
+	if bundle.Value == nil {
+		return nil, errors.New("secret has no value")
 	}
-	key, ok := keyIface.(*rsa.PrivateKey)
-	if !ok {
-		return nil, nil, nil, errors.New("failed to parse key as rsa.PrivateKey")
+	var contentType string
+	if bundle.ContentType != nil {
+		contentType = *bundle.ContentType
 	}
-	return cert, caCerts, key, nil
+
+	switch contentType {
+	case contentTypePKCS12:
+		pfx, err := base64.StdEncoding.DecodeString(*bundle.Value)
+		if err != nil {
+			return nil, appendErr("failed to base64-decode secret", err)
+		}
+		_, cert, caCerts, err := pkcs12.DecodeChain(pfx, certPassword)
+		if err != nil {
+			if errors.Is(err, pkcs12.ErrIncorrectPassword) {
+				err = ErrInvalidPassword
+			}
+			return nil, appendErr("failed to parse pkcs12", err)
+		}
+		return append([]*x509.Certificate{cert}, caCerts...), nil
+	case contentTypePEM:
+		certs, err := decodePEMCerts([]byte(*bundle.Value))
+		if err != nil {
+			return nil, appendErr("failed to parse PEM bundle", err)
+		}
+		return certs, nil
+	}
+
+	return nil, fmt.Errorf("%w '%v', should be '%v' or '%v'", ErrInvalidContentType, contentType, contentTypePKCS12, contentTypePEM)
 }
 
 func uploadAzureKVCert(
 	ctx context.Context,
+	kv keyvault.BaseClient,
 	urlStr string,
 	cert *x509.Certificate,
 	caCerts []*x509.Certificate,
-	key *rsa.PrivateKey,
+	key crypto.Signer,
 	certPassword string,
+	opts uploadCertOptions,
 ) error {
-	kv, err := newAzureKVClient()
-	if err != nil {
-		return err
-	}
-
 	// Parse URL provided by caller
 	baseURL, certName, err := parseAzureCertURL(urlStr)
 	if err != nil {
@@ -101,62 +196,556 @@ func uploadAzureKVCert(
 	}
 
 	// Check if cert already exists
-	exists, err := checkAzureKVCertExists(ctx, baseURL, certName)
+	if !opts.newVersion {
+		exists, err := checkAzureKVCertExists(ctx, kv, baseURL, certName)
+		if err != nil {
+			return appendErr("failed to check whether the certificate already exists", err)
+		}
+		if exists {
+			return fmt.Errorf("a remote certificate with the name %v %w", certName, ErrAlreadyExists)
+		}
+	}
+
+	if opts.generatePassword {
+		if certPassword != "" {
+			return errors.New("a certificate password cannot be given when generating one")
+		}
+		if opts.format == FormatPEM {
+			return errors.New("PEM bundles are not protected by a password")
+		}
+		certPassword, err = generatePassword()
+		if err != nil {
+			return appendErr("failed to generate password", err)
+		}
+		// Store the password first, a certificate without its password is
+		// of no use
+		err = setAzureKVSecret(ctx, kv, baseURL, passwordSecretName(certName), certPassword, contentTypePassword)
+		if err != nil {
+			return appendErr("failed to store password", err)
+		}
+	}
+
+	var params keyvault.CertificateImportParameters
+	switch opts.format {
+	case "", FormatPKCS12:
+		// Encode certificate to pkcs12
+		pfx, err := encodePKCS12(opts.pkcs12Encoding, key, cert, caCerts, certPassword)
+		if err != nil {
+			return appendErr("failed to encode pkcs12 cert", err)
+		}
+		base64Encoded := base64.StdEncoding.EncodeToString(pfx)
+		params.Base64EncodedCertificate = &base64Encoded
+		params.Password = &certPassword
+	case FormatPEM:
+		// Key Vault expects the PEM contents as-is along with a policy that
+		// keeps the secret in PEM format
+		pemBytes, err := encodePEMBundle(cert, caCerts, key)
+		if err != nil {
+			return appendErr("failed to encode PEM cert", err)
+		}
+		pemStr := string(pemBytes)
+		contentType := contentTypePEM
+		params.Base64EncodedCertificate = &pemStr
+		params.CertificatePolicy = &keyvault.CertificatePolicy{
+			SecretProperties: &keyvault.SecretProperties{
+				ContentType: &contentType,
+			},
+		}
+	default:
+		return fmt.Errorf("unsupported format '%v', should be '%v' or '%v'", opts.format, FormatPKCS12, FormatPEM)
+	}
+
+	// Upload cert
+	_, err = kv.ImportCertificate(ctx, baseURL, certName, params)
+	if err != nil {
+		err = newStoreError("ImportCertificate", err)
+		// The name of a deleted certificate cannot be reused until it is
+		// purged
+		if errors.Is(err, ErrAlreadyExists) {
+			if _, deletedErr := kv.GetDeletedCertificate(ctx, baseURL, certName); deletedErr == nil {
+				return fmt.Errorf("certificate %v %w", certName, ErrDeleted)
+			}
+		}
+		return appendErr("failed to import certificate", err)
+	}
+
+	return nil
+}
+
+func listAzureKVCertVersions(ctx context.Context, kv keyvault.BaseClient, urlStr string) ([]CertVersion, error) {
+	baseURL, name, _, err := parseAzureKVURL(urlStr)
 	if err != nil {
-		return appendErr("failed to check whether the certificate already exists", err)
+		return nil, appendErr("failed to parse URL", err)
 	}
-	if exists {
-		return fmt.Errorf("a remote certificate with the name %v already exists, exiting...", certName)
+
+	versions, err := getAzureKVCertVersions(ctx, kv, baseURL, name)
+	if err != nil {
+		return nil, err
 	}
+	for i := range versions {
+		if err := describeAzureKVCertVersion(ctx, kv, baseURL, name, &versions[i]); err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
 
-	// Encode certificate to pkcs12
-	pfx, err := pkcs12.Encode(rand.Reader, key, cert, caCerts, certPassword)
+func rollbackAzureKVCert(
+	ctx context.Context,
+	kv keyvault.BaseClient,
+	urlStr string,
+	badVersion string,
+	toVersion string,
+) (disabled CertVersion, enabled CertVersion, err error) {
+	baseURL, name, _, err := parseAzureKVURL(urlStr)
 	if err != nil {
-		return appendErr("failed to encode pkcs12 cert", err)
+		return CertVersion{}, CertVersion{}, appendErr("failed to parse URL", err)
 	}
-	base64Encoded := base64.StdEncoding.EncodeToString(pfx)
 
-	// Upload cert
-	kv.ImportCertificate(ctx, baseURL, certName, keyvault.CertificateImportParameters{
-		Base64EncodedCertificate: &base64Encoded,
-		Password:                 &certPassword,
+	versions, err := getAzureKVCertVersions(ctx, kv, baseURL, name)
+	if err != nil {
+		return CertVersion{}, CertVersion{}, appendErr("failed to list certificate versions", err)
+	}
+
+	bad, to, err := planRollback(versions, badVersion, toVersion, time.Now())
+	if err != nil {
+		return CertVersion{}, CertVersion{}, err
+	}
+	for _, v := range []*CertVersion{&bad, &to} {
+		if err := describeAzureKVCertVersion(ctx, kv, baseURL, name, v); err != nil {
+			return CertVersion{}, CertVersion{}, err
+		}
+	}
+
+	// Enable the prior version before disabling the bad one so that there is
+	// always at least one enabled version.
+	if err := setAzureKVCertVersionEnabled(ctx, kv, baseURL, name, to.Version, true); err != nil {
+		return CertVersion{}, CertVersion{}, appendErr("failed to enable version "+to.Version, err)
+	}
+	to.Enabled = true
+	if err := setAzureKVCertVersionEnabled(ctx, kv, baseURL, name, bad.Version, false); err != nil {
+		return CertVersion{}, CertVersion{}, appendErr("failed to disable version "+bad.Version, err)
+	}
+	bad.Enabled = false
+
+	return bad, to, nil
+}
+
+// azureKVSecretDisabled returns true if a secret version is disabled, which
+// the vault reports as forbidden when retrieving it.
+func azureKVSecretDisabled(bundle keyvault.SecretBundle, err error) bool {
+	if err != nil {
+		return errors.Is(newStoreError("GetSecret", err), ErrForbidden)
+	}
+	return bundle.Attributes != nil && bundle.Attributes.Enabled != nil && !*bundle.Attributes.Enabled
+}
+
+// getAzureKVLatestEnabledSecret retrieves the latest enabled version of the
+// secret of a certificate. If the versions cannot be listed, getErr, the
+// error of retrieving the latest version, is returned instead, since the
+// secret may have been forbidden for another reason than being disabled.
+func getAzureKVLatestEnabledSecret(
+	ctx context.Context,
+	kv keyvault.BaseClient,
+	baseURL string,
+	name string,
+	getErr error,
+) (keyvault.SecretBundle, error) {
+	versions, err := getAzureKVCertVersions(ctx, kv, baseURL, name)
+	if err != nil {
+		if getErr != nil {
+			return keyvault.SecretBundle{}, getErr
+		}
+		return keyvault.SecretBundle{}, appendErr("failed to list certificate versions", err)
+	}
+	v, err := selectCertVersion(versions, VersionLatestEnabled, time.Now())
+	if err != nil {
+		return keyvault.SecretBundle{}, err
+	}
+	return kv.GetSecret(ctx, baseURL, name, v.Version)
+}
+
+// getAzureKVCertVersions lists all versions of a certificate, newest first.
+//
+// Only the attributes included in the listing are filled in, which is enough
+// to select a version. Use describeAzureKVCertVersion to fill in the fields
+// which require the certificate itself.
+func getAzureKVCertVersions(
+	ctx context.Context,
+	kv keyvault.BaseClient,
+	baseURL string,
+	certName string,
+) ([]CertVersion, error) {
+	it, err := kv.GetCertificateVersionsComplete(ctx, baseURL, certName, nil)
+	if err != nil {
+		return nil, newStoreError("GetCertificateVersions", err)
+	}
+
+	var versions []CertVersion
+	for it.NotDone() {
+		item := it.Value()
+		if item.ID == nil {
+			return nil, errors.New("certificate version is missing an ID")
+		}
+
+		v := CertVersion{Version: path.Base(*item.ID)}
+		if item.X509Thumbprint != nil {
+			if thumbprint, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(*item.X509Thumbprint, "=")); err == nil {
+				v.Thumbprint = fmt.Sprintf("%X", thumbprint)
+			}
+		}
+		if attrs := item.Attributes; attrs != nil {
+			v.Enabled = attrs.Enabled != nil && *attrs.Enabled
+			if attrs.Created != nil {
+				v.CreatedAt = time.Time(*attrs.Created)
+			}
+			if attrs.NotBefore != nil {
+				v.NotBefore = time.Time(*attrs.NotBefore)
+			}
+			if attrs.Expires != nil {
+				v.NotAfter = time.Time(*attrs.Expires)
+			}
+		}
+		versions = append(versions, v)
+
+		if err := it.NextWithContext(ctx); err != nil {
+			return nil, newStoreError("GetCertificateVersions", err)
+		}
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].CreatedAt.After(versions[j].CreatedAt)
 	})
 
+	return versions, nil
+}
+
+// describeAzureKVCertVersion retrieves the certificate of version v and fills
+// in its serial number, thumbprint, subject, issuer and validity period.
+func describeAzureKVCertVersion(
+	ctx context.Context,
+	kv keyvault.BaseClient,
+	baseURL string,
+	certName string,
+	v *CertVersion,
+) error {
+	bundle, err := kv.GetCertificate(ctx, baseURL, certName, v.Version)
+	if err != nil {
+		return appendErr("failed to retrieve certificate version "+v.Version, newStoreError("GetCertificate", err))
+	}
+	if bundle.Cer == nil {
+		return fmt.Errorf("certificate version %v has no contents", v.Version)
+	}
+	cert, err := x509.ParseCertificate(*bundle.Cer)
+	if err != nil {
+		return appendErr("failed to parse certificate version "+v.Version, err)
+	}
+
+	v.SerialNumber = cert.SerialNumber
+	v.Thumbprint = fmt.Sprintf("%X", sha1.Sum(cert.Raw))
+	v.Subject = cert.Subject.String()
+	v.Issuer = cert.Issuer.String()
+	v.NotBefore = cert.NotBefore
+	v.NotAfter = cert.NotAfter
 	return nil
 }
 
-func checkAzureKVCertExists(ctx context.Context, baseURL, certName string) (bool, error) {
-	kv, err := newAzureKVClient()
+// listAzureKVCerts lists the certificates of a vault selected by the
+// filter, ordered by name. The name, tags and expiry in the listing are used
+// to filter before the certificates themselves are retrieved.
+func listAzureKVCerts(ctx context.Context, kv keyvault.BaseClient, vaultURL string, filter CertFilter, now time.Time) ([]CertInfo, error) {
+	baseURL, err := parseAzureVaultURL(vaultURL)
 	if err != nil {
-		return false, err
+		return nil, appendErr("failed to parse vault URL", err)
 	}
 
-	_, err = kv.GetCertificate(ctx, baseURL, certName, "")
+	it, err := kv.GetCertificatesComplete(ctx, baseURL, nil, nil)
 	if err != nil {
-		if detailedErr, ok := err.(autorest.DetailedError); ok {
-			if detailedErr.StatusCode == 404 {
-				return false, nil
+		return nil, newStoreError("GetCertificates", err)
+	}
+	var infos []CertInfo
+	for it.NotDone() {
+		item := it.Value()
+		if item.ID == nil {
+			return nil, errors.New("certificate is missing an ID")
+		}
+		info := CertInfo{Name: path.Base(*item.ID), Tags: make(map[string]string)}
+		info.URL = baseURL + "/secrets/" + info.Name
+		for k, v := range item.Tags {
+			if v != nil {
+				info.Tags[k] = *v
 			}
 		}
+		var notAfter time.Time
+		if attrs := item.Attributes; attrs != nil {
+			info.Enabled = attrs.Enabled != nil && *attrs.Enabled
+			if attrs.Expires != nil {
+				notAfter = time.Time(*attrs.Expires)
+			}
+		}
+		if filter.match(info.Name, info.Tags, notAfter, now) {
+			infos = append(infos, info)
+		}
+
+		if err := it.NextWithContext(ctx); err != nil {
+			return nil, newStoreError("GetCertificates", err)
+		}
+	}
+
+	// Retrieve the certificates, a few at a time
+	var wg sync.WaitGroup
+	errs := make([]error, len(infos))
+	sem := make(chan struct{}, listConcurrency)
+	for i := range infos {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(info *CertInfo, err *error) {
+			defer func() { <-sem; wg.Done() }()
+			bundle, getErr := kv.GetCertificate(ctx, baseURL, info.Name, "")
+			if getErr != nil {
+				*err = appendErr("failed to retrieve certificate "+info.Name, newStoreError("GetCertificate", getErr))
+				return
+			}
+			if bundle.Cer == nil {
+				*err = fmt.Errorf("certificate %v has no contents", info.Name)
+				return
+			}
+			info.Cert, getErr = x509.ParseCertificate(*bundle.Cer)
+			if getErr != nil {
+				*err = appendErr("failed to parse certificate "+info.Name, getErr)
+			}
+		}(&infos[i], &errs[i])
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+func deleteAzureKVCert(ctx context.Context, kv keyvault.BaseClient, urlStr string) (DeletedCert, error) {
+	baseURL, name, _, err := parseAzureKVURL(urlStr)
+	if err != nil {
+		return DeletedCert{}, appendErr("failed to parse URL", err)
+	}
+	bundle, err := kv.DeleteCertificate(ctx, baseURL, name)
+	if err != nil {
+		return DeletedCert{}, appendErr("failed to delete certificate", newStoreError("DeleteCertificate", err))
+	}
+	return newDeletedCert(name, bundle)
+}
+
+func recoverAzureKVCert(ctx context.Context, kv keyvault.BaseClient, urlStr string) error {
+	baseURL, name, _, err := parseAzureKVURL(urlStr)
+	if err != nil {
+		return appendErr("failed to parse URL", err)
+	}
+	_, err = kv.RecoverDeletedCertificate(ctx, baseURL, name)
+	if err != nil {
+		return appendErr("failed to recover certificate", newStoreError("RecoverDeletedCertificate", err))
+	}
+	return nil
+}
+
+// purgeAzureKVCert purges a deleted certificate unless it is a CA which
+// still signs certificates in the vault.
+func purgeAzureKVCert(ctx context.Context, kv keyvault.BaseClient, urlStr string, now time.Time) error {
+	baseURL, name, _, err := parseAzureKVURL(urlStr)
+	if err != nil {
+		return appendErr("failed to parse URL", err)
+	}
+	d, err := getAzureKVDeletedCert(ctx, kv, baseURL, name)
+	if err != nil {
+		return err
+	}
+	deps, err := azureKVDependents(ctx, kv, baseURL, name, d.Cert, now)
+	if err != nil {
+		return appendErr("failed to check for dependent certificates", err)
+	}
+	if len(deps) > 0 {
+		names := make([]string, len(deps))
+		for i, dep := range deps {
+			names[i] = dep.Name
+		}
+		return fmt.Errorf("certificate %v %w: %v", name, ErrHasDependents, strings.Join(names, ", "))
+	}
+
+	_, err = kv.PurgeDeletedCertificate(ctx, baseURL, name)
+	if err != nil {
+		return appendErr("failed to purge certificate", newStoreError("PurgeDeletedCertificate", err))
+	}
+	return nil
+}
+
+func getAzureKVDeletedCert(ctx context.Context, kv keyvault.BaseClient, baseURL, name string) (DeletedCert, error) {
+	bundle, err := kv.GetDeletedCertificate(ctx, baseURL, name)
+	if err != nil {
+		return DeletedCert{}, appendErr("failed to retrieve deleted certificate", newStoreError("GetDeletedCertificate", err))
+	}
+	return newDeletedCert(name, bundle)
+}
+
+func newDeletedCert(name string, bundle keyvault.DeletedCertificateBundle) (DeletedCert, error) {
+	d := DeletedCert{Name: name}
+	if bundle.DeletedDate != nil {
+		d.DeletedAt = time.Time(*bundle.DeletedDate)
+	}
+	if bundle.ScheduledPurgeDate != nil {
+		d.PurgeAt = time.Time(*bundle.ScheduledPurgeDate)
+	}
+	if bundle.Cer == nil {
+		return DeletedCert{}, fmt.Errorf("deleted certificate %v has no contents", name)
+	}
+	cert, err := x509.ParseCertificate(*bundle.Cer)
+	if err != nil {
+		return DeletedCert{}, appendErr("failed to parse deleted certificate", err)
+	}
+	d.Cert = cert
+	return d, nil
+}
+
+// azureKVDependents lists the certificates of the vault signed by ca, see
+// dependents.
+func azureKVDependents(ctx context.Context, kv keyvault.BaseClient, baseURL, name string, ca *x509.Certificate, now time.Time) ([]CertInfo, error) {
+	if !ca.IsCA {
+		return nil, nil
+	}
+	infos, err := listAzureKVCerts(ctx, kv, baseURL, CertFilter{}, now)
+	if err != nil {
+		return nil, err
+	}
+	return dependents(infos, name, ca, now), nil
+}
+
+func setAzureKVCertVersionEnabled(
+	ctx context.Context,
+	kv keyvault.BaseClient,
+	baseURL string,
+	certName string,
+	version string,
+	enabled bool,
+) error {
+	_, err := kv.UpdateCertificate(ctx, baseURL, certName, version, keyvault.CertificateUpdateParameters{
+		CertificateAttributes: &keyvault.CertificateAttributes{
+			Enabled: &enabled,
+		},
+	})
+	return newStoreError("UpdateCertificate", err)
+}
+
+func checkAzureKVCertExists(ctx context.Context, kv keyvault.BaseClient, baseURL, certName string) (bool, error) {
+	_, err := kv.GetCertificate(ctx, baseURL, certName, "")
+	if err != nil {
+		err = newStoreError("GetCertificate", err)
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
 		return false, err
 	}
 
 	return true, nil
 }
 
-func newAzureCLIAuthorizer() (autorest.Authorizer, error) {
-	kvResourceURL := "https://vault.azure.net"
-	token, err := cli.GetTokenFromCLI(kvResourceURL)
+// getAzureKVSecret retrieves the latest value of a secret which is not a
+// certificate, e.g. the state of a CA rollover.
+func getAzureKVSecret(ctx context.Context, kv keyvault.BaseClient, baseURL, name string) (string, error) {
+	return getAzureKVSecretVersion(ctx, kv, baseURL, name, "")
+}
+
+// getAzureKVSecretVersion retrieves a version of a secret, or the latest
+// version if version is empty.
+func getAzureKVSecretVersion(ctx context.Context, kv keyvault.BaseClient, baseURL, name, version string) (string, error) {
+	bundle, err := kv.GetSecret(ctx, baseURL, name, version)
 	if err != nil {
+		return "", newStoreError("GetSecret", err)
+	}
+	if bundle.Value == nil {
+		return "", errors.New("secret has no value")
+	}
+	return *bundle.Value, nil
+}
+
+// setAzureKVSecret stores value as a new version of a secret.
+func setAzureKVSecret(ctx context.Context, kv keyvault.BaseClient, baseURL, name, value, contentType string) error {
+	_, err := kv.SetSecret(ctx, baseURL, name, keyvault.SecretSetParameters{
+		Value:       &value,
+		ContentType: &contentType,
+	})
+	return newStoreError("SetSecret", err)
+}
+
+func newAzureCLIAuthorizer() (autorest.Authorizer, error) {
+	p := &azureCLITokenProvider{getToken: getAzureCLIToken}
+	if err := p.Refresh(); err != nil {
 		return nil, err
 	}
 
-	adalToken, err := token.ToADALToken()
+	return autorest.NewBearerAuthorizer(p), nil
+}
+
+// azureCLITokenRefreshMargin is how long before expiry a token retrieved from
+// the Azure CLI is refreshed.
+const azureCLITokenRefreshMargin = 5 * time.Minute
+
+// azureCLITokenProvider caches the access token retrieved from the Azure CLI
+// and refreshes it once it is about to expire.
+type azureCLITokenProvider struct {
+	getToken func() (adal.Token, error)
+
+	mu    sync.Mutex
+	token adal.Token
+}
+
+func (p *azureCLITokenProvider) OAuthToken() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.token.AccessToken
+}
+
+func (p *azureCLITokenProvider) Refresh() error {
+	adalToken, err := p.getToken()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return autorest.NewBearerAuthorizer(&adalToken), nil
+	p.mu.Lock()
+	p.token = adalToken
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *azureCLITokenProvider) RefreshWithContext(ctx context.Context) error {
+	return p.Refresh()
+}
+
+func (p *azureCLITokenProvider) RefreshExchangeWithContext(ctx context.Context, resource string) error {
+	return p.Refresh()
+}
+
+func (p *azureCLITokenProvider) EnsureFreshWithContext(ctx context.Context) error {
+	p.mu.Lock()
+	fresh := !p.token.WillExpireIn(azureCLITokenRefreshMargin)
+	p.mu.Unlock()
+	if fresh {
+		return nil
+	}
+	return p.Refresh()
+}
+
+// getAzureCLIToken retrieves a Key Vault access token from the Azure CLI.
+func getAzureCLIToken() (adal.Token, error) {
+	kvResourceURL := "https://vault.azure.net"
+	token, err := cli.GetTokenFromCLI(kvResourceURL)
+	if err != nil {
+		return adal.Token{}, err
+	}
+	return token.ToADALToken()
 }
 
 func newAzureEnvAuthorizer() (autorest.Authorizer, error) {
@@ -177,8 +766,10 @@ func newAzureEnvAuthorizer() (autorest.Authorizer, error) {
 	return cfg.Authorizer()
 }
 
-var errInvalidKVSecretURL = errors.New("invalid key vault secret URL, expected format: https://{baseURL}/secrets/{secretName}(/{version}) - did you forget to change /certificates/ to /secrets/?")
-var errInvalidKVCertURL = errors.New("invalid key vault certificate URL, expected format: https://{baseURL}/certificates/{certName}, - did you forget to change /secrets/ to /certificates/?")
+var errInvalidKVSecretURL error = invalidURLError("invalid key vault secret URL, expected format: https://{baseURL}/secrets/{secretName}(/{version}) - did you forget to change /certificates/ to /secrets/?")
+var errInvalidKVCertURL error = invalidURLError("invalid key vault certificate URL, expected format: https://{baseURL}/certificates/{certName}, - did you forget to change /secrets/ to /certificates/?")
+var errInvalidKVVaultURL error = invalidURLError("invalid key vault URL, expected format: https://{baseURL}/ - without /secrets/ or /certificates/")
+var errInvalidKVURL error = invalidURLError("invalid key vault URL, expected format: https://{baseURL}/{secrets|certificates}/{name}(/{version})")
 
 func parseAzureSecretURL(urlStr string) (baseURL, secretName, secretVersion string, err error) {
 	var url *url.URL
@@ -230,3 +821,43 @@ func parseAzureCertURL(urlStr string) (baseURL, certName string, err error) {
 
 	return
 }
+
+// parseAzureKVURL parses either a secret or a certificate URL.
+func parseAzureKVURL(urlStr string) (baseURL, name, version string, err error) {
+	var url *url.URL
+	url, err = url.Parse(urlStr)
+	if err != nil {
+		return
+	}
+
+	var r *regexp.Regexp
+	r, err = regexp.Compile("/(?:secrets|certificates)/([^/]+)/?([^/]+)?")
+	if err != nil {
+		err = errInvalidKVURL
+		return
+	}
+	matches := r.FindStringSubmatch(url.Path)
+	if len(matches) <= 1 || len(matches) > 3 {
+		err = errInvalidKVURL
+		return
+	}
+
+	baseURL = url.Scheme + "://" + url.Host
+	name = matches[1]
+	version = matches[2]
+
+	return
+}
+
+// parseAzureVaultURL parses the URL of a vault, e.g.
+// https://myvault.vault.azure.net/.
+func parseAzureVaultURL(urlStr string) (baseURL string, err error) {
+	url, err := url.Parse(urlStr)
+	if err != nil {
+		return "", err
+	}
+	if url.Host == "" || strings.Trim(url.Path, "/") != "" {
+		return "", errInvalidKVVaultURL
+	}
+	return url.Scheme + "://" + url.Host, nil
+}
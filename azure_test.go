@@ -1,10 +1,20 @@
 package certmanager
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"testing"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+	"github.com/Azure/go-autorest/autorest/date"
 	"github.com/google/go-cmp/cmp"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
 )
 
 func Test_parseAzureSecretURL(t *testing.T) {
@@ -45,3 +55,263 @@ func Test_parseAzureSecretURL(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseAzureKVURL(t *testing.T) {
+	type Resp struct {
+		BaseURL string
+		Name    string
+		Version string
+	}
+
+	for _, tc := range []struct {
+		in      string
+		want    Resp
+		wantErr error
+	}{
+		{
+			"https://test-vault.vault.azure.net/secrets/abc",
+			Resp{"https://test-vault.vault.azure.net", "abc", ""}, nil,
+		},
+		{
+			"https://test-vault.vault.azure.net/certificates/abc/1234",
+			Resp{"https://test-vault.vault.azure.net", "abc", "1234"}, nil,
+		},
+		{
+			"https://test-vault.vault.azure.net/keys/abc",
+			Resp{"", "", ""}, errInvalidKVURL,
+		},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			baseURL, name, version, gotErr := parseAzureKVURL(tc.in)
+			got := Resp{baseURL, name, version}
+
+			if !cmp.Equal(tc.want, got) {
+				t.Error("test failed", cmp.Diff(tc.want, got))
+			}
+			if !errors.Is(gotErr, tc.wantErr) {
+				t.Errorf("wrong return err\nexpected: %v\ngot: %v", tc.wantErr, gotErr)
+			}
+		})
+	}
+}
+
+func Test_getAzureKVCert(t *testing.T) {
+	caCert, caKey, err := GenSelfSignedCA("testca", time.Now().AddDate(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfx, err := pkcs12.Encode(rand.Reader, caKey, caCert, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBundle, err := encodePEMBundle(caCert, nil, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPEMBundle, err := encodePEMBundle(newTestCert(t, "ec", ecKey), nil, ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strPtr := func(s string) *string { return &s }
+
+	s := newFakeKVStore(t, &fakeKeyVault{
+		permissions: map[string]bool{"secrets/get": true},
+		secrets: map[string]keyvault.SecretBundle{
+			"pkcs12": {
+				Value:       strPtr(base64.StdEncoding.EncodeToString(pfx)),
+				ContentType: strPtr(contentTypePKCS12),
+			},
+			"pem": {
+				Value:       strPtr(string(pemBundle)),
+				ContentType: strPtr(contentTypePEM),
+			},
+			"pem-ec": {
+				Value:       strPtr(string(ecPEMBundle)),
+				ContentType: strPtr(contentTypePEM),
+			},
+			"nocontenttype": {
+				Value: strPtr("abc"),
+			},
+		},
+	})
+
+	for _, tc := range []struct {
+		name     string
+		password string
+		wantErr  error
+	}{
+		{"pkcs12", "secret", nil},
+		{"pkcs12", "wrong", ErrInvalidPassword},
+		{"pem", "", nil},
+		{"pem-ec", "", ErrUnsupportedKeyType},
+		{"nocontenttype", "", ErrInvalidContentType},
+		{"missing", "", ErrNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			url := "https://test.vault.azure.net/secrets/" + tc.name
+			cert, _, key, err := s.GetCert(context.Background(), url, tc.password)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("wrong return err\nexpected: %v\ngot: %v", tc.wantErr, err)
+			}
+			if tc.wantErr != nil {
+				return
+			}
+			if !cert.Equal(caCert) || !caKey.Equal(key) {
+				t.Error("retrieved certificate or key did not match")
+			}
+		})
+	}
+}
+
+func Test_getAzureKVCert_selectVersion(t *testing.T) {
+	now := time.Now()
+	strPtr := func(s string) *string { return &s }
+	boolPtr := func(b bool) *bool { return &b }
+	unixPtr := func(t time.Time) *date.UnixTime { u := date.UnixTime(t); return &u }
+
+	// v3 is the newest but disabled, v2 is enabled but expired
+	secrets := make(map[string]keyvault.SecretBundle)
+	certs := make(map[string]*x509.Certificate)
+	var items []keyvault.CertificateItem
+	for i, v := range []struct {
+		version   string
+		enabled   bool
+		notBefore time.Time
+		expires   time.Time
+	}{
+		{"v3", false, now.Add(-time.Hour), now.AddDate(1, 0, 0)},
+		{"v2", true, now.AddDate(-1, 0, 0), now.Add(-time.Hour)},
+		{"v1", true, now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0)},
+	} {
+		caCert, caKey, err := GenSelfSignedCA("testca-"+v.version, now.AddDate(1, 0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pemBundle, err := encodePEMBundle(caCert, nil, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secrets["ca/"+v.version] = keyvault.SecretBundle{Value: strPtr(string(pemBundle)), ContentType: strPtr(contentTypePEM)}
+		certs[v.version] = caCert
+		items = append(items, keyvault.CertificateItem{
+			ID: strPtr("https://test.vault.azure.net/certificates/ca/" + v.version),
+			Attributes: &keyvault.CertificateAttributes{
+				Enabled:   boolPtr(v.enabled),
+				NotBefore: unixPtr(v.notBefore),
+				Expires:   unixPtr(v.expires),
+				Created:   unixPtr(now.Add(-time.Duration(i) * time.Hour)),
+			},
+		})
+	}
+
+	for _, tc := range []struct {
+		selector string
+		want     string
+	}{
+		{VersionLatestEnabled, "v2"},
+		{VersionLatestValid, "v1"},
+	} {
+		t.Run(tc.selector, func(t *testing.T) {
+			kv := &fakeKeyVault{
+				permissions:  map[string]bool{"secrets/get": true, "certificates/list": true},
+				secrets:      secrets,
+				certVersions: map[string][]keyvault.CertificateItem{"ca": items},
+			}
+			s := newFakeKVStore(t, kv)
+
+			cert, _, _, err := s.GetCert(context.Background(), "https://test.vault.azure.net/secrets/ca", "", SelectVersion(tc.selector))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cert.Equal(certs[tc.want]) {
+				t.Errorf("want version %v, got %v", tc.want, cert.Subject.CommonName)
+			}
+
+			// Selection must not retrieve each version
+			if n := kv.requestCount("GET /certificates/ca/versions"); n != 1 {
+				t.Errorf("want 1 listing request, got %v", n)
+			}
+			for _, v := range []string{"v1", "v2", "v3"} {
+				if n := kv.requestCount("GET /certificates/ca/" + v); n != 0 {
+					t.Errorf("want no certificate requests for %v, got %v", v, n)
+				}
+			}
+			if n := kv.requestCount("GET /secrets/"); n != 1 {
+				t.Errorf("want 1 secret request, got %v", n)
+			}
+		})
+	}
+}
+
+func Test_uploadAzureKVCert(t *testing.T) {
+	caCert, caKey, err := GenSelfSignedCA("testca", time.Now().AddDate(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key, err := GenSignedCert(caCert, caKey, "test", []string{"test.example.com"}, time.Now().AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		format string
+		// decode returns the uploaded certificate and CA chain
+		decode func(t *testing.T, params keyvault.CertificateImportParameters) (*x509.Certificate, []*x509.Certificate)
+	}{
+		{FormatPKCS12, func(t *testing.T, params keyvault.CertificateImportParameters) (*x509.Certificate, []*x509.Certificate) {
+			pfx, err := base64.StdEncoding.DecodeString(*params.Base64EncodedCertificate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, gotCert, gotCACerts, err := pkcs12.DecodeChain(pfx, *params.Password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if params.CertificatePolicy != nil {
+				t.Errorf("want no certificate policy, got %+v", params.CertificatePolicy)
+			}
+			return gotCert, gotCACerts
+		}},
+		{FormatPEM, func(t *testing.T, params keyvault.CertificateImportParameters) (*x509.Certificate, []*x509.Certificate) {
+			gotCert, gotCACerts, gotKey, err := decodePEMBundle([]byte(*params.Base64EncodedCertificate))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !key.Equal(gotKey) {
+				t.Error("uploaded key did not match")
+			}
+			// The policy must keep the secret in PEM format
+			if p := params.CertificatePolicy; p == nil || p.SecretProperties == nil || *p.SecretProperties.ContentType != contentTypePEM {
+				t.Errorf("want secret content type %v", contentTypePEM)
+			}
+			return gotCert, gotCACerts
+		}},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			kv := &fakeKeyVault{
+				permissions: map[string]bool{"certificates/get": true, "certificates/import": true},
+			}
+			s := newFakeKVStore(t, kv)
+
+			err := s.UploadCert(context.Background(), "https://test.vault.azure.net/certificates/test", cert, []*x509.Certificate{caCert}, key, "secret", WithFormat(tc.format))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(kv.imports) != 1 {
+				t.Fatalf("want 1 import, got %v", len(kv.imports))
+			}
+
+			gotCert, gotCACerts := tc.decode(t, kv.imports[0])
+			if !gotCert.Equal(cert) {
+				t.Error("uploaded certificate did not match")
+			}
+			if len(gotCACerts) != 1 || !gotCACerts[0].Equal(caCert) {
+				t.Error("uploaded CA chain did not match")
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LoadTrustBundle loads the certificates to trust from each source and merges
+// them, see MergeTrustBundles. A source is either a secret URL in the store,
+// e.g. https://myvault.azure.net/secrets/partner-ca, or the path to a PEM
+// file. Secrets may hold a PEM bundle, which needs no key, or a PKCS#12
+// bundle protected by certPassword. All certificates of a source are trusted,
+// including intermediates.
+func LoadTrustBundle(ctx context.Context, certPassword string, sources ...string) ([]*x509.Certificate, error) {
+	s, err := getDefaultStore()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.LoadTrustBundle(ctx, certPassword, sources...)
+}
+
+// LoadTrustBundle loads and merges the certificates of each source. See the
+// package-level LoadTrustBundle for details.
+func (s *Store) LoadTrustBundle(ctx context.Context, certPassword string, sources ...string) ([]*x509.Certificate, error) {
+	var bundles [][]*x509.Certificate
+	for _, src := range sources {
+		var certs []*x509.Certificate
+		var err error
+		if strings.Contains(src, "vault.azure.net") {
+			certs, err = getAzureKVCertificates(ctx, s.kv, src, certPassword)
+		} else {
+			certs, err = readTrustBundleFile(src)
+		}
+		if err != nil {
+			return nil, appendErr(fmt.Sprintf("failed to load trust bundle from %v", src), err)
+		}
+		bundles = append(bundles, certs)
+	}
+	return MergeTrustBundles(bundles...), nil
+}
+
+func readTrustBundleFile(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodePEMCerts(data)
+}
+
+// MergeTrustBundles returns the certificates of all bundles in order, without
+// duplicates.
+func MergeTrustBundles(bundles ...[]*x509.Certificate) []*x509.Certificate {
+	var merged []*x509.Certificate
+	seen := make(map[string]bool)
+	for _, bundle := range bundles {
+		for _, cert := range bundle {
+			if seen[string(cert.Raw)] {
+				continue
+			}
+			seen[string(cert.Raw)] = true
+			merged = append(merged, cert)
+		}
+	}
+	return merged
+}
+
+// EncodeTrustBundle encodes certificates as PEM blocks.
+func EncodeTrustBundle(certs []*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		buf.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	}
+	return buf.Bytes()
+}
+
+// PublishTrustBundle stores certificates as a new version of the PEM secret at
+// secretURL, e.g. https://myvault.azure.net/secrets/trust-bundle, from which
+// LoadTrustBundle can load them.
+func PublishTrustBundle(ctx context.Context, secretURL string, certs []*x509.Certificate) error {
+	s, err := getDefaultStore()
+	if err != nil {
+		return err
+	}
+
+	return s.PublishTrustBundle(ctx, secretURL, certs)
+}
+
+// PublishTrustBundle stores certificates as a PEM secret. See the
+// package-level PublishTrustBundle for details.
+func (s *Store) PublishTrustBundle(ctx context.Context, secretURL string, certs []*x509.Certificate) error {
+	if !strings.Contains(secretURL, "vault.azure.net") {
+		return ErrUnsupportedURL
+	}
+	baseURL, name, version, err := parseAzureSecretURL(secretURL)
+	if err != nil {
+		return appendErr("failed to parse secret URL", err)
+	}
+	if version != "" {
+		return fmt.Errorf("cannot publish to version %v, remove it from the URL", version)
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("trust bundle for %v is empty", name)
+	}
+	return setAzureKVSecret(ctx, s.kv, baseURL, name, string(EncodeTrustBundle(certs)), contentTypePEM)
+}
+
+// newTrustPool returns a pool of caCert and the certificates of the bundle.
+func newTrustPool(caCert *x509.Certificate, bundle []*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	for _, cert := range bundle {
+		pool.AddCert(cert)
+	}
+	return pool
+}
@@ -0,0 +1,201 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+)
+
+func TestMergeTrustBundles(t *testing.T) {
+	a, _, err := GenSelfSignedCA("a", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err := GenSelfSignedCA("b", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := MergeTrustBundles([]*x509.Certificate{a, b}, nil, []*x509.Certificate{b, a})
+	if len(got) != 2 || !got[0].Equal(a) || !got[1].Equal(b) {
+		t.Errorf("want [a b], got %v certificates", len(got))
+	}
+}
+
+func TestStore_LoadTrustBundle(t *testing.T) {
+	expiry := time.Now().Add(time.Hour)
+	ca, caKey, err := GenSelfSignedCA("ca", expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partner, _, err := GenSelfSignedCA("partner", expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBundle, err := encodePEMBundle(ca, nil, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strPtr := func(s string) *string { return &s }
+	kv := &fakeKeyVault{
+		permissions: map[string]bool{"secrets/get": true, "secrets/set": true},
+		secrets: map[string]keyvault.SecretBundle{
+			"ca": {Value: strPtr(string(pemBundle)), ContentType: strPtr(contentTypePEM)},
+		},
+	}
+	s := newFakeKVStore(t, kv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	partnerPath := filepath.Join(t.TempDir(), "partner.pem")
+	if err := os.WriteFile(partnerPath, EncodeTrustBundle([]*x509.Certificate{partner, ca}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.LoadTrustBundle(ctx, "", "https://test.vault.azure.net/secrets/ca", partnerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || !got[0].Equal(ca) || !got[1].Equal(partner) {
+		t.Fatalf("want [ca partner], got %v certificates", len(got))
+	}
+
+	// Published bundles can be loaded again
+	bundleURL := "https://test.vault.azure.net/secrets/trust-bundle"
+	if err := s.PublishTrustBundle(ctx, bundleURL, got); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := s.LoadTrustBundle(ctx, "", bundleURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 {
+		t.Errorf("want 2 published certificates, got %v", len(loaded))
+	}
+
+	if _, err := s.LoadTrustBundle(ctx, "", filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Error("want error for missing file")
+	}
+}
+
+func TestStore_GetMTLSServerConfig_trustBundle(t *testing.T) {
+	expiry := time.Now().Add(time.Hour)
+	strPtr := func(s string) *string { return &s }
+	secrets := make(map[string]keyvault.SecretBundle)
+	cas := make(map[string]*x509.Certificate)
+	for _, name := range []string{"ca", "partner-ca", "other-ca"} {
+		ca, key, err := GenSelfSignedCA(name, expiry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pemBundle, err := encodePEMBundle(ca, nil, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secrets[name] = keyvault.SecretBundle{Value: strPtr(string(pemBundle)), ContentType: strPtr(contentTypePEM)}
+		cas[name] = ca
+	}
+	s := newFakeKVStore(t, &fakeKeyVault{
+		permissions: map[string]bool{"secrets/get": true},
+		secrets:     secrets,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	caURL := func(name string) string { return "https://test.vault.azure.net/secrets/" + name }
+
+	serverConf, err := s.GetMTLSServerConfig(ctx, caURL("ca"), "", "localhost", []string{"localhost"}, expiry,
+		WithTrustBundleFrom(caURL("partner-ca")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		clientCA string
+		wantErr  bool
+	}{
+		{"ca", false},
+		{"partner-ca", false},
+		{"other-ca", true},
+	} {
+		t.Run(tc.clientCA, func(t *testing.T) {
+			clientConf, err := s.GetMTLSClientConfig(ctx, caURL(tc.clientCA), "", "client", "localhost", expiry,
+				WithTrustBundle(cas["ca"]),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+			serverErr := make(chan error, 1)
+			go func() {
+				serverErr <- tls.Server(serverConn, serverConf).Handshake()
+			}()
+			_ = tls.Client(clientConn, clientConf).Handshake()
+			clientConn.Close()
+
+			if err := <-serverErr; (err != nil) != tc.wantErr {
+				t.Errorf("want error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestStore_GetMTLSConfig_rootless(t *testing.T) {
+	expiry := time.Now().Add(time.Hour)
+	root, rootKey, err := GenSelfSignedCA("root", expiry, WithMaxPathLen(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate, intermediateKey, err := GenIntermediateCA(root, rootKey, "intermediate", expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The intermediate is stored without its root
+	pemBundle, err := encodePEMBundle(intermediate, nil, intermediateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strPtr := func(s string) *string { return &s }
+	s := newFakeKVStore(t, &fakeKeyVault{
+		permissions: map[string]bool{"secrets/get": true},
+		secrets: map[string]keyvault.SecretBundle{
+			"ca": {Value: strPtr(string(pemBundle)), ContentType: strPtr(contentTypePEM)},
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	caURL := "https://test.vault.azure.net/secrets/ca"
+
+	serverConf, err := s.GetMTLSServerConfig(ctx, caURL, "", "localhost", []string{"localhost"}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConf, err := s.GetMTLSClientConfig(ctx, caURL, "", "client", "localhost", expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- tls.Server(serverConn, serverConf).Handshake()
+	}()
+	if err := tls.Client(clientConn, clientConf).Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+}
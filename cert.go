@@ -2,42 +2,126 @@ package certmanager
 
 import (
 	"context"
+	"crypto"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/x509"
+	asn1pkix "crypto/x509/pkix"
+	"encoding/asn1"
 	"errors"
 	"fmt"
-	"strings"
+	"math/big"
+	"net"
 	"sync"
 	"time"
 
 	"github.com/square/certstrap/pkix"
 )
 
+// GetCert retrieves a certificate, its CA chain and its key from the store.
+// Certificates may be stored either as PKCS#12 or as PEM bundles. The key must
+// be an RSA key, use GetCertSigner for other key types. Other keys cause
+// ErrUnsupportedKeyType to be returned.
+//
+// By default, the latest version of the certificate is retrieved. Use
+// SelectVersion to pick another version.
 func GetCert(
 	ctx context.Context,
 	url string,
 	certPassword string,
+	opts ...GetCertOption,
 ) (cert *x509.Certificate, caCerts []*x509.Certificate, key *rsa.PrivateKey, err error) {
-	if !strings.Contains(url, "vault.azure.net") {
-		return nil, nil, nil, errors.New("only azure key vault URLs are supported")
+	s, err := getDefaultStore()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return s.GetCert(ctx, url, certPassword, opts...)
+}
+
+// GetCertSigner retrieves a certificate, its CA chain and its key from the
+// store. Unlike GetCert, the key may be of any type supported by crypto/x509,
+// e.g. an EC key from a PEM bundle.
+func GetCertSigner(
+	ctx context.Context,
+	url string,
+	certPassword string,
+	opts ...GetCertOption,
+) (cert *x509.Certificate, caCerts []*x509.Certificate, key crypto.Signer, err error) {
+	s, err := getDefaultStore()
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	return getAzureKVCert(ctx, url, certPassword)
+	return s.GetCertSigner(ctx, url, certPassword, opts...)
+}
+
+// UploadCertOption configures the behaviour of UploadCert.
+type UploadCertOption func(*uploadCertOptions)
+
+type uploadCertOptions struct {
+	format           string
+	newVersion       bool
+	pkcs12Encoding   string
+	generatePassword bool
+}
+
+// WithFormat selects the format in which the certificate is stored, either
+// FormatPKCS12 (default) or FormatPEM. The certificate password is ignored for
+// PEM bundles.
+func WithFormat(format string) UploadCertOption {
+	return func(o *uploadCertOptions) {
+		o.format = format
+	}
+}
+
+// WithPKCS12Encoding selects how PKCS#12 bundles are encrypted, either
+// PKCS12Legacy (default) or PKCS12Modern. Legacy bundles use RC2 and 3DES,
+// which are weak but understood by old clients. The default stays legacy so
+// that bundles uploaded by existing callers remain readable by the clients
+// they were written for, while the CLI defaults to PKCS12Modern.
+func WithPKCS12Encoding(encoding string) UploadCertOption {
+	return func(o *uploadCertOptions) {
+		o.pkcs12Encoding = encoding
+	}
 }
 
+// WithGeneratedPassword protects the PKCS#12 bundle with a strong random
+// password, which is stored in a companion secret before the certificate is
+// uploaded. See PasswordSecretURL for the URL of the secret. The certificate
+// password passed to UploadCert must be empty.
+func WithGeneratedPassword() UploadCertOption {
+	return func(o *uploadCertOptions) {
+		o.generatePassword = true
+	}
+}
+
+// AllowNewVersion uploads the certificate as a new version if a certificate
+// with the same name already exists, e.g. when renewing it. By default,
+// uploading fails with ErrAlreadyExists.
+func AllowNewVersion() UploadCertOption {
+	return func(o *uploadCertOptions) {
+		o.newVersion = true
+	}
+}
+
+// UploadCert uploads a certificate, its CA chain and its key to the store.
 func UploadCert(
 	ctx context.Context,
 	url string,
 	cert *x509.Certificate,
 	caCerts []*x509.Certificate,
-	key *rsa.PrivateKey,
+	key crypto.Signer,
 	certPassword string,
+	opts ...UploadCertOption,
 ) error {
-	if !strings.Contains(url, "vault.azure.net") {
-		return errors.New("only azure key vault URLs are supported")
+	s, err := getDefaultStore()
+	if err != nil {
+		return err
 	}
 
-	return uploadAzureKVCert(ctx, url, cert, caCerts, key, certPassword)
+	return s.UploadCert(ctx, url, cert, caCerts, key, certPassword, opts...)
 }
 
 // GenSignedCert generates a new certificate that has been signed by the provided
@@ -46,13 +130,38 @@ func UploadCert(
 //
 // For mTLS, it is important that the server's hostname matches that of the certificate.
 // For alternative addresses, simply add them to the sans list.
+//
+// SANs of the form spiffe://trust-domain/path are added as URI SANs, which
+// makes the certificate an X.509-SVID. At most one SPIFFE ID may be provided.
+//
+// Use WithPolicy to restrict which names may be signed. Certificates which are
+// not permitted by the name constraints of the CA are never signed.
+//
+// With WithProfile, the certificate is issued by GenSignedCertSigner, and the
+// key type of the profile must be RSA.
 func GenSignedCert(
 	caCert *x509.Certificate,
 	caKey *rsa.PrivateKey,
 	commonName string,
 	sans []string,
 	expiry time.Time,
+	opts ...SignOption,
 ) (cert *x509.Certificate, key *rsa.PrivateKey, firstErr error) {
+	var o signOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.profile != nil {
+		if o.profile.KeyType != "" && o.profile.KeyType != KeyTypeRSA {
+			return nil, nil, fmt.Errorf("%w: profile key type %v, want %v", ErrUnsupportedKeyType, o.profile.KeyType, KeyTypeRSA)
+		}
+		cert, key, err := GenSignedCertSigner(caCert, caKey, commonName, sans, expiry, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cert, key.(*rsa.PrivateKey), nil
+	}
+
 	var errOnce sync.Once
 	check := func(err error) {
 		if err != nil {
@@ -66,12 +175,29 @@ func GenSignedCert(
 	pkixCAKey := pkix.NewKey(caKey.Public, caKey)
 	pkixCACert := pkix.NewCertificateFromDER(caCert.Raw)
 
+	// Split SANs into DNS names and SPIFFE IDs
+	dnsNames, uris, err := splitSANs(sans)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Check policy before doing any work
+	err = o.policy.Check(&x509.Certificate{
+		Subject:  asn1pkix.Name{CommonName: commonName},
+		DNSNames: dnsNames,
+		URIs:     uris,
+		NotAfter: expiry,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Generate key
 	pkixKey, err := pkix.CreateRSAKey(2048)
 	check(err)
 
 	// Create CSR
-	csr, err := pkix.CreateCertificateSigningRequest(pkixKey, "", nil, sans, nil, "", "", "", "", commonName)
+	csr, err := pkix.CreateCertificateSigningRequest(pkixKey, "", nil, dnsNames, uris, "", "", "", "", commonName)
 	check(err)
 
 	// Sign
@@ -90,40 +216,353 @@ func GenSignedCert(
 		})
 	}
 
+	if firstErr == nil {
+		firstErr = checkNameConstraints(caCert, cert)
+	}
 	if firstErr == nil {
 		return cert, key, firstErr
 	}
 	return nil, nil, firstErr
 }
 
+// SignCSR signs the certificate signing request (CSR) with the provided
+// certificate authority (CA). The subject and Subject Alternative Names (SAN)
+// are copied from the CSR. Unlike GenSignedCert, the key of the CSR may be of
+// any type supported by crypto/x509.
+//
+// The certificate will not expire after the CA. Use WithPolicy to restrict
+// which names may be signed.
+//
+// With WithProfile, the usages, subject defaults and SAN rules of the profile
+// are applied, and the certificate does not outlive the validity of the
+// profile. A zero expiry means the full validity of the profile.
+func SignCSR(
+	caCert *x509.Certificate,
+	caKey crypto.Signer,
+	csr *x509.CertificateRequest,
+	expiry time.Time,
+	opts ...SignOption,
+) (*x509.Certificate, error) {
+	var o signOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, appendErr("invalid CSR signature", err)
+	}
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Subject key ID is the SHA-1 hash of the subject public key
+	var spki struct {
+		Algorithm        asn1pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(csr.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, appendErr("failed to parse CSR public key", err)
+	}
+	subjectKeyID := sha1.Sum(spki.SubjectPublicKey.Bytes)
+
+	keyUsage := defaultKeyUsage(csr.PublicKey)
+	extKeyUsage := defaultExtKeyUsage()
+	if p := o.profile; p != nil {
+		if keyUsage, err = p.keyUsage(csr.PublicKey); err != nil {
+			return nil, err
+		}
+		if extKeyUsage, err = p.extKeyUsage(); err != nil {
+			return nil, err
+		}
+		if maxExpiry := time.Now().Add(p.Validity); p.Validity > 0 && (expiry.IsZero() || expiry.After(maxExpiry)) {
+			expiry = maxExpiry
+		}
+	}
+	if expiry.After(caCert.NotAfter) {
+		expiry = caCert.NotAfter
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serialNumber,
+		RawSubject:   csr.RawSubject,
+		// Allow for some clock skew between hosts
+		NotBefore:    time.Now().Add(-10 * time.Minute).UTC(),
+		NotAfter:     expiry,
+		KeyUsage:     keyUsage,
+		ExtKeyUsage:  extKeyUsage,
+		SubjectKeyId: subjectKeyID[:],
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		URIs:         csr.URIs,
+	}
+
+	if p := o.profile; p != nil {
+		// Setting the subject rather than the raw subject re-encodes it
+		tmpl.RawSubject = nil
+		tmpl.Subject = p.subject(csr.Subject)
+		p.SANs.complete(tmpl)
+		if err := p.SANs.check(tmpl); err != nil {
+			return nil, err
+		}
+	}
+
+	// The template may only hold the raw subject
+	checkTmpl := *tmpl
+	checkTmpl.Subject = csr.Subject
+	if err := o.policy.Check(&checkTmpl); err != nil {
+		return nil, err
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, csr.PublicKey, caKey)
+	if err != nil {
+		return nil, appendErr("failed to sign certificate", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNameConstraints(caCert, cert); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// NameConstraints restrict the names of the certificates a CA may issue, see
+// WithNameConstraints. The fields have the same meaning as the corresponding
+// fields of x509.Certificate. A certificate with a name outside the permitted
+// subtrees, or inside an excluded subtree, is rejected by clients.
+type NameConstraints struct {
+	PermittedDNSDomains     []string
+	ExcludedDNSDomains      []string
+	PermittedIPRanges       []*net.IPNet
+	ExcludedIPRanges        []*net.IPNet
+	PermittedURIDomains     []string
+	ExcludedURIDomains      []string
+	PermittedEmailAddresses []string
+	ExcludedEmailAddresses  []string
+}
+
+// CAOption configures the behaviour of GenSelfSignedCA and
+// GenIntermediateCA.
+type CAOption func(*caOptions)
+
+type caOptions struct {
+	constraints NameConstraints
+	maxPathLen  int
+}
+
+// WithNameConstraints adds a critical name constraints extension to the CA
+// certificate, which limits the names of the certificates issued by the CA
+// and by any CA below it.
+func WithNameConstraints(c NameConstraints) CAOption {
+	return func(o *caOptions) {
+		o.constraints = c
+	}
+}
+
+// WithMaxPathLen sets how many intermediate CAs may follow the CA in a chain.
+// By default it is zero, i.e. the CA may only issue leaf certificates. A
+// negative value means no limit.
+func WithMaxPathLen(n int) CAOption {
+	return func(o *caOptions) {
+		o.maxPathLen = n
+	}
+}
+
 // GenSelfSignedCA generates a self-signed Certificate Authority certificate and key.
 func GenSelfSignedCA(
 	name string,
 	expiry time.Time,
+	opts ...CAOption,
 ) (cert *x509.Certificate, key *rsa.PrivateKey, err error) {
-	pkixKey, err := pkix.CreateRSAKey(2048)
+	key, err = rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	pkixCert, err := pkix.CreateCertificateAuthority(pkixKey, "", expiry, "", "", "", "", name)
+	tmpl, err := newCATemplate(name, expiry, opts)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	x509cert, err := pkixCert.GetRawCertificate()
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, nil, appendErr("failed to create CA certificate", err)
+	}
+
+	cert, err = x509.ParseCertificate(der)
 	if err != nil {
 		return nil, nil, err
 	}
+	return cert, key, nil
+}
 
-	rsaKey, ok := pkixKey.Private.(*rsa.PrivateKey)
-	if !ok {
-		return nil, nil, errors.New("failed to parse private CA key as RSA key")
+// GenIntermediateCA generates an intermediate Certificate Authority
+// certificate and key signed by the provided CA. The certificate will not
+// expire after the CA.
+//
+// The CA must allow intermediates, see WithMaxPathLen. The name constraints of
+// the CA also apply to certificates issued by the intermediate, so they are
+// copied to the intermediate: excluded subtrees are added to its own, and
+// permitted subtrees are used unless it has its own. This lets the
+// constraints be checked when signing with the intermediate alone.
+func GenIntermediateCA(
+	caCert *x509.Certificate,
+	caKey crypto.Signer,
+	name string,
+	expiry time.Time,
+	opts ...CAOption,
+) (cert *x509.Certificate, key *rsa.PrivateKey, err error) {
+	if !caCert.IsCA {
+		return nil, nil, errors.New("issuer is not a CA certificate")
+	}
+	if caCert.MaxPathLenZero {
+		return nil, nil, errors.New("issuer CA does not allow intermediate CAs")
+	}
+
+	key, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if expiry.After(caCert.NotAfter) {
+		expiry = caCert.NotAfter
 	}
+	tmpl, err := newCATemplate(name, expiry, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	inheritNameConstraints(tmpl, caCert)
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, appendErr("failed to sign CA certificate", err)
+	}
+
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// CrossSign signs the certificate of a CA with another CA, e.g. during a CA
+// rollover. The cross-signed certificate has the subject, key and
+// constraints of caCert, so certificates issued by the CA are accepted by
+// clients which trust either CA when it is included in their chain. The
+// certificate will not expire after the issuer.
+//
+// The issuer must allow intermediates, see WithMaxPathLen, since clients
+// treat the cross-signed certificate as an intermediate of the issuer.
+func CrossSign(
+	issuerCert *x509.Certificate,
+	issuerKey crypto.Signer,
+	caCert *x509.Certificate,
+) (*x509.Certificate, error) {
+	if !issuerCert.IsCA || !caCert.IsCA {
+		return nil, errors.New("both certificates must be CA certificates")
+	}
+	if issuerCert.MaxPathLenZero {
+		return nil, errors.New("issuer CA does not allow intermediate CAs")
+	}
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, err
+	}
+	expiry := caCert.NotAfter
+	if expiry.After(issuerCert.NotAfter) {
+		expiry = issuerCert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      caCert.Subject,
+		// Allow for some clock skew between hosts
+		NotBefore:             time.Now().Add(-10 * time.Minute).UTC(),
+		NotAfter:              expiry,
+		SubjectKeyId:          caCert.SubjectKeyId,
+		KeyUsage:              caCert.KeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            caCert.MaxPathLen,
+		MaxPathLenZero:        caCert.MaxPathLenZero,
 
-	return x509cert, rsaKey, nil
+		PermittedDNSDomainsCritical: caCert.PermittedDNSDomainsCritical,
+		PermittedDNSDomains:         caCert.PermittedDNSDomains,
+		ExcludedDNSDomains:          caCert.ExcludedDNSDomains,
+		PermittedIPRanges:           caCert.PermittedIPRanges,
+		ExcludedIPRanges:            caCert.ExcludedIPRanges,
+		PermittedURIDomains:         caCert.PermittedURIDomains,
+		ExcludedURIDomains:          caCert.ExcludedURIDomains,
+		PermittedEmailAddresses:     caCert.PermittedEmailAddresses,
+		ExcludedEmailAddresses:      caCert.ExcludedEmailAddresses,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuerCert, caCert.PublicKey, issuerKey)
+	if err != nil {
+		return nil, appendErr("failed to cross-sign CA certificate", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+func inheritNameConstraints(tmpl *x509.Certificate, caCert *x509.Certificate) {
+	if len(tmpl.PermittedDNSDomains) == 0 {
+		tmpl.PermittedDNSDomains = caCert.PermittedDNSDomains
+	}
+	if len(tmpl.PermittedIPRanges) == 0 {
+		tmpl.PermittedIPRanges = caCert.PermittedIPRanges
+	}
+	if len(tmpl.PermittedURIDomains) == 0 {
+		tmpl.PermittedURIDomains = caCert.PermittedURIDomains
+	}
+	if len(tmpl.PermittedEmailAddresses) == 0 {
+		tmpl.PermittedEmailAddresses = caCert.PermittedEmailAddresses
+	}
+	tmpl.ExcludedDNSDomains = append(tmpl.ExcludedDNSDomains, caCert.ExcludedDNSDomains...)
+	tmpl.ExcludedIPRanges = append(tmpl.ExcludedIPRanges, caCert.ExcludedIPRanges...)
+	tmpl.ExcludedURIDomains = append(tmpl.ExcludedURIDomains, caCert.ExcludedURIDomains...)
+	tmpl.ExcludedEmailAddresses = append(tmpl.ExcludedEmailAddresses, caCert.ExcludedEmailAddresses...)
 }
 
-func appendErr(s string, err error) error {
-	return fmt.Errorf("%v, err: %v", s, err)
+func newCATemplate(name string, expiry time.Time, opts []CAOption) (*x509.Certificate, error) {
+	var o caOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	c := o.constraints
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      asn1pkix.Name{CommonName: name},
+		// Allow for some clock skew between hosts
+		NotBefore:             time.Now().Add(-10 * time.Minute).UTC(),
+		NotAfter:              expiry,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            o.maxPathLen,
+		MaxPathLenZero:        o.maxPathLen == 0,
+
+		// RFC 5280 requires the extension to be critical
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         c.PermittedDNSDomains,
+		ExcludedDNSDomains:          c.ExcludedDNSDomains,
+		PermittedIPRanges:           c.PermittedIPRanges,
+		ExcludedIPRanges:            c.ExcludedIPRanges,
+		PermittedURIDomains:         c.PermittedURIDomains,
+		ExcludedURIDomains:          c.ExcludedURIDomains,
+		PermittedEmailAddresses:     c.PermittedEmailAddresses,
+		ExcludedEmailAddresses:      c.ExcludedEmailAddresses,
+	}, nil
 }
@@ -0,0 +1,130 @@
+package certmanager
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// BuildChain orders the certificates which make up the chain of cert, linking
+// each certificate to its issuer by name and key identifiers with
+// x509.Verify. Certificates which are not part of the chain are ignored, and
+// the order of certs does not matter.
+//
+// The returned chain starts with cert, followed by its intermediates, and is
+// what a peer should be presented. It excludes the root, which is returned
+// separately. If cert is itself a root, the chain is empty. Chains of expired
+// certificates are built as of their expiry.
+//
+// If no root can be reached, e.g. because an intermediate is missing, the
+// returned error matches ErrIncompleteChain.
+func BuildChain(cert *x509.Certificate, certs []*x509.Certificate) (chain []*x509.Certificate, root *x509.Certificate, err error) {
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	for _, c := range append([]*x509.Certificate{cert}, certs...) {
+		if isSelfSigned(c) {
+			roots.AddCert(c)
+		} else {
+			intermediates.AddCert(c)
+		}
+	}
+
+	at := time.Now()
+	if at.After(cert.NotAfter) {
+		at = cert.NotAfter
+	}
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		var unknownErr x509.UnknownAuthorityError
+		if errors.As(err, &unknownErr) {
+			last := lastLinked(cert, certs)
+			return nil, nil, fmt.Errorf("%w: no issuer found for %v, issued by %v", ErrIncompleteChain, last.Subject, last.Issuer)
+		}
+		return nil, nil, appendErr(fmt.Sprintf("failed to build chain of %v", cert.Subject), err)
+	}
+
+	// Prefer the shortest chain, e.g. over a path through a cross-signed CA
+	best := chains[0]
+	for _, c := range chains[1:] {
+		if len(c) < len(best) {
+			best = c
+		}
+	}
+	return best[:len(best)-1], best[len(best)-1], nil
+}
+
+// isSelfSigned reports whether cert is signed by its own key. Unlike
+// CheckSignatureFrom, this holds for self-signed leaf certificates too.
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// BuildPartialChain is like BuildChain, but also accepts chains stored
+// without their root, e.g. public certificates stored with the intermediates
+// of their issuer only, or intermediate CAs stored without the root above
+// them. If certs holds no root, the chain of cert linked through certs is
+// returned with a nil root.
+//
+// If a certificate of certs is not linked into the chain, e.g. because an
+// intermediate between them is missing, the returned error matches
+// ErrIncompleteChain.
+func BuildPartialChain(cert *x509.Certificate, certs []*x509.Certificate) (chain []*x509.Certificate, root *x509.Certificate, err error) {
+	if isSelfSigned(cert) {
+		return BuildChain(cert, certs)
+	}
+	for _, c := range certs {
+		if isSelfSigned(c) {
+			return BuildChain(cert, certs)
+		}
+	}
+
+	chain = linkedChain(cert, certs)
+	for _, c := range certs {
+		linked := false
+		for _, l := range chain {
+			linked = linked || l.Equal(c)
+		}
+		if !linked {
+			last := chain[len(chain)-1]
+			return nil, nil, fmt.Errorf("%w: %v is not linked to %v, issued by %v", ErrIncompleteChain, c.Subject, last.Subject, last.Issuer)
+		}
+	}
+	return chain, nil, nil
+}
+
+// lastLinked follows the issuers of cert among certs, and returns the first
+// certificate whose issuer is missing.
+func lastLinked(cert *x509.Certificate, certs []*x509.Certificate) *x509.Certificate {
+	chain := linkedChain(cert, certs)
+	return chain[len(chain)-1]
+}
+
+// linkedChain follows the issuers of cert among certs, and returns cert and
+// the issuers found, in order.
+func linkedChain(cert *x509.Certificate, certs []*x509.Certificate) []*x509.Certificate {
+	chain := []*x509.Certificate{cert}
+	seen := map[*x509.Certificate]bool{cert: true}
+	for {
+		var issuer *x509.Certificate
+		for _, c := range certs {
+			if !seen[c] && bytes.Equal(c.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(c) == nil {
+				issuer = c
+				break
+			}
+		}
+		if issuer == nil {
+			return chain
+		}
+		seen[issuer] = true
+		chain = append(chain, issuer)
+		cert = issuer
+	}
+}
@@ -0,0 +1,125 @@
+package certmanager
+
+import (
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBuildChain(t *testing.T) {
+	expiry := time.Now().Add(time.Hour)
+	root, rootKey, err := GenSelfSignedCA("root", expiry, WithMaxPathLen(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate, intermediateKey, err := GenIntermediateCA(root, rootKey, "intermediate", expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _, err := GenSignedCert(intermediate, intermediateKey, "leaf", nil, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := GenSelfSignedCA("other", expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		cert      *x509.Certificate
+		certs     []*x509.Certificate
+		wantChain []*x509.Certificate
+		wantRoot  *x509.Certificate
+		wantErr   error
+	}{
+		{"root", root, nil, nil, root, nil},
+		{"intermediate", intermediate, []*x509.Certificate{root}, []*x509.Certificate{intermediate}, root, nil},
+		{"ordered", leaf, []*x509.Certificate{intermediate, root}, []*x509.Certificate{leaf, intermediate}, root, nil},
+		{"unordered", leaf, []*x509.Certificate{other, root, intermediate}, []*x509.Certificate{leaf, intermediate}, root, nil},
+		{"missing intermediate", leaf, []*x509.Certificate{root}, nil, nil, ErrIncompleteChain},
+		{"missing root", intermediate, nil, nil, nil, ErrIncompleteChain},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chain, gotRoot, err := BuildChain(tc.cert, tc.certs)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("want err %v, got %v", tc.wantErr, err)
+			}
+			if tc.wantErr != nil {
+				return
+			}
+			if !gotRoot.Equal(tc.wantRoot) {
+				t.Errorf("want root %v, got %v", tc.wantRoot.Subject, gotRoot.Subject)
+			}
+			if len(chain) != len(tc.wantChain) {
+				t.Fatalf("want chain of %v certificates, got %v", len(tc.wantChain), len(chain))
+			}
+			for i := range chain {
+				if !chain[i].Equal(tc.wantChain[i]) {
+					t.Errorf("want %v at %v, got %v", tc.wantChain[i].Subject, i, chain[i].Subject)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildPartialChain(t *testing.T) {
+	expiry := time.Now().Add(time.Hour)
+	root, rootKey, err := GenSelfSignedCA("root", expiry, WithMaxPathLen(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate, intermediateKey, err := GenIntermediateCA(root, rootKey, "intermediate", expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _, err := GenSignedCert(intermediate, intermediateKey, "leaf", nil, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := GenSelfSignedCA("other", expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherIntermediate, _, err := GenIntermediateCA(root, rootKey, "other-intermediate", expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		cert      *x509.Certificate
+		certs     []*x509.Certificate
+		wantChain []*x509.Certificate
+		wantRoot  *x509.Certificate
+		wantErr   error
+	}{
+		{"with root", leaf, []*x509.Certificate{root, intermediate}, []*x509.Certificate{leaf, intermediate}, root, nil},
+		{"without root", leaf, []*x509.Certificate{intermediate}, []*x509.Certificate{leaf, intermediate}, nil, nil},
+		{"intermediate only", intermediate, nil, []*x509.Certificate{intermediate}, nil, nil},
+		{"unlinked", leaf, []*x509.Certificate{otherIntermediate}, nil, nil, ErrIncompleteChain},
+		{"other root", leaf, []*x509.Certificate{intermediate, other}, nil, nil, ErrIncompleteChain},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chain, gotRoot, err := BuildPartialChain(tc.cert, tc.certs)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("want err %v, got %v", tc.wantErr, err)
+			}
+			if tc.wantErr != nil {
+				return
+			}
+			if (gotRoot == nil) != (tc.wantRoot == nil) || (gotRoot != nil && !gotRoot.Equal(tc.wantRoot)) {
+				t.Errorf("want root %v, got %v", tc.wantRoot, gotRoot)
+			}
+			if len(chain) != len(tc.wantChain) {
+				t.Fatalf("want chain of %v certificates, got %v", len(tc.wantChain), len(chain))
+			}
+			for i := range chain {
+				if !chain[i].Equal(tc.wantChain[i]) {
+					t.Errorf("want %v at %v, got %v", tc.wantChain[i].Subject, i, chain[i].Subject)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package certcli
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"github.com/sebnyberg/certmanager/acmeclient"
+	"github.com/sebnyberg/flagtags"
+	"github.com/urfave/cli/v2"
+)
+
+type acmeIssueConfig struct {
+	Directory        string `env:"ACME_DIRECTORY" usage:"ACME directory URL" value:"https://acme-v02.api.letsencrypt.org/directory"`
+	DirectoryCA      string `name:"directory-ca" usage:"Path to a CA certificate to trust for the ACME server, e.g. for certmanager acme-serve"`
+	Domains          string `usage:"Comma-separated list of domain names, the first one is used as the common name"`
+	StoreURL         string `env:"STORE_URL" name:"store-url" usage:"Certificate URL to upload the result to, e.g. https://myvault.azure.net/certificates/mycert"`
+	CertPassword     string `usage:"Certificate password - leave blank if none"`
+	Format           string `usage:"Format to store the certificate in, pkcs12 or pem" value:"pkcs12"`
+	PKCS12           pkcs12Config
+	NewVersion       bool   `usage:"Upload as a new version if the certificate already exists, e.g. when renewing"`
+	Email            string `usage:"Contact email of the ACME account"`
+	AccountKey       string `env:"ACME_ACCOUNT_KEY" usage:"Path to the PEM-encoded key of the ACME account, created if missing - leave blank to register a new account"`
+	Challenge        string `usage:"Challenge type to solve, http-01 or dns-01" value:"http-01"`
+	HTTP01Addr       string `name:"http01-addr" usage:"Address to serve http-01 challenges on" value:":80"`
+	DNS01Hook        string `name:"dns01-hook" usage:"Command run as '<hook> present|cleanup <fqdn> <value>' to create and remove the TXT record"`
+	DNS01WaitSeconds int    `name:"dns01-wait" usage:"Seconds to wait for the TXT record to propagate after running the hook"`
+	TimeoutSeconds   int    `name:"timeout" usage:"Timeout in seconds before giving up" value:"300"`
+}
+
+func (c acmeIssueConfig) validate() error {
+	if len(c.Directory) == 0 {
+		return errors.New("directory is required")
+	}
+	if len(c.Domains) == 0 {
+		return errors.New("domains are required")
+	}
+	if len(c.StoreURL) == 0 {
+		return errors.New("store URL is required")
+	}
+	if c.Format != certmanager.FormatPKCS12 && c.Format != certmanager.FormatPEM {
+		return fmt.Errorf("format must be %v or %v", certmanager.FormatPKCS12, certmanager.FormatPEM)
+	}
+	if err := c.PKCS12.validate(c.Format, passwordSource{Value: c.CertPassword}); err != nil {
+		return err
+	}
+	switch c.Challenge {
+	case acmeclient.ChallengeHTTP01:
+	case acmeclient.ChallengeDNS01:
+		if len(c.DNS01Hook) == 0 {
+			return errors.New("dns01-hook is required for dns-01 challenges")
+		}
+	default:
+		return fmt.Errorf("challenge must be %v or %v", acmeclient.ChallengeHTTP01, acmeclient.ChallengeDNS01)
+	}
+	return nil
+}
+
+func NewCmdACMEIssue() *cli.Command {
+	var conf acmeIssueConfig
+
+	return &cli.Command{
+		Name:        "acme-issue",
+		Description: "Obtain a certificate from an ACME server and upload it to the store",
+		Flags:       flagtags.MustParseFlags(&conf),
+		Action: func(c *cli.Context) error {
+			if err := conf.validate(); err != nil {
+				return err
+			}
+			return acmeIssue(conf)
+		},
+	}
+}
+
+func acmeIssue(conf acmeIssueConfig) error {
+	timeoutSeconds := 300
+	if conf.TimeoutSeconds > 0 {
+		timeoutSeconds = conf.TimeoutSeconds
+	}
+	timeout := time.Second * time.Duration(timeoutSeconds)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Parse domain names
+	domains := strings.Split(conf.Domains, ",")
+	for i := range domains {
+		domains[i] = strings.Trim(domains[i], " ")
+	}
+
+	var opts []acmeclient.Option
+	switch conf.Challenge {
+	case acmeclient.ChallengeHTTP01:
+		opts = append(opts, acmeclient.WithSolver(acmeclient.ChallengeHTTP01, &acmeclient.HTTP01Solver{Addr: conf.HTTP01Addr}))
+	case acmeclient.ChallengeDNS01:
+		opts = append(opts, acmeclient.WithSolver(acmeclient.ChallengeDNS01, acmeclient.DNS01HookSolver{
+			Command:          conf.DNS01Hook,
+			PropagationDelay: time.Duration(conf.DNS01WaitSeconds) * time.Second,
+		}))
+	}
+	if conf.Email != "" {
+		opts = append(opts, acmeclient.WithContact("mailto:"+conf.Email))
+	}
+	if conf.AccountKey != "" {
+		key, err := loadOrCreateAccountKey(conf.AccountKey)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, acmeclient.WithAccountKey(key))
+	}
+	if conf.DirectoryCA != "" {
+		client, err := newHTTPClientWithCA(conf.DirectoryCA)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, acmeclient.WithHTTPClient(client))
+	}
+
+	log.Println("requesting certificate for", strings.Join(domains, ", "), "from", conf.Directory, "...")
+	cert, caCerts, key, err := acmeclient.Issue(ctx, conf.Directory, domains, opts...)
+	if err != nil {
+		return err
+	}
+	log.Println("certificate issued by", cert.Issuer.CommonName, "valid until", cert.NotAfter.Format(time.RFC3339))
+
+	uploadOpts := append([]certmanager.UploadCertOption{certmanager.WithFormat(conf.Format)}, conf.PKCS12.uploadOptions()...)
+	if conf.NewVersion {
+		uploadOpts = append(uploadOpts, certmanager.AllowNewVersion())
+	}
+	log.Println("uploading certificate to", conf.StoreURL, "...")
+	err = certmanager.UploadCert(ctx, conf.StoreURL, cert, caCerts, key, conf.CertPassword, uploadOpts...)
+	if err != nil {
+		return describeErr(err)
+	}
+	conf.PKCS12.logPasswordSecret(conf.StoreURL)
+	return nil
+}
+
+// loadOrCreateAccountKey reads the PEM-encoded account key at path. If there
+// is no such file, a new key is generated and written to path so that
+// subsequent runs reuse the same ACME account.
+func loadOrCreateAccountKey(path string) (crypto.Signer, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(pemBytes)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data found in %v", path)
+		}
+		var key interface{}
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		default:
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse account key, err: %v", err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported account key type %T", key)
+		}
+		return signer, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read account key, err: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate account key, err: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode account key, err: %v", err)
+	}
+	pemBytes = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, pemBytes, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write account key, err: %v", err)
+	}
+	log.Println("created account key", path)
+	return key, nil
+}
+
+// newHTTPClientWithCA returns a client which trusts the PEM-encoded CA
+// certificates found at path, in addition to the system roots.
+func newHTTPClientWithCA(path string) (*http.Client, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate, err: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, fmt.Errorf("no certificates found in %v", path)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
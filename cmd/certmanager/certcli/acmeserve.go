@@ -0,0 +1,177 @@
+package certcli
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"github.com/sebnyberg/certmanager/acmeserver"
+	"github.com/sebnyberg/flagtags"
+	"github.com/urfave/cli/v2"
+)
+
+type acmeServeConfig struct {
+	CAURL          string `env:"CA_URL" name:"ca-url" usage:"URL to CA certificate secret e.g. https://myvault.azure.net/secrets/myca"`
+	CACertPassword string `usage:"CA Certificate password - leave blank if none"`
+	CAVersion      string `name:"ca-version" usage:"CA version to sign with: a version ID, latest, latest-enabled or latest-valid" value:"latest"`
+	Addr           string `env:"ACME_ADDR" usage:"Address to listen on" value:":8443"`
+	Hostname       string `env:"ACME_HOSTNAME" usage:"Hostname of the server, used for its own certificate unless tls-cert and tls-key are provided" value:"localhost"`
+	TLSCert        string `name:"tls-cert" usage:"Path to the server certificate - issued by the CA if blank"`
+	TLSKey         string `name:"tls-key" usage:"Path to the server key - issued by the CA if blank"`
+	HTTP01Port     string `name:"http01-port" usage:"Port used to validate http-01 challenges" value:"80"`
+	TrustAll       bool   `usage:"Accept all challenges without validating them - only use on trusted networks"`
+	ValidityDays   int    `usage:"Number of days issued certificates are valid" value:"90"`
+	TimeoutSeconds int    `name:"timeout" usage:"Timeout in seconds before giving up fetching the CA" value:"10"`
+	Policy         policyConfig
+}
+
+func (c acmeServeConfig) validate() error {
+	if len(c.CAURL) == 0 {
+		return errors.New("CA URL is required")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls-cert and tls-key must be provided together")
+	}
+	if c.ValidityDays <= 0 {
+		return errors.New("validity days must be positive")
+	}
+	if _, err := c.Policy.policy(); err != nil {
+		return err
+	}
+	if c.Policy.MaxValidityDays > 0 && c.ValidityDays > c.Policy.MaxValidityDays {
+		return errors.New("validity days must not exceed max validity days")
+	}
+	return nil
+}
+
+func NewCmdACMEServe() *cli.Command {
+	var conf acmeServeConfig
+
+	return &cli.Command{
+		Name:        "acme-serve",
+		Description: "Serve an ACME (RFC 8555) endpoint which issues certificates signed by a CA",
+		Flags:       flagtags.MustParseFlags(&conf),
+		Action: func(c *cli.Context) error {
+			if err := conf.validate(); err != nil {
+				return err
+			}
+			return acmeServe(conf)
+		},
+	}
+}
+
+func acmeServe(conf acmeServeConfig) error {
+	timeoutSeconds := 10
+	if conf.TimeoutSeconds > 0 {
+		timeoutSeconds = conf.TimeoutSeconds
+	}
+	timeout := time.Second * time.Duration(timeoutSeconds)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Fetch CA cert and key
+	caCert, caCertChain, caKey, err := certmanager.GetCertSigner(ctx, conf.CAURL, conf.CACertPassword, certmanager.SelectVersion(conf.CAVersion))
+	if err != nil {
+		return describeErr(err)
+	}
+
+	// Server certificate
+	var serverCert tls.Certificate
+	if conf.TLSCert != "" {
+		serverCert, err = tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
+		if err != nil {
+			return err
+		}
+	} else {
+		serverCert, err = issueServerCert(caCert, caCertChain, caKey, conf.Hostname)
+		if err != nil {
+			return err
+		}
+	}
+
+	policy, err := conf.Policy.policy()
+	if err != nil {
+		return err
+	}
+	opts := []acmeserver.Option{
+		acmeserver.WithValidity(time.Duration(conf.ValidityDays) * 24 * time.Hour),
+		acmeserver.WithPolicy(policy),
+		acmeserver.WithValidator(acmeserver.ChallengeHTTP01, acmeserver.HTTP01Validator{Port: conf.HTTP01Port}),
+	}
+	if conf.TrustAll {
+		log.Println("WARNING: trust-all is enabled, challenges will not be validated")
+		opts = append(opts, acmeserver.WithTrustAll())
+	}
+
+	handler, err := acmeserver.New(caCert, caCertChain, caKey, opts...)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:      conf.Addr,
+		Handler:   handler,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{serverCert}},
+
+		// Requests are small JWS messages, so slow clients are cut off
+		// early
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	log.Printf("serving ACME directory at https://%v%v/directory ...\n", conf.Hostname, portSuffix(conf.Addr))
+	return srv.ListenAndServeTLS("", "")
+}
+
+// issueServerCert issues a certificate for the ACME server itself.
+func issueServerCert(caCert *x509.Certificate, caCertChain []*x509.Certificate, caKey crypto.Signer, hostname string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: hostname},
+		DNSNames: []string{hostname},
+	}, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := certmanager.SignCSR(caCert, caKey, csr, time.Now().AddDate(1, 0, 0))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	// Chain should contain server -> issuer -> intermediary
+	chain, _, err := certmanager.BuildPartialChain(caCert, caCertChain)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tlsCert := tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+	for _, c := range chain {
+		tlsCert.Certificate = append(tlsCert.Certificate, c.Raw)
+	}
+	return tlsCert, nil
+}
+
+func portSuffix(addr string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil || port == "443" {
+		return ""
+	}
+	return ":" + port
+}
@@ -0,0 +1,62 @@
+package certcli
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sebnyberg/certmanager/agent"
+	"github.com/sebnyberg/flagtags"
+	"github.com/urfave/cli/v2"
+)
+
+type agentConfig struct {
+	Config string `env:"AGENT_CONFIG" usage:"Path to a YAML file listing the certificates to keep fresh"`
+	Once   bool   `usage:"Check all certificates once and exit, e.g. from cron"`
+}
+
+func (c agentConfig) validate() error {
+	if len(c.Config) == 0 {
+		return errors.New("config is required")
+	}
+	return nil
+}
+
+func NewCmdAgent() *cli.Command {
+	var conf agentConfig
+
+	return &cli.Command{
+		Name:        "agent",
+		Description: "Keep certificates on disk fresh, renewing them before they expire and reloading the services using them",
+		Flags:       flagtags.MustParseFlags(&conf),
+		Action: func(c *cli.Context) error {
+			if err := conf.validate(); err != nil {
+				return err
+			}
+			return runAgent(conf)
+		},
+	}
+}
+
+func runAgent(conf agentConfig) error {
+	agentConf, err := agent.LoadConfig(conf.Config)
+	if err != nil {
+		return err
+	}
+	a, err := agent.New(agentConf, agent.WithLogger(log.Default()))
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if conf.Once {
+		return describeErr(a.CheckAll(ctx))
+	}
+	log.Printf("keeping %v certificates fresh...\n", len(agentConf.Certificates))
+	return a.Run(ctx)
+}
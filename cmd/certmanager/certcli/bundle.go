@@ -0,0 +1,92 @@
+package certcli
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"github.com/sebnyberg/flagtags"
+	"github.com/urfave/cli/v2"
+)
+
+type bundleConfig struct {
+	Sources        string `env:"BUNDLE_SOURCES" usage:"Comma-separated secret URLs or PEM files to trust, e.g. https://myvault.azure.net/secrets/myca,partner-ca.pem"`
+	CertPassword   string `usage:"Password of PKCS#12 sources - leave blank if none"`
+	Out            string `usage:"Path to write the PEM bundle to"`
+	PublishURL     string `name:"publish-url" env:"BUNDLE_PUBLISH_URL" usage:"Secret URL to publish the PEM bundle to, e.g. https://myvault.azure.net/secrets/trust-bundle"`
+	KeepExpired    bool   `usage:"Keep expired certificates in the bundle"`
+	TimeoutSeconds int    `name:"timeout" usage:"Timeout in seconds before giving up" value:"30"`
+}
+
+func (c bundleConfig) validate() error {
+	if len(splitList(c.Sources)) == 0 {
+		return errors.New("sources are required")
+	}
+	if len(c.Out) == 0 && len(c.PublishURL) == 0 {
+		return errors.New("out or publish URL is required")
+	}
+	return nil
+}
+
+func NewCmdBundle() *cli.Command {
+	var conf bundleConfig
+
+	return &cli.Command{
+		Name:        "bundle",
+		Description: "Assemble a trust bundle of CAs from the store and PEM files, without duplicates, and write or publish it for mTLS peers to trust",
+		Flags:       flagtags.MustParseFlags(&conf),
+		Action: func(c *cli.Context) error {
+			if err := conf.validate(); err != nil {
+				return err
+			}
+			return bundle(conf)
+		},
+	}
+}
+
+func bundle(conf bundleConfig) error {
+	timeoutSeconds := 30
+	if conf.TimeoutSeconds > 0 {
+		timeoutSeconds = conf.TimeoutSeconds
+	}
+	timeout := time.Second * time.Duration(timeoutSeconds)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	certs, err := certmanager.LoadTrustBundle(ctx, conf.CertPassword, splitList(conf.Sources)...)
+	if err != nil {
+		return describeErr(err)
+	}
+
+	var bundle []*x509.Certificate
+	now := time.Now()
+	for _, cert := range certs {
+		if now.After(cert.NotAfter) && !conf.KeepExpired {
+			log.Printf("skipping %v, expired at %v\n", cert.Subject, cert.NotAfter.Format(time.RFC3339))
+			continue
+		}
+		log.Printf("adding %v, expires at %v, sha256 %v\n", cert.Subject, cert.NotAfter.Format(time.RFC3339), certmanager.Fingerprint(cert))
+		bundle = append(bundle, cert)
+	}
+	if len(bundle) == 0 {
+		return errors.New("no certificates left to bundle")
+	}
+
+	if conf.Out != "" {
+		if err := os.WriteFile(conf.Out, certmanager.EncodeTrustBundle(bundle), 0644); err != nil {
+			return err
+		}
+		log.Printf("wrote %v certificates to %v\n", len(bundle), conf.Out)
+	}
+	if conf.PublishURL != "" {
+		if err := certmanager.PublishTrustBundle(ctx, conf.PublishURL, bundle); err != nil {
+			return describeErr(err)
+		}
+		log.Printf("published %v certificates to %v\n", len(bundle), conf.PublishURL)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package certcli
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"github.com/sebnyberg/flagtags"
+	"github.com/urfave/cli/v2"
+)
+
+func NewCmdCA() *cli.Command {
+	return &cli.Command{
+		Name:        "ca",
+		Description: "manage certificate authorities",
+		Subcommands: []*cli.Command{
+			newCmdCARollover(),
+		},
+	}
+}
+
+type caRolloverConfig struct {
+	CAURL          string `env:"CA_URL" name:"ca-url" usage:"URL to the secret of the CA to replace e.g. https://myvault.azure.net/secrets/myca"`
+	CACertPassword string `usage:"CA Certificate password, also used for the new CA - leave blank if none"`
+	Phase          string `usage:"Rollover phase to enter: introduce, migrate or retire" value:"introduce"`
+	NewCAURL       string `name:"new-ca-url" usage:"Certificate URL to upload the new CA to, e.g. https://myvault.azure.net/certificates/myca2"`
+	NewCAName      string `name:"new-ca-name" usage:"Name of the new CA"`
+	Format         string `usage:"Format to store the new CA in, pkcs12 or pem" value:"pkcs12"`
+	PKCS12Encoding string `name:"pkcs12-encoding" env:"PKCS12_ENCODING" usage:"Encryption of the new CA's PKCS#12 bundle, modern (AES-256) or legacy (3DES and RC2) for old clients such as Java 8" value:"modern"`
+	ExpireAt       string `usage:"RFC3339 date when the new CA will expire. By default ten years from now."`
+	MaxPathLen     int    `usage:"Number of intermediate CAs which may follow the new CA in a chain - at least 1 to cross-sign the old CA" value:"1"`
+	Force          bool   `usage:"Migrate even though the new CA is not cross-signed, breaking clients which do not trust the new CA yet"`
+	TimeoutSeconds int    `name:"timeout" usage:"Timeout in seconds before giving up" value:"30"`
+}
+
+func (c caRolloverConfig) validate() error {
+	if len(c.CAURL) == 0 {
+		return errors.New("CA URL is required")
+	}
+	switch c.Phase {
+	case certmanager.RolloverIntroduce:
+		if len(c.NewCAURL) == 0 || len(c.NewCAName) == 0 {
+			return errors.New("new CA URL and name are required to introduce a new CA")
+		}
+		if !strings.HasSuffix(c.NewCAURL, "/certificates/"+c.NewCAName) {
+			return errors.New("new CA name must match certificate name in the URL, e.g. MyCA2 -> https://myvault.azure.net/certificates/MyCA2")
+		}
+		if c.Format != certmanager.FormatPKCS12 && c.Format != certmanager.FormatPEM {
+			return fmt.Errorf("format must be %v or %v", certmanager.FormatPKCS12, certmanager.FormatPEM)
+		}
+		if err := (pkcs12Config{PKCS12Encoding: c.PKCS12Encoding}).validate(c.Format, passwordSource{}); err != nil {
+			return err
+		}
+	case certmanager.RolloverMigrate, certmanager.RolloverRetire:
+	default:
+		return fmt.Errorf("phase must be %v, %v or %v", certmanager.RolloverIntroduce, certmanager.RolloverMigrate, certmanager.RolloverRetire)
+	}
+	return nil
+}
+
+func newCmdCARollover() *cli.Command {
+	var conf caRolloverConfig
+
+	return &cli.Command{
+		Name:        "rollover",
+		Description: "Replace a CA without breaking clients: introduce a cross-signed new CA, migrate issuing to it, then retire the old CA. Cross-signing requires the old CA to allow intermediates, i.e. a path length of at least 1 - CAs from gen ca-cert have a path length of 0 unless --max-path-len is set, and can only be migrated with --force",
+		Flags:       flagtags.MustParseFlags(&conf),
+		Action: func(c *cli.Context) error {
+			if err := conf.validate(); err != nil {
+				return err
+			}
+			return caRollover(conf)
+		},
+	}
+}
+
+func caRollover(conf caRolloverConfig) error {
+	timeoutSeconds := 30
+	if conf.TimeoutSeconds > 0 {
+		timeoutSeconds = conf.TimeoutSeconds
+	}
+	timeout := time.Second * time.Duration(timeoutSeconds)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var rollover *certmanager.Rollover
+	var err error
+	if conf.Phase == certmanager.RolloverIntroduce {
+		rollover, err = introduceCA(ctx, conf)
+	} else {
+		rollover, err = certmanager.GetRollover(ctx, conf.CAURL)
+		if errors.Is(err, certmanager.ErrNotFound) {
+			return fmt.Errorf("the CA is not being rolled over, start with --phase %v", certmanager.RolloverIntroduce)
+		}
+		if err == nil {
+			err = rollover.Advance(conf.Phase, conf.Force)
+		}
+	}
+	if err != nil {
+		return describeErr(err)
+	}
+
+	rollover.UpdatedAt = time.Now().UTC()
+	if err := certmanager.PutRollover(ctx, rollover); err != nil {
+		return describeErr(err)
+	}
+
+	bundleURL, err := certmanager.TrustBundleURL(conf.CAURL)
+	if err != nil {
+		return err
+	}
+	log.Printf("rollover is in phase %v, issuing with %v\n", rollover.Phase, rollover.IssuingCAURL())
+	log.Printf("the trust bundle for clients is published at %v\n", bundleURL)
+	switch rollover.Phase {
+	case certmanager.RolloverIntroduce:
+		log.Printf("once clients trust the bundle, run with --phase %v\n", certmanager.RolloverMigrate)
+	case certmanager.RolloverMigrate:
+		log.Printf("once all certificates from the old CA have been replaced, run with --phase %v\n", certmanager.RolloverRetire)
+	}
+	return nil
+}
+
+// introduceCA generates the new CA, cross-signs it with the old CA and the
+// other way around, and uploads it.
+func introduceCA(ctx context.Context, conf caRolloverConfig) (*certmanager.Rollover, error) {
+	existing, err := certmanager.GetRollover(ctx, conf.CAURL)
+	if err == nil {
+		return nil, fmt.Errorf("the CA is already being rolled over, in phase %v", existing.Phase)
+	}
+	if !errors.Is(err, certmanager.ErrNotFound) {
+		return nil, err
+	}
+
+	expiry := time.Now().AddDate(10, 0, 0)
+	if conf.ExpireAt != "" {
+		expiry, err = time.Parse(time.RFC3339, conf.ExpireAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse expiry date, %v", err)
+		}
+	}
+
+	oldCA, oldChain, oldKey, err := certmanager.GetCertSigner(ctx, conf.CAURL, conf.CACertPassword)
+	if err != nil {
+		return nil, err
+	}
+	if len(oldChain) > 0 {
+		return nil, errors.New("only root CAs can be rolled over - issue a new intermediate CA with gen ca-cert --issuer-url instead")
+	}
+
+	// The new CA keeps the name constraints of the old CA
+	newCA, newKey, err := certmanager.GenSelfSignedCA(conf.NewCAName, expiry,
+		certmanager.WithNameConstraints(nameConstraintsOf(oldCA)),
+		certmanager.WithMaxPathLen(conf.MaxPathLen),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rollover := &certmanager.Rollover{
+		Phase:    certmanager.RolloverIntroduce,
+		OldCAURL: conf.CAURL,
+		NewCAURL: strings.Replace(conf.NewCAURL, "/certificates/", "/secrets/", 1),
+		OldCA:    oldCA,
+		NewCA:    newCA,
+	}
+	rollover.NewCrossSigned, err = certmanager.CrossSign(oldCA, oldKey, newCA)
+	if err != nil {
+		log.Printf("warning: not cross-signing the new CA, clients must trust the bundle before migrating with --force, err: %v\n", err)
+	}
+	rollover.OldCrossSigned, err = certmanager.CrossSign(newCA, newKey, oldCA)
+	if err != nil {
+		log.Printf("not cross-signing the old CA, clients must trust the bundle before they only trust the new CA, err: %v\n", err)
+	}
+
+	log.Printf("uploading new CA %v to %v...\n", conf.NewCAName, conf.NewCAURL)
+	err = certmanager.UploadCert(ctx, conf.NewCAURL, newCA, nil, newKey, conf.CACertPassword,
+		certmanager.WithFormat(conf.Format), certmanager.WithPKCS12Encoding(conf.PKCS12Encoding))
+	if err != nil {
+		return nil, err
+	}
+	return rollover, nil
+}
+
+func nameConstraintsOf(cert *x509.Certificate) certmanager.NameConstraints {
+	return certmanager.NameConstraints{
+		PermittedDNSDomains:     cert.PermittedDNSDomains,
+		ExcludedDNSDomains:      cert.ExcludedDNSDomains,
+		PermittedIPRanges:       cert.PermittedIPRanges,
+		ExcludedIPRanges:        cert.ExcludedIPRanges,
+		PermittedURIDomains:     cert.PermittedURIDomains,
+		ExcludedURIDomains:      cert.ExcludedURIDomains,
+		PermittedEmailAddresses: cert.PermittedEmailAddresses,
+		ExcludedEmailAddresses:  cert.ExcludedEmailAddresses,
+	}
+}
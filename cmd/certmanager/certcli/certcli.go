@@ -1,16 +1,49 @@
 package certcli
 
 import (
+	"context"
+	"crypto"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/sebnyberg/certmanager"
 	"github.com/square/certstrap/pkix"
 )
 
+// describeErr adds hints on how to resolve common errors returned by
+// certmanager.
+func describeErr(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, certmanager.ErrNotFound):
+		return fmt.Errorf("%w - please verify that the URL is correct", err)
+	case errors.Is(err, certmanager.ErrUnauthorized):
+		return fmt.Errorf("%w - please log in with the Azure CLI or set the AZURE_* environment variables", err)
+	case errors.Is(err, certmanager.ErrForbidden):
+		return fmt.Errorf("%w - please verify the access policies of the vault", err)
+	case errors.Is(err, certmanager.ErrDeleted):
+		return fmt.Errorf("%w - please recover it with certmanager recover, or purge it with certmanager purge", err)
+	case errors.Is(err, certmanager.ErrHasDependents):
+		return fmt.Errorf("%w - please delete or reissue them first", err)
+	case errors.Is(err, certmanager.ErrNotCrossSigned):
+		return fmt.Errorf("%w - the old CA does not allow intermediates, please pass --force once all clients trust the new CA", err)
+	case errors.Is(err, certmanager.ErrThrottled):
+		return fmt.Errorf("%w - the vault is throttling requests, please try again later", err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return errors.New("request timed out - please verify that the URL is correct and that the vault is reachable")
+	}
+	return err
+}
+
 func validateDir(dir string) error {
 	if len(dir) > 0 {
 		fi, err := os.Stat(dir)
@@ -27,11 +60,21 @@ func validateDir(dir string) error {
 	return nil
 }
 
-func writeKey(path string, rsaKey *rsa.PrivateKey) error {
-	key := pkix.NewKey(rsaKey.Public, rsaKey)
-	keyBytes, err := key.ExportPrivate()
-	if err != nil {
-		return err
+func writeKey(path string, signer crypto.Signer) error {
+	var keyBytes []byte
+	if rsaKey, ok := signer.(*rsa.PrivateKey); ok {
+		key := pkix.NewKey(rsaKey.Public, rsaKey)
+		var err error
+		keyBytes, err = key.ExportPrivate()
+		if err != nil {
+			return err
+		}
+	} else {
+		der, err := x509.MarshalPKCS8PrivateKey(signer)
+		if err != nil {
+			return err
+		}
+		keyBytes = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
 	}
 	log.Println("saving certificate key to", path, "...")
 	keyFile, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0600)
@@ -40,6 +83,7 @@ func writeKey(path string, rsaKey *rsa.PrivateKey) error {
 			log.Println("file", path, "already exists, skipping...")
 			return nil
 		}
+		return err
 	}
 	defer keyFile.Close()
 	_, err = keyFile.Write(keyBytes)
@@ -71,3 +115,55 @@ func writeCert(path string, x509Certs ...*x509.Certificate) error {
 	}
 	return nil
 }
+
+// splitList splits a comma-separated list, ignoring surrounding whitespace
+// and empty entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseCIDRs parses a comma-separated list of CIDR ranges.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+	for _, cidr := range splitList(s) {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range '%v', err: %v", cidr, err)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+// policyConfig configures the issuance policy of commands which sign
+// certificates.
+type policyConfig struct {
+	AllowedNames    string `env:"POLICY_ALLOWED_NAMES" usage:"Comma-separated patterns of names which may be signed, e.g. *.internal.example.com - any name if blank"`
+	AllowedIPs      string `name:"allowed-ips" env:"POLICY_ALLOWED_IPS" usage:"Comma-separated CIDR ranges of IP addresses which may be signed"`
+	AllowedURIs     string `name:"allowed-uris" env:"POLICY_ALLOWED_URIS" usage:"Comma-separated prefixes of URIs which may be signed, e.g. spiffe://example.org/ns/prod/"`
+	DenyWildcards   bool   `env:"POLICY_DENY_WILDCARDS" usage:"Refuse to sign wildcard names"`
+	MaxValidityDays int    `env:"POLICY_MAX_VALIDITY_DAYS" usage:"Maximum number of days signed certificates may be valid - no limit if 0"`
+}
+
+func (c policyConfig) policy() (certmanager.Policy, error) {
+	if c.MaxValidityDays < 0 {
+		return certmanager.Policy{}, errors.New("max validity days must not be negative")
+	}
+	ipRanges, err := parseCIDRs(c.AllowedIPs)
+	if err != nil {
+		return certmanager.Policy{}, err
+	}
+	return certmanager.Policy{
+		AllowedNames:       splitList(c.AllowedNames),
+		AllowedIPRanges:    ipRanges,
+		AllowedURIPrefixes: splitList(c.AllowedURIs),
+		DenyWildcards:      c.DenyWildcards,
+		MaxValidity:        time.Duration(c.MaxValidityDays) * 24 * time.Hour,
+	}, nil
+}
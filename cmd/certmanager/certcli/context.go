@@ -0,0 +1,304 @@
+package certcli
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sebnyberg/certmanager"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// cliConfig is the part of the certmanager config file used by the CLI.
+// Contexts hold flag defaults by flag name, e.g.
+//
+//	currentContext: prod
+//	contexts:
+//	  prod:
+//	    ca-url: https://prod-kv.vault.azure.net/secrets/customca
+//	    out-dir: ./certs
+//	    timeout: 30
+type cliConfig struct {
+	CurrentContext string                       `yaml:"currentContext"`
+	Contexts       map[string]map[string]string `yaml:"contexts"`
+}
+
+// loadCLIConfig reads the config file, or returns an empty config if there
+// is none.
+func loadCLIConfig(path string) (cliConfig, error) {
+	var conf cliConfig
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return conf, nil
+	}
+	if err != nil {
+		return conf, fmt.Errorf("failed to read config, err: %v", err)
+	}
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return conf, fmt.Errorf("failed to parse config %v, err: %v", path, err)
+	}
+	return conf, nil
+}
+
+// context returns the named context, or the current context if name is
+// empty. It returns an empty name if no context is selected.
+func (c cliConfig) context(name string) (string, map[string]string, error) {
+	if name == "" {
+		name = c.CurrentContext
+	}
+	if name == "" {
+		return "", nil, nil
+	}
+	values, ok := c.Contexts[name]
+	if !ok {
+		return "", nil, fmt.Errorf("context '%v' %w in the config", name, certmanager.ErrNotFound)
+	}
+	return name, values, nil
+}
+
+// ContextFlags returns the global flags which select the context.
+func ContextFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "context",
+			EnvVars: []string{"CERTMANAGER_CONTEXT"},
+			Usage:   "Context of the config file to take flag defaults from - the current context if blank",
+		},
+	}
+}
+
+// WithContexts makes the commands take defaults for flags which are neither
+// set on the command line nor in the environment from the selected context.
+// The context command itself is left as is, so that contexts can be managed
+// even if the config is broken.
+func WithContexts(cmds []*cli.Command) []*cli.Command {
+	for _, cmd := range cmds {
+		if cmd.Name == "context" {
+			continue
+		}
+		if len(cmd.Subcommands) > 0 {
+			WithContexts(cmd.Subcommands)
+			continue
+		}
+		before := cmd.Before
+		cmd.Before = func(c *cli.Context) error {
+			if err := applyContext(c); err != nil {
+				return err
+			}
+			if before != nil {
+				return before(c)
+			}
+			return nil
+		}
+	}
+	return cmds
+}
+
+// applyContext sets the flags of the command which are not already set to
+// the values of the selected context. Values for flags the command does not
+// have are ignored, since a context holds defaults for all commands. A
+// missing current context only gives a warning, while a missing context
+// passed with --context is an error.
+func applyContext(c *cli.Context) error {
+	path, err := certmanager.ConfigPath()
+	if err != nil {
+		return err
+	}
+	conf, err := loadCLIConfig(path)
+	if err != nil {
+		return err
+	}
+	name := c.String("context")
+	_, values, err := conf.context(name)
+	if err != nil {
+		if name != "" {
+			return err
+		}
+		log.Printf("warning: current %v - not using any flag defaults, please select a context with certmanager context use NAME\n", err)
+	}
+	for _, f := range c.Command.Flags {
+		for _, name := range f.Names() {
+			value, ok := values[name]
+			if !ok || c.IsSet(name) {
+				continue
+			}
+			if err := c.Set(name, value); err != nil {
+				return fmt.Errorf("invalid value '%v' for %v in the context, err: %v", value, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func NewCmdContext() *cli.Command {
+	return &cli.Command{
+		Name:        "context",
+		Description: "manage contexts holding flag defaults per environment",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "use",
+				Usage:       "certmanager context use NAME",
+				Description: "Make the named context the current context",
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return errors.New("context name is required")
+					}
+					return useContext(c.Args().First())
+				},
+			},
+			{
+				Name:        "list",
+				Description: "List contexts, the current context is marked with *",
+				Action: func(c *cli.Context) error {
+					return listContexts()
+				},
+			},
+			{
+				Name:        "show",
+				Usage:       "certmanager context show [NAME]",
+				Description: "Show the flag defaults of a context, the current context by default",
+				Action: func(c *cli.Context) error {
+					return showContext(c.Args().First())
+				},
+			},
+		},
+	}
+}
+
+func useContext(name string) error {
+	path, err := certmanager.ConfigPath()
+	if err != nil {
+		return err
+	}
+	conf, err := loadCLIConfig(path)
+	if err != nil {
+		return err
+	}
+	if _, _, err := conf.context(name); err != nil {
+		return fmt.Errorf("%w - please add it under contexts in %v", err, path)
+	}
+	if err := setCurrentContext(path, name); err != nil {
+		return err
+	}
+	fmt.Printf("Switched to context %v.\n", name)
+	return nil
+}
+
+// setCurrentContext sets the current context in the config file, keeping
+// the rest of the file and its comments as is.
+func setCurrentContext(path string, name string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read config, err: %v", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse config %v, err: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("failed to parse config %v, err: not a mapping", path)
+	}
+
+	found := false
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "currentContext" {
+			root.Content[i+1].SetString(name)
+			found = true
+		}
+	}
+	if !found {
+		key := &yaml.Node{}
+		key.SetString("currentContext")
+		value := &yaml.Node{}
+		value.SetString(name)
+		// Keep a comment at the top of the file there
+		if len(root.Content) > 0 {
+			key.HeadComment, root.Content[0].HeadComment = root.Content[0].HeadComment, ""
+		}
+		root.Content = append([]*yaml.Node{key, value}, root.Content...)
+	}
+
+	var b strings.Builder
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(b.String()), 0600)
+}
+
+func listContexts() error {
+	path, err := certmanager.ConfigPath()
+	if err != nil {
+		return err
+	}
+	conf, err := loadCLIConfig(path)
+	if err != nil {
+		return err
+	}
+	if len(conf.Contexts) == 0 {
+		fmt.Printf("No contexts in %v.\n", path)
+		return nil
+	}
+	var names []string
+	for name := range conf.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		marker := " "
+		if name == conf.CurrentContext {
+			marker = "*"
+		}
+		fmt.Println(marker, name)
+	}
+	return nil
+}
+
+func showContext(name string) error {
+	path, err := certmanager.ConfigPath()
+	if err != nil {
+		return err
+	}
+	conf, err := loadCLIConfig(path)
+	if err != nil {
+		return err
+	}
+	name, values, err := conf.context(name)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return errors.New("no current context - please select one with certmanager context use NAME")
+	}
+
+	var flags []string
+	for flag := range values {
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FLAG\tVALUE")
+	for _, flag := range flags {
+		value := values[flag]
+		if strings.Contains(flag, "password") && value != "" {
+			value = "********"
+		}
+		fmt.Fprintf(w, "%v\t%v\n", flag, value)
+	}
+	return w.Flush()
+}
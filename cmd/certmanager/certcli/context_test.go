@@ -0,0 +1,119 @@
+package certcli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sebnyberg/flagtags"
+	"github.com/urfave/cli/v2"
+)
+
+type testContextConfig struct {
+	CAURL          string `env:"TEST_CA_URL" name:"ca-url"`
+	TimeoutSeconds int    `env:"TEST_TIMEOUT" name:"timeout" value:"30"`
+}
+
+// newTestApp returns an app with the context command and a command which
+// records its flags in conf, reading the config file at path.
+func newTestApp(t *testing.T, path string, conf *testContextConfig) *cli.App {
+	t.Helper()
+	t.Setenv("CERTMANAGER_CONFIG", path)
+	t.Setenv("CERTMANAGER_CONTEXT", "")
+	return &cli.App{
+		Name:  "certmanager",
+		Flags: ContextFlags(),
+		Commands: WithContexts([]*cli.Command{
+			{
+				Name:   "test",
+				Flags:  flagtags.MustParseFlags(conf),
+				Action: func(c *cli.Context) error { return nil },
+			},
+			NewCmdContext(),
+		}),
+	}
+}
+
+func writeTestConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestWithContexts(t *testing.T) {
+	config := `currentContext: prod
+contexts:
+  prod:
+    ca-url: https://prod.vault.azure.net/secrets/ca
+    timeout: "60"
+  dev:
+    ca-url: https://dev.vault.azure.net/secrets/ca
+`
+	for _, tc := range []struct {
+		name        string
+		env         map[string]string
+		args        []string
+		wantCAURL   string
+		wantTimeout int
+	}{
+		{"current context", nil, []string{"test"}, "https://prod.vault.azure.net/secrets/ca", 60},
+		{"context flag", nil, []string{"--context", "dev", "test"}, "https://dev.vault.azure.net/secrets/ca", 30},
+		{"env over context", map[string]string{"TEST_CA_URL": "https://env.vault.azure.net/secrets/ca"}, []string{"test"}, "https://env.vault.azure.net/secrets/ca", 60},
+		{"flag over env", map[string]string{"TEST_TIMEOUT": "90"}, []string{"test", "--timeout", "10"}, "https://prod.vault.azure.net/secrets/ca", 10},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var conf testContextConfig
+			app := newTestApp(t, writeTestConfig(t, config), &conf)
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			if err := app.Run(append([]string{"certmanager"}, tc.args...)); err != nil {
+				t.Fatal(err)
+			}
+			if conf.CAURL != tc.wantCAURL {
+				t.Errorf("want ca-url %v, got %v", tc.wantCAURL, conf.CAURL)
+			}
+			if conf.TimeoutSeconds != tc.wantTimeout {
+				t.Errorf("want timeout %v, got %v", tc.wantTimeout, conf.TimeoutSeconds)
+			}
+		})
+	}
+}
+
+func TestWithContexts_missingContext(t *testing.T) {
+	path := writeTestConfig(t, `currentContext: gone
+contexts:
+  prod:
+    ca-url: https://prod.vault.azure.net/secrets/ca
+`)
+
+	// A missing current context gives no defaults
+	var conf testContextConfig
+	app := newTestApp(t, path, &conf)
+	if err := app.Run([]string{"certmanager", "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if conf.CAURL != "" || conf.TimeoutSeconds != 30 {
+		t.Errorf("want no defaults from the context, got %+v", conf)
+	}
+
+	// A missing context passed explicitly is an error
+	if err := app.Run([]string{"certmanager", "--context", "gone", "test"}); err == nil {
+		t.Error("want error for missing context")
+	}
+
+	// The current context can be fixed
+	if err := app.Run([]string{"certmanager", "context", "use", "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadCLIConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CurrentContext != "prod" {
+		t.Errorf("want current context prod, got %v", got.CurrentContext)
+	}
+}
@@ -0,0 +1,212 @@
+package certcli
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"github.com/sebnyberg/flagtags"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+)
+
+type deleteConfig struct {
+	URL            string `env:"URL" usage:"Secret or certificate URL, e.g. https://myvault.azure.net/certificates/mycert"`
+	TimeoutSeconds int    `name:"timeout" usage:"Timeout in seconds before giving up" value:"30"`
+}
+
+func (c deleteConfig) validate() error {
+	if len(c.URL) == 0 {
+		return errors.New("URL is required")
+	}
+	return nil
+}
+
+func (c deleteConfig) context() (context.Context, context.CancelFunc) {
+	timeoutSeconds := 30
+	if c.TimeoutSeconds > 0 {
+		timeoutSeconds = c.TimeoutSeconds
+	}
+	return context.WithTimeout(context.Background(), time.Second*time.Duration(timeoutSeconds))
+}
+
+// newCmdURL returns a command which takes the URL of a certificate as its
+// argument, as delete, recover, disable and enable do.
+func newCmdURL(name, description string, action func(deleteConfig) error) *cli.Command {
+	var conf deleteConfig
+
+	return &cli.Command{
+		Name:        name,
+		ArgsUsage:   "<url>",
+		Description: description,
+		Flags:       flagtags.MustParseFlags(&conf),
+		Action: func(c *cli.Context) error {
+			if c.Args().Present() {
+				conf.URL = c.Args().First()
+			}
+			if err := conf.validate(); err != nil {
+				return err
+			}
+			return action(conf)
+		},
+	}
+}
+
+func NewCmdDelete() *cli.Command {
+	return newCmdURL("delete", "Delete a certificate, which can be recovered until it is purged", deleteCert)
+}
+
+func NewCmdRecover() *cli.Command {
+	return newCmdURL("recover", "Recover a deleted certificate", recoverCert)
+}
+
+func NewCmdDisable() *cli.Command {
+	return newCmdURL("disable", "Disable the latest version of a certificate", func(conf deleteConfig) error {
+		return setCertEnabled(conf, false)
+	})
+}
+
+func NewCmdEnable() *cli.Command {
+	return newCmdURL("enable", "Enable the latest version of a certificate", func(conf deleteConfig) error {
+		return setCertEnabled(conf, true)
+	})
+}
+
+func deleteCert(conf deleteConfig) error {
+	ctx, cancel := conf.context()
+	defer cancel()
+
+	// Deleting a CA is allowed, since it can be recovered, but its
+	// certificates stop working
+	deps, err := certmanager.Dependents(ctx, conf.URL)
+	if err != nil {
+		log.Printf("warning: failed to check for certificates signed by the certificate, err: %v\n", describeErr(err))
+	}
+	for _, dep := range deps {
+		log.Printf("warning: %v is signed by the certificate and expires at %v\n", dep.URL, dep.Cert.NotAfter.Format(time.RFC3339))
+	}
+
+	d, err := certmanager.DeleteCert(ctx, conf.URL)
+	if err != nil {
+		return describeErr(err)
+	}
+	if !d.Recoverable() {
+		log.Println("deleted", d.Name, "permanently, the vault does not keep deleted certificates")
+		return nil
+	}
+	log.Println("deleted", d.Name+", recover it with 'certmanager recover' until", d.PurgeAt.Format(time.RFC3339))
+	return nil
+}
+
+func recoverCert(conf deleteConfig) error {
+	ctx, cancel := conf.context()
+	defer cancel()
+
+	if err := certmanager.RecoverCert(ctx, conf.URL); err != nil {
+		return describeErr(err)
+	}
+	log.Println("recovered", conf.URL)
+	return nil
+}
+
+func setCertEnabled(conf deleteConfig, enabled bool) error {
+	ctx, cancel := conf.context()
+	defer cancel()
+
+	if err := certmanager.SetCertEnabled(ctx, conf.URL, enabled); err != nil {
+		return describeErr(err)
+	}
+	if enabled {
+		log.Println("enabled the latest version of", conf.URL)
+	} else {
+		log.Println("disabled the latest version of", conf.URL)
+	}
+	return nil
+}
+
+type purgeConfig struct {
+	URL            string `env:"URL" usage:"Secret or certificate URL of the deleted certificate, e.g. https://myvault.azure.net/certificates/mycert"`
+	Yes            bool   `usage:"Purge without asking for confirmation - only certificates in the same vault are checked for being signed by it"`
+	TimeoutSeconds int    `name:"timeout" usage:"Timeout in seconds before giving up" value:"30"`
+}
+
+func (c purgeConfig) validate() error {
+	if len(c.URL) == 0 {
+		return errors.New("URL is required")
+	}
+	return nil
+}
+
+func NewCmdPurge() *cli.Command {
+	var conf purgeConfig
+
+	return &cli.Command{
+		Name:        "purge",
+		ArgsUsage:   "<url>",
+		Description: "Permanently delete a deleted certificate, unless it is a CA which still signs certificates in the vault - certificates outside the vault, e.g. from gen signed-cert or the issue server, are not checked",
+		Flags:       flagtags.MustParseFlags(&conf),
+		Action: func(c *cli.Context) error {
+			if c.Args().Present() {
+				conf.URL = c.Args().First()
+			}
+			if err := conf.validate(); err != nil {
+				return err
+			}
+			return purge(conf)
+		},
+	}
+}
+
+func purge(conf purgeConfig) error {
+	if !conf.Yes {
+		if err := confirmPurge(certName(conf.URL)); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := deleteConfig{TimeoutSeconds: conf.TimeoutSeconds}.context()
+	defer cancel()
+
+	if err := certmanager.PurgeCert(ctx, conf.URL); err != nil {
+		return describeErr(err)
+	}
+	log.Println("purged", conf.URL)
+	return nil
+}
+
+// confirmPurge asks for the name of the certificate to be typed, as purging
+// cannot be undone.
+func confirmPurge(name string) error {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return errors.New("cannot confirm purging without a terminal - please pass --yes")
+	}
+	fmt.Fprintf(os.Stderr, "Purging %v cannot be undone. Only certificates in the same vault were checked for being signed by it - "+
+		"certificates issued outside the vault, e.g. by gen signed-cert or the issue server, stop working too.\n"+
+		"Type the name of the certificate to confirm: ", name)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("failed to read confirmation, err: %v", err)
+	}
+	if strings.TrimSpace(line) != name {
+		return errors.New("name does not match, not purging")
+	}
+	return nil
+}
+
+// certName returns the name of the certificate of a secret or certificate
+// URL, or the URL itself if it has none.
+func certName(url string) string {
+	parts := strings.Split(url, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "secrets" || parts[i] == "certificates" {
+			return parts[i+1]
+		}
+	}
+	return url
+}
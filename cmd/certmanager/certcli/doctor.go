@@ -0,0 +1,76 @@
+package certcli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"github.com/sebnyberg/flagtags"
+	"github.com/urfave/cli/v2"
+)
+
+type doctorConfig struct {
+	URL            string `env:"URL" usage:"Secret or certificate URL, e.g. https://myvault.azure.net/secrets/mycert"`
+	Op             string `usage:"Intended operation: get (download, gen signed-cert) or upload (gen ca-cert) - inferred from the URL if blank"`
+	TimeoutSeconds int    `name:"timeout" usage:"Timeout in seconds before giving up" value:"30"`
+}
+
+func (c doctorConfig) validate() error {
+	if len(c.URL) == 0 {
+		return errors.New("URL is required")
+	}
+	return nil
+}
+
+func NewCmdDoctor() *cli.Command {
+	var conf doctorConfig
+
+	return &cli.Command{
+		Name:        "doctor",
+		Description: "Check credentials, URL and access policies needed to use a vault",
+		Flags:       flagtags.MustParseFlags(&conf),
+		Action: func(c *cli.Context) error {
+			if err := conf.validate(); err != nil {
+				return err
+			}
+			return doctor(conf)
+		},
+	}
+}
+
+func doctor(conf doctorConfig) error {
+	timeoutSeconds := 30
+	if conf.TimeoutSeconds > 0 {
+		timeoutSeconds = conf.TimeoutSeconds
+	}
+	timeout := time.Second * time.Duration(timeoutSeconds)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	checks := certmanager.Diagnose(ctx, conf.URL, conf.Op)
+
+	var failed int
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tSTATUS\tDETAIL")
+	for _, check := range checks {
+		fmt.Fprintf(w, "%v\t%v\t%v\n", check.Name, check.Status, check.Detail)
+		if check.Fix != "" {
+			fmt.Fprintf(w, "\t\tfix: %v\n", check.Fix)
+		}
+		if check.Status == certmanager.CheckFail {
+			failed++
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%v check(s) failed", failed)
+	}
+	return nil
+}
@@ -2,9 +2,15 @@ package certcli
 
 import (
 	"context"
+	"crypto"
 	"crypto/x509"
 	"errors"
+	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sebnyberg/certmanager"
@@ -13,19 +19,57 @@ import (
 )
 
 type DownloadConfig struct {
-	URL            string `env:"URL" usage:"Secret URL, e.g. https://myvault.azure.net/secrets/mycert"`
-	CertPassword   string `usage:"Certificate password - leave blank if none"`
-	OutDir         string `value:"." usage:"Output directory, defaults to current directory"`
-	TimeoutSeconds int    `name:"timeout" usage:"Timeout in seconds before giving up" value:"10"`
+	URL                string `env:"URL" usage:"Secret URL, e.g. https://myvault.azure.net/secrets/mycert, or vault URL with --all"`
+	CertPassword       string `usage:"Certificate password - leave blank if none. Visible in ps and shell history, prefer the other password flags"`
+	PasswordFile       string `usage:"Path to a file holding the certificate password"`
+	PasswordEnv        string `usage:"Name of an environment variable holding the certificate password"`
+	PasswordStdin      bool   `usage:"Read the certificate password from stdin"`
+	PasswordPrompt     bool   `usage:"Prompt for the certificate password"`
+	PasswordSecret     string `usage:"URL of a secret holding the certificate password, e.g. https://myvault.azure.net/secrets/mycert-password"`
+	Version            string `usage:"Version to download: a version ID, latest, latest-enabled or latest-valid" value:"latest"`
+	OutDir             string `value:"." usage:"Output directory, defaults to current directory"`
+	TimeoutSeconds     int    `name:"timeout" usage:"Timeout in seconds before giving up, per certificate with --all" value:"10"`
+	All                bool   `usage:"Download all certificates of the vault at the URL, each into a folder of its own"`
+	Filter             string `usage:"With --all, comma-separated terms certificates must match: name=GLOB, tag:KEY=VALUE or expires<DURATION"`
+	Concurrency        int    `usage:"With --all, number of certificates downloaded at once" value:"4"`
+	GeneratedPasswords bool   `usage:"With --all, read the password of each certificate from its <name>-password secret"`
 }
 
 func (c DownloadConfig) validate() error {
 	if len(c.URL) == 0 {
 		return errors.New("URL is required")
 	}
+	if err := c.passwordSource().validate(); err != nil {
+		return err
+	}
+	if !c.All && (c.Filter != "" || c.GeneratedPasswords) {
+		return errors.New("filter and generated passwords require --all")
+	}
+	if c.All {
+		if _, err := certmanager.ParseCertFilter(c.Filter); err != nil {
+			return err
+		}
+		if c.Concurrency < 1 {
+			return errors.New("concurrency must be at least 1")
+		}
+		if c.GeneratedPasswords && c.passwordSource() != (passwordSource{}) {
+			return errors.New("a password cannot be given with generated passwords")
+		}
+	}
 	return validateDir(c.OutDir)
 }
 
+func (c DownloadConfig) passwordSource() passwordSource {
+	return passwordSource{
+		Value:  c.CertPassword,
+		File:   c.PasswordFile,
+		Env:    c.PasswordEnv,
+		Stdin:  c.PasswordStdin,
+		Prompt: c.PasswordPrompt,
+		Secret: c.PasswordSecret,
+	}
+}
+
 func NewCmdDownload() *cli.Command {
 	var conf DownloadConfig
 
@@ -37,6 +81,9 @@ func NewCmdDownload() *cli.Command {
 			if err := conf.validate(); err != nil {
 				return err
 			}
+			if conf.All {
+				return downloadAll(conf)
+			}
 			return download(conf)
 		},
 	}
@@ -48,38 +95,133 @@ func download(conf DownloadConfig) error {
 		timeoutSeconds = conf.TimeoutSeconds
 	}
 	timeout := time.Second * time.Duration(timeoutSeconds)
+	password, err := conf.passwordSource().password("certificate password", timeout)
+	if err != nil {
+		return err
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	cert, caCerts, key, err := certmanager.GetCert(ctx, conf.URL, conf.CertPassword)
+	cert, caCerts, key, err := certmanager.GetCertSigner(ctx, conf.URL, password, certmanager.SelectVersion(conf.Version))
 	if err != nil {
-		select {
-		case <-ctx.Done():
-			return errors.New("request timed out - please verify that the URL is correct")
-		default:
-		}
-		return err
+		return describeErr(err)
 	}
 
-	certs := []*x509.Certificate{cert}
-	certs = append(certs, caCerts...)
-
-	fileName := cert.Subject.CommonName
 	if err = os.MkdirAll(conf.OutDir, 0644); err != nil {
 		return err
 	}
+	return writeCertFiles(conf.OutDir, cert, caCerts, key)
+}
+
+// writeCertFiles writes the key and the chain of the certificate to dir,
+// named by the common name of the certificate.
+func writeCertFiles(dir string, cert *x509.Certificate, caCerts []*x509.Certificate, key crypto.Signer) error {
+	// Written in order: cert -> intermediary -> root, if stored
+	certs, root, err := certmanager.BuildPartialChain(cert, caCerts)
+	if err != nil {
+		return err
+	}
+	if root != nil {
+		certs = append(certs, root)
+	}
+
+	fileName := cert.Subject.CommonName
 
 	// Write key to file
-	keyPath := conf.OutDir + "/" + fileName + ".key"
+	keyPath := dir + "/" + fileName + ".key"
 	if err = writeKey(keyPath, key); err != nil {
 		return err
 	}
 
 	// Write cert to file
-	certPath := conf.OutDir + "/" + fileName + ".crt"
+	certPath := dir + "/" + fileName + ".crt"
 	if err := writeCert(certPath, certs...); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// downloadAll downloads the certificates of a vault selected by the filter
+// into a folder per certificate. Failing certificates are reported, and do
+// not stop the others from being downloaded.
+func downloadAll(conf DownloadConfig) error {
+	timeoutSeconds := 10
+	if conf.TimeoutSeconds > 0 {
+		timeoutSeconds = conf.TimeoutSeconds
+	}
+	timeout := time.Second * time.Duration(timeoutSeconds)
+	var password string
+	if !conf.GeneratedPasswords {
+		var err error
+		password, err = conf.passwordSource().password("certificate password", timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	filter, err := certmanager.ParseCertFilter(conf.Filter)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	infos, err := certmanager.ListCerts(ctx, conf.URL, filter)
+	cancel()
+	if err != nil {
+		return describeErr(err)
+	}
+	if len(infos) == 0 {
+		log.Println("no certificates match the filter")
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	var failed int32
+	sem := make(chan struct{}, conf.Concurrency)
+	for _, info := range infos {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(info certmanager.CertInfo) {
+			defer func() { <-sem; wg.Done() }()
+			err := downloadCertInfo(conf, info, password, timeout)
+			if err != nil {
+				atomic.AddInt32(&failed, 1)
+				log.Printf("failed to download %v, err: %v\n", info.Name, err)
+				return
+			}
+			log.Printf("downloaded %v\n", info.Name)
+		}(info)
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("failed to download %v of %v certificates", failed, len(infos))
+	}
+	return nil
+}
+
+func downloadCertInfo(conf DownloadConfig, info certmanager.CertInfo, password string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if conf.GeneratedPasswords {
+		secretURL, err := certmanager.PasswordSecretURL(info.URL)
+		if err != nil {
+			return err
+		}
+		password, err = certmanager.GetPassword(ctx, secretURL)
+		if err != nil {
+			return describeErr(err)
+		}
+	}
+	cert, caCerts, key, err := certmanager.GetCertSigner(ctx, info.URL, password, certmanager.SelectVersion(conf.Version))
+	if err != nil {
+		return describeErr(err)
+	}
+
+	dir := filepath.Join(conf.OutDir, info.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return writeCertFiles(dir, cert, caCerts, key)
+}
@@ -0,0 +1,48 @@
+package certcli
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+)
+
+func Test_writeCertFiles_rootless(t *testing.T) {
+	expiry := time.Now().Add(time.Hour)
+	root, rootKey, err := certmanager.GenSelfSignedCA("root", expiry, certmanager.WithMaxPathLen(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate, intermediateKey, err := certmanager.GenIntermediateCA(root, rootKey, "intermediate", expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, leafKey, err := certmanager.GenSignedCert(intermediate, intermediateKey, "leaf", nil, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := writeCertFiles(dir, leaf, []*x509.Certificate{intermediate}, leafKey); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "leaf.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) != 2 || !certs[0].Equal(leaf) || !certs[1].Equal(intermediate) {
+		t.Fatalf("want [leaf intermediate], got %v certificates", len(certs))
+	}
+}
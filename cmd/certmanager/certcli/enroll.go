@@ -0,0 +1,133 @@
+package certcli
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"github.com/sebnyberg/certmanager/issueserver"
+	"github.com/sebnyberg/flagtags"
+	"github.com/urfave/cli/v2"
+)
+
+type enrollConfig struct {
+	ServerURL      string `name:"server-url" env:"ENROLL_SERVER_URL" usage:"URL of certmanager serve, e.g. https://certs.example.com:8444"`
+	Token          string `env:"ENROLL_TOKEN" usage:"Enrollment token created with token create"`
+	CAFile         string `name:"ca-file" usage:"Path to the CA certificate which verifies the server - fetched and verified with the fingerprint in the token if blank"`
+	KeyType        string `usage:"Type of the generated key, ec or rsa" value:"ec"`
+	Validity       string `usage:"How long the certificate should be valid, e.g. 24h - the maximum of the server if blank"`
+	CertPath       string `usage:"Path to write the certificate chain to" value:"tls.crt"`
+	KeyPath        string `usage:"Path to write the key to" value:"tls.key"`
+	CAPath         string `name:"ca-path" usage:"Path to write the CA certificate to" value:"ca.crt"`
+	TimeoutSeconds int    `name:"timeout" usage:"Timeout in seconds before giving up" value:"30"`
+}
+
+func (c enrollConfig) validate() error {
+	if len(c.ServerURL) == 0 {
+		return errors.New("server URL is required")
+	}
+	if len(c.Token) == 0 {
+		return errors.New("token is required")
+	}
+	if !certmanager.IsEnrollmentToken(c.Token) {
+		return errors.New("token is not an enrollment token")
+	}
+	if c.KeyType != issueserver.KeyTypeEC && c.KeyType != issueserver.KeyTypeRSA {
+		return fmt.Errorf("key type must be %v or %v", issueserver.KeyTypeEC, issueserver.KeyTypeRSA)
+	}
+	for _, path := range []string{c.CertPath, c.KeyPath, c.CAPath} {
+		if len(path) == 0 {
+			return errors.New("cert, key and CA paths are required")
+		}
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%v already exists - enrollment only obtains the first certificate", path)
+		}
+	}
+	return nil
+}
+
+func NewCmdEnroll() *cli.Command {
+	var conf enrollConfig
+
+	return &cli.Command{
+		Name:        "enroll",
+		Description: "Obtain a first certificate from certmanager serve with an enrollment token",
+		Flags:       flagtags.MustParseFlags(&conf),
+		Action: func(c *cli.Context) error {
+			if err := conf.validate(); err != nil {
+				return err
+			}
+			return enroll(conf)
+		},
+	}
+}
+
+func enroll(conf enrollConfig) error {
+	timeoutSeconds := 30
+	if conf.TimeoutSeconds > 0 {
+		timeoutSeconds = conf.TimeoutSeconds
+	}
+	timeout := time.Second * time.Duration(timeoutSeconds)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	token, err := certmanager.ParseEnrollmentToken(conf.Token)
+	if err != nil {
+		return err
+	}
+
+	// Trust the server
+	pool := x509.NewCertPool()
+	if conf.CAFile != "" {
+		caPEM, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return err
+		}
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("no certificates found in %v", conf.CAFile)
+		}
+	} else {
+		caCert, err := issueserver.FetchCA(ctx, conf.ServerURL, token.RootFingerprint)
+		if err != nil {
+			return err
+		}
+		pool.AddCert(caCert)
+	}
+	httpClient := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+
+	log.Printf("enrolling for %v...\n", strings.Join(append([]string{token.CommonName}, token.SANs...), ", "))
+	resp, err := issueserver.Request(ctx, httpClient, conf.ServerURL, conf.Token, issueserver.IssueRequest{
+		CommonName: token.CommonName,
+		SANs:       token.SANs,
+		KeyType:    conf.KeyType,
+		Validity:   conf.Validity,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("saving certificate key to", conf.KeyPath, "...")
+	if err := os.WriteFile(conf.KeyPath, []byte(resp.PrivateKey), 0600); err != nil {
+		return err
+	}
+	log.Println("saving certificate to", conf.CertPath, "...")
+	if err := os.WriteFile(conf.CertPath, []byte(resp.Certificate), 0644); err != nil {
+		return err
+	}
+	log.Println("saving CA certificate to", conf.CAPath, "...")
+	if err := os.WriteFile(conf.CAPath, []byte(resp.CACertificates), 0644); err != nil {
+		return err
+	}
+	log.Printf("enrolled, the certificate expires at %v\n", resp.NotAfter.Format(time.RFC3339))
+	return nil
+}
@@ -2,9 +2,11 @@ package certcli
 
 import (
 	"context"
+	"crypto"
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"log"
 	"os"
 	"strings"
 	"time"
@@ -27,12 +29,22 @@ func NewCmdGen() *cli.Command {
 
 type genSignedConfig struct {
 	CAURL          string `env:"CA_URL" name:"ca-url" usage:"URL to CA certificate secret e.g. https://myvault.azure.net/secrets/myca"`
-	CACertPassword string `usage:"CA Certificate password - leave blank if none"`
+	CACertPassword string `usage:"CA Certificate password - leave blank if none. Visible in ps and shell history, prefer the other password flags"`
+	PasswordFile   string `usage:"Path to a file holding the CA certificate password"`
+	PasswordEnv    string `usage:"Name of an environment variable holding the CA certificate password"`
+	PasswordStdin  bool   `usage:"Read the CA certificate password from stdin"`
+	PasswordPrompt bool   `usage:"Prompt for the CA certificate password"`
+	PasswordSecret string `usage:"URL of a secret holding the CA certificate password, e.g. https://myvault.azure.net/secrets/myca-password"`
+	CAVersion      string `name:"ca-version" usage:"CA version to sign with: a version ID, latest, latest-enabled or latest-valid" value:"latest"`
 	OutDir         string `value:"." usage:"Output directory, defaults to current directory"`
 	TimeoutSeconds int    `name:"timeout" usage:"Timeout in seconds before giving up" value:"10"`
 	CommonName     string `usage:"Subject name. Can be used to identify the subject"`
 	Domains        string `usage:"Comma-separated list of domain names (SAN)"`
-	ExpireAt       string `usage:"RFC3339 date when the cert will expire. By default one year from now."`
+	SPIFFEID       string `name:"spiffe-id" usage:"SPIFFE ID to issue the cert as an X.509-SVID, e.g. spiffe://example.org/ns/prod/sa/api"`
+	ExpireAt       string `usage:"RFC3339 date when the cert will expire. By default one year from now, or the validity of the profile."`
+	Profile        string `usage:"Name of a profile in the config file to issue the cert with, e.g. grpc-server"`
+	Config         string `env:"CERTMANAGER_CONFIG" usage:"Path to the config file holding profiles. By default ~/.config/certmanager/config.yaml"`
+	Policy         policyConfig
 }
 
 func (c genSignedConfig) validate() error {
@@ -44,15 +56,89 @@ func (c genSignedConfig) validate() error {
 		return errors.New("common name is required")
 	}
 
+	if len(c.SPIFFEID) > 0 {
+		if _, err := certmanager.ParseSPIFFEID(c.SPIFFEID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := c.Policy.policy(); err != nil {
+		return err
+	}
+
+	if err := c.passwordSource().validate(); err != nil {
+		return err
+	}
+
 	return validateDir(c.OutDir)
 }
 
+func (c genSignedConfig) passwordSource() passwordSource {
+	return passwordSource{
+		Value:  c.CACertPassword,
+		File:   c.PasswordFile,
+		Env:    c.PasswordEnv,
+		Stdin:  c.PasswordStdin,
+		Prompt: c.PasswordPrompt,
+		Secret: c.PasswordSecret,
+	}
+}
+
 type genCAConfig struct {
-	URL            string `name:"ca-url" usage:"Certificate URL to upload result to, e.g. https://myvault.azure.net/certificates/myca"`
-	Name           string `usage:"Certificate Authority (CA) name"`
-	CertPassword   string `usage:"Certificate Authority (CA) certificate password - leave blank if none"`
-	TimeoutSeconds int    `name:"timeout" usage:"Timeout in seconds before giving up" value:"10"`
-	ExpireAt       string `usage:"RFC3339 date when the cert will expire. By default one year from now."`
+	URL                  string `name:"ca-url" usage:"Certificate URL to upload result to, e.g. https://myvault.azure.net/certificates/myca"`
+	Name                 string `usage:"Certificate Authority (CA) name"`
+	CertPassword         string `usage:"Certificate Authority (CA) certificate password - leave blank if none. Visible in ps and shell history, prefer the other password flags"`
+	PasswordFile         string `usage:"Path to a file holding the CA certificate password"`
+	PasswordEnv          string `usage:"Name of an environment variable holding the CA certificate password"`
+	PasswordStdin        bool   `usage:"Read the CA certificate password from stdin"`
+	PasswordPrompt       bool   `usage:"Prompt for the CA certificate password"`
+	PasswordSecret       string `usage:"URL of a secret holding the CA certificate password, e.g. https://myvault.azure.net/secrets/myca-password"`
+	Format               string `usage:"Format to store the certificate in, pkcs12 or pem" value:"pkcs12"`
+	PKCS12               pkcs12Config
+	TimeoutSeconds       int    `name:"timeout" usage:"Timeout in seconds before giving up" value:"10"`
+	ExpireAt             string `usage:"RFC3339 date when the cert will expire. By default one year from now."`
+	IssuerURL            string `name:"issuer-url" usage:"URL to the secret of a CA which signs the new CA as an intermediate CA - self-signed if blank"`
+	IssuerPassword       string `usage:"Issuer CA certificate password - leave blank if none. Visible in ps and shell history, prefer the other issuer password flags"`
+	IssuerPasswordFile   string `usage:"Path to a file holding the issuer CA certificate password"`
+	IssuerPasswordEnv    string `usage:"Name of an environment variable holding the issuer CA certificate password"`
+	IssuerPasswordPrompt bool   `usage:"Prompt for the issuer CA certificate password"`
+	IssuerPasswordSecret string `usage:"URL of a secret holding the issuer CA certificate password"`
+	IssuerVersion        string `usage:"Issuer CA version to sign with: a version ID, latest, latest-enabled or latest-valid" value:"latest"`
+	MaxPathLen           int    `usage:"Number of intermediate CAs which may follow the CA in a chain, -1 for no limit - at least 1 to cross-sign a new CA in a ca rollover" value:"0"`
+	Constraints          nameConstraintsConfig
+}
+
+// nameConstraintsConfig configures the name constraints of a CA.
+type nameConstraintsConfig struct {
+	PermittedDNS    string `name:"permitted-dns" usage:"Comma-separated DNS domains the CA may issue certificates for, e.g. internal.example.com"`
+	ExcludedDNS     string `name:"excluded-dns" usage:"Comma-separated DNS domains the CA may not issue certificates for"`
+	PermittedIPs    string `name:"permitted-ips" env:"PERMITTED_IPS" usage:"Comma-separated CIDR ranges the CA may issue certificates for"`
+	ExcludedIPs     string `name:"excluded-ips" env:"EXCLUDED_IPS" usage:"Comma-separated CIDR ranges the CA may not issue certificates for"`
+	PermittedURIs   string `name:"permitted-uris" env:"PERMITTED_URIS" usage:"Comma-separated URI domains the CA may issue certificates for, e.g. a SPIFFE trust domain"`
+	ExcludedURIs    string `name:"excluded-uris" env:"EXCLUDED_URIS" usage:"Comma-separated URI domains the CA may not issue certificates for"`
+	PermittedEmails string `usage:"Comma-separated email addresses, domains or mailboxes the CA may issue certificates for"`
+	ExcludedEmails  string `usage:"Comma-separated email addresses, domains or mailboxes the CA may not issue certificates for"`
+}
+
+func (c nameConstraintsConfig) nameConstraints() (certmanager.NameConstraints, error) {
+	permittedIPs, err := parseCIDRs(c.PermittedIPs)
+	if err != nil {
+		return certmanager.NameConstraints{}, err
+	}
+	excludedIPs, err := parseCIDRs(c.ExcludedIPs)
+	if err != nil {
+		return certmanager.NameConstraints{}, err
+	}
+	return certmanager.NameConstraints{
+		PermittedDNSDomains:     splitList(c.PermittedDNS),
+		ExcludedDNSDomains:      splitList(c.ExcludedDNS),
+		PermittedIPRanges:       permittedIPs,
+		ExcludedIPRanges:        excludedIPs,
+		PermittedURIDomains:     splitList(c.PermittedURIs),
+		ExcludedURIDomains:      splitList(c.ExcludedURIs),
+		PermittedEmailAddresses: splitList(c.PermittedEmails),
+		ExcludedEmailAddresses:  splitList(c.ExcludedEmails),
+	}, nil
 }
 
 func (c genCAConfig) validate() error {
@@ -65,9 +151,46 @@ func (c genCAConfig) validate() error {
 	if !strings.HasSuffix(c.URL, c.Name) {
 		return errors.New("CA name must match certificate name in the URL, e.g. MyCA -> https://myvault.azure.net/certificates/MyCA")
 	}
+	if c.Format != certmanager.FormatPKCS12 && c.Format != certmanager.FormatPEM {
+		return fmt.Errorf("format must be %v or %v", certmanager.FormatPKCS12, certmanager.FormatPEM)
+	}
+	if _, err := c.Constraints.nameConstraints(); err != nil {
+		return err
+	}
+	if err := c.passwordSource().validate(); err != nil {
+		return err
+	}
+	if err := c.PKCS12.validate(c.Format, c.passwordSource()); err != nil {
+		return err
+	}
+	if err := c.issuerPasswordSource().validate(); err != nil {
+		return fmt.Errorf("issuer %v", err)
+	}
 	return nil
 }
 
+func (c genCAConfig) passwordSource() passwordSource {
+	return passwordSource{
+		Value:   c.CertPassword,
+		File:    c.PasswordFile,
+		Env:     c.PasswordEnv,
+		Stdin:   c.PasswordStdin,
+		Prompt:  c.PasswordPrompt,
+		Secret:  c.PasswordSecret,
+		confirm: true,
+	}
+}
+
+func (c genCAConfig) issuerPasswordSource() passwordSource {
+	return passwordSource{
+		Value:  c.IssuerPassword,
+		File:   c.IssuerPasswordFile,
+		Env:    c.IssuerPasswordEnv,
+		Prompt: c.IssuerPasswordPrompt,
+		Secret: c.IssuerPasswordSecret,
+	}
+}
+
 func newCmdGenCACert() *cli.Command {
 	var conf genCAConfig
 
@@ -102,15 +225,64 @@ func genCACert(conf genCAConfig) error {
 	}
 
 	timeout := time.Second * time.Duration(timeoutSeconds)
+	password, err := conf.passwordSource().password("new CA certificate password", timeout)
+	if err != nil {
+		return err
+	}
+	var issuerPassword string
+	if conf.IssuerURL != "" {
+		issuerPassword, err = conf.issuerPasswordSource().password("issuer CA certificate password", timeout)
+		if err != nil {
+			return err
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	cert, key, err := certmanager.GenSelfSignedCA(conf.Name, expiry)
+	constraints, err := conf.Constraints.nameConstraints()
 	if err != nil {
 		return err
 	}
+	opts := []certmanager.CAOption{
+		certmanager.WithNameConstraints(constraints),
+		certmanager.WithMaxPathLen(conf.MaxPathLen),
+	}
+	upload := func(cert *x509.Certificate, caCerts []*x509.Certificate, key crypto.Signer) error {
+		uploadOpts := append([]certmanager.UploadCertOption{certmanager.WithFormat(conf.Format)}, conf.PKCS12.uploadOptions()...)
+		if err := certmanager.UploadCert(ctx, conf.URL, cert, caCerts, key, password, uploadOpts...); err != nil {
+			return describeErr(err)
+		}
+		conf.PKCS12.logPasswordSecret(conf.URL)
+		return nil
+	}
 
-	return certmanager.UploadCert(ctx, conf.URL, cert, nil, key, conf.CertPassword)
+	if conf.IssuerURL == "" {
+		cert, key, err := certmanager.GenSelfSignedCA(conf.Name, expiry, opts...)
+		if err != nil {
+			return err
+		}
+		return upload(cert, nil, key)
+	}
+
+	// Sign as an intermediate of the issuer
+	issuerCert, issuerChain, issuerKey, err := certmanager.GetCertSigner(ctx, conf.IssuerURL, issuerPassword, certmanager.SelectVersion(conf.IssuerVersion))
+	if err != nil {
+		return describeErr(err)
+	}
+	cert, key, err := certmanager.GenIntermediateCA(issuerCert, issuerKey, conf.Name, expiry, opts...)
+	if err != nil {
+		return err
+	}
+	// Stored in order: issuer -> intermediary -> root, if stored
+	caCerts, root, err := certmanager.BuildPartialChain(issuerCert, issuerChain)
+	if err != nil {
+		return err
+	}
+	if root != nil {
+		caCerts = append(caCerts, root)
+	}
+	return upload(cert, caCerts, key)
 }
 
 // Generate a client certificate signed by a CA.
@@ -137,11 +309,35 @@ func genSignedCert(conf genSignedConfig) error {
 		timeoutSeconds = conf.TimeoutSeconds
 	}
 	timeout := time.Second * time.Duration(timeoutSeconds)
+	caPassword, err := conf.passwordSource().password("CA certificate password", timeout)
+	if err != nil {
+		return err
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	// Parse expiry date
+	// Load profile
+	var profile *certmanager.Profile
+	if conf.Profile != "" {
+		path := conf.Config
+		if path == "" {
+			var err error
+			if path, err = certmanager.ConfigPath(); err != nil {
+				return err
+			}
+		}
+		p, err := certmanager.LoadProfile(path, conf.Profile)
+		if err != nil {
+			return err
+		}
+		profile = &p
+	}
+
+	// Parse expiry date, the profile validity applies if it is not given
 	expiry := time.Now().AddDate(10, 0, 0)
+	if profile != nil && profile.Validity > 0 {
+		expiry = time.Time{}
+	}
 	if conf.ExpireAt != "" {
 		var err error
 		expiry, err = time.Parse(time.RFC3339, conf.ExpireAt)
@@ -159,35 +355,67 @@ func genSignedCert(conf genSignedConfig) error {
 		}
 	}
 	domains = append(domains, conf.CommonName)
+	if len(conf.SPIFFEID) > 0 {
+		domains = append(domains, conf.SPIFFEID)
+	}
 
 	// Create output dir
 	if err := os.MkdirAll(conf.OutDir, 0644); err != nil {
 		return err
 	}
 
+	// Issue with the new CA once a rollover of the CA has been migrated
+	caURL, caVersion := conf.CAURL, conf.CAVersion
+	rollover, err := certmanager.GetRollover(ctx, conf.CAURL)
+	switch {
+	case errors.Is(err, certmanager.ErrNotFound):
+		rollover = nil
+	case err != nil:
+		return describeErr(err)
+	case rollover.IssuingCAURL() != conf.CAURL:
+		log.Printf("CA rollover is in phase %v, signing with the new CA %v...\n", rollover.Phase, rollover.IssuingCAURL())
+		caURL, caVersion = rollover.IssuingCAURL(), certmanager.VersionLatest
+	}
+
 	// Fetch CA cert and key
-	caCert, caCertChain, caKey, err := certmanager.GetCert(ctx, conf.CAURL, conf.CACertPassword)
+	caCert, caCertChain, caKey, err := certmanager.GetCertSigner(ctx, caURL, caPassword, certmanager.SelectVersion(caVersion))
 	if err != nil {
-		return err
+		return describeErr(err)
 	}
 
 	// Sign cert
-	cert, key, err := certmanager.GenSignedCert(
-		caCert, caKey, conf.CommonName, domains, expiry)
+	policy, err := conf.Policy.policy()
+	if err != nil {
+		return err
+	}
+	opts := []certmanager.SignOption{certmanager.WithPolicy(policy)}
+	if profile != nil {
+		opts = append(opts, certmanager.WithProfile(*profile))
+	}
+	cert, key, err := certmanager.GenSignedCertSigner(
+		caCert, caKey, conf.CommonName, domains, expiry, opts...)
+	if err != nil {
+		return err
+	}
+
+	// Client cert should contain client -> issuer -> intermediary
+	chain, _, err := certmanager.BuildPartialChain(caCert, caCertChain)
 	if err != nil {
 		return err
 	}
+	certs := append([]*x509.Certificate{cert}, chain...)
 
-	// Client cert should contain client -> issuer -> intermediary [ -> root ]
-	certs := []*x509.Certificate{cert}
-	if len(caCertChain) > 0 {
-		certs = append(certs, caCert)
-		certs = append(certs, caCertChain[:len(caCertChain)-1]...)
+	// During a rollover, clients trust both CAs and chains include the
+	// cross-signed CA for clients which only trust one of them
+	caCerts := []*x509.Certificate{caCert}
+	if rollover != nil {
+		certs = append(certs, rollover.CrossCerts(caCert)...)
+		caCerts = rollover.TrustBundle()
 	}
 
 	// Write files
 	caCertPath := fmt.Sprintf("%v/%v.crt", conf.OutDir, caCert.Subject.CommonName)
-	if err := writeCert(caCertPath, caCert); err != nil {
+	if err := writeCert(caCertPath, caCerts...); err != nil {
 		return err
 	}
 
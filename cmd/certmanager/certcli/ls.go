@@ -0,0 +1,80 @@
+package certcli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"github.com/sebnyberg/flagtags"
+	"github.com/urfave/cli/v2"
+)
+
+type lsConfig struct {
+	URL            string `env:"VAULT_URL" name:"vault-url" usage:"Vault URL, e.g. https://myvault.vault.azure.net/"`
+	Filter         string `usage:"Comma-separated terms certificates must match: name=GLOB, tag:KEY=VALUE or expires<DURATION, e.g. name=web-*,expires<720h"`
+	TimeoutSeconds int    `name:"timeout" usage:"Timeout in seconds before giving up" value:"30"`
+}
+
+func (c lsConfig) validate() error {
+	if len(c.URL) == 0 {
+		return errors.New("vault URL is required")
+	}
+	_, err := certmanager.ParseCertFilter(c.Filter)
+	return err
+}
+
+func NewCmdLs() *cli.Command {
+	var conf lsConfig
+
+	return &cli.Command{
+		Name:        "ls",
+		ArgsUsage:   "<vault-url>",
+		Description: "List the certificates in a vault",
+		Flags:       flagtags.MustParseFlags(&conf),
+		Action: func(c *cli.Context) error {
+			if c.Args().Present() {
+				conf.URL = c.Args().First()
+			}
+			if err := conf.validate(); err != nil {
+				return err
+			}
+			return ls(conf)
+		},
+	}
+}
+
+func ls(conf lsConfig) error {
+	timeoutSeconds := 30
+	if conf.TimeoutSeconds > 0 {
+		timeoutSeconds = conf.TimeoutSeconds
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(timeoutSeconds))
+	defer cancel()
+
+	filter, err := certmanager.ParseCertFilter(conf.Filter)
+	if err != nil {
+		return err
+	}
+	infos, err := certmanager.ListCerts(ctx, conf.URL, filter)
+	if err != nil {
+		return describeErr(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "URL\tSUBJECT\tISSUER\tNOT AFTER\tCA\tENABLED")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			info.URL,
+			info.Cert.Subject,
+			info.Cert.Issuer,
+			info.Cert.NotAfter.Format(time.RFC3339),
+			info.Cert.IsCA,
+			info.Enabled,
+		)
+	}
+	return w.Flush()
+}
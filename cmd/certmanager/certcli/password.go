@@ -0,0 +1,127 @@
+package certcli
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"golang.org/x/term"
+)
+
+// passwordSource is where a certificate password is taken from. At most one
+// source may be set. The plain value shows up in ps and shell history, so the
+// other sources are preferred.
+type passwordSource struct {
+	// Value is the password itself.
+	Value string
+
+	// File is the path of a file holding the password.
+	File string
+
+	// Env is the name of an environment variable holding the password.
+	Env string
+
+	// Stdin reads the password from the first line of stdin.
+	Stdin bool
+
+	// Prompt asks for the password on the terminal without echoing it.
+	Prompt bool
+
+	// Secret is the URL of a store secret holding the password.
+	Secret string
+
+	// confirm asks for a prompted password twice, for new passwords.
+	confirm bool
+}
+
+func (s passwordSource) validate() error {
+	n := 0
+	for _, set := range []bool{s.Value != "", s.File != "", s.Env != "", s.Stdin, s.Prompt, s.Secret != ""} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("only one of the password, password file, env, stdin, prompt and secret may be set")
+	}
+	return nil
+}
+
+// password returns the password from the source, or an empty password if
+// no source is set. what names the password in the prompt. The timeout
+// applies to retrieving a secret, not to prompts, so passwords are read
+// before the timeout of the command starts.
+func (s passwordSource) password(what string, timeout time.Duration) (string, error) {
+	switch {
+	case s.File != "":
+		return readPasswordFile(s.File)
+	case s.Env != "":
+		password, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %v holding the %v is not set", s.Env, what)
+		}
+		return password, nil
+	case s.Stdin:
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read %v from stdin, err: %v", what, err)
+		}
+		return certmanager.TrimPassword(line), nil
+	case s.Prompt:
+		password, err := promptPassword(what)
+		if err != nil || !s.confirm {
+			return password, err
+		}
+		again, err := promptPassword(what + " again")
+		if err != nil {
+			return "", err
+		}
+		if again != password {
+			return "", errors.New("passwords do not match")
+		}
+		return password, nil
+	case s.Secret != "":
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		password, err := certmanager.GetPassword(ctx, s.Secret)
+		if err != nil {
+			return "", describeErr(err)
+		}
+		return password, nil
+	}
+	return s.Value, nil
+}
+
+func readPasswordFile(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file, err: %v", err)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		log.Printf("warning: password file %v is readable by other users, consider chmod 600\n", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file, err: %v", err)
+	}
+	return certmanager.TrimPassword(string(data)), nil
+}
+
+func promptPassword(what string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("cannot prompt for a password without a terminal - please use a password file, env or stdin instead")
+	}
+	fmt.Fprintf(os.Stderr, "Enter %v: ", what)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %v, err: %v", what, err)
+	}
+	return string(password), nil
+}
@@ -0,0 +1,53 @@
+package certcli
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sebnyberg/certmanager"
+)
+
+// pkcs12Config configures how uploaded PKCS#12 bundles are protected.
+type pkcs12Config struct {
+	PKCS12Encoding   string `name:"pkcs12-encoding" env:"PKCS12_ENCODING" usage:"Encryption of PKCS#12 bundles, modern (AES-256) or legacy (3DES and RC2) for old clients such as Java 8" value:"modern"`
+	GeneratePassword bool   `usage:"Protect the PKCS#12 bundle with a generated password, stored in the secret <name>-password next to the certificate"`
+}
+
+// validate checks the config given the format and the password of the
+// certificate.
+func (c pkcs12Config) validate(format string, password passwordSource) error {
+	if c.PKCS12Encoding != certmanager.PKCS12Modern && c.PKCS12Encoding != certmanager.PKCS12Legacy {
+		return fmt.Errorf("PKCS#12 encoding must be %v or %v", certmanager.PKCS12Modern, certmanager.PKCS12Legacy)
+	}
+	if !c.GeneratePassword {
+		return nil
+	}
+	if format != certmanager.FormatPKCS12 {
+		return fmt.Errorf("a password can only be generated for the %v format", certmanager.FormatPKCS12)
+	}
+	if password != (passwordSource{confirm: password.confirm}) {
+		return errors.New("a password cannot be given when generating one")
+	}
+	return nil
+}
+
+func (c pkcs12Config) uploadOptions() []certmanager.UploadCertOption {
+	opts := []certmanager.UploadCertOption{certmanager.WithPKCS12Encoding(c.PKCS12Encoding)}
+	if c.GeneratePassword {
+		opts = append(opts, certmanager.WithGeneratedPassword())
+	}
+	return opts
+}
+
+// logPasswordSecret tells where the generated password of the certificate
+// at certURL was stored.
+func (c pkcs12Config) logPasswordSecret(certURL string) {
+	if !c.GeneratePassword {
+		return
+	}
+	secretURL, err := certmanager.PasswordSecretURL(certURL)
+	if err != nil {
+		return
+	}
+	fmt.Printf("Password stored in %v, use --password-secret %v to retrieve the certificate.\n", secretURL, secretURL)
+}
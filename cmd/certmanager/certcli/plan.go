@@ -0,0 +1,111 @@
+package certcli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/sebnyberg/certmanager/pki"
+	"github.com/sebnyberg/flagtags"
+	"github.com/urfave/cli/v2"
+)
+
+type manifestConfig struct {
+	File           string `env:"PKI_MANIFEST" usage:"Path to a YAML manifest declaring CAs and certificates, e.g. pki.yaml"`
+	TimeoutSeconds int    `name:"timeout" usage:"Timeout in seconds before giving up" value:"60"`
+}
+
+func (c manifestConfig) validate() error {
+	if len(c.File) == 0 {
+		return errors.New("file is required")
+	}
+	return nil
+}
+
+// manifestFlags returns the flags of conf, with -f as an alias of --file.
+func manifestFlags(conf *manifestConfig) []cli.Flag {
+	flags := flagtags.MustParseFlags(conf)
+	for _, f := range flags {
+		if sf, ok := f.(*cli.StringFlag); ok && sf.Name == "file" {
+			sf.Aliases = []string{"f"}
+		}
+	}
+	return flags
+}
+
+func NewCmdPlan() *cli.Command {
+	var conf manifestConfig
+
+	return &cli.Command{
+		Name:        "plan",
+		Description: "Show what apply would change for the store and files to match a PKI manifest",
+		Flags:       manifestFlags(&conf),
+		Action: func(c *cli.Context) error {
+			if err := conf.validate(); err != nil {
+				return err
+			}
+			return planManifest(conf, false)
+		},
+	}
+}
+
+func NewCmdApply() *cli.Command {
+	var conf manifestConfig
+
+	return &cli.Command{
+		Name:        "apply",
+		Description: "Create, renew and reissue the CAs and certificates of a PKI manifest which are missing, expiring or drifted",
+		Flags:       manifestFlags(&conf),
+		Action: func(c *cli.Context) error {
+			if err := conf.validate(); err != nil {
+				return err
+			}
+			return planManifest(conf, true)
+		},
+	}
+}
+
+// planManifest prints the plan of the manifest, and applies it if apply is
+// set.
+func planManifest(conf manifestConfig, apply bool) error {
+	timeoutSeconds := 60
+	if conf.TimeoutSeconds > 0 {
+		timeoutSeconds = conf.TimeoutSeconds
+	}
+	timeout := time.Second * time.Duration(timeoutSeconds)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	manifest, err := pki.Load(conf.File)
+	if err != nil {
+		return err
+	}
+	planner, err := pki.New(manifest)
+	if err != nil {
+		return err
+	}
+	plan, err := planner.Plan(ctx)
+	if err != nil {
+		return describeErr(err)
+	}
+
+	if len(plan.Actions) == 0 {
+		fmt.Println("Everything is up to date.")
+		return nil
+	}
+	for _, a := range plan.Actions {
+		fmt.Println(a)
+	}
+	if !apply {
+		fmt.Printf("\n%v actions, run apply to perform them.\n", len(plan.Actions))
+		return nil
+	}
+
+	if err := planner.Apply(ctx, plan); err != nil {
+		return describeErr(err)
+	}
+	log.Printf("applied %v actions\n", len(plan.Actions))
+	return nil
+}
@@ -0,0 +1,66 @@
+package certcli
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"github.com/sebnyberg/flagtags"
+	"github.com/urfave/cli/v2"
+)
+
+type rollbackConfig struct {
+	URL            string `env:"URL" usage:"Secret or certificate URL, e.g. https://myvault.azure.net/certificates/mycert"`
+	Version        string `usage:"Version to disable - defaults to the latest enabled version"`
+	To             string `usage:"Version to re-enable - defaults to the version prior to the disabled one"`
+	TimeoutSeconds int    `name:"timeout" usage:"Timeout in seconds before giving up" value:"10"`
+}
+
+func (c rollbackConfig) validate() error {
+	if len(c.URL) == 0 {
+		return errors.New("URL is required")
+	}
+	return nil
+}
+
+func NewCmdRollback() *cli.Command {
+	var conf rollbackConfig
+
+	return &cli.Command{
+		Name:        "rollback",
+		ArgsUsage:   "<url>",
+		Description: "Disable a bad certificate version and re-enable a prior one",
+		Flags:       flagtags.MustParseFlags(&conf),
+		Action: func(c *cli.Context) error {
+			if c.Args().Present() {
+				conf.URL = c.Args().First()
+			}
+			if err := conf.validate(); err != nil {
+				return err
+			}
+			return rollback(conf)
+		},
+	}
+}
+
+func rollback(conf rollbackConfig) error {
+	timeoutSeconds := 10
+	if conf.TimeoutSeconds > 0 {
+		timeoutSeconds = conf.TimeoutSeconds
+	}
+	timeout := time.Second * time.Duration(timeoutSeconds)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	disabled, enabled, err := certmanager.RollbackCert(ctx, conf.URL, conf.Version, conf.To)
+	if err != nil {
+		return describeErr(err)
+	}
+
+	log.Println("disabled version", disabled.Version, "with serial", disabled.SerialNumber)
+	log.Println("enabled version", enabled.Version, "with serial", enabled.SerialNumber)
+
+	return nil
+}
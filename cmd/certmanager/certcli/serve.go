@@ -0,0 +1,225 @@
+package certcli
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"github.com/sebnyberg/certmanager/issueserver"
+	"github.com/sebnyberg/flagtags"
+	"github.com/urfave/cli/v2"
+)
+
+type serveConfig struct {
+	CAURL            string `env:"CA_URL" name:"ca-url" usage:"URL to CA certificate secret e.g. https://myvault.azure.net/secrets/myca"`
+	CACertPassword   string `usage:"CA Certificate password - leave blank if none"`
+	CAVersion        string `name:"ca-version" usage:"CA version to sign with: a version ID, latest, latest-enabled or latest-valid" value:"latest"`
+	Addr             string `env:"SERVE_ADDR" usage:"Address to listen on" value:":8444"`
+	Hostname         string `env:"SERVE_HOSTNAME" usage:"Hostname of the server, used for its own certificate unless tls-cert and tls-key are provided" value:"localhost"`
+	TLSCert          string `name:"tls-cert" usage:"Path to the server certificate - issued by the CA if blank"`
+	TLSKey           string `name:"tls-key" usage:"Path to the server key - issued by the CA if blank"`
+	Clients          string `env:"SERVE_CLIENTS" usage:"Path to a JSON file listing the clients and the names they may request"`
+	UsedTokens       string `name:"used-tokens" env:"SERVE_USED_TOKENS" usage:"Path to a file recording used enrollment tokens - enrollment tokens are refused if blank"`
+	MaxValidityHours int    `usage:"Maximum number of hours issued certificates are valid" value:"24"`
+	TimeoutSeconds   int    `name:"timeout" usage:"Timeout in seconds before giving up fetching the CA" value:"10"`
+}
+
+func (c serveConfig) validate() error {
+	if len(c.CAURL) == 0 {
+		return errors.New("CA URL is required")
+	}
+	if len(c.Clients) == 0 && len(c.UsedTokens) == 0 {
+		return errors.New("clients file or used tokens file is required")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls-cert and tls-key must be provided together")
+	}
+	if c.MaxValidityHours <= 0 {
+		return errors.New("max validity hours must be positive")
+	}
+	return nil
+}
+
+func NewCmdServe() *cli.Command {
+	var conf serveConfig
+
+	return &cli.Command{
+		Name:        "serve",
+		Description: "Serve an API which issues short-lived certificates signed by a CA to authenticated clients",
+		Flags:       flagtags.MustParseFlags(&conf),
+		Action: func(c *cli.Context) error {
+			if err := conf.validate(); err != nil {
+				return err
+			}
+			return serve(conf)
+		},
+	}
+}
+
+func serve(conf serveConfig) error {
+	var clients []issueserver.Client
+	if conf.Clients != "" {
+		var err error
+		clients, err = loadClients(conf.Clients)
+		if err != nil {
+			return err
+		}
+	}
+	opts := []issueserver.Option{
+		issueserver.WithMaxValidity(time.Duration(conf.MaxValidityHours) * time.Hour),
+		issueserver.WithLogger(log.Default()),
+	}
+	if conf.UsedTokens != "" {
+		ledger, err := issueserver.NewFileLedger(conf.UsedTokens)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, issueserver.WithEnrollment(ledger))
+	}
+
+	timeoutSeconds := 10
+	if conf.TimeoutSeconds > 0 {
+		timeoutSeconds = conf.TimeoutSeconds
+	}
+	timeout := time.Second * time.Duration(timeoutSeconds)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Fetch CA cert and key once, clients never need access to the store
+	caCert, caCertChain, caKey, err := certmanager.GetCertSigner(ctx, conf.CAURL, conf.CACertPassword, certmanager.SelectVersion(conf.CAVersion))
+	if err != nil {
+		return describeErr(err)
+	}
+
+	// Server certificate
+	var serverCert tls.Certificate
+	if conf.TLSCert != "" {
+		serverCert, err = tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
+		if err != nil {
+			return err
+		}
+	} else {
+		serverCert, err = issueServerCert(caCert, caCertChain, caKey, conf.Hostname)
+		if err != nil {
+			return err
+		}
+	}
+
+	handler, err := issueserver.New(caCert, caCertChain, caKey, clients, opts...)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:              conf.Addr,
+		Handler:           handler,
+		TLSConfig:         handler.TLSConfig(serverCert),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	log.Printf("serving certificates for %v clients at https://%v%v/v1/certificates ...\n", len(clients), conf.Hostname, portSuffix(conf.Addr))
+	return srv.ListenAndServeTLS("", "")
+}
+
+// clientsFile lists the clients of the serve command.
+type clientsFile struct {
+	Clients []clientEntry `json:"clients"`
+}
+
+type clientEntry struct {
+	Name string `json:"name"`
+
+	// Authentication, by token or by client certificate
+	TokenSHA256 string   `json:"tokenSha256"`
+	CommonNames []string `json:"commonNames"`
+	SPIFFEIDs   []string `json:"spiffeIds"`
+
+	// Names the client may request
+	AllowedNames  []string `json:"allowedNames"`
+	AllowedIPs    []string `json:"allowedIps"`
+	AllowedURIs   []string `json:"allowedUris"`
+	DenyWildcards bool     `json:"denyWildcards"`
+	MaxValidity   string   `json:"maxValidity"`
+}
+
+func loadClients(path string) ([]issueserver.Client, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read clients file, err: %v", err)
+	}
+	var f clientsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse clients file, err: %v", err)
+	}
+	if len(f.Clients) == 0 {
+		return nil, errors.New("clients file lists no clients")
+	}
+
+	clients := make([]issueserver.Client, 0, len(f.Clients))
+	for _, entry := range f.Clients {
+		client, err := entry.client()
+		if err != nil {
+			return nil, fmt.Errorf("invalid client '%v', err: %v", entry.Name, err)
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+func (e clientEntry) client() (issueserver.Client, error) {
+	client := issueserver.Client{
+		Name: e.Name,
+		Certificate: certmanager.ClientAllowlist{
+			CommonNames: e.CommonNames,
+			SPIFFEIDs:   e.SPIFFEIDs,
+		},
+	}
+	if e.Name == "" {
+		return client, errors.New("name is required")
+	}
+
+	// Authentication
+	if e.TokenSHA256 == "" && len(e.CommonNames) == 0 && len(e.SPIFFEIDs) == 0 {
+		return client, errors.New("tokenSha256, commonNames or spiffeIds is required")
+	}
+	if e.TokenSHA256 != "" {
+		hash, err := hex.DecodeString(e.TokenSHA256)
+		if err != nil || len(hash) != sha256.Size {
+			return client, errors.New("tokenSha256 must be a hex-encoded SHA-256 hash")
+		}
+		copy(client.TokenHash[:], hash)
+	}
+
+	// Authorization
+	if len(e.AllowedNames) == 0 && len(e.AllowedIPs) == 0 && len(e.AllowedURIs) == 0 {
+		return client, errors.New("allowedNames, allowedIps or allowedUris is required")
+	}
+	ipRanges, err := parseCIDRs(strings.Join(e.AllowedIPs, ","))
+	if err != nil {
+		return client, err
+	}
+	client.Policy = certmanager.Policy{
+		AllowedNames:       e.AllowedNames,
+		AllowedIPRanges:    ipRanges,
+		AllowedURIPrefixes: e.AllowedURIs,
+		DenyWildcards:      e.DenyWildcards,
+	}
+	if e.MaxValidity != "" {
+		client.Policy.MaxValidity, err = time.ParseDuration(e.MaxValidity)
+		if err != nil || client.Policy.MaxValidity <= 0 {
+			return client, errors.New("maxValidity must be a positive duration, e.g. 1h")
+		}
+	}
+	return client, nil
+}
@@ -0,0 +1,86 @@
+package certcli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"github.com/sebnyberg/flagtags"
+	"github.com/urfave/cli/v2"
+)
+
+func NewCmdToken() *cli.Command {
+	return &cli.Command{
+		Name:        "token",
+		Description: "manage enrollment tokens",
+		Subcommands: []*cli.Command{
+			newCmdTokenCreate(),
+		},
+	}
+}
+
+type tokenCreateConfig struct {
+	CAURL          string `env:"CA_URL" name:"ca-url" usage:"URL to CA certificate secret e.g. https://myvault.azure.net/secrets/myca"`
+	CACertPassword string `usage:"CA Certificate password - leave blank if none"`
+	CAVersion      string `name:"ca-version" usage:"CA version to sign with: a version ID, latest, latest-enabled or latest-valid" value:"latest"`
+	CommonName     string `usage:"Common name the token may request a certificate for"`
+	SANs           string `name:"sans" env:"SANS" usage:"Comma-separated DNS names, IP addresses or URIs the token may request a certificate for"`
+	TTLMinutes     int    `name:"ttl-minutes" env:"TTL_MINUTES" usage:"Number of minutes until the token expires" value:"60"`
+	TimeoutSeconds int    `name:"timeout" usage:"Timeout in seconds before giving up" value:"10"`
+}
+
+func (c tokenCreateConfig) validate() error {
+	if len(c.CAURL) == 0 {
+		return errors.New("CA URL is required")
+	}
+	if len(c.CommonName) == 0 && len(splitList(c.SANs)) == 0 {
+		return errors.New("common name or SANs are required")
+	}
+	if c.TTLMinutes <= 0 {
+		return errors.New("TTL minutes must be positive")
+	}
+	return nil
+}
+
+func newCmdTokenCreate() *cli.Command {
+	var conf tokenCreateConfig
+
+	return &cli.Command{
+		Name:        "create",
+		Description: "Create a single-use token which lets a new workload enroll with certmanager serve for a certificate with the given names",
+		Flags:       flagtags.MustParseFlags(&conf),
+		Action: func(c *cli.Context) error {
+			if err := conf.validate(); err != nil {
+				return err
+			}
+			return createToken(conf)
+		},
+	}
+}
+
+func createToken(conf tokenCreateConfig) error {
+	timeoutSeconds := 10
+	if conf.TimeoutSeconds > 0 {
+		timeoutSeconds = conf.TimeoutSeconds
+	}
+	timeout := time.Second * time.Duration(timeoutSeconds)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	caCert, caCertChain, caKey, err := certmanager.GetCertSigner(ctx, conf.CAURL, conf.CACertPassword, certmanager.SelectVersion(conf.CAVersion))
+	if err != nil {
+		return describeErr(err)
+	}
+
+	expiry := time.Now().Add(time.Duration(conf.TTLMinutes) * time.Minute)
+	token, err := certmanager.NewEnrollmentToken(caCert, caCertChain, caKey, conf.CommonName, splitList(conf.SANs), expiry)
+	if err != nil {
+		return err
+	}
+
+	// Only the token is printed to stdout, so that it can be captured
+	fmt.Println(token)
+	return nil
+}
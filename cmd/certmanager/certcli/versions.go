@@ -0,0 +1,76 @@
+package certcli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"github.com/sebnyberg/flagtags"
+	"github.com/urfave/cli/v2"
+)
+
+type versionsConfig struct {
+	URL            string `env:"URL" usage:"Secret or certificate URL, e.g. https://myvault.azure.net/secrets/mycert"`
+	TimeoutSeconds int    `name:"timeout" usage:"Timeout in seconds before giving up" value:"10"`
+}
+
+func (c versionsConfig) validate() error {
+	if len(c.URL) == 0 {
+		return errors.New("URL is required")
+	}
+	return nil
+}
+
+func NewCmdVersions() *cli.Command {
+	var conf versionsConfig
+
+	return &cli.Command{
+		Name:        "versions",
+		ArgsUsage:   "<url>",
+		Description: "List all versions of a certificate",
+		Flags:       flagtags.MustParseFlags(&conf),
+		Action: func(c *cli.Context) error {
+			if c.Args().Present() {
+				conf.URL = c.Args().First()
+			}
+			if err := conf.validate(); err != nil {
+				return err
+			}
+			return versions(conf)
+		},
+	}
+}
+
+func versions(conf versionsConfig) error {
+	timeoutSeconds := 10
+	if conf.TimeoutSeconds > 0 {
+		timeoutSeconds = conf.TimeoutSeconds
+	}
+	timeout := time.Second * time.Duration(timeoutSeconds)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	versions, err := certmanager.ListCertVersions(ctx, conf.URL)
+	if err != nil {
+		return describeErr(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tENABLED\tCREATED\tSERIAL\tTHUMBPRINT\tNOT BEFORE\tNOT AFTER")
+	for _, v := range versions {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%X\t%v\t%v\t%v\n",
+			v.Version,
+			v.Enabled,
+			v.CreatedAt.Format(time.RFC3339),
+			v.SerialNumber,
+			v.Thumbprint,
+			v.NotBefore.Format(time.RFC3339),
+			v.NotAfter.Format(time.RFC3339),
+		)
+	}
+	return w.Flush()
+}
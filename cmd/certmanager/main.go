@@ -18,10 +18,31 @@ func main() {
 		Description: "certmanager contains some useful commands for working with certs",
 		Usage:       "management of TLS certificates",
 		Version:     version,
-		Commands: []*cli.Command{
+		Flags:       certcli.ContextFlags(),
+		Commands: certcli.WithContexts([]*cli.Command{
+			certcli.NewCmdLs(),
 			certcli.NewCmdDownload(),
 			certcli.NewCmdGen(),
-		},
+			certcli.NewCmdVersions(),
+			certcli.NewCmdRollback(),
+			certcli.NewCmdDisable(),
+			certcli.NewCmdEnable(),
+			certcli.NewCmdDelete(),
+			certcli.NewCmdRecover(),
+			certcli.NewCmdPurge(),
+			certcli.NewCmdDoctor(),
+			certcli.NewCmdACMEServe(),
+			certcli.NewCmdACMEIssue(),
+			certcli.NewCmdServe(),
+			certcli.NewCmdAgent(),
+			certcli.NewCmdToken(),
+			certcli.NewCmdEnroll(),
+			certcli.NewCmdCA(),
+			certcli.NewCmdBundle(),
+			certcli.NewCmdPlan(),
+			certcli.NewCmdApply(),
+			certcli.NewCmdContext(),
+		}),
 	}
 
 	if err := app.Run(os.Args); err != nil {
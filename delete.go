@@ -0,0 +1,199 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"path"
+	"strings"
+	"time"
+)
+
+// DeletedCert describes a deleted certificate.
+type DeletedCert struct {
+	// Name is the name of the certificate in the store.
+	Name string
+
+	// DeletedAt is when the certificate was deleted.
+	DeletedAt time.Time
+
+	// PurgeAt is when the certificate will be purged, after which it cannot
+	// be recovered. It is zero if the store does not keep deleted
+	// certificates, in which case the certificate was deleted for good.
+	PurgeAt time.Time
+
+	// Cert is the latest version of the certificate.
+	Cert *x509.Certificate
+}
+
+// Recoverable returns true if the certificate may be recovered with
+// RecoverCert.
+func (d DeletedCert) Recoverable() bool {
+	return !d.PurgeAt.IsZero()
+}
+
+// DeleteCert deletes the certificate at url, with all its versions, and its
+// key. Stores which keep deleted certificates, e.g. vaults with soft-delete
+// enabled, keep it until it is purged, and it can be recovered with
+// RecoverCert until then. The name cannot be reused before the certificate is
+// purged. The url may be the certificate URL or its secret URL.
+func DeleteCert(ctx context.Context, url string) (DeletedCert, error) {
+	s, err := getDefaultStore()
+	if err != nil {
+		return DeletedCert{}, err
+	}
+
+	return s.DeleteCert(ctx, url)
+}
+
+// DeleteCert deletes a certificate. See the package-level DeleteCert for
+// details.
+func (s *Store) DeleteCert(ctx context.Context, url string) (DeletedCert, error) {
+	if !strings.Contains(url, "vault.azure.net") {
+		return DeletedCert{}, ErrUnsupportedURL
+	}
+
+	d, err := deleteAzureKVCert(ctx, s.kv, url)
+	if err != nil {
+		return DeletedCert{}, err
+	}
+	s.ClearCache()
+	return d, nil
+}
+
+// RecoverCert recovers the deleted certificate at url, with all its versions.
+func RecoverCert(ctx context.Context, url string) error {
+	s, err := getDefaultStore()
+	if err != nil {
+		return err
+	}
+
+	return s.RecoverCert(ctx, url)
+}
+
+// RecoverCert recovers a deleted certificate. See the package-level
+// RecoverCert for details.
+func (s *Store) RecoverCert(ctx context.Context, url string) error {
+	if !strings.Contains(url, "vault.azure.net") {
+		return ErrUnsupportedURL
+	}
+
+	return recoverAzureKVCert(ctx, s.kv, url)
+}
+
+// PurgeCert permanently deletes the deleted certificate at url. Purging
+// fails with ErrHasDependents if certificates which have not expired in the
+// same store are still signed by it, see Dependents. Certificates which are
+// not kept in the store, e.g. those issued to clients, are not checked.
+// Purged certificates cannot be recovered.
+func PurgeCert(ctx context.Context, url string) error {
+	s, err := getDefaultStore()
+	if err != nil {
+		return err
+	}
+
+	return s.PurgeCert(ctx, url)
+}
+
+// PurgeCert permanently deletes a deleted certificate. See the package-level
+// PurgeCert for details.
+func (s *Store) PurgeCert(ctx context.Context, url string) error {
+	if !strings.Contains(url, "vault.azure.net") {
+		return ErrUnsupportedURL
+	}
+
+	return purgeAzureKVCert(ctx, s.kv, url, time.Now())
+}
+
+// SetCertEnabled enables or disables the latest version of the certificate
+// at url. Disabled versions cannot be retrieved, but are kept, unlike deleted
+// certificates. Use RollbackCert to disable a version and enable the one
+// before it instead.
+func SetCertEnabled(ctx context.Context, url string, enabled bool) error {
+	s, err := getDefaultStore()
+	if err != nil {
+		return err
+	}
+
+	return s.SetCertEnabled(ctx, url, enabled)
+}
+
+// SetCertEnabled enables or disables the latest version of a certificate.
+// See the package-level SetCertEnabled for details.
+func (s *Store) SetCertEnabled(ctx context.Context, url string, enabled bool) error {
+	if !strings.Contains(url, "vault.azure.net") {
+		return ErrUnsupportedURL
+	}
+
+	baseURL, name, _, err := parseAzureKVURL(url)
+	if err != nil {
+		return appendErr("failed to parse URL", err)
+	}
+	bundle, err := s.kv.GetCertificate(ctx, baseURL, name, "")
+	if err != nil {
+		return appendErr("failed to retrieve certificate", newStoreError("GetCertificate", err))
+	}
+	if bundle.ID == nil {
+		return errors.New("certificate is missing an ID")
+	}
+	if err := setAzureKVCertVersionEnabled(ctx, s.kv, baseURL, name, path.Base(*bundle.ID), enabled); err != nil {
+		return err
+	}
+	s.ClearCache()
+	return nil
+}
+
+// Dependents lists the certificates in the same store as the CA at url which
+// are signed by the latest version of the CA and have not expired, i.e. the
+// certificates which stop working if the CA is removed. Certificates signed
+// by intermediates of the CA are not listed, the intermediates are. Neither
+// are certificates kept outside the store, e.g. those issued to clients,
+// which the store knows nothing about.
+func Dependents(ctx context.Context, url string) ([]CertInfo, error) {
+	s, err := getDefaultStore()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Dependents(ctx, url)
+}
+
+// Dependents lists the certificates signed by a CA. See the package-level
+// Dependents for details.
+func (s *Store) Dependents(ctx context.Context, url string) ([]CertInfo, error) {
+	if !strings.Contains(url, "vault.azure.net") {
+		return nil, ErrUnsupportedURL
+	}
+
+	baseURL, name, _, err := parseAzureKVURL(url)
+	if err != nil {
+		return nil, appendErr("failed to parse URL", err)
+	}
+	bundle, err := s.kv.GetCertificate(ctx, baseURL, name, "")
+	if err != nil {
+		return nil, appendErr("failed to retrieve certificate", newStoreError("GetCertificate", err))
+	}
+	if bundle.Cer == nil {
+		return nil, ErrNotFound
+	}
+	ca, err := x509.ParseCertificate(*bundle.Cer)
+	if err != nil {
+		return nil, appendErr("failed to parse certificate", err)
+	}
+	return azureKVDependents(ctx, s.kv, baseURL, name, ca, time.Now())
+}
+
+// dependents returns the certificates signed by ca, other than the
+// certificate with the given name, which have not expired at now.
+func dependents(infos []CertInfo, name string, ca *x509.Certificate, now time.Time) []CertInfo {
+	var deps []CertInfo
+	for _, info := range infos {
+		if info.Name == name || !now.Before(info.Cert.NotAfter) {
+			continue
+		}
+		if info.Cert.CheckSignatureFrom(ca) == nil {
+			deps = append(deps, info)
+		}
+	}
+	return deps
+}
@@ -0,0 +1,125 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+)
+
+func TestStore_DeleteCert(t *testing.T) {
+	now := time.Now()
+	strPtr := func(s string) *string { return &s }
+
+	caCert, caKey, err := GenSelfSignedCA("test-ca", now.AddDate(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _, err := GenSignedCert(caCert, caKey, "leaf", nil, now.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &fakeKeyVault{
+		permissions: map[string]bool{
+			"certificates/list":    true,
+			"certificates/get":     true,
+			"certificates/delete":  true,
+			"certificates/recover": true,
+			"certificates/purge":   true,
+			"certificates/import":  true,
+		},
+		certs: map[string]keyvault.CertificateBundle{
+			"ca":   {ID: strPtr("https://test.vault.azure.net/certificates/ca"), Cer: &caCert.Raw},
+			"leaf": {ID: strPtr("https://test.vault.azure.net/certificates/leaf"), Cer: &leaf.Raw},
+		},
+	}
+	s := newFakeKVStore(t, kv)
+	ctx := context.Background()
+	caURL := "https://test.vault.azure.net/certificates/ca"
+
+	deps, err := s.Dependents(ctx, caURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 1 || deps[0].Name != "leaf" {
+		t.Errorf("want leaf to depend on the CA, got %+v", deps)
+	}
+
+	d, err := s.DeleteCert(ctx, caURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "ca" || !d.Recoverable() || !d.Cert.Equal(caCert) {
+		t.Errorf("unexpected deleted certificate %+v", d)
+	}
+
+	// The name of a deleted certificate cannot be reused
+	err = s.UploadCert(ctx, caURL, caCert, nil, caKey, "", AllowNewVersion())
+	if !errors.Is(err, ErrDeleted) {
+		t.Errorf("want %v when uploading over a deleted certificate, got %v", ErrDeleted, err)
+	}
+
+	// The CA may not be purged while the leaf is in the vault
+	err = s.PurgeCert(ctx, caURL)
+	if !errors.Is(err, ErrHasDependents) || !strings.Contains(err.Error(), "leaf") {
+		t.Fatalf("want %v naming leaf, got %v", ErrHasDependents, err)
+	}
+
+	if err := s.RecoverCert(ctx, caURL); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kv.certs["ca"]; !ok {
+		t.Fatalf("want CA to be recovered")
+	}
+
+	// Once the leaf is gone, the CA may be purged
+	for _, url := range []string{"https://test.vault.azure.net/secrets/leaf", caURL} {
+		if _, err := s.DeleteCert(ctx, url); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.PurgeCert(ctx, caURL); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kv.deletedCerts["ca"]; ok {
+		t.Errorf("want CA to be purged")
+	}
+	if err := s.RecoverCert(ctx, caURL); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want %v when recovering a purged certificate, got %v", ErrNotFound, err)
+	}
+}
+
+func TestDependents(t *testing.T) {
+	now := time.Now()
+	caCert, caKey, err := GenSelfSignedCA("test-ca", now.AddDate(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA, otherKey, err := GenSelfSignedCA("other-ca", now.AddDate(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := func(ca *x509.Certificate, key *rsa.PrivateKey, expiry time.Time) *x509.Certificate {
+		cert, _, err := GenSignedCert(ca, key, "leaf", nil, expiry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	infos := []CertInfo{
+		{Name: "ca", Cert: caCert},
+		{Name: "valid", Cert: signed(caCert, caKey, now.AddDate(0, 1, 0))},
+		{Name: "expired", Cert: signed(caCert, caKey, now.Add(-time.Minute))},
+		{Name: "other", Cert: signed(otherCA, otherKey, now.AddDate(0, 1, 0))},
+	}
+	deps := dependents(infos, "ca", caCert, now)
+	if len(deps) != 1 || deps[0].Name != "valid" {
+		t.Errorf("want only the valid leaf of the CA, got %+v", deps)
+	}
+}
@@ -0,0 +1,240 @@
+package certmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+// Operations which can be diagnosed with Diagnose.
+const (
+	// OpGet retrieves a certificate, e.g. with download or gen signed-cert.
+	OpGet = "get"
+
+	// OpUpload uploads a certificate, e.g. with gen ca-cert.
+	OpUpload = "upload"
+)
+
+// CheckStatus is the outcome of a diagnostic check.
+type CheckStatus string
+
+const (
+	CheckOK      CheckStatus = "OK"
+	CheckWarn    CheckStatus = "WARN"
+	CheckFail    CheckStatus = "FAIL"
+	CheckSkipped CheckStatus = "SKIPPED"
+)
+
+// Check is the result of a single diagnostic check performed by Diagnose.
+type Check struct {
+	Name   string
+	Status CheckStatus
+	Detail string
+	Fix    string
+}
+
+// doctorProbeName is the name of the (non-existent) object used to probe for
+// permissions that would otherwise modify the vault.
+const doctorProbeName = "certmanager-doctor-probe"
+
+// Diagnose checks, step by step, whether the intended operation op can be
+// performed against url: which credentials are used, whether the access token
+// is valid, whether the URL is suitable for the operation, and which
+// permissions are granted by the vault. If op is empty, it is inferred from
+// the URL.
+//
+// Permissions which would modify the vault are probed with requests that are
+// bound to fail, without creating or changing any objects.
+func (s *Store) Diagnose(ctx context.Context, url string, op string) []Check {
+	checks := []Check{{
+		Name:   "credentials",
+		Status: CheckOK,
+		Detail: "using credentials from " + s.credentials,
+	}}
+
+	// Token
+	tokenCheck := Check{Name: "token", Status: CheckOK, Detail: "access token is valid"}
+	if err := checkAzureToken(ctx, s.kv.Authorizer); err != nil {
+		tokenCheck.Status = CheckFail
+		tokenCheck.Detail = err.Error()
+		if s.credentials == credentialSourceCLI {
+			tokenCheck.Fix = "log in again with 'az login'"
+		} else {
+			tokenCheck.Fix = "verify the AZURE_CLIENT_ID, AZURE_TENANT_ID and AZURE_CLIENT_SECRET environment variables"
+		}
+	}
+	checks = append(checks, tokenCheck)
+
+	// URL
+	urlCheck, baseURL, name := diagnoseURL(url, &op)
+	checks = append(checks, urlCheck)
+
+	// Permissions
+	for _, p := range []struct {
+		name     string
+		required bool
+		probe    func() error
+	}{
+		{"secrets/get", op == OpGet, func() error {
+			_, err := s.kv.GetSecret(ctx, baseURL, name, "")
+			return newStoreError("GetSecret", err)
+		}},
+		{"secrets/list", false, func() error {
+			_, err := s.kv.GetSecrets(ctx, baseURL, nil)
+			return newStoreError("GetSecrets", err)
+		}},
+		{"secrets/set", false, func() error {
+			_, err := s.kv.UpdateSecret(ctx, baseURL, doctorProbeName, "", keyvault.SecretUpdateParameters{})
+			return newStoreError("UpdateSecret", err)
+		}},
+		{"certificates/get", op == OpUpload, func() error {
+			_, err := s.kv.GetCertificate(ctx, baseURL, name, "")
+			return newStoreError("GetCertificate", err)
+		}},
+		{"certificates/list", false, func() error {
+			_, err := s.kv.GetCertificates(ctx, baseURL, nil, nil)
+			return newStoreError("GetCertificates", err)
+		}},
+		{"certificates/import", op == OpUpload, func() error {
+			empty := ""
+			_, err := s.kv.ImportCertificate(ctx, baseURL, doctorProbeName, keyvault.CertificateImportParameters{
+				Base64EncodedCertificate: &empty,
+			})
+			return newStoreError("ImportCertificate", err)
+		}},
+	} {
+		check := Check{Name: "permission " + p.name}
+		if tokenCheck.Status != CheckOK || urlCheck.Status == CheckFail {
+			check.Status = CheckSkipped
+			checks = append(checks, check)
+			continue
+		}
+		check.Status, check.Detail, check.Fix = diagnosePermission(p.name, p.required, p.probe())
+		checks = append(checks, check)
+	}
+
+	return checks
+}
+
+// Diagnose checks whether the intended operation op can be performed against
+// url using the default Store. See Store.Diagnose for details.
+//
+// If no credentials could be found, a single failed check is returned.
+func Diagnose(ctx context.Context, url string, op string) []Check {
+	s, err := getDefaultStore()
+	if err != nil {
+		return []Check{{
+			Name:   "credentials",
+			Status: CheckFail,
+			Detail: err.Error(),
+			Fix:    "log in with 'az login' or set the AZURE_CLIENT_ID, AZURE_TENANT_ID and AZURE_CLIENT_SECRET environment variables",
+		}}
+	}
+
+	return s.Diagnose(ctx, url, op)
+}
+
+// diagnoseURL validates url for op. If op is empty, it is inferred from the
+// URL and updated in place.
+func diagnoseURL(url string, op *string) (check Check, baseURL string, name string) {
+	check.Name = "url"
+	if !strings.Contains(url, "vault.azure.net") {
+		check.Status = CheckFail
+		check.Detail = ErrUnsupportedURL.Error()
+		check.Fix = "use a Key Vault URL, e.g. https://myvault.vault.azure.net/secrets/mycert"
+		return check, "", ""
+	}
+
+	baseURL, name, _, err := parseAzureKVURL(url)
+	if err != nil {
+		check.Status = CheckFail
+		check.Detail = err.Error()
+		check.Fix = "use a URL of the form https://myvault.vault.azure.net/secrets/mycert"
+		return check, "", ""
+	}
+	isSecretURL := strings.Contains(url, "/secrets/")
+
+	switch *op {
+	case "":
+		*op = OpUpload
+		if isSecretURL {
+			*op = OpGet
+		}
+		check.Status = CheckWarn
+		check.Detail = fmt.Sprintf("no operation provided, assuming '%v' based on the URL", *op)
+	case OpGet:
+		check.Status = CheckOK
+		check.Detail = "secret URL can be used to retrieve certificates"
+		if !isSecretURL {
+			check.Status = CheckFail
+			check.Detail = errInvalidKVSecretURL.Error()
+			check.Fix = "replace /certificates/ with /secrets/ in the URL"
+		}
+	case OpUpload:
+		check.Status = CheckOK
+		check.Detail = "certificate URL can be used to upload certificates"
+		if isSecretURL {
+			check.Status = CheckFail
+			check.Detail = errInvalidKVCertURL.Error()
+			check.Fix = "replace /secrets/ with /certificates/ in the URL"
+		}
+	default:
+		check.Status = CheckFail
+		check.Detail = fmt.Sprintf("unknown operation '%v'", *op)
+		check.Fix = fmt.Sprintf("use one of '%v' or '%v'", OpGet, OpUpload)
+	}
+
+	return check, baseURL, name
+}
+
+// diagnosePermission interprets the result of a permission probe.
+func diagnosePermission(permission string, required bool, err error) (status CheckStatus, detail string, fix string) {
+	missing := CheckWarn
+	if required {
+		missing = CheckFail
+	}
+	fix = fmt.Sprintf("add the '%v' permission to the access policy of the vault", permission)
+
+	var storeErr *StoreError
+	switch {
+	case err == nil:
+		return CheckOK, "permission granted", ""
+	case errors.Is(err, ErrForbidden):
+		return missing, "permission missing", fix
+	case errors.Is(err, ErrUnauthorized):
+		return missing, "request was not authorized", "verify that the credentials belong to the tenant of the vault"
+	case errors.Is(err, ErrNotFound):
+		if required && permission == "secrets/get" {
+			return CheckFail, "permission granted, but the secret does not exist", "verify the secret name in the URL"
+		}
+		return CheckOK, "permission granted", ""
+	case errors.As(err, &storeErr) && storeErr.StatusCode == 400:
+		// Probes which would modify the vault are sent with invalid parameters
+		return CheckOK, "permission granted", ""
+	}
+	return CheckWarn, err.Error(), "verify that the vault is reachable"
+}
+
+// checkAzureToken verifies that a valid access token can be retrieved.
+func checkAzureToken(ctx context.Context, authorizer autorest.Authorizer) error {
+	ba, ok := authorizer.(*autorest.BearerAuthorizer)
+	if !ok {
+		return nil
+	}
+
+	tp := ba.TokenProvider()
+	if refresher, ok := tp.(adal.RefresherWithContext); ok {
+		if err := refresher.EnsureFreshWithContext(ctx); err != nil {
+			return appendErr("failed to refresh access token", err)
+		}
+	}
+	if tp.OAuthToken() == "" {
+		return errors.New("access token is empty")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package certmanager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStore_Diagnose(t *testing.T) {
+	allPermissions := map[string]bool{
+		"secrets/get":         true,
+		"secrets/list":        true,
+		"secrets/set":         true,
+		"certificates/get":    true,
+		"certificates/list":   true,
+		"certificates/import": true,
+	}
+	readOnly := map[string]bool{
+		"secrets/get":       true,
+		"certificates/get":  true,
+		"certificates/list": true,
+	}
+	secrets := map[string]keyvault.SecretBundle{"myca": {}}
+
+	for _, tc := range []struct {
+		name        string
+		url         string
+		op          string
+		permissions map[string]bool
+		want        map[string]CheckStatus
+	}{
+		{
+			"get with all permissions",
+			"https://test.vault.azure.net/secrets/myca", OpGet, allPermissions,
+			map[string]CheckStatus{
+				"credentials":                    CheckOK,
+				"token":                          CheckOK,
+				"url":                            CheckOK,
+				"permission secrets/get":         CheckOK,
+				"permission secrets/list":        CheckOK,
+				"permission secrets/set":         CheckOK,
+				"permission certificates/get":    CheckOK,
+				"permission certificates/list":   CheckOK,
+				"permission certificates/import": CheckOK,
+			},
+		},
+		{
+			"upload without import permission",
+			"https://test.vault.azure.net/certificates/newca", "", readOnly,
+			map[string]CheckStatus{
+				"credentials":                    CheckOK,
+				"token":                          CheckOK,
+				"url":                            CheckWarn,
+				"permission secrets/get":         CheckOK,
+				"permission secrets/list":        CheckWarn,
+				"permission secrets/set":         CheckWarn,
+				"permission certificates/get":    CheckOK,
+				"permission certificates/list":   CheckOK,
+				"permission certificates/import": CheckFail,
+			},
+		},
+		{
+			"get with missing secret",
+			"https://test.vault.azure.net/secrets/missing", OpGet, readOnly,
+			map[string]CheckStatus{
+				"credentials":                    CheckOK,
+				"token":                          CheckOK,
+				"url":                            CheckOK,
+				"permission secrets/get":         CheckFail,
+				"permission secrets/list":        CheckWarn,
+				"permission secrets/set":         CheckWarn,
+				"permission certificates/get":    CheckOK,
+				"permission certificates/list":   CheckOK,
+				"permission certificates/import": CheckWarn,
+			},
+		},
+		{
+			"get with certificate URL",
+			"https://test.vault.azure.net/certificates/myca", OpGet, allPermissions,
+			map[string]CheckStatus{
+				"credentials":                    CheckOK,
+				"token":                          CheckOK,
+				"url":                            CheckFail,
+				"permission secrets/get":         CheckSkipped,
+				"permission secrets/list":        CheckSkipped,
+				"permission secrets/set":         CheckSkipped,
+				"permission certificates/get":    CheckSkipped,
+				"permission certificates/list":   CheckSkipped,
+				"permission certificates/import": CheckSkipped,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newFakeKVStore(t, &fakeKeyVault{
+				permissions: tc.permissions,
+				secrets:     secrets,
+			})
+
+			got := make(map[string]CheckStatus)
+			for _, check := range s.Diagnose(context.Background(), tc.url, tc.op) {
+				got[check.Name] = check.Status
+				if check.Status == CheckFail && check.Fix == "" {
+					t.Errorf("failed check %v has no suggested fix", check.Name)
+				}
+			}
+			if !cmp.Equal(tc.want, got) {
+				t.Error("unexpected checks", cmp.Diff(tc.want, got))
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package certmanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// enrollmentTokenPrefix identifies enrollment tokens and their version.
+const enrollmentTokenPrefix = "cmet1."
+
+// EnrollmentToken allows a workload without access to the store to obtain
+// its first certificate, for a fixed set of names, from a service holding
+// the CA. Tokens are signed by the CA key, so that any service holding the
+// CA can verify them, and should only be accepted once, see ErrTokenUsed.
+type EnrollmentToken struct {
+	// ID uniquely identifies the token, e.g. to record that it was used.
+	ID string `json:"jti"`
+
+	// CommonName and SANs are the only names a certificate requested with
+	// the token may contain.
+	CommonName string   `json:"cn,omitempty"`
+	SANs       []string `json:"sans,omitempty"`
+
+	// RootFingerprint is the hex-encoded SHA-256 hash of the root of the CA
+	// chain, which lets the workload verify the service before trusting it.
+	RootFingerprint string `json:"rootSha256"`
+
+	ExpiresAt time.Time `json:"exp"`
+}
+
+// NewEnrollmentToken returns a token signed by the CA which may be used once
+// before expiry to request a certificate for commonName and sans. caCerts is
+// the chain of caCert, as returned by GetCertSigner.
+func NewEnrollmentToken(
+	caCert *x509.Certificate,
+	caCerts []*x509.Certificate,
+	caKey crypto.Signer,
+	commonName string,
+	sans []string,
+	expiry time.Time,
+) (string, error) {
+	if commonName == "" && len(sans) == 0 {
+		return "", errors.New("common name or SANs are required")
+	}
+	if !publicKeysEqual(caCert.PublicKey, caKey.Public()) {
+		return "", errors.New("CA key does not match the CA certificate")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	_, root, err := BuildChain(caCert, caCerts)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(EnrollmentToken{
+		ID:              hex.EncodeToString(id),
+		CommonName:      commonName,
+		SANs:            sans,
+		RootFingerprint: Fingerprint(root),
+		ExpiresAt:       expiry.UTC().Truncate(time.Second),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := enrollmentTokenPrefix + base64.RawURLEncoding.EncodeToString(payload)
+	var sig []byte
+	if _, ok := caKey.Public().(ed25519.PublicKey); ok {
+		sig, err = caKey.Sign(rand.Reader, []byte(signed), crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256([]byte(signed))
+		sig, err = caKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token, err: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// IsEnrollmentToken reports whether token looks like an enrollment token,
+// without verifying it.
+func IsEnrollmentToken(token string) bool {
+	return strings.HasPrefix(token, enrollmentTokenPrefix)
+}
+
+// ParseEnrollmentToken returns the claims of an enrollment token without
+// verifying its signature, e.g. to read the root fingerprint before the CA
+// is trusted.
+func ParseEnrollmentToken(token string) (*EnrollmentToken, error) {
+	_, payload, _, err := splitEnrollmentToken(token)
+	if err != nil {
+		return nil, err
+	}
+	var t EnrollmentToken
+	if err := json.Unmarshal(payload, &t); err != nil || t.ID == "" {
+		return nil, ErrInvalidToken
+	}
+	return &t, nil
+}
+
+// VerifyEnrollmentToken verifies that the token was signed by the CA and
+// has not expired, and returns its claims. Whether the token has already
+// been used must be checked by the caller.
+func VerifyEnrollmentToken(caCert *x509.Certificate, token string) (*EnrollmentToken, error) {
+	return verifyEnrollmentToken(caCert, token, time.Now())
+}
+
+func verifyEnrollmentToken(caCert *x509.Certificate, token string, now time.Time) (*EnrollmentToken, error) {
+	signed, _, sig, err := splitEnrollmentToken(token)
+	if err != nil {
+		return nil, err
+	}
+	var algo x509.SignatureAlgorithm
+	switch caCert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		algo = x509.SHA256WithRSA
+	case *ecdsa.PublicKey:
+		algo = x509.ECDSAWithSHA256
+	case ed25519.PublicKey:
+		algo = x509.PureEd25519
+	default:
+		return nil, ErrUnsupportedKeyType
+	}
+	if err := caCert.CheckSignature(algo, []byte(signed), sig); err != nil {
+		return nil, fmt.Errorf("%w: signature is not from the CA", ErrInvalidToken)
+	}
+
+	t, err := ParseEnrollmentToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(t.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	return t, nil
+}
+
+func splitEnrollmentToken(token string) (signed string, payload []byte, sig []byte, err error) {
+	if !IsEnrollmentToken(token) {
+		return "", nil, nil, ErrInvalidToken
+	}
+	parts := strings.Split(strings.TrimPrefix(token, enrollmentTokenPrefix), ".")
+	if len(parts) != 2 {
+		return "", nil, nil, ErrInvalidToken
+	}
+	payload, err = base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", nil, nil, ErrInvalidToken
+	}
+	sig, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, ErrInvalidToken
+	}
+	return enrollmentTokenPrefix + parts[0], payload, sig, nil
+}
+
+// Check returns an error matching ErrPolicyViolation unless every name in
+// cert is one of the names of the token.
+func (t EnrollmentToken) Check(cert *x509.Certificate) error {
+	allowed := make(map[string]bool)
+	for _, name := range append([]string{t.CommonName}, t.SANs...) {
+		if name != "" {
+			allowed[strings.ToLower(name)] = true
+		}
+	}
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	names = append(names, cert.EmailAddresses...)
+	for _, name := range names {
+		if !allowed[strings.ToLower(name)] {
+			return fmt.Errorf("%w: '%v' is not allowed by the enrollment token", ErrPolicyViolation, name)
+		}
+	}
+	return nil
+}
+
+// Fingerprint returns the hex-encoded SHA-256 hash of a certificate.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
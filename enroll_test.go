@@ -0,0 +1,114 @@
+package certmanager
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyEnrollmentToken(t *testing.T) {
+	now := time.Now()
+	caCert, caKey, err := GenSelfSignedCA("test-ca", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCACert, otherCAKey, err := GenSelfSignedCA("other-ca", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecCACert := newTestCert(t, "ec-ca", ecKey)
+
+	token, err := NewEnrollmentToken(caCert, nil, caKey, "api.example.com", []string{"api.example.com"}, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := NewEnrollmentToken(otherCACert, nil, otherCAKey, "api.example.com", nil, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecToken, err := NewEnrollmentToken(ecCACert, nil, ecKey, "api.example.com", nil, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + parts[1] + "x." + parts[2]
+
+	for _, tc := range []struct {
+		name    string
+		caCert  *x509.Certificate
+		token   string
+		now     time.Time
+		wantErr error
+	}{
+		{"valid", caCert, token, now, nil},
+		{"ecdsa", ecCACert, ecToken, now, nil},
+		{"expired", caCert, token, now.Add(2 * time.Hour), ErrTokenExpired},
+		{"other CA", caCert, otherToken, now, ErrInvalidToken},
+		{"tampered", caCert, tampered, now, ErrInvalidToken},
+		{"not a token", caCert, "secret", now, ErrInvalidToken},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := verifyEnrollmentToken(tc.caCert, tc.token, tc.now)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("want %v, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.CommonName != "api.example.com" || got.ID == "" {
+				t.Errorf("unexpected token %+v", got)
+			}
+			if got.RootFingerprint != Fingerprint(tc.caCert) {
+				t.Errorf("want root fingerprint %v, got %v", Fingerprint(tc.caCert), got.RootFingerprint)
+			}
+		})
+	}
+
+	if _, err := NewEnrollmentToken(caCert, nil, otherCAKey, "api.example.com", nil, now.Add(time.Hour)); err == nil {
+		t.Error("want error when the key does not match the CA")
+	}
+}
+
+func TestEnrollmentToken_Check(t *testing.T) {
+	token := EnrollmentToken{CommonName: "api", SANs: []string{"api.example.com", "10.0.0.1"}}
+	for _, tc := range []struct {
+		name    string
+		cert    *x509.Certificate
+		wantErr bool
+	}{
+		{"all names", &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "api"},
+			DNSNames:    []string{"API.example.com"},
+			IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+		}, false},
+		{"some names", &x509.Certificate{DNSNames: []string{"api.example.com"}}, false},
+		{"other common name", &x509.Certificate{Subject: pkix.Name{CommonName: "db"}}, true},
+		{"other dns name", &x509.Certificate{DNSNames: []string{"db.example.com"}}, true},
+		{"other ip", &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.0.0.2")}}, true},
+		{"email", &x509.Certificate{EmailAddresses: []string{"admin@example.com"}}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := token.Check(tc.cert)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("want err: %v, got %v", tc.wantErr, err)
+			}
+			if err != nil && !errors.Is(err, ErrPolicyViolation) {
+				t.Errorf("want %v, got %v", ErrPolicyViolation, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package certmanager
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// Errors returned by store operations. Use errors.Is to check for them.
+var (
+	ErrUnsupportedURL     = errors.New("only azure key vault URLs are supported")
+	ErrInvalidURL         = errors.New("invalid URL")
+	ErrNotFound           = errors.New("not found")
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrForbidden          = errors.New("forbidden")
+	ErrAlreadyExists      = errors.New("already exists")
+	ErrThrottled          = errors.New("throttled")
+	ErrInvalidContentType = errors.New("invalid content type")
+	ErrInvalidPassword    = errors.New("invalid certificate password")
+	ErrUnsupportedKeyType = errors.New("unsupported key type")
+)
+
+// ErrPolicyViolation is returned when signing a certificate which is not
+// allowed by a Policy or by the name constraints of the CA.
+var ErrPolicyViolation = errors.New("certificate policy violation")
+
+// ErrDeleted is returned when uploading a certificate with the name of a
+// deleted certificate, which must be recovered or purged first.
+var ErrDeleted = errors.New("is deleted but not purged")
+
+// ErrHasDependents is returned when purging a CA which still signs
+// certificates which have not expired, see PurgeCert.
+var ErrHasDependents = errors.New("still signs certificates which have not expired")
+
+// ErrNotCrossSigned is returned when migrating a rollover whose new CA is not
+// cross-signed by the old CA, see Rollover.Advance.
+var ErrNotCrossSigned = errors.New("new CA is not cross-signed by the old CA")
+
+// ErrIncompleteChain is returned when a certificate chain cannot be built up
+// to a root, e.g. because an intermediate is missing, see BuildChain.
+var ErrIncompleteChain = errors.New("incomplete certificate chain")
+
+// Errors returned when verifying enrollment tokens, see EnrollmentToken.
+var (
+	ErrInvalidToken = errors.New("invalid enrollment token")
+	ErrTokenExpired = errors.New("enrollment token has expired")
+	ErrTokenUsed    = errors.New("enrollment token has already been used")
+)
+
+// StoreError is returned when a request to the store fails. Depending on the
+// status code, it matches one of ErrNotFound, ErrUnauthorized, ErrForbidden,
+// ErrAlreadyExists or ErrThrottled when checked with errors.Is.
+type StoreError struct {
+	// Op is the name of the failed operation, e.g. GetSecret.
+	Op string
+
+	// StatusCode is the HTTP status code returned by the store, or zero if no
+	// response was received.
+	StatusCode int
+
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *StoreError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%v failed, err: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%v failed with status code %v, err: %v", e.Op, e.StatusCode, e.Err)
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+func (e *StoreError) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		return target == ErrForbidden
+	case http.StatusConflict:
+		return target == ErrAlreadyExists
+	case http.StatusTooManyRequests:
+		return target == ErrThrottled
+	}
+	return false
+}
+
+// newStoreError wraps an error returned by the Key Vault client in a
+// *StoreError. Nil errors are returned as-is.
+func newStoreError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	storeErr := &StoreError{Op: op, Err: err}
+	var detailedErr autorest.DetailedError
+	if errors.As(err, &detailedErr) {
+		if statusCode, ok := detailedErr.StatusCode.(int); ok {
+			storeErr.StatusCode = statusCode
+		}
+	}
+	return storeErr
+}
+
+// invalidURLError is an ErrInvalidURL with a more helpful message.
+type invalidURLError string
+
+func (e invalidURLError) Error() string {
+	return string(e)
+}
+
+func (e invalidURLError) Is(target error) bool {
+	return target == ErrInvalidURL
+}
+
+func appendErr(s string, err error) error {
+	return fmt.Errorf("%v, err: %w", s, err)
+}
@@ -0,0 +1,46 @@
+package certmanager
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+func Test_newStoreError(t *testing.T) {
+	for _, tc := range []struct {
+		statusCode int
+		want       error
+	}{
+		{401, ErrUnauthorized},
+		{403, ErrForbidden},
+		{404, ErrNotFound},
+		{409, ErrAlreadyExists},
+		{429, ErrThrottled},
+	} {
+		t.Run(fmt.Sprint(tc.statusCode), func(t *testing.T) {
+			original := errors.New("original")
+			err := newStoreError("GetSecret", autorest.DetailedError{
+				Original:   original,
+				StatusCode: tc.statusCode,
+			})
+			err = appendErr("failed to retrieve secret", err)
+
+			if !errors.Is(err, tc.want) {
+				t.Errorf("expected errors.Is(err, %v) for %v", tc.want, err)
+			}
+			if !errors.Is(err, original) {
+				t.Errorf("expected original error to be wrapped by %v", err)
+			}
+			var storeErr *StoreError
+			if !errors.As(err, &storeErr) || storeErr.StatusCode != tc.statusCode {
+				t.Errorf("expected *StoreError with status code %v", tc.statusCode)
+			}
+		})
+	}
+
+	if err := newStoreError("GetSecret", nil); err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+}
@@ -0,0 +1,327 @@
+package certmanager
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/date"
+)
+
+// fakeKeyVault is a minimal stand-in for the Key Vault REST API.
+type fakeKeyVault struct {
+	// permissions granted to the caller, e.g. "secrets/get".
+	permissions map[string]bool
+
+	// secrets maps secret names, or names and versions separated by a
+	// slash, to their bundles.
+	secrets map[string]keyvault.SecretBundle
+
+	// certVersions maps certificate names to their versions.
+	certVersions map[string][]keyvault.CertificateItem
+
+	// certs maps certificate names and versions separated by a slash to
+	// their bundles. Bundles under a name alone are the latest versions,
+	// which are listed.
+	certs map[string]keyvault.CertificateBundle
+
+	// deletedCerts maps names of deleted certificates to their bundles.
+	deletedCerts map[string]keyvault.DeletedCertificateBundle
+
+	// onRequest, if set, is called with each request before it is handled.
+	onRequest func(r *http.Request)
+
+	mu sync.Mutex
+	// requests contains the method and path of each request.
+	requests []string
+	// failures are status codes returned, in order, instead of handling
+	// the first requests.
+	failures []int
+	// retryAfter is the Retry-After header returned with 429 failures.
+	retryAfter string
+	// imports contains the parameters of each certificate import.
+	imports []keyvault.CertificateImportParameters
+}
+
+func (f *fakeKeyVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	var failure int
+	if len(f.failures) > 0 {
+		failure, f.failures = f.failures[0], f.failures[1:]
+	}
+	f.mu.Unlock()
+
+	if failure != 0 {
+		if failure == http.StatusTooManyRequests && f.retryAfter != "" {
+			w.Header().Set("Retry-After", f.retryAfter)
+		}
+		writeFakeKVError(w, failure, http.StatusText(failure))
+		return
+	}
+	if f.onRequest != nil {
+		f.onRequest(r)
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	kind := parts[0]
+
+	var permission string
+	switch {
+	case kind == "deletedcertificates" && r.Method == http.MethodGet:
+		permission = "certificates/get"
+	case len(parts) == 1 && r.Method == http.MethodGet,
+		len(parts) == 3 && parts[2] == "versions" && r.Method == http.MethodGet:
+		permission = kind + "/list"
+	case r.Method == http.MethodGet:
+		permission = kind + "/get"
+	case kind == "secrets" && (r.Method == http.MethodPatch || r.Method == http.MethodPut):
+		permission = "secrets/set"
+	case kind == "certificates" && r.Method == http.MethodPatch:
+		permission = "certificates/update"
+	case kind == "certificates" && r.Method == http.MethodPost && parts[len(parts)-1] == "import":
+		permission = "certificates/import"
+	case kind == "certificates" && r.Method == http.MethodDelete:
+		permission = "certificates/delete"
+	case kind == "deletedcertificates" && r.Method == http.MethodPost && parts[len(parts)-1] == "recover":
+		permission = "certificates/recover"
+	case kind == "deletedcertificates" && r.Method == http.MethodDelete:
+		permission = "certificates/purge"
+	default:
+		writeFakeKVError(w, http.StatusBadRequest, "BadParameter")
+		return
+	}
+	if !f.permissions[permission] {
+		writeFakeKVError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	if kind == "deletedcertificates" && permission == "certificates/get" {
+		f.mu.Lock()
+		bundle, ok := f.deletedCerts[parts[1]]
+		f.mu.Unlock()
+		if !ok {
+			writeFakeKVError(w, http.StatusNotFound, "CertificateNotFound")
+			return
+		}
+		writeFakeKVJSON(w, fakeDeletedCert(bundle))
+		return
+	}
+
+	switch permission {
+	case "secrets/list", "certificates/list":
+		if len(parts) == 3 {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			writeFakeKVJSON(w, map[string]interface{}{"value": f.certVersions[parts[1]]})
+			return
+		}
+		if kind == "certificates" {
+			// The latest versions are listed
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			items := []keyvault.CertificateItem{}
+			for name, bundle := range f.certs {
+				if !strings.Contains(name, "/") {
+					items = append(items, keyvault.CertificateItem{ID: bundle.ID, Tags: bundle.Tags, Attributes: bundle.Attributes})
+				}
+			}
+			writeFakeKVJSON(w, map[string]interface{}{"value": items})
+			return
+		}
+		writeFakeKVJSON(w, map[string]interface{}{"value": []interface{}{}})
+	case "secrets/get":
+		f.mu.Lock()
+		bundle, ok := f.secrets[strings.Join(parts[1:], "/")]
+		if !ok {
+			bundle, ok = f.secrets[parts[1]]
+		}
+		disabled := ok && bundle.ID != nil && f.certVersionDisabled(parts[1], path.Base(*bundle.ID))
+		f.mu.Unlock()
+		if !ok {
+			writeFakeKVError(w, http.StatusNotFound, "SecretNotFound")
+			return
+		}
+		if disabled {
+			// Disabled versions are forbidden, like in Key Vault
+			writeFakeKVError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+		writeFakeKVJSON(w, bundle)
+	case "secrets/set":
+		var params keyvault.SecretSetParameters
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil || r.Method != http.MethodPut || len(parts) != 2 {
+			writeFakeKVError(w, http.StatusBadRequest, "BadParameter")
+			return
+		}
+		bundle := keyvault.SecretBundle{Value: params.Value, ContentType: params.ContentType}
+		f.mu.Lock()
+		if f.secrets == nil {
+			f.secrets = make(map[string]keyvault.SecretBundle)
+		}
+		f.secrets[parts[1]] = bundle
+		f.mu.Unlock()
+		writeFakeKVJSON(w, bundle)
+	case "certificates/get":
+		bundle, ok := f.certs[strings.Join(parts[1:], "/")]
+		if !ok {
+			writeFakeKVError(w, http.StatusNotFound, "CertificateNotFound")
+			return
+		}
+		writeFakeKVJSON(w, bundle)
+	case "certificates/update":
+		var params keyvault.CertificateUpdateParameters
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil || len(parts) != 3 {
+			writeFakeKVError(w, http.StatusBadRequest, "BadParameter")
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for _, item := range f.certVersions[parts[1]] {
+			if strings.HasSuffix(*item.ID, "/"+parts[2]) {
+				item.Attributes.Enabled = params.CertificateAttributes.Enabled
+				writeFakeKVJSON(w, keyvault.CertificateBundle{ID: item.ID, Attributes: item.Attributes})
+				return
+			}
+		}
+		writeFakeKVError(w, http.StatusNotFound, "CertificateNotFound")
+	case "certificates/import":
+		var params keyvault.CertificateImportParameters
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			writeFakeKVError(w, http.StatusBadRequest, "BadParameter")
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.deletedCerts[parts[1]]; ok {
+			writeFakeKVError(w, http.StatusConflict, "Conflict")
+			return
+		}
+		f.imports = append(f.imports, params)
+		writeFakeKVJSON(w, keyvault.CertificateBundle{})
+	case "certificates/delete":
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		bundle, ok := f.certs[parts[1]]
+		if !ok {
+			writeFakeKVError(w, http.StatusNotFound, "CertificateNotFound")
+			return
+		}
+		deletedAt, purgeAt := date.UnixTime(time.Now()), date.UnixTime(time.Now().AddDate(0, 0, 90))
+		deleted := keyvault.DeletedCertificateBundle{
+			ID:                 bundle.ID,
+			Cer:                bundle.Cer,
+			Tags:               bundle.Tags,
+			Attributes:         bundle.Attributes,
+			DeletedDate:        &deletedAt,
+			ScheduledPurgeDate: &purgeAt,
+		}
+		if f.deletedCerts == nil {
+			f.deletedCerts = make(map[string]keyvault.DeletedCertificateBundle)
+		}
+		f.deletedCerts[parts[1]] = deleted
+		delete(f.certs, parts[1])
+		writeFakeKVJSON(w, fakeDeletedCert(deleted))
+	case "certificates/recover", "certificates/purge":
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		deleted, ok := f.deletedCerts[parts[1]]
+		if !ok {
+			writeFakeKVError(w, http.StatusNotFound, "CertificateNotFound")
+			return
+		}
+		delete(f.deletedCerts, parts[1])
+		if permission == "certificates/purge" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		bundle := keyvault.CertificateBundle{ID: deleted.ID, Cer: deleted.Cer, Tags: deleted.Tags, Attributes: deleted.Attributes}
+		f.certs[parts[1]] = bundle
+		writeFakeKVJSON(w, bundle)
+	default:
+		writeFakeKVError(w, http.StatusNotFound, "NotFound")
+	}
+}
+
+// certVersionDisabled returns true if the version of the certificate is
+// listed as disabled.
+func (f *fakeKeyVault) certVersionDisabled(name, version string) bool {
+	for _, item := range f.certVersions[name] {
+		if item.ID != nil && path.Base(*item.ID) == version {
+			return item.Attributes != nil && item.Attributes.Enabled != nil && !*item.Attributes.Enabled
+		}
+	}
+	return false
+}
+
+// fakeDeletedCert returns the JSON of a deleted certificate, including the
+// read-only dates which the SDK leaves out when marshalling.
+func fakeDeletedCert(bundle keyvault.DeletedCertificateBundle) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                 bundle.ID,
+		"cer":                bundle.Cer,
+		"tags":               bundle.Tags,
+		"attributes":         bundle.Attributes,
+		"deletedDate":        bundle.DeletedDate,
+		"scheduledPurgeDate": bundle.ScheduledPurgeDate,
+	}
+}
+
+// requestCount returns the number of requests whose method and path start
+// with prefix, e.g. "GET /secrets/".
+func (f *fakeKeyVault) requestCount(prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var n int
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func writeFakeKVJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeFakeKVError(w http.ResponseWriter, statusCode int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{"code": code, "message": code},
+	})
+}
+
+// newFakeKVStore returns a Store which sends all requests to handler,
+// regardless of the host in the URL.
+func newFakeKVStore(t *testing.T, handler http.Handler, opts ...StoreOption) *Store {
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+
+	tr := srv.Client().Transport.(*http.Transport).Clone()
+	tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	// The test server certificate is issued for example.com
+	tr.TLSClientConfig.ServerName = "example.com"
+
+	kv := keyvault.New()
+	kv.Sender = &http.Client{Transport: tr}
+	kv.Authorizer = autorest.NewBearerAuthorizer(&adal.Token{AccessToken: "token"})
+
+	return newStore(kv, credentialSourceCLI, opts...)
+}
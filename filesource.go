@@ -0,0 +1,324 @@
+package certmanager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay is how long to wait for more changes after a file has changed,
+// so that a certificate and key written one after the other are loaded
+// together.
+const reloadDelay = 100 * time.Millisecond
+
+// newWatcher creates the file system watcher used by FileSource.
+var newWatcher = fsnotify.NewWatcher
+
+// FileSource serves a certificate, key and CA bundle from files on disk, e.g.
+// as written by the download and gen signed-cert commands, and reloads them
+// when they change. This allows certificates to be rotated without
+// restarting.
+//
+// Changes are detected with file system notifications (inotify on Linux),
+// falling back to polling when notifications are not available. A changed
+// certificate is only used once it has been loaded together with a key that
+// matches it; until then, the previous certificate is kept.
+type FileSource struct {
+	certPath     string
+	keyPath      string
+	caPath       string
+	pollInterval time.Duration
+	onReload     func(err error)
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	caPool *x509.CertPool
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// FileSourceOption configures a FileSource.
+type FileSourceOption func(*FileSource)
+
+// WithPollInterval sets how often files are checked for changes when file
+// system notifications are not available, 30 seconds by default.
+func WithPollInterval(d time.Duration) FileSourceOption {
+	return func(s *FileSource) {
+		s.pollInterval = d
+	}
+}
+
+// WithReloadHook sets a function which is called after each attempt to
+// reload the files, with the error if the attempt failed.
+func WithReloadHook(f func(err error)) FileSourceOption {
+	return func(s *FileSource) {
+		s.onReload = f
+	}
+}
+
+// NewFileSource loads the PEM-encoded certificate chain at certPath, the key
+// at keyPath and, unless caPath is empty, the CA bundle at caPath, and starts
+// watching them for changes. Call Close to stop watching.
+func NewFileSource(certPath, keyPath, caPath string, opts ...FileSourceOption) (*FileSource, error) {
+	s := &FileSource{
+		certPath:     certPath,
+		keyPath:      keyPath,
+		caPath:       caPath,
+		pollInterval: 30 * time.Second,
+		done:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := s.watchDirs()
+	s.wg.Add(1)
+	if err != nil {
+		go s.poll()
+	} else {
+		go s.watch(watcher)
+	}
+	return s, nil
+}
+
+// Close stops watching the files.
+func (s *FileSource) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.wg.Wait()
+	return nil
+}
+
+// Reload loads the files. On failure, the previously loaded certificate and
+// CA bundle are kept.
+func (s *FileSource) Reload() error {
+	cert, caPool, err := s.load()
+	if err == nil {
+		s.mu.Lock()
+		s.cert = cert
+		s.caPool = caPool
+		s.mu.Unlock()
+	}
+	if s.onReload != nil {
+		s.onReload(err)
+	}
+	return err
+}
+
+func (s *FileSource) load() (*tls.Certificate, *x509.CertPool, error) {
+	certPEM, err := os.ReadFile(s.certPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read certificate, err: %w", err)
+	}
+	keyPEM, err := os.ReadFile(s.keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read key, err: %w", err)
+	}
+
+	// Fails unless the key matches the certificate
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load key pair, err: %w", err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse certificate, err: %w", err)
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return nil, nil, fmt.Errorf("certificate %v expired at %v", s.certPath, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	if s.caPath == "" {
+		return &cert, nil, nil
+	}
+	caPEM, err := os.ReadFile(s.caPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read CA bundle, err: %w", err)
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caPEM) {
+		return nil, nil, fmt.Errorf("no certificates found in %v", s.caPath)
+	}
+	return &cert, caPool, nil
+}
+
+// Certificate returns the current certificate.
+func (s *FileSource) Certificate() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert
+}
+
+// CAPool returns the current CA pool, or nil if no CA bundle was provided.
+func (s *FileSource) CAPool() *x509.CertPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.caPool
+}
+
+// GetCertificate returns the current certificate, to be used as
+// tls.Config.GetCertificate.
+func (s *FileSource) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.Certificate(), nil
+}
+
+// GetClientCertificate returns the current certificate, to be used as
+// tls.Config.GetClientCertificate.
+func (s *FileSource) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return s.Certificate(), nil
+}
+
+// ServerConfig returns a server TLS config which serves the current
+// certificate. If a CA bundle was provided, client certificates are required
+// and verified against the current CA pool.
+func (s *FileSource) ServerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			conf := &tls.Config{
+				GetCertificate: s.GetCertificate,
+				NextProtos:     []string{"h2", "http/1.1"},
+			}
+			if caPool := s.CAPool(); caPool != nil {
+				conf.ClientCAs = caPool
+				conf.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return conf, nil
+		},
+	}
+}
+
+// ClientConfig returns a client TLS config which presents the current
+// certificate and verifies that the server certificate was issued for
+// serverName by a CA in the current CA pool, or by a system root if no CA
+// bundle was provided.
+func (s *FileSource) ClientConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName:           serverName,
+		GetClientCertificate: s.GetClientCertificate,
+		// The server is verified against the current CA pool below, since
+		// RootCAs cannot be changed once the config is in use
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				DNSName:       serverName,
+				Roots:         s.CAPool(),
+				Intermediates: intermediates,
+			})
+			return err
+		},
+	}
+}
+
+// watchDirs watches the directories of the files, which also catches files
+// being replaced, e.g. when Kubernetes updates a mounted secret.
+func (s *FileSource) watchDirs() (*fsnotify.Watcher, error) {
+	watcher, err := newWatcher()
+	if err != nil {
+		return nil, err
+	}
+	dirs := make(map[string]bool)
+	for _, path := range []string{s.certPath, s.keyPath, s.caPath} {
+		if path == "" {
+			continue
+		}
+		dir := filepath.Dir(path)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	return watcher, nil
+}
+
+func (s *FileSource) watch(watcher *fsnotify.Watcher) {
+	defer s.wg.Done()
+	defer watcher.Close()
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-s.done:
+			return
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if reload == nil {
+				reload = time.After(reloadDelay)
+			}
+		case _, ok := <-watcher.Errors:
+			// Errors are reported by the reloads which follow them
+			if !ok {
+				return
+			}
+		case <-reload:
+			reload = nil
+			_ = s.Reload()
+		}
+	}
+}
+
+func (s *FileSource) poll() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	last := s.stat()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			current := s.stat()
+			if current != last {
+				last = current
+				_ = s.Reload()
+			}
+		}
+	}
+}
+
+// fileStat identifies a version of a file.
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+func (s *FileSource) stat() [3]fileStat {
+	var stats [3]fileStat
+	for i, path := range []string{s.certPath, s.keyPath, s.caPath} {
+		if path == "" {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil {
+			stats[i] = fileStat{modTime: fi.ModTime(), size: fi.Size()}
+		}
+	}
+	return stats
+}
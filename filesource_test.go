@@ -0,0 +1,139 @@
+package certmanager
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// writeTestCertFiles issues a certificate for localhost and writes it and its
+// key to dir as tls.crt and tls.key.
+func writeTestCertFiles(t *testing.T, dir string, caCert *x509.Certificate, caKey *rsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+	cert, key, err := GenSignedCert(caCert, caKey, "localhost", []string{"localhost"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(dir, "tls.key"), pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	writeTestFile(t, filepath.Join(dir, "tls.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	return cert
+}
+
+// writeTestFile atomically replaces the file at path.
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		polling bool
+	}{
+		{"notify", false},
+		{"polling", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.polling {
+				newWatcher = func() (*fsnotify.Watcher, error) { return nil, errors.New("not supported") }
+				defer func() { newWatcher = fsnotify.NewWatcher }()
+			}
+
+			caCert, caKey, err := GenSelfSignedCA("test-ca", time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := t.TempDir()
+			caPath := filepath.Join(dir, "ca.crt")
+			writeTestFile(t, caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}))
+			first := writeTestCertFiles(t, dir, caCert, caKey)
+
+			reloaded := make(chan error, 16)
+			s, err := NewFileSource(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), caPath,
+				WithPollInterval(10*time.Millisecond),
+				WithReloadHook(func(err error) { reloaded <- err }),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			<-reloaded
+			if !s.Certificate().Leaf.Equal(first) {
+				t.Fatal("initial certificate was not loaded")
+			}
+
+			// The server and client configs use the current files
+			serverErr, clientErr := handshake(t, s.ServerConfig(), s.ClientConfig("localhost"))
+			if serverErr != nil || clientErr != nil {
+				t.Fatalf("handshake failed, server err: %v, client err: %v", serverErr, clientErr)
+			}
+
+			// A certificate which does not match the key is not loaded
+			other, _, err := GenSignedCert(caCert, caKey, "localhost", nil, time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, filepath.Join(dir, "tls.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.Raw}))
+			select {
+			case err := <-reloaded:
+				if err == nil {
+					t.Fatal("want error for mismatched key pair")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("files were not reloaded")
+			}
+			if !s.Certificate().Leaf.Equal(first) {
+				t.Fatal("certificate was replaced by a mismatched one")
+			}
+
+			// A new pair is loaded
+			second := writeTestCertFiles(t, dir, caCert, caKey)
+			deadline := time.After(5 * time.Second)
+			for !s.Certificate().Leaf.Equal(second) {
+				select {
+				case <-reloaded:
+				case <-deadline:
+					t.Fatal("new certificate was not loaded")
+				}
+			}
+		})
+	}
+}
+
+func TestNewFileSource_invalid(t *testing.T) {
+	caCert, caKey, err := GenSelfSignedCA("test-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	writeTestCertFiles(t, dir, caCert, caKey)
+	writeTestFile(t, filepath.Join(dir, "empty.crt"), nil)
+
+	for _, tc := range []struct {
+		name   string
+		caPath string
+	}{
+		{"missing ca", filepath.Join(dir, "missing.crt")},
+		{"empty ca", filepath.Join(dir, "empty.crt")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewFileSource(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), tc.caPath)
+			if err == nil {
+				t.Fatal("want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// Package grpccreds provides gRPC transport credentials for mTLS with
+// certificates issued by a CA in the certificate store.
+//
+// Certificates are issued on creation and renewed in the background before
+// they expire, so that long-running services keep working without restarts.
+package grpccreds
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"google.golang.org/grpc/credentials"
+)
+
+// renewTimeout caps the time spent renewing a certificate in the background.
+const renewTimeout = 30 * time.Second
+
+// Option configures the credentials.
+type Option func(*options)
+
+type options struct {
+	store      *certmanager.Store
+	caPassword string
+	validity   time.Duration
+	mtlsOpts   []certmanager.MTLSOption
+}
+
+// WithStore sets the Store used to retrieve the CA. By default, the store
+// shared by the package-level functions of certmanager is used.
+func WithStore(s *certmanager.Store) Option {
+	return func(o *options) {
+		o.store = s
+	}
+}
+
+// WithCAPassword sets the password of the CA certificate.
+func WithCAPassword(password string) Option {
+	return func(o *options) {
+		o.caPassword = password
+	}
+}
+
+// WithValidity sets how long issued certificates are valid, 24 hours by
+// default. Certificates are renewed once less than a third of the validity
+// remains.
+func WithValidity(d time.Duration) Option {
+	return func(o *options) {
+		o.validity = d
+	}
+}
+
+// WithMTLSOptions passes options to certmanager.GetMTLSServerConfig and
+// certmanager.GetMTLSClientConfig, e.g. certmanager.WithSPIFFEID.
+func WithMTLSOptions(opts ...certmanager.MTLSOption) Option {
+	return func(o *options) {
+		o.mtlsOpts = append(o.mtlsOpts, opts...)
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{validity: 24 * time.Hour}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// NewServerCredentials returns server transport credentials which require and
+// verify client certificates signed by the CA found at caURL. The server
+// certificate is issued for hostname and altNames.
+func NewServerCredentials(
+	ctx context.Context,
+	caURL string,
+	hostname string,
+	altNames []string,
+	opts ...Option,
+) (credentials.TransportCredentials, error) {
+	o := newOptions(opts)
+	issue := func(ctx context.Context, expiresAt time.Time) (*tls.Config, error) {
+		if o.store != nil {
+			return o.store.GetMTLSServerConfig(ctx, caURL, o.caPassword, hostname, altNames, expiresAt, o.mtlsOpts...)
+		}
+		return certmanager.GetMTLSServerConfig(ctx, caURL, o.caPassword, hostname, altNames, expiresAt, o.mtlsOpts...)
+	}
+	return newServerCredentials(ctx, issue, o.validity)
+}
+
+// NewClientCredentials returns client transport credentials which present a
+// client certificate for clientName, signed by the CA found at caURL, and
+// verify that the server certificate was issued for serverName by the CA.
+func NewClientCredentials(
+	ctx context.Context,
+	caURL string,
+	clientName string,
+	serverName string,
+	opts ...Option,
+) (credentials.TransportCredentials, error) {
+	o := newOptions(opts)
+	issue := func(ctx context.Context, expiresAt time.Time) (*tls.Config, error) {
+		if o.store != nil {
+			return o.store.GetMTLSClientConfig(ctx, caURL, o.caPassword, clientName, serverName, expiresAt, o.mtlsOpts...)
+		}
+		return certmanager.GetMTLSClientConfig(ctx, caURL, o.caPassword, clientName, serverName, expiresAt, o.mtlsOpts...)
+	}
+	return newClientCredentials(ctx, issue, o.validity)
+}
+
+func newServerCredentials(ctx context.Context, issue issueFunc, validity time.Duration) (credentials.TransportCredentials, error) {
+	r, err := newRotator(ctx, issue, validity)
+	if err != nil {
+		return nil, err
+	}
+
+	// The whole config is replaced on renewal so that a renewed CA is also
+	// trusted for client certificates
+	return credentials.NewTLS(&tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current()
+		},
+	}), nil
+}
+
+func newClientCredentials(ctx context.Context, issue issueFunc, validity time.Duration) (credentials.TransportCredentials, error) {
+	r, err := newRotator(ctx, issue, validity)
+	if err != nil {
+		return nil, err
+	}
+	return clientCredentials(r)
+}
+
+// clientCredentials returns client credentials which take the certificate
+// and the trusted CAs from the current config of r on each handshake, since
+// a client config cannot be replaced as a whole like a server config.
+func clientCredentials(r *rotator) (credentials.TransportCredentials, error) {
+	conf, err := r.current()
+	if err != nil {
+		return nil, err
+	}
+	conf = conf.Clone()
+	conf.Certificates = nil
+	conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		conf, err := r.current()
+		if err != nil {
+			return nil, err
+		}
+		return &conf.Certificates[0], nil
+	}
+
+	// The server is verified in VerifyConnection instead, against the CAs
+	// trusted by the current config
+	conf.RootCAs = nil
+	conf.InsecureSkipVerify = true
+	conf.VerifyPeerCertificate = nil
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		conf, err := r.current()
+		if err != nil {
+			return err
+		}
+		return verifyServer(conf, cs)
+	}
+	return credentials.NewTLS(conf), nil
+}
+
+// verifyServer verifies the certificate of the server as the client config
+// conf would have.
+func verifyServer(conf *tls.Config, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+	if conf.VerifyPeerCertificate != nil {
+		// The server is verified by its SPIFFE ID
+		rawCerts := make([][]byte, 0, len(cs.PeerCertificates))
+		for _, cert := range cs.PeerCertificates {
+			rawCerts = append(rawCerts, cert.Raw)
+		}
+		return conf.VerifyPeerCertificate(rawCerts, nil)
+	}
+	if conf.InsecureSkipVerify {
+		return nil
+	}
+
+	serverName := conf.ServerName
+	if serverName == "" {
+		serverName = cs.ServerName
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         conf.RootCAs,
+		Intermediates: intermediates,
+		DNSName:       serverName,
+	})
+	return err
+}
+
+// issueFunc issues a TLS config with a certificate which expires at
+// expiresAt.
+type issueFunc func(ctx context.Context, expiresAt time.Time) (*tls.Config, error)
+
+// rotator keeps a TLS config with a valid certificate, renewing it once less
+// than a third of its validity remains.
+type rotator struct {
+	issue    issueFunc
+	validity time.Duration
+
+	mu       sync.Mutex
+	conf     *tls.Config
+	renewAt  time.Time
+	expires  time.Time
+	renewing bool
+}
+
+func newRotator(ctx context.Context, issue issueFunc, validity time.Duration) (*rotator, error) {
+	r := &rotator{issue: issue, validity: validity}
+	if err := r.renew(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// current returns the current config. An expired certificate is renewed
+// before returning, while a certificate which is about to expire is renewed in
+// the background.
+func (r *rotator) current() (*tls.Config, error) {
+	now := time.Now()
+
+	r.mu.Lock()
+	conf, renewAt, expires := r.conf, r.renewAt, r.expires
+	renewInBackground := now.After(renewAt) && now.Before(expires) && !r.renewing
+	if renewInBackground {
+		r.renewing = true
+	}
+	r.mu.Unlock()
+
+	if !now.Before(expires) {
+		ctx, cancel := context.WithTimeout(context.Background(), renewTimeout)
+		defer cancel()
+		if err := r.renew(ctx); err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		conf = r.conf
+		r.mu.Unlock()
+		return conf, nil
+	}
+
+	if renewInBackground {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), renewTimeout)
+			defer cancel()
+			// On failure, the current certificate is kept and renewal is
+			// retried on the next handshake
+			_ = r.renew(ctx)
+			r.mu.Lock()
+			r.renewing = false
+			r.mu.Unlock()
+		}()
+	}
+	return conf, nil
+}
+
+func (r *rotator) renew(ctx context.Context) error {
+	conf, err := r.issue(ctx, time.Now().Add(r.validity))
+	if err != nil {
+		return err
+	}
+	if len(conf.Certificates) == 0 || len(conf.Certificates[0].Certificate) == 0 {
+		return errors.New("issued config contains no certificate")
+	}
+	leaf, err := x509.ParseCertificate(conf.Certificates[0].Certificate[0])
+	if err != nil {
+		return err
+	}
+	conf.NextProtos = []string{"h2"}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conf = conf
+	r.expires = leaf.NotAfter
+	r.renewAt = leaf.NotAfter.Add(-leaf.NotAfter.Sub(leaf.NotBefore) / 3)
+	return nil
+}
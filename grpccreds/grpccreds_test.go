@@ -0,0 +1,328 @@
+package grpccreds
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// testCA issues TLS configs the same way as certmanager.GetMTLSServerConfig
+// and certmanager.GetMTLSClientConfig, without a store.
+type testCA struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) testCA {
+	t.Helper()
+	cert, key, err := certmanager.GenSelfSignedCA("test-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{cert: cert, key: key}
+}
+
+func (ca testCA) issue(commonName string, sans []string, server bool) issueFunc {
+	return func(ctx context.Context, expiresAt time.Time) (*tls.Config, error) {
+		cert, key, err := certmanager.GenSignedCert(ca.cert, ca.key, commonName, sans, expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		tlsCert, err := certmanager.TLSCertificate([]*x509.Certificate{cert, ca.cert}, key)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		if server {
+			return &tls.Config{
+				ClientCAs:    pool,
+				Certificates: []tls.Certificate{tlsCert},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+			}, nil
+		}
+		return &tls.Config{
+			ServerName:   "localhost",
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{tlsCert},
+		}, nil
+	}
+}
+
+// serve starts a gRPC health server and returns its address and the
+// identities seen by its interceptors.
+func serve(t *testing.T, creds credentials.TransportCredentials) (string, func() []Identity) {
+	t.Helper()
+	var mu sync.Mutex
+	var ids []Identity
+	record := func(ctx context.Context) {
+		id, _ := IdentityFromContext(ctx)
+		mu.Lock()
+		ids = append(ids, id)
+		mu.Unlock()
+	}
+
+	srv := grpc.NewServer(
+		grpc.Creds(creds),
+		grpc.ChainUnaryInterceptor(UnaryServerInterceptor(),
+			func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				record(ctx)
+				return handler(ctx, req)
+			}),
+		grpc.ChainStreamInterceptor(StreamServerInterceptor(),
+			func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				record(ss.Context())
+				return handler(srv, ss)
+			}),
+	)
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(srv.Stop)
+
+	return ln.Addr().String(), func() []Identity {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]Identity{}, ids...)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	ca := newTestCA(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	serverCreds, err := newServerCredentials(ctx, ca.issue("localhost", []string{"localhost"}, true), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, identities := serve(t, serverCreds)
+
+	clientCreds, err := newClientCredentials(ctx, ca.issue("client", []string{"spiffe://example.org/client"}, false), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(clientCreds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := identities()
+	if len(ids) != 2 {
+		t.Fatalf("want 2 identities, got %v", len(ids))
+	}
+	for _, id := range ids {
+		if id.CommonName != "client" {
+			t.Errorf("want common name client, got %v", id.CommonName)
+		}
+		if id.SPIFFEID == nil || id.SPIFFEID.String() != "spiffe://example.org/client" {
+			t.Errorf("want SPIFFE ID spiffe://example.org/client, got %v", id.SPIFFEID)
+		}
+	}
+}
+
+func TestCredentials_noClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	serverCreds, err := newServerCredentials(ctx, ca.issue("localhost", []string{"localhost"}, true), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, identities := serve(t, serverCreds)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+		ServerName: "localhost",
+		RootCAs:    pool,
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("want %v, got %v", codes.Unavailable, err)
+	}
+	if ids := identities(); len(ids) != 0 {
+		t.Errorf("want no identities, got %v", ids)
+	}
+}
+
+func TestUnaryServerInterceptor_noTLS(t *testing.T) {
+	_, err := UnaryServerInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			t.Fatal("handler was called")
+			return nil, nil
+		})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("want %v, got %v", codes.Unauthenticated, err)
+	}
+}
+
+func Test_rotator(t *testing.T) {
+	ca := newTestCA(t)
+	var mu sync.Mutex
+	var calls int
+	issue := ca.issue("localhost", []string{"localhost"}, true)
+	countingIssue := func(ctx context.Context, expiresAt time.Time) (*tls.Config, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return issue(ctx, expiresAt)
+	}
+	getCalls := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+
+	r, err := newRotator(context.Background(), countingIssue, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.current(); err != nil {
+		t.Fatal(err)
+	}
+	if n := getCalls(); n != 1 {
+		t.Fatalf("want 1 issued certificate, got %v", n)
+	}
+
+	// Renewal is due, the current config is returned while renewing
+	r.mu.Lock()
+	old := r.conf
+	r.renewAt = time.Now().Add(-time.Minute)
+	r.mu.Unlock()
+	conf, err := r.current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf != old {
+		t.Errorf("want current config while renewing in the background")
+	}
+	for deadline := time.Now().Add(5 * time.Second); getCalls() != 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate was not renewed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// An expired certificate is renewed before returning
+	r.mu.Lock()
+	for r.renewing {
+		r.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		r.mu.Lock()
+	}
+	old = r.conf
+	r.expires = time.Now().Add(-time.Minute)
+	r.mu.Unlock()
+	conf, err = r.current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf == old || getCalls() != 3 {
+		t.Errorf("want a renewed config, got %v issued certificates", getCalls())
+	}
+}
+
+func TestCredentials_clientCARotation(t *testing.T) {
+	oldCA, newCA := newTestCA(t), newTestCA(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The server has moved on to the new CA
+	serverCreds, err := newServerCredentials(ctx, newCA.issue("localhost", []string{"localhost"}, true), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := serve(t, serverCreds)
+
+	// The client trusts the CA it was issued by at the time
+	var mu sync.Mutex
+	clientCA := oldCA
+	issue := func(ctx context.Context, expiresAt time.Time) (*tls.Config, error) {
+		mu.Lock()
+		ca := clientCA
+		mu.Unlock()
+		return ca.issue("client", nil, false)(ctx, expiresAt)
+	}
+	r, err := newRotator(ctx, issue, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCreds, err := clientCredentials(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func() error {
+		conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(clientCreds))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		return err
+	}
+
+	if err := check(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("want %v before the client trusts the new CA, got %v", codes.Unavailable, err)
+	}
+
+	// The renewed config trusts the new CA, without new credentials
+	mu.Lock()
+	clientCA = newCA
+	mu.Unlock()
+	r.mu.Lock()
+	r.expires = time.Now().Add(-time.Minute)
+	r.mu.Unlock()
+	if err := check(); err != nil {
+		t.Fatalf("want the renewed CA to be trusted, err: %v", err)
+	}
+}
+
+func TestPeerIdentity_unverified(t *testing.T) {
+	ca := newTestCA(t)
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{ca.cert},
+		}},
+	})
+	if _, err := PeerIdentity(ctx); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("want %v for an unverified certificate, got %v", codes.Unauthenticated, err)
+	}
+}
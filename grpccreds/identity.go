@@ -0,0 +1,107 @@
+package grpccreds
+
+import (
+	"context"
+	"crypto/x509"
+	"net/url"
+
+	"github.com/sebnyberg/certmanager"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Identity is the identity of an authenticated peer, taken from its verified
+// certificate.
+type Identity struct {
+	CommonName string
+	DNSNames   []string
+	URIs       []*url.URL
+
+	// SPIFFEID is the SPIFFE ID of the peer, or nil if the certificate is not
+	// an X.509-SVID.
+	SPIFFEID *url.URL
+
+	Certificate *x509.Certificate
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the identity of the peer stored in the context
+// by UnaryServerInterceptor or StreamServerInterceptor.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// PeerIdentity returns the identity of the peer of a gRPC call from its
+// verified TLS certificate. Peers whose certificate was not verified, e.g.
+// because the server does not require client certificates, are rejected.
+func PeerIdentity(ctx context.Context) (Identity, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return Identity{}, status.Error(codes.Unauthenticated, "no peer found")
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return Identity{}, status.Error(codes.Unauthenticated, "peer did not connect over TLS")
+	}
+	if len(tlsInfo.State.PeerCertificates) == 0 {
+		return Identity{}, status.Error(codes.Unauthenticated, "peer presented no certificate")
+	}
+	if len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return Identity{}, status.Error(codes.Unauthenticated, "peer certificate was not verified")
+	}
+
+	cert := tlsInfo.State.VerifiedChains[0][0]
+	id := Identity{
+		CommonName:  cert.Subject.CommonName,
+		DNSNames:    cert.DNSNames,
+		URIs:        cert.URIs,
+		Certificate: cert,
+	}
+	if spiffeID, err := certmanager.SPIFFEID(cert); err == nil {
+		id.SPIFFEID = spiffeID
+	}
+	return id, nil
+}
+
+// UnaryServerInterceptor stores the identity of the peer in the context of
+// each call, see IdentityFromContext. Calls from peers without a verified
+// certificate are rejected with codes.Unauthenticated.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		id, err := PeerIdentity(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(context.WithValue(ctx, identityKey{}, id), req)
+	}
+}
+
+// StreamServerInterceptor stores the identity of the peer in the context of
+// each stream, see IdentityFromContext. Streams from peers without a verified
+// certificate are rejected with codes.Unauthenticated.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		id, err := PeerIdentity(ss.Context())
+		if err != nil {
+			return err
+		}
+		return handler(srv, &identityStream{
+			ServerStream: ss,
+			ctx:          context.WithValue(ss.Context(), identityKey{}, id),
+		})
+	}
+}
+
+type identityStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *identityStream) Context() context.Context {
+	return s.ctx
+}
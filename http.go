@@ -0,0 +1,193 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// NewMTLSHTTPClient returns an HTTP client which authenticates with a newly
+// issued client certificate signed by the CA found at caURL, and only trusts
+// servers with certificates signed by the same CA. See GetMTLSClientConfig.
+func NewMTLSHTTPClient(
+	ctx context.Context,
+	caURL string,
+	caPassword string,
+	clientName string,
+	serverName string,
+	expiresAt time.Time,
+	opts ...MTLSOption,
+) (*http.Client, error) {
+	s, err := getDefaultStore()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.NewMTLSHTTPClient(ctx, caURL, caPassword, clientName, serverName, expiresAt, opts...)
+}
+
+// NewMTLSHTTPClient returns an HTTP client which authenticates with a newly
+// issued client certificate signed by the CA found at caURL, and only trusts
+// servers with certificates signed by the same CA. See GetMTLSClientConfig.
+func (s *Store) NewMTLSHTTPClient(
+	ctx context.Context,
+	caURL string,
+	caPassword string,
+	clientName string,
+	serverName string,
+	expiresAt time.Time,
+	opts ...MTLSOption,
+) (*http.Client, error) {
+	tlsConf, err := s.GetMTLSClientConfig(ctx, caURL, caPassword, clientName, serverName, expiresAt, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConf
+	return &http.Client{Transport: transport}, nil
+}
+
+// NewMTLSHTTPServer returns an HTTP server which requires and verifies client
+// certificates signed by the CA found at caURL. See GetMTLSServerConfig.
+//
+// The server should be started with ListenAndServeTLS("", ""). Wrap handler
+// with RequireClientCert to authorize clients by their certificate.
+func NewMTLSHTTPServer(
+	ctx context.Context,
+	addr string,
+	handler http.Handler,
+	caURL string,
+	caPassword string,
+	hostname string,
+	altNames []string,
+	expiresAt time.Time,
+	opts ...MTLSOption,
+) (*http.Server, error) {
+	s, err := getDefaultStore()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.NewMTLSHTTPServer(ctx, addr, handler, caURL, caPassword, hostname, altNames, expiresAt, opts...)
+}
+
+// NewMTLSHTTPServer returns an HTTP server which requires and verifies client
+// certificates signed by the CA found at caURL. See GetMTLSServerConfig.
+//
+// The server should be started with ListenAndServeTLS("", ""). Wrap handler
+// with RequireClientCert to authorize clients by their certificate.
+func (s *Store) NewMTLSHTTPServer(
+	ctx context.Context,
+	addr string,
+	handler http.Handler,
+	caURL string,
+	caPassword string,
+	hostname string,
+	altNames []string,
+	expiresAt time.Time,
+	opts ...MTLSOption,
+) (*http.Server, error) {
+	tlsConf, err := s.GetMTLSServerConfig(ctx, caURL, caPassword, hostname, altNames, expiresAt, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		TLSConfig:         tlsConf,
+		ReadHeaderTimeout: 10 * time.Second,
+	}, nil
+}
+
+// ClientAllowlist lists the clients authorized by RequireClientCert. A client
+// is authorized if its certificate matches any of the entries.
+type ClientAllowlist struct {
+	// CommonNames are authorized subject common names.
+	CommonNames []string
+
+	// SANPatterns are authorized DNS names. A pattern may start with a
+	// wildcard label which matches exactly one label, e.g. *.example.com
+	// matches api.example.com but not example.com or a.b.example.com.
+	SANPatterns []string
+
+	// SPIFFEIDs are authorized SPIFFE IDs, e.g. spiffe://example.org/api.
+	SPIFFEIDs []string
+}
+
+// Authorize returns an error if the certificate matches none of the entries.
+func (l ClientAllowlist) Authorize(cert *x509.Certificate) error {
+	for _, cn := range l.CommonNames {
+		if cert.Subject.CommonName == cn {
+			return nil
+		}
+	}
+	for _, pattern := range l.SANPatterns {
+		for _, name := range cert.DNSNames {
+			if matchDNSPattern(pattern, name) {
+				return nil
+			}
+		}
+	}
+	if len(l.SPIFFEIDs) > 0 {
+		if id, err := SPIFFEID(cert); err == nil {
+			for _, allowed := range l.SPIFFEIDs {
+				if id.String() == allowed {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("client %v is not authorized", cert.Subject.CommonName)
+}
+
+// RequireClientCert returns a middleware which only passes on requests from
+// clients which presented a verified certificate that is authorized by the
+// allowlist. Other requests are rejected with 403 Forbidden.
+//
+// The server must verify client certificates, e.g. by using the config from
+// GetMTLSServerConfig.
+func RequireClientCert(allowlist ClientAllowlist) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cert, err := verifiedClientCert(r)
+			if err == nil {
+				err = allowlist.Authorize(cert)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// verifiedClientCert returns the client certificate of the request if it was
+// verified during the TLS handshake.
+func verifiedClientCert(r *http.Request) (*x509.Certificate, error) {
+	if r.TLS == nil {
+		return nil, errors.New("request was not made over TLS")
+	}
+	if len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, errors.New("client presented no verified certificate")
+	}
+	return r.TLS.VerifiedChains[0][0], nil
+}
+
+// matchDNSPattern reports whether name matches pattern, see
+// ClientAllowlist.SANPatterns.
+func matchDNSPattern(pattern, name string) bool {
+	pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+	if !strings.HasPrefix(pattern, "*.") {
+		return pattern == name
+	}
+	suffix := pattern[1:]
+	label := strings.TrimSuffix(name, suffix)
+	return label != name && label != "" && !strings.Contains(label, ".")
+}
@@ -0,0 +1,152 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+)
+
+func TestClientAllowlist_Authorize(t *testing.T) {
+	caCert, caKey, err := GenSelfSignedCA("test-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _, err := GenSignedCert(caCert, caKey, "client", []string{"api.example.com", "spiffe://example.org/client"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		allowlist ClientAllowlist
+		wantErr   bool
+	}{
+		{"empty", ClientAllowlist{}, true},
+		{"common name", ClientAllowlist{CommonNames: []string{"other", "client"}}, false},
+		{"other common name", ClientAllowlist{CommonNames: []string{"other"}}, true},
+		{"san", ClientAllowlist{SANPatterns: []string{"api.example.com"}}, false},
+		{"san wildcard", ClientAllowlist{SANPatterns: []string{"*.example.com"}}, false},
+		{"san wildcard too deep", ClientAllowlist{SANPatterns: []string{"*.com"}}, true},
+		{"san wildcard apex", ClientAllowlist{SANPatterns: []string{"*.api.example.com"}}, true},
+		{"spiffe id", ClientAllowlist{SPIFFEIDs: []string{"spiffe://example.org/client"}}, false},
+		{"other spiffe id", ClientAllowlist{SPIFFEIDs: []string{"spiffe://example.org/other"}}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.allowlist.Authorize(cert); (err != nil) != tc.wantErr {
+				t.Errorf("want err: %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	caCert, caKey, err := GenSelfSignedCA("test-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _, err := GenSignedCert(caCert, caKey, "client", nil, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := RequireClientCert(ClientAllowlist{CommonNames: []string{"client"}})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	for _, tc := range []struct {
+		name       string
+		state      *tls.ConnectionState
+		wantStatus int
+	}{
+		{"no tls", nil, http.StatusForbidden},
+		{"no certificate", &tls.ConnectionState{}, http.StatusForbidden},
+		{"unverified certificate", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, http.StatusForbidden},
+		{"verified certificate", &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert, caCert}},
+		}, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.TLS = tc.state
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tc.wantStatus {
+				t.Errorf("want status %v, got %v", tc.wantStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestStore_NewMTLSHTTPServer(t *testing.T) {
+	caCert, caKey, err := GenSelfSignedCA("test-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBundle, err := encodePEMBundle(caCert, nil, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strPtr := func(s string) *string { return &s }
+	s := newFakeKVStore(t, &fakeKeyVault{
+		permissions: map[string]bool{"secrets/get": true},
+		secrets: map[string]keyvault.SecretBundle{
+			"ca": {Value: strPtr(string(pemBundle)), ContentType: strPtr(contentTypePEM)},
+		},
+	})
+	caURL := "https://test.vault.azure.net/secrets/ca"
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Hour)
+
+	handler := RequireClientCert(ClientAllowlist{CommonNames: []string{"client"}})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("hello " + r.TLS.PeerCertificates[0].Subject.CommonName))
+		}),
+	)
+	srv, err := s.NewMTLSHTTPServer(ctx, "", handler, caURL, "", "localhost", []string{"localhost"}, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.ServeTLS(ln, "", "") }()
+	defer srv.Close()
+	url := "https://" + ln.Addr().String()
+
+	for _, tc := range []struct {
+		clientName string
+		wantStatus int
+	}{
+		{"client", http.StatusOK},
+		{"other", http.StatusForbidden},
+	} {
+		t.Run(tc.clientName, func(t *testing.T) {
+			client, err := s.NewMTLSHTTPClient(ctx, caURL, "", tc.clientName, "localhost", expiresAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Timeout = 10 * time.Second
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("want status %v, got %v: %s", tc.wantStatus, resp.StatusCode, body)
+			}
+			if tc.wantStatus == http.StatusOK && string(body) != "hello client" {
+				t.Errorf("want body 'hello client', got %q", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package issueserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+)
+
+// Request requests a certificate from the server at serverURL, e.g.
+// https://issuer.example.com:8444. The client authenticates with token
+// unless it is empty, in which case httpClient should present a client
+// certificate.
+func Request(ctx context.Context, httpClient *http.Client, serverURL string, token string, req IssueRequest) (*IssueResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(serverURL, "/")+"/v1/certificates", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxRequestSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp errorResponse
+		if err := json.Unmarshal(respBody, &errResp); err != nil || errResp.Error == "" {
+			return nil, fmt.Errorf("request failed with status %v", resp.Status)
+		}
+		return nil, fmt.Errorf("request failed with status %v: %v", resp.Status, errResp.Error)
+	}
+
+	var issued IssueResponse
+	if err := json.Unmarshal(respBody, &issued); err != nil {
+		return nil, fmt.Errorf("failed to parse response, err: %v", err)
+	}
+	return &issued, nil
+}
+
+// FetchCA fetches the CA certificate of the server at serverURL before it is
+// trusted, e.g. when enrolling with a token, and returns it if its SHA-256
+// fingerprint matches. See certmanager.EnrollmentToken.RootFingerprint.
+func FetchCA(ctx context.Context, serverURL string, fingerprint string) (*x509.Certificate, error) {
+	// The server cannot be verified yet, the fingerprint is verified instead
+	httpClient := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(serverURL, "/")+"/v1/ca", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed with status %v", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRequestSize))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("server did not return a CA certificate with fingerprint %v", fingerprint)
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(certmanager.Fingerprint(cert), fingerprint) {
+			return cert, nil
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package issueserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+)
+
+// TokenLedger records which enrollment tokens have been used, so that each
+// token is only accepted once.
+type TokenLedger interface {
+	// Use records that the token with the ID was used, or returns an error
+	// matching certmanager.ErrTokenUsed if it already was. The record may be
+	// dropped once the token has expired.
+	Use(id string, expiresAt time.Time) error
+}
+
+// FileLedger is a TokenLedger which persists used tokens to a JSON file, so
+// that tokens cannot be replayed after a restart. Expired tokens are pruned
+// from the file.
+type FileLedger struct {
+	path string
+	mu   sync.Mutex
+	used map[string]time.Time
+	now  func() time.Time
+}
+
+// NewFileLedger returns a ledger backed by the file at path, which is
+// created on first use.
+func NewFileLedger(path string) (*FileLedger, error) {
+	l := &FileLedger{
+		path: path,
+		used: make(map[string]time.Time),
+		now:  time.Now,
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read used tokens, err: %v", err)
+	}
+	if err := json.Unmarshal(data, &l.used); err != nil {
+		return nil, fmt.Errorf("failed to parse used tokens, err: %v", err)
+	}
+	return l, nil
+}
+
+// Use implements TokenLedger. The token is only recorded as used once the
+// file has been written.
+func (l *FileLedger) Use(id string, expiresAt time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.used[id]; ok {
+		return certmanager.ErrTokenUsed
+	}
+
+	used := make(map[string]time.Time, len(l.used)+1)
+	now := l.now()
+	for usedID, exp := range l.used {
+		if now.Before(exp) {
+			used[usedID] = exp
+		}
+	}
+	used[id] = expiresAt
+	if err := l.write(used); err != nil {
+		return err
+	}
+	l.used = used
+	return nil
+}
+
+// write replaces the file atomically.
+func (l *FileLedger) write(used map[string]time.Time) error {
+	data, err := json.MarshalIndent(used, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), "."+filepath.Base(l.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write used tokens, err: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write used tokens, err: %v", err)
+	}
+	return nil
+}
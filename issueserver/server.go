@@ -0,0 +1,451 @@
+// Package issueserver implements an HTTP service which holds a certificate
+// authority (CA) and issues short-lived certificates to authenticated
+// clients, so that clients do not need read access to the CA secret in the
+// store.
+//
+// Clients authenticate with a bearer token or a client certificate, and may
+// only request the names allowed by their policy. Certificates are requested
+// with a POST to /v1/certificates, either by sending a certificate signing
+// request (CSR) or by letting the server generate the key. The CA
+// certificates to trust are served at /v1/ca.
+//
+// New workloads may instead authenticate with a single-use enrollment token
+// signed by the CA, see certmanager.NewEnrollmentToken and WithEnrollment,
+// to obtain their first certificate.
+package issueserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+)
+
+// maxRequestSize limits the size of request bodies.
+const maxRequestSize = 64 << 10
+
+// Key types which can be generated by the server.
+const (
+	KeyTypeEC  = "ec"
+	KeyTypeRSA = "rsa"
+)
+
+// Client is a client which may request certificates.
+type Client struct {
+	// Name identifies the client in logs.
+	Name string
+
+	// TokenHash is the SHA-256 hash of the bearer token which authenticates
+	// the client. See HashToken.
+	TokenHash [sha256.Size]byte
+
+	// Certificate authorizes clients which present a verified client
+	// certificate, e.g. to renew a certificate issued by the server. An
+	// empty allowlist matches no certificate.
+	Certificate certmanager.ClientAllowlist
+
+	// Policy restricts the certificates the client may request. The zero
+	// policy allows any name, so it should at least set AllowedNames.
+	Policy certmanager.Policy
+}
+
+// HashToken returns the hash of a bearer token, see Client.TokenHash.
+func HashToken(token string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(token))
+}
+
+// Server issues certificates signed by a CA. It implements http.Handler and
+// should be served over HTTPS, see TLSConfig.
+type Server struct {
+	caCert      *x509.Certificate
+	caChain     []*x509.Certificate
+	caRoot      *x509.Certificate
+	caKey       crypto.Signer
+	clients     []Client
+	maxValidity time.Duration
+	ledger      TokenLedger
+	logger      *log.Logger
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithMaxValidity sets how long issued certificates are valid at most, 24
+// hours by default. Requests without a validity get the maximum.
+// Certificates never outlive the CA.
+func WithMaxValidity(d time.Duration) Option {
+	return func(s *Server) {
+		s.maxValidity = d
+	}
+}
+
+// WithEnrollment accepts enrollment tokens signed by the CA as bearer
+// tokens. Each token is only accepted once, as recorded by ledger. A
+// certificate requested with a token may only contain the names of the
+// token.
+func WithEnrollment(ledger TokenLedger) Option {
+	return func(s *Server) {
+		s.ledger = ledger
+	}
+}
+
+// WithLogger logs issued certificates and rejected requests to l.
+func WithLogger(l *log.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
+// New creates a new server which issues certificates signed by caCert to
+// the clients. caCerts is the chain of caCert, as returned by
+// certmanager.GetCertSigner, and must lead to a root.
+func New(caCert *x509.Certificate, caCerts []*x509.Certificate, caKey crypto.Signer, clients []Client, opts ...Option) (*Server, error) {
+	caChain, caRoot, err := certmanager.BuildChain(caCert, caCerts)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		caCert:      caCert,
+		caChain:     caChain,
+		caRoot:      caRoot,
+		caKey:       caKey,
+		clients:     clients,
+		maxValidity: 24 * time.Hour,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// TLSConfig returns a server TLS config which presents cert and verifies
+// client certificates signed by the CA when clients present one. Clients
+// which authenticate with a token do not need a certificate.
+func (s *Server) TLSConfig(cert tls.Certificate) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.caRoot)
+	for _, c := range s.caChain {
+		pool.AddCert(c)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+}
+
+// IssueRequest is the body of a request to /v1/certificates. Either CSR, or
+// CommonName and SANs, must be set.
+type IssueRequest struct {
+	// CSR is a PEM-encoded certificate signing request. The subject and SANs
+	// are copied from the CSR.
+	CSR string `json:"csr,omitempty"`
+
+	// CommonName and SANs of a certificate for which the server generates the
+	// key. SANs may be DNS names, IP addresses or URIs, e.g. SPIFFE IDs.
+	CommonName string   `json:"commonName,omitempty"`
+	SANs       []string `json:"sans,omitempty"`
+
+	// KeyType of the generated key, KeyTypeEC (default) or KeyTypeRSA.
+	KeyType string `json:"keyType,omitempty"`
+
+	// Validity is how long the certificate should be valid, e.g. "1h". By
+	// default, and at most, the maximum validity of the server.
+	Validity string `json:"validity,omitempty"`
+}
+
+// IssueResponse is the response to an IssueRequest.
+type IssueResponse struct {
+	// Certificate is the PEM-encoded certificate followed by its
+	// intermediates.
+	Certificate string `json:"certificate"`
+
+	// PrivateKey is the PEM-encoded PKCS#8 key, if it was generated by the
+	// server.
+	PrivateKey string `json:"privateKey,omitempty"`
+
+	// CACertificates are the PEM-encoded CA certificates to trust.
+	CACertificates string `json:"caCertificates"`
+
+	// NotAfter is when the certificate expires.
+	NotAfter time.Time `json:"notAfter"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	switch {
+	case r.URL.Path == "/v1/ca" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		_, _ = w.Write(s.caPEM())
+	case r.URL.Path == "/v1/certificates" && r.Method == http.MethodPost:
+		s.handleIssue(w, r)
+	case r.URL.Path == "/v1/ca", r.URL.Path == "/v1/certificates":
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Server) handleIssue(w http.ResponseWriter, r *http.Request) {
+	client, token, err := s.authenticate(r)
+	if err != nil {
+		s.logf("rejected request from %v: %v", r.RemoteAddr, err)
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	var req IssueRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	validity := s.maxValidity
+	if req.Validity != "" {
+		d, err := time.ParseDuration(req.Validity)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid validity, e.g. 1h")
+			return
+		}
+		if d < validity {
+			validity = d
+		}
+	}
+	if d := client.Policy.MaxValidity; d > 0 && d < validity {
+		validity = d
+	}
+
+	csr, key, err := parseRequest(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if token != nil {
+		err := token.Check(&x509.Certificate{
+			Subject:        csr.Subject,
+			DNSNames:       csr.DNSNames,
+			IPAddresses:    csr.IPAddresses,
+			URIs:           csr.URIs,
+			EmailAddresses: csr.EmailAddresses,
+		})
+		if err != nil {
+			s.logf("rejected request from %v: %v", client.Name, err)
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+
+	cert, err := certmanager.SignCSR(s.caCert, s.caKey, csr, time.Now().Add(validity), certmanager.WithPolicy(client.Policy))
+	if err != nil {
+		s.logf("rejected request from client %v: %v", client.Name, err)
+		status := http.StatusBadRequest
+		if errors.Is(err, certmanager.ErrPolicyViolation) {
+			status = http.StatusForbidden
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+
+	// The token is only used up once the certificate has been signed, so
+	// that rejected requests can be retried. A certificate signed for a token
+	// which was used in the meantime is discarded.
+	if token != nil {
+		if err := s.ledger.Use(token.ID, token.ExpiresAt); err != nil {
+			s.logf("rejected request from %v: %v", client.Name, err)
+			if errors.Is(err, certmanager.ErrTokenUsed) {
+				writeError(w, http.StatusUnauthorized, err.Error())
+			} else {
+				writeError(w, http.StatusInternalServerError, "failed to record token use")
+			}
+			return
+		}
+	}
+	s.logf("issued certificate %x to client %v for %v, expires at %v",
+		cert.SerialNumber, client.Name, names(cert), cert.NotAfter.Format(time.RFC3339))
+
+	resp := IssueResponse{
+		Certificate:    string(encodeCerts(s.chain(cert))),
+		CACertificates: string(s.caPEM()),
+		NotAfter:       cert.NotAfter,
+	}
+	if key != nil {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to encode key")
+			return
+		}
+		resp.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// authenticate returns the client which made the request, identified by its
+// bearer token or its verified client certificate. Requests authenticated
+// with an enrollment token also return the token, whose use has not yet
+// been recorded.
+func (s *Server) authenticate(r *http.Request) (*Client, *certmanager.EnrollmentToken, error) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || token == "" {
+			return nil, nil, errors.New("authorization header must be a bearer token")
+		}
+		if s.ledger != nil && certmanager.IsEnrollmentToken(token) {
+			t, err := certmanager.VerifyEnrollmentToken(s.caCert, token)
+			if err != nil {
+				return nil, nil, err
+			}
+			return &Client{Name: "enrollment token " + t.ID}, t, nil
+		}
+		hash := HashToken(token)
+		for i := range s.clients {
+			if subtle.ConstantTimeCompare(hash[:], s.clients[i].TokenHash[:]) == 1 {
+				return &s.clients[i], nil, nil
+			}
+		}
+		return nil, nil, errors.New("invalid token")
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		for i := range s.clients {
+			if s.clients[i].Certificate.Authorize(cert) == nil {
+				return &s.clients[i], nil, nil
+			}
+		}
+		return nil, nil, fmt.Errorf("client certificate %v is not authorized", cert.Subject.CommonName)
+	}
+
+	return nil, nil, errors.New("a bearer token or client certificate is required")
+}
+
+// parseRequest returns the CSR of the request, generating a key if the
+// request does not contain a CSR.
+func parseRequest(req IssueRequest) (*x509.CertificateRequest, crypto.Signer, error) {
+	if req.CSR != "" {
+		if req.CommonName != "" || len(req.SANs) > 0 {
+			return nil, nil, errors.New("common name and SANs must not be set together with a CSR")
+		}
+		block, _ := pem.Decode([]byte(req.CSR))
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			return nil, nil, errors.New("CSR must be a PEM-encoded CERTIFICATE REQUEST")
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse CSR, err: %v", err)
+		}
+		return csr, nil, nil
+	}
+
+	if req.CommonName == "" && len(req.SANs) == 0 {
+		return nil, nil, errors.New("either a CSR, or a common name or SANs, is required")
+	}
+	tmpl := &x509.CertificateRequest{Subject: pkix.Name{CommonName: req.CommonName}}
+	for _, san := range req.SANs {
+		switch {
+		case strings.Contains(san, "://"):
+			uri, err := url.Parse(san)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid URI SAN '%v'", san)
+			}
+			tmpl.URIs = append(tmpl.URIs, uri)
+		case net.ParseIP(san) != nil:
+			tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(san))
+		default:
+			tmpl.DNSNames = append(tmpl.DNSNames, san)
+		}
+	}
+
+	var key crypto.Signer
+	var err error
+	switch req.KeyType {
+	case "", KeyTypeEC:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeRSA:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, nil, fmt.Errorf("key type must be %v or %v", KeyTypeEC, KeyTypeRSA)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CSR, err: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return csr, key, nil
+}
+
+// chain returns cert followed by its intermediates, without the root.
+func (s *Server) chain(cert *x509.Certificate) []*x509.Certificate {
+	return append([]*x509.Certificate{cert}, s.caChain...)
+}
+
+// caPEM returns the root of the CA chain.
+func (s *Server) caPEM() []byte {
+	return encodeCerts([]*x509.Certificate{s.caRoot})
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.logger != nil {
+		s.logger.Printf(format, args...)
+	}
+}
+
+func names(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	if len(names) == 0 {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+func encodeCerts(certs []*x509.Certificate) []byte {
+	var b []byte
+	for _, c := range certs {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	return b
+}
+
+func writeError(w http.ResponseWriter, statusCode int, msg string) {
+	writeJSON(w, statusCode, errorResponse{Error: msg})
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,319 @@
+package issueserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sebnyberg/certmanager"
+)
+
+// newTestServer starts a server with a token client "ci" and a client "web"
+// which authenticates with a certificate, and returns it and its CA.
+func newTestServer(t *testing.T, opts ...Option) (*httptest.Server, *x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	caCert, caKey, err := certmanager.GenSelfSignedCA("test-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := []Client{
+		{
+			Name:      "ci",
+			TokenHash: HashToken("secret"),
+			Policy: certmanager.Policy{
+				AllowedNames:       []string{"*.ci.example.com"},
+				AllowedURIPrefixes: []string{"spiffe://example.org/ci/"},
+				DenyWildcards:      true,
+			},
+		},
+		{
+			Name:        "web",
+			Certificate: certmanager.ClientAllowlist{CommonNames: []string{"web.example.com"}},
+			Policy:      certmanager.Policy{AllowedNames: []string{"web.example.com"}, MaxValidity: time.Minute},
+		},
+	}
+	srv, err := New(caCert, nil, caKey, clients, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCert, serverKey, err := certmanager.GenSignedCert(caCert, caKey, "localhost", []string{"localhost"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsCert, err := certmanager.TLSCertificate([]*x509.Certificate{serverCert}, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(srv)
+	ts.TLS = srv.TLSConfig(tlsCert)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts, caCert, caKey
+}
+
+func httpClient(caCert *x509.Certificate, certs ...tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			ServerName:   "localhost",
+			RootCAs:      pool,
+			Certificates: certs,
+		}},
+	}
+}
+
+func newCSR(t *testing.T, dnsNames ...string) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: dnsNames}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+func TestServer(t *testing.T) {
+	ts, caCert, _ := newTestServer(t)
+	client := httpClient(caCert)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, tc := range []struct {
+		name      string
+		token     string
+		req       IssueRequest
+		wantNames []string
+		wantErr   string
+	}{
+		{"generated key", "secret", IssueRequest{CommonName: "api.ci.example.com", SANs: []string{"api.ci.example.com", "spiffe://example.org/ci/api"}}, []string{"api.ci.example.com"}, ""},
+		{"generated rsa key", "secret", IssueRequest{SANs: []string{"api.ci.example.com"}, KeyType: KeyTypeRSA}, []string{"api.ci.example.com"}, ""},
+		{"csr", "secret", IssueRequest{CSR: newCSR(t, "db.ci.example.com")}, []string{"db.ci.example.com"}, ""},
+		{"no token", "", IssueRequest{SANs: []string{"api.ci.example.com"}}, nil, "401"},
+		{"invalid token", "other", IssueRequest{SANs: []string{"api.ci.example.com"}}, nil, "401"},
+		{"name not allowed", "secret", IssueRequest{SANs: []string{"www.google.com"}}, nil, "403"},
+		{"wildcard", "secret", IssueRequest{SANs: []string{"*.ci.example.com"}}, nil, "403"},
+		{"uri not allowed", "secret", IssueRequest{SANs: []string{"spiffe://example.org/prod/api"}}, nil, "403"},
+		{"csr not allowed", "secret", IssueRequest{CSR: newCSR(t, "www.google.com")}, nil, "403"},
+		{"csr and names", "secret", IssueRequest{CSR: newCSR(t, "db.ci.example.com"), SANs: []string{"db.ci.example.com"}}, nil, "400"},
+		{"empty", "secret", IssueRequest{}, nil, "400"},
+		{"invalid validity", "secret", IssueRequest{SANs: []string{"api.ci.example.com"}, Validity: "soon"}, nil, "400"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := Request(ctx, client, ts.URL, tc.token, tc.req)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("want err containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cert := parseCert(t, resp.Certificate)
+			if diff := cmp.Diff(tc.wantNames, cert.DNSNames); diff != "" {
+				t.Errorf("DNSNames mismatch (-want +got):\n%s", diff)
+			}
+			if err := cert.CheckSignatureFrom(caCert); err != nil {
+				t.Errorf("certificate was not signed by the CA, err: %v", err)
+			}
+			if !parseCert(t, resp.CACertificates).Equal(caCert) {
+				t.Error("want CA certificate in response")
+			}
+			if (resp.PrivateKey != "") != (tc.req.CSR == "") {
+				t.Errorf("want a key only when the key was generated, got %q", resp.PrivateKey)
+			}
+			if resp.PrivateKey != "" {
+				if _, err := tls.X509KeyPair([]byte(resp.Certificate), []byte(resp.PrivateKey)); err != nil {
+					t.Errorf("key does not match certificate, err: %v", err)
+				}
+			}
+			if d := time.Until(cert.NotAfter); d > 24*time.Hour {
+				t.Errorf("want certificate valid for at most 24h, got %v", d)
+			}
+		})
+	}
+}
+
+func TestServer_clientCert(t *testing.T) {
+	ts, caCert, caKey := newTestServer(t, WithMaxValidity(time.Hour))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, tc := range []struct {
+		name       string
+		commonName string
+		wantErr    string
+	}{
+		{"authorized", "web.example.com", ""},
+		{"not authorized", "other.example.com", "401"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cert, key, err := certmanager.GenSignedCert(caCert, caKey, tc.commonName, nil, time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsCert, err := certmanager.TLSCertificate([]*x509.Certificate{cert}, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := Request(ctx, httpClient(caCert, tlsCert), ts.URL, "", IssueRequest{CSR: newCSR(t, "web.example.com")})
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("want err containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The validity is capped by the policy of the client
+			if d := time.Until(parseCert(t, resp.Certificate).NotAfter); d > time.Minute {
+				t.Errorf("want certificate valid for at most 1m, got %v", d)
+			}
+		})
+	}
+}
+
+func TestServer_ca(t *testing.T) {
+	ts, caCert, _ := newTestServer(t)
+	resp, err := httpClient(caCert).Get(ts.URL + "/v1/ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parseCert(t, string(body)).Equal(caCert) {
+		t.Error("want CA certificate")
+	}
+}
+
+func TestServer_enrollment(t *testing.T) {
+	ledgerPath := filepath.Join(t.TempDir(), "used-tokens.json")
+	ledger, err := NewFileLedger(ledgerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, caCert, caKey := newTestServer(t, WithEnrollment(ledger))
+	client := httpClient(caCert)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	newToken := func(expiry time.Time) string {
+		token, err := certmanager.NewEnrollmentToken(caCert, nil, caKey, "db.example.com", []string{"db.example.com"}, expiry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	token := newToken(time.Now().Add(time.Hour))
+	req := IssueRequest{CommonName: "db.example.com", SANs: []string{"db.example.com"}}
+
+	// Names outside the token are refused without using up the token
+	_, err = Request(ctx, client, ts.URL, token, IssueRequest{SANs: []string{"www.example.com"}})
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("want 403 for names outside the token, got %v", err)
+	}
+
+	// CSRs which fail to be signed do not use up the token either
+	block, _ := pem.Decode([]byte(newCSR(t, "db.example.com")))
+	block.Bytes[len(block.Bytes)-1] ^= 0xff
+	_, err = Request(ctx, client, ts.URL, token, IssueRequest{CSR: string(pem.EncodeToMemory(block))})
+	if err == nil || !strings.Contains(err.Error(), "invalid CSR signature") {
+		t.Fatalf("want error for a CSR with an invalid signature, got %v", err)
+	}
+
+	resp, err := Request(ctx, client, ts.URL, token, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert := parseCert(t, resp.Certificate); cert.Subject.CommonName != "db.example.com" {
+		t.Errorf("want certificate for db.example.com, got %v", cert.Subject.CommonName)
+	}
+
+	// Tokens are single-use, also after a restart
+	if _, err := Request(ctx, client, ts.URL, token, req); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("want 401 when replaying a token, got %v", err)
+	}
+	reloaded, err := NewFileLedger(ledgerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := certmanager.ParseEnrollmentToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.Use(payload.ID, payload.ExpiresAt); !errors.Is(err, certmanager.ErrTokenUsed) {
+		t.Errorf("want %v from reloaded ledger, got %v", certmanager.ErrTokenUsed, err)
+	}
+
+	// Expired tokens are refused
+	expired := newToken(time.Now().Add(-time.Minute))
+	if _, err := Request(ctx, client, ts.URL, expired, req); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("want 401 for an expired token, got %v", err)
+	}
+
+	// The CA can be fetched with the fingerprint of the token
+	gotCA, err := FetchCA(ctx, ts.URL, payload.RootFingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotCA.Equal(caCert) {
+		t.Error("want CA certificate")
+	}
+	if _, err := FetchCA(ctx, ts.URL, strings.Repeat("0", 64)); err == nil {
+		t.Error("want error for a CA with another fingerprint")
+	}
+}
+
+func TestServer_enrollmentDisabled(t *testing.T) {
+	ts, caCert, caKey := newTestServer(t)
+	token, err := certmanager.NewEnrollmentToken(caCert, nil, caKey, "db.example.com", nil, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = Request(ctx, httpClient(caCert), ts.URL, token, IssueRequest{CommonName: "db.example.com"})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("want 401 when enrollment is disabled, got %v", err)
+	}
+}
+
+func parseCert(t *testing.T, s string) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		t.Fatalf("no certificate in %q", s)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
@@ -0,0 +1,130 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// CertInfo describes the latest version of a certificate in a store, as
+// listed by ListCerts.
+type CertInfo struct {
+	// Name is the name of the certificate in the store.
+	Name string
+
+	// URL is the URL of the secret holding the certificate, its chain and
+	// its key, to pass to GetCert.
+	URL string
+
+	// Enabled is false if the latest version of the certificate is disabled.
+	Enabled bool
+
+	// Tags are the tags of the certificate.
+	Tags map[string]string
+
+	// Cert is the certificate itself, without its chain.
+	Cert *x509.Certificate
+}
+
+// CertFilter selects certificates listed by ListCerts. The zero value selects
+// all certificates.
+type CertFilter struct {
+	// Name is a pattern the name of the certificate must match, as in
+	// path.Match, e.g. web-*.
+	Name string
+
+	// Tags are tags the certificate must have, with the given values.
+	Tags map[string]string
+
+	// ExpiresWithin selects certificates which expire within the duration,
+	// including expired certificates, if non-zero.
+	ExpiresWithin time.Duration
+}
+
+// ParseCertFilter parses a comma-separated list of terms of a filter:
+//
+//	name=GLOB       the name matches the pattern, e.g. name=web-*
+//	tag:KEY=VALUE   the certificate has the tag, e.g. tag:env=prod
+//	expires<DUR     the certificate expires within the duration, e.g. expires<720h
+//
+// All terms must hold for a certificate to be selected.
+func ParseCertFilter(s string) (CertFilter, error) {
+	var f CertFilter
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		switch {
+		case term == "":
+		case strings.HasPrefix(term, "name="):
+			f.Name = strings.TrimPrefix(term, "name=")
+			if _, err := path.Match(f.Name, ""); err != nil {
+				return CertFilter{}, fmt.Errorf("invalid name pattern '%v', err: %v", f.Name, err)
+			}
+		case strings.HasPrefix(term, "tag:"):
+			kv := strings.SplitN(strings.TrimPrefix(term, "tag:"), "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return CertFilter{}, fmt.Errorf("invalid tag term '%v', should be tag:KEY=VALUE", term)
+			}
+			if f.Tags == nil {
+				f.Tags = make(map[string]string)
+			}
+			f.Tags[kv[0]] = kv[1]
+		case strings.HasPrefix(term, "expires<"):
+			d, err := time.ParseDuration(strings.TrimPrefix(term, "expires<"))
+			if err != nil {
+				return CertFilter{}, fmt.Errorf("invalid expiry term '%v', err: %v", term, err)
+			}
+			f.ExpiresWithin = d
+		default:
+			return CertFilter{}, fmt.Errorf("invalid filter term '%v', should be name=GLOB, tag:KEY=VALUE or expires<DURATION", term)
+		}
+	}
+	return f, nil
+}
+
+// match returns true if a certificate with the given name, tags and expiry
+// is selected by the filter.
+func (f CertFilter) match(name string, tags map[string]string, notAfter time.Time, now time.Time) bool {
+	if f.Name != "" {
+		if ok, _ := path.Match(f.Name, name); !ok {
+			return false
+		}
+	}
+	for k, v := range f.Tags {
+		if value, ok := tags[k]; !ok || value != v {
+			return false
+		}
+	}
+	if f.ExpiresWithin != 0 && notAfter.After(now.Add(f.ExpiresWithin)) {
+		return false
+	}
+	return true
+}
+
+// listConcurrency is the number of certificates retrieved at once when
+// listing certificates.
+const listConcurrency = 8
+
+// ListCerts lists the certificates in the vault at vaultURL, e.g.
+// https://myvault.vault.azure.net/, which are selected by the filter,
+// ordered by name.
+func ListCerts(ctx context.Context, vaultURL string, filter CertFilter) ([]CertInfo, error) {
+	s, err := getDefaultStore()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.ListCerts(ctx, vaultURL, filter)
+}
+
+// ListCerts lists the certificates in a vault. See the package-level
+// ListCerts for details.
+func (s *Store) ListCerts(ctx context.Context, vaultURL string, filter CertFilter) ([]CertInfo, error) {
+	if !strings.Contains(vaultURL, "vault.azure.net") {
+		return nil, ErrUnsupportedURL
+	}
+
+	return listAzureKVCerts(ctx, s.kv, vaultURL, filter, time.Now())
+}
@@ -0,0 +1,114 @@
+package certmanager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseCertFilter(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    CertFilter
+		wantErr bool
+	}{
+		{"", CertFilter{}, false},
+		{"name=web-*", CertFilter{Name: "web-*"}, false},
+		{"name=web-*, tag:env=prod,expires<720h", CertFilter{Name: "web-*", Tags: map[string]string{"env": "prod"}, ExpiresWithin: 720 * time.Hour}, false},
+		{"tag:env=", CertFilter{Tags: map[string]string{"env": ""}}, false},
+		{"name=[", CertFilter{}, true},
+		{"tag:env", CertFilter{}, true},
+		{"expires<30d", CertFilter{}, true},
+		{"subject=foo", CertFilter{}, true},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := ParseCertFilter(tc.in)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("want error %v, got %v", tc.wantErr, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("unexpected filter (-want +got):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestStore_ListCerts(t *testing.T) {
+	now := time.Now()
+	strPtr := func(s string) *string { return &s }
+	boolPtr := func(b bool) *bool { return &b }
+	unixPtr := func(t time.Time) *date.UnixTime { u := date.UnixTime(t); return &u }
+
+	caCert, caKey, err := GenSelfSignedCA("test-ca", now.AddDate(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &fakeKeyVault{
+		permissions: map[string]bool{"certificates/list": true, "certificates/get": true},
+		certs:       make(map[string]keyvault.CertificateBundle),
+	}
+	for _, c := range []struct {
+		name   string
+		env    string
+		expiry time.Time
+		isCA   bool
+	}{
+		{"ca", "prod", now.AddDate(1, 0, 0), true},
+		{"web-prod", "prod", now.AddDate(0, 0, 10), false},
+		{"web-test", "test", now.AddDate(0, 0, 10), false},
+		{"api-prod", "prod", now.AddDate(0, 6, 0), false},
+	} {
+		cert := caCert
+		if !c.isCA {
+			cert, _, err = GenSignedCert(caCert, caKey, c.name, nil, c.expiry)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		kv.certs[c.name] = keyvault.CertificateBundle{
+			ID:         strPtr("https://test.vault.azure.net/certificates/" + c.name),
+			Cer:        &cert.Raw,
+			Tags:       map[string]*string{"env": strPtr(c.env)},
+			Attributes: &keyvault.CertificateAttributes{Enabled: boolPtr(true), Expires: unixPtr(cert.NotAfter)},
+		}
+	}
+	s := newFakeKVStore(t, kv)
+
+	for _, tc := range []struct {
+		name   string
+		filter CertFilter
+		want   []string
+	}{
+		{"all", CertFilter{}, []string{"api-prod", "ca", "web-prod", "web-test"}},
+		{"name", CertFilter{Name: "web-*"}, []string{"web-prod", "web-test"}},
+		{"tag", CertFilter{Tags: map[string]string{"env": "prod"}}, []string{"api-prod", "ca", "web-prod"}},
+		{"expiry", CertFilter{ExpiresWithin: 30 * 24 * time.Hour}, []string{"web-prod", "web-test"}},
+		{"combined", CertFilter{Name: "web-*", Tags: map[string]string{"env": "prod"}}, []string{"web-prod"}},
+		{"none", CertFilter{Name: "db-*"}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			infos, err := s.ListCerts(context.Background(), "https://test.vault.azure.net/", tc.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, info := range infos {
+				got = append(got, info.Name)
+				if info.Cert == nil || info.Cert.IsCA != (info.Name == "ca") || info.URL != "https://test.vault.azure.net/secrets/"+info.Name {
+					t.Errorf("unexpected info for %v: %+v", info.Name, info)
+				}
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("unexpected certificates (-want +got):\n%v", diff)
+			}
+		})
+	}
+
+	if _, err := s.ListCerts(context.Background(), "https://test.vault.azure.net/secrets/ca", CertFilter{}); err == nil {
+		t.Errorf("want error for secret URL")
+	}
+}
@@ -0,0 +1,88 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// contentTypePassword is the content type of generated password secrets.
+const contentTypePassword = "text/plain"
+
+// generatedPasswordBytes is the number of random bytes of a generated
+// password, which is 43 characters once encoded.
+const generatedPasswordBytes = 32
+
+// GetPassword retrieves a certificate password kept as a secret of its own,
+// e.g. https://myvault.azure.net/secrets/mycert-password, so that it never
+// has to be passed on the command line. The latest version is retrieved
+// unless the URL includes a version. A single trailing newline is removed.
+func GetPassword(ctx context.Context, secretURL string) (string, error) {
+	s, err := getDefaultStore()
+	if err != nil {
+		return "", err
+	}
+
+	return s.GetPassword(ctx, secretURL)
+}
+
+// GetPassword retrieves a password secret. See the package-level GetPassword
+// for details.
+func (s *Store) GetPassword(ctx context.Context, secretURL string) (string, error) {
+	if !strings.Contains(secretURL, "vault.azure.net") {
+		return "", ErrUnsupportedURL
+	}
+	baseURL, name, version, err := parseAzureSecretURL(secretURL)
+	if err != nil {
+		return "", appendErr("failed to parse secret URL", err)
+	}
+	value, err := getAzureKVSecretVersion(ctx, s.kv, baseURL, name, version)
+	if err != nil {
+		return "", appendErr("failed to retrieve password", err)
+	}
+	value = TrimPassword(value)
+	if value == "" {
+		return "", errors.New("password secret is empty")
+	}
+	return value, nil
+}
+
+// TrimPassword removes a single trailing newline, as left by editors and
+// echo, from a password read from a file or secret.
+func TrimPassword(s string) string {
+	s = strings.TrimSuffix(s, "\n")
+	return strings.TrimSuffix(s, "\r")
+}
+
+// PasswordSecretURL returns the URL of the secret holding the password
+// generated by WithGeneratedPassword for the certificate at url, e.g.
+// https://myvault.vault.azure.net/secrets/mycert-password. The URL may be
+// the certificate URL or the secret URL of the certificate.
+func PasswordSecretURL(url string) (string, error) {
+	if !strings.Contains(url, "vault.azure.net") {
+		return "", ErrUnsupportedURL
+	}
+	baseURL, certName, _, err := parseAzureKVURL(url)
+	if err != nil {
+		return "", appendErr("failed to parse certificate URL", err)
+	}
+	return baseURL + "/secrets/" + passwordSecretName(certName), nil
+}
+
+// passwordSecretName is the name of the secret holding the generated
+// password of the certificate with the given name.
+func passwordSecretName(certName string) string {
+	return certName + "-password"
+}
+
+// generatePassword returns a random password which is safe to pass in URLs
+// and on the command line.
+func generatePassword() (string, error) {
+	b := make([]byte, generatedPasswordBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
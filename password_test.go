@@ -0,0 +1,55 @@
+package certmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+)
+
+func TestStore_GetPassword(t *testing.T) {
+	strPtr := func(s string) *string { return &s }
+	s := newFakeKVStore(t, &fakeKeyVault{
+		permissions: map[string]bool{"secrets/get": true},
+		secrets: map[string]keyvault.SecretBundle{
+			"ca-password":    {Value: strPtr("s3cret\n")},
+			"ca-password/v1": {Value: strPtr("old")},
+			"empty":          {Value: strPtr("\n")},
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	secretURL := func(name string) string { return "https://test.vault.azure.net/secrets/" + name }
+
+	for _, tc := range []struct {
+		name    string
+		url     string
+		want    string
+		wantErr bool
+		errIs   error
+	}{
+		{"latest", secretURL("ca-password"), "s3cret", false, nil},
+		{"version", secretURL("ca-password/v1"), "old", false, nil},
+		{"empty", secretURL("empty"), "", true, nil},
+		{"missing", secretURL("other"), "", true, ErrNotFound},
+		{"unsupported", "https://example.com/secrets/ca-password", "", true, ErrUnsupportedURL},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := s.GetPassword(ctx, tc.url)
+			if tc.wantErr {
+				if err == nil || (tc.errIs != nil && !errors.Is(err, tc.errIs)) {
+					t.Errorf("want error matching %v, got %v", tc.errIs, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
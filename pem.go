@@ -0,0 +1,166 @@
+package certmanager
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// Formats in which certificates can be stored.
+const (
+	// FormatPKCS12 stores the certificate, its chain and its key in a
+	// password-protected PKCS#12 bundle. This is the default.
+	FormatPKCS12 = "pkcs12"
+
+	// FormatPEM stores the certificate, its chain and its key as PEM blocks.
+	// PEM bundles are not password-protected.
+	FormatPEM = "pem"
+)
+
+// Secret content types used by Key Vault for each format.
+const (
+	contentTypePKCS12 = "application/x-pkcs12"
+	contentTypePEM    = "application/x-pem-file"
+)
+
+// decodePEMBundle decodes a PEM bundle containing a certificate, its chain and
+// its key. The certificate is the one matching the key, and the remaining
+// certificates are returned in order as the chain.
+//
+// Keys may be PKCS#1 (RSA PRIVATE KEY), SEC 1 (EC PRIVATE KEY) or PKCS#8
+// (PRIVATE KEY).
+func decodePEMBundle(data []byte) (cert *x509.Certificate, caCerts []*x509.Certificate, key crypto.Signer, err error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "CERTIFICATE":
+			c, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, nil, appendErr("failed to parse certificate", err)
+			}
+			certs = append(certs, c)
+		case "RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY":
+			if key != nil {
+				return nil, nil, nil, errors.New("PEM bundle contains more than one private key")
+			}
+			key, err = parsePrivateKey(block)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		case "ENCRYPTED PRIVATE KEY":
+			return nil, nil, nil, errors.New("encrypted PEM private keys are not supported")
+		}
+	}
+
+	if len(certs) == 0 {
+		return nil, nil, nil, errors.New("PEM bundle contains no certificates")
+	}
+	if key == nil {
+		return nil, nil, nil, errors.New("PEM bundle contains no private key")
+	}
+
+	for i, c := range certs {
+		if publicKeysEqual(c.PublicKey, key.Public()) {
+			caCerts = append(caCerts, certs[:i]...)
+			caCerts = append(caCerts, certs[i+1:]...)
+			return c, caCerts, key, nil
+		}
+	}
+	return nil, nil, nil, errors.New("PEM bundle contains no certificate matching the private key")
+}
+
+// decodePEMCerts decodes all certificates in PEM data, e.g. a trust bundle.
+// Other blocks, such as keys, are skipped.
+func decodePEMCerts(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, appendErr("failed to parse certificate", err)
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("PEM data contains no certificates")
+	}
+	return certs, nil
+}
+
+// encodePEMBundle encodes the key, the certificate and its chain as PEM
+// blocks. The key is encoded as PKCS#8, which is what Key Vault expects.
+func encodePEMBundle(cert *x509.Certificate, caCerts []*x509.Certificate, key crypto.Signer) ([]byte, error) {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, appendErr("failed to marshal private key", err)
+	}
+
+	var buf bytes.Buffer
+	if err := pem.Encode(&buf, &pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}); err != nil {
+		return nil, err
+	}
+	for _, c := range append([]*x509.Certificate{cert}, caCerts...) {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, appendErr("failed to parse PKCS#1 private key", err)
+		}
+		return key, nil
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, appendErr("failed to parse EC private key", err)
+		}
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, appendErr("failed to parse PKCS#8 private key", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	switch a := a.(type) {
+	case *rsa.PublicKey:
+		return a.Equal(b)
+	case *ecdsa.PublicKey:
+		return a.Equal(b)
+	case ed25519.PublicKey:
+		return a.Equal(b)
+	}
+	return false
+}
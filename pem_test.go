@@ -0,0 +1,136 @@
+package certmanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestCert creates a self-signed certificate for key.
+func newTestCert(t *testing.T, name string, key crypto.Signer) *x509.Certificate {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func Test_decodePEMBundle(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaCert := newTestCert(t, "rsa", rsaKey)
+	ecCert := newTestCert(t, "ec", ecKey)
+
+	certBlock := func(c *x509.Certificate) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+	pkcs8 := func(key crypto.Signer) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	sec1 := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})
+
+	join := func(parts ...[]byte) []byte {
+		var res []byte
+		for _, p := range parts {
+			res = append(res, p...)
+		}
+		return res
+	}
+
+	for _, tc := range []struct {
+		name      string
+		in        []byte
+		wantCN    string
+		wantChain int
+		wantErr   bool
+	}{
+		{"pkcs1 key first", join(pkcs1, certBlock(rsaCert), certBlock(ecCert)), "rsa", 1, false},
+		{"pkcs8 rsa key last", join(certBlock(rsaCert), pkcs8(rsaKey)), "rsa", 0, false},
+		{"ec key with chain before leaf", join(certBlock(rsaCert), certBlock(ecCert), sec1), "ec", 1, false},
+		{"pkcs8 ec key", join(pkcs8(ecKey), certBlock(ecCert)), "ec", 0, false},
+		{"no key", certBlock(rsaCert), "", 0, true},
+		{"no certificate", pkcs1, "", 0, true},
+		{"key does not match", join(pkcs1, certBlock(ecCert)), "", 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cert, caCerts, key, err := decodePEMBundle(tc.in)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if tc.wantErr {
+				return
+			}
+			if cert.Subject.CommonName != tc.wantCN {
+				t.Errorf("expected CN %v, got %v", tc.wantCN, cert.Subject.CommonName)
+			}
+			if len(caCerts) != tc.wantChain {
+				t.Errorf("expected %v chain certificates, got %v", tc.wantChain, len(caCerts))
+			}
+			if !publicKeysEqual(cert.PublicKey, key.Public()) {
+				t.Error("key does not match certificate")
+			}
+		})
+	}
+}
+
+func Test_encodePEMBundle(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newTestCert(t, "leaf", ecKey)
+	caCert := newTestCert(t, "ca", caKey)
+
+	data, err := encodePEMBundle(cert, []*x509.Certificate{caCert}, ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotCert, gotCACerts, gotKey, err := decodePEMBundle(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotCert.Equal(cert) || len(gotCACerts) != 1 || !gotCACerts[0].Equal(caCert) {
+		t.Error("certificates did not survive a round trip")
+	}
+	if !ecKey.Equal(gotKey) {
+		t.Error("key did not survive a round trip")
+	}
+}
@@ -0,0 +1,36 @@
+package certmanager
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// PKCS#12 encodings, see WithPKCS12Encoding.
+const (
+	// PKCS12Legacy encrypts the key with 3DES and the certificates with
+	// 40-bit RC2, with a SHA-1 MAC. It is understood by old clients such as
+	// OpenSSL 1.0 and Java 8, but the encryption is weak.
+	PKCS12Legacy = "legacy"
+
+	// PKCS12Modern encrypts the key and the certificates with AES-256-CBC,
+	// with keys derived by PBKDF2 with HMAC-SHA-256, and a SHA-256 MAC.
+	// OpenSSL 1.1.1 and later, Java 11 and later and Windows Server 2019
+	// and later understand it.
+	PKCS12Modern = "modern"
+)
+
+// encodePKCS12 encodes the key, certificate and chain as PKCS#12 with the
+// given encoding, PKCS12Legacy if empty.
+func encodePKCS12(encoding string, key crypto.Signer, cert *x509.Certificate, caCerts []*x509.Certificate, password string) ([]byte, error) {
+	switch encoding {
+	case "", PKCS12Legacy:
+		return pkcs12.LegacyRC2.WithRand(rand.Reader).Encode(key, cert, caCerts, password)
+	case PKCS12Modern:
+		return pkcs12.Modern.WithRand(rand.Reader).Encode(key, cert, caCerts, password)
+	}
+	return nil, fmt.Errorf("unsupported PKCS#12 encoding '%v', should be '%v' or '%v'", encoding, PKCS12Modern, PKCS12Legacy)
+}
@@ -0,0 +1,99 @@
+package certmanager
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func Test_encodePKCS12(t *testing.T) {
+	caCert, caKey, err := GenSelfSignedCA("test-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key, err := GenSignedCertSigner(caCert, caKey, "leaf", nil, time.Now().Add(time.Hour), WithProfile(Profile{KeyType: KeyTypeEC}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, password := range []string{"", "secret", "lösenord"} {
+		pfx, err := encodePKCS12(PKCS12Modern, key, cert, []*x509.Certificate{caCert}, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotKey, gotCert, gotCACerts, err := pkcs12.DecodeChain(pfx, password)
+		if err != nil {
+			t.Fatalf("want bundle with password %q to decode, got %v", password, err)
+		}
+		if !gotCert.Equal(cert) || len(gotCACerts) != 1 || !gotCACerts[0].Equal(caCert) {
+			t.Errorf("want certificate and chain to round-trip")
+		}
+		if !key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(gotKey.(crypto.Signer).Public()) {
+			t.Errorf("want key to round-trip")
+		}
+		if _, _, _, err := pkcs12.DecodeChain(pfx, password+"x"); err != pkcs12.ErrIncorrectPassword {
+			t.Errorf("want %v, got %v", pkcs12.ErrIncorrectPassword, err)
+		}
+	}
+
+	if _, err := encodePKCS12("strong", key, cert, nil, ""); err == nil {
+		t.Errorf("want error for unsupported encoding")
+	}
+}
+
+func TestStore_UploadCert_generatedPassword(t *testing.T) {
+	caCert, caKey, err := GenSelfSignedCA("test-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &fakeKeyVault{permissions: map[string]bool{"secrets/set": true, "certificates/import": true}}
+	s := newFakeKVStore(t, kv)
+	certURL := "https://test.vault.azure.net/certificates/ca"
+
+	err = s.UploadCert(context.Background(), certURL, caCert, nil, caKey, "", AllowNewVersion(), WithPKCS12Encoding(PKCS12Modern), WithGeneratedPassword())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, ok := kv.secrets["ca-password"]
+	if !ok || secret.Value == nil || len(*secret.Value) < 40 {
+		t.Fatalf("want generated password stored in ca-password, got %+v", secret)
+	}
+	if len(kv.imports) != 1 || *kv.imports[0].Password != *secret.Value {
+		t.Fatalf("want certificate imported with the generated password")
+	}
+	pfx, err := base64.StdEncoding.DecodeString(*kv.imports[0].Base64EncodedCertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pkcs12.Decode(pfx, *secret.Value); err != nil {
+		t.Errorf("want bundle to decode with the generated password, got %v", err)
+	}
+
+	for _, url := range []string{certURL, "https://test.vault.azure.net/secrets/ca/0123"} {
+		if got, _ := PasswordSecretURL(url); got != "https://test.vault.azure.net/secrets/ca-password" {
+			t.Errorf("want password secret URL next to the certificate for %v, got %v", url, got)
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		password string
+		opts     []UploadCertOption
+	}{
+		{"password given", "secret", nil},
+		{"pem", "", []UploadCertOption{WithFormat(FormatPEM)}},
+	} {
+		opts := append([]UploadCertOption{AllowNewVersion(), WithGeneratedPassword()}, tc.opts...)
+		if err := s.UploadCert(context.Background(), certURL, caCert, nil, caKey, tc.password, opts...); err == nil {
+			t.Errorf("%v: want error", tc.name)
+		}
+	}
+	if len(kv.imports) != 1 {
+		t.Errorf("want no further imports, got %v", len(kv.imports))
+	}
+}
@@ -0,0 +1,257 @@
+package pki
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/sebnyberg/certmanager"
+)
+
+// Apply performs the actions of the plan in order, and stops at the first
+// failure. Actions performed before the failure are kept, so running Plan
+// and Apply again continues where it stopped.
+func (p *Planner) Apply(ctx context.Context, plan *Plan) error {
+	for _, a := range plan.Actions {
+		var err error
+		switch {
+		case a.CA:
+			err = p.applyCA(ctx, plan, a.Name)
+		case a.Kind == ActionWrite:
+			c, _ := p.certificate(a.Name)
+			err = writeFiles(c, plan.certs[a.Name])
+		default:
+			err = p.applyCert(ctx, plan, a.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to %v, err: %w", a, err)
+		}
+	}
+	return nil
+}
+
+func (p *Planner) ca(name string) CA {
+	for _, ca := range p.manifest.CAs {
+		if ca.Name == name {
+			return ca
+		}
+	}
+	return CA{}
+}
+
+// certificate returns the named certificate with the defaults of its profile
+// applied, and the profile if it has one.
+func (p *Planner) certificate(name string) (Certificate, *certmanager.Profile) {
+	for _, c := range p.manifest.Certificates {
+		if c.Name == name {
+			return p.manifest.resolve(c)
+		}
+	}
+	return Certificate{}, nil
+}
+
+func (p *Planner) applyCA(ctx context.Context, plan *Plan, name string) error {
+	ca := p.ca(name)
+	validity, _ := validity(ca.Validity, ca.RenewBefore, defaultCAValidity)
+	expiry := p.now().Add(validity)
+	opts := []certmanager.CAOption{
+		certmanager.WithMaxPathLen(ca.MaxPathLen),
+		certmanager.WithNameConstraints(certmanager.NameConstraints{
+			PermittedDNSDomains: ca.PermittedDNSDomains,
+			ExcludedDNSDomains:  ca.ExcludedDNSDomains,
+		}),
+	}
+
+	var cert *x509.Certificate
+	var key *rsa.PrivateKey
+	var caCerts []*x509.Certificate
+	var err error
+	if ca.Issuer == "" {
+		cert, key, err = certmanager.GenSelfSignedCA(ca.Name, expiry, opts...)
+	} else {
+		issuer := plan.cas[ca.Issuer]
+		if issuer == nil {
+			return fmt.Errorf("issuer %v not found", ca.Issuer)
+		}
+		caCerts, err = storedChain(issuer)
+		if err != nil {
+			return err
+		}
+		cert, key, err = certmanager.GenIntermediateCA(issuer.cert, issuer.key, ca.Name, expiry, opts...)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = p.store.UploadCert(ctx, ca.URL, cert, caCerts, key, password(ca.PasswordEnv),
+		certmanager.WithFormat(ca.Format), certmanager.AllowNewVersion())
+	if err != nil {
+		return err
+	}
+	plan.cas[ca.Name] = &material{cert: cert, caCerts: caCerts, key: key}
+	return nil
+}
+
+func (p *Planner) applyCert(ctx context.Context, plan *Plan, name string) error {
+	c, profile := p.certificate(name)
+	issuer := plan.cas[c.Issuer]
+	if issuer == nil {
+		return fmt.Errorf("issuer %v not found", c.Issuer)
+	}
+	caCerts, err := storedChain(issuer)
+	if err != nil {
+		return err
+	}
+
+	csr, key, err := newCSR(c)
+	if err != nil {
+		return err
+	}
+	validity, _ := validity(c.Validity, c.RenewBefore, defaultCertValidity)
+	var opts []certmanager.SignOption
+	if profile != nil {
+		opts = append(opts, certmanager.WithProfile(*profile))
+	}
+	cert, err := certmanager.SignCSR(issuer.cert, issuer.key, csr, p.now().Add(validity), opts...)
+	if err != nil {
+		return err
+	}
+	m := &material{cert: cert, caCerts: caCerts, key: key}
+
+	if c.URL != "" {
+		err := p.store.UploadCert(ctx, c.URL, cert, caCerts, key, password(c.PasswordEnv),
+			certmanager.WithFormat(c.Format), certmanager.AllowNewVersion())
+		if err != nil {
+			return err
+		}
+	}
+	if c.CertPath != "" {
+		if err := writeFiles(c, m); err != nil {
+			return err
+		}
+	}
+	plan.certs[c.Name] = m
+	return nil
+}
+
+// storedChain returns the chain to store with certificates signed by the
+// issuer: issuer -> intermediary -> root.
+func storedChain(issuer *material) ([]*x509.Certificate, error) {
+	chain, root, err := certmanager.BuildChain(issuer.cert, issuer.caCerts)
+	if err != nil {
+		return nil, err
+	}
+	return append(chain, root), nil
+}
+
+func newCSRTemplate(commonName string, sans []string) (*x509.CertificateRequest, error) {
+	tmpl := &x509.CertificateRequest{Subject: pkix.Name{CommonName: commonName}}
+	for _, san := range sans {
+		switch {
+		case strings.Contains(san, "://"):
+			uri, err := url.Parse(san)
+			if err != nil {
+				return nil, fmt.Errorf("invalid URI SAN '%v'", san)
+			}
+			tmpl.URIs = append(tmpl.URIs, uri)
+		case net.ParseIP(san) != nil:
+			tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(san))
+		default:
+			tmpl.DNSNames = append(tmpl.DNSNames, san)
+		}
+	}
+	return tmpl, nil
+}
+
+func newCSR(c Certificate) (*x509.CertificateRequest, crypto.Signer, error) {
+	tmpl, err := newCSRTemplate(c.CommonName, c.SANs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := certmanager.GenKey(c.KeyType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CSR, err: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return csr, key, nil
+}
+
+// readFiles reads the certificate chain at CertPath, or returns nil if there
+// is none.
+func readFiles(c Certificate) (*material, error) {
+	data, err := os.ReadFile(c.CertPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %v, err: %v", c.CertPath, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %v", c.CertPath)
+	}
+	return &material{cert: certs[0], caCerts: certs[1:]}, nil
+}
+
+// writeFiles writes the chain without the root to CertPath, the key to
+// KeyPath and the root to CAPath.
+func writeFiles(c Certificate, m *material) error {
+	chain, root, err := certmanager.BuildChain(m.cert, m.caCerts)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(m.key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key, err: %v", err)
+	}
+
+	// The key is written first, so that the certificate never refers to a
+	// key which is not on disk
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(c.KeyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.CertPath, certmanager.EncodeTrustBundle(chain), 0644); err != nil {
+		return err
+	}
+	if c.CAPath != "" {
+		if err := os.WriteFile(c.CAPath, certmanager.EncodeTrustBundle([]*x509.Certificate{root}), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+// Package pki keeps a PKI in the store in line with a manifest. The manifest
+// declares CAs and the leaf certificates they issue; a Planner compares it
+// with the store and files on disk, and performs only the operations needed
+// for them to match: creating what is missing, renewing what is expiring and
+// reissuing what has drifted from the manifest.
+package pki
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+	"gopkg.in/yaml.v3"
+)
+
+// Key types of generated keys.
+const (
+	KeyTypeRSA = certmanager.KeyTypeRSA
+	KeyTypeEC  = certmanager.KeyTypeEC
+)
+
+// Default validities.
+const (
+	defaultCAValidity   = 10 * 365 * 24 * time.Hour
+	defaultCertValidity = 365 * 24 * time.Hour
+)
+
+// Manifest declares the CAs and leaf certificates of a PKI.
+type Manifest struct {
+	CAs          []CA          `yaml:"cas"`
+	Certificates []Certificate `yaml:"certificates"`
+
+	// Profiles which certificates may be issued with, by name, as in the
+	// certmanager config file.
+	Profiles map[string]certmanager.Profile `yaml:"profiles"`
+}
+
+// CA is a certificate authority kept in the store.
+type CA struct {
+	// Name is the common name of the CA, and how certificates refer to it.
+	Name string `yaml:"name"`
+
+	// URL is the certificate URL of the CA in the store, e.g.
+	// https://myvault.azure.net/certificates/myca.
+	URL string `yaml:"url"`
+
+	// Issuer is the name of the CA which signs this CA as an intermediate.
+	// The CA is self-signed if empty.
+	Issuer string `yaml:"issuer"`
+
+	// KeyType of the CA key. Only rsa is supported for CAs.
+	KeyType string `yaml:"keyType"`
+
+	// Validity is how long the CA is valid, ten years by default. It never
+	// outlives its issuer.
+	Validity time.Duration `yaml:"validity"`
+
+	// RenewBefore is how long before expiry the CA is renewed, a third of
+	// its validity by default.
+	RenewBefore time.Duration `yaml:"renewBefore"`
+
+	// MaxPathLen is how many intermediate CAs may follow the CA in a chain.
+	// It must be at least 1 for CAs which issue other CAs.
+	MaxPathLen int `yaml:"maxPathLen"`
+
+	// PermittedDNSDomains and ExcludedDNSDomains are the name constraints of
+	// the CA.
+	PermittedDNSDomains []string `yaml:"permittedDnsDomains"`
+	ExcludedDNSDomains  []string `yaml:"excludedDnsDomains"`
+
+	// Format in which the CA is stored, pkcs12 (default) or pem.
+	Format string `yaml:"format"`
+
+	// PasswordEnv is the environment variable holding the password of the
+	// CA in the store, if any.
+	PasswordEnv string `yaml:"passwordEnv"`
+}
+
+// Certificate is a leaf certificate issued by one of the CAs, kept in the
+// store, on disk or both.
+type Certificate struct {
+	Name string `yaml:"name"`
+
+	// Issuer is the name of the CA which signs the certificate.
+	Issuer string `yaml:"issuer"`
+
+	// CommonName and SANs of the certificate. SANs may be DNS names, IP
+	// addresses or URIs, e.g. spiffe://example.org/api.
+	CommonName string   `yaml:"commonName"`
+	SANs       []string `yaml:"sans"`
+
+	// Profile is the name of the profile the certificate is issued with.
+	// The key type and validity of the profile apply unless they are set on
+	// the certificate.
+	Profile string `yaml:"profile"`
+
+	// KeyType of the certificate key, rsa (default) or ec.
+	KeyType string `yaml:"keyType"`
+
+	// Validity is how long the certificate is valid, one year by default.
+	// It never outlives its issuer, nor the validity of its profile.
+	Validity time.Duration `yaml:"validity"`
+
+	// RenewBefore is how long before expiry the certificate is renewed, a
+	// third of its validity by default.
+	RenewBefore time.Duration `yaml:"renewBefore"`
+
+	// URL is the certificate URL in the store, if the certificate is kept
+	// there. Format and PasswordEnv are as for CAs.
+	URL         string `yaml:"url"`
+	Format      string `yaml:"format"`
+	PasswordEnv string `yaml:"passwordEnv"`
+
+	// CertPath is where the certificate chain is written as PEM, without
+	// the root. KeyPath is where the key is written, and CAPath where the
+	// root is written, if set.
+	CertPath string `yaml:"certPath"`
+	KeyPath  string `yaml:"keyPath"`
+	CAPath   string `yaml:"caPath"`
+}
+
+// Load reads a YAML manifest file.
+func Load(path string) (Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to read manifest, err: %v", err)
+	}
+	var m Manifest
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return Manifest{}, fmt.Errorf("failed to parse manifest, err: %v", err)
+	}
+	return m, nil
+}
+
+func (m Manifest) validate() error {
+	if len(m.CAs) == 0 && len(m.Certificates) == 0 {
+		return errors.New("manifest declares no CAs or certificates")
+	}
+
+	cas := make(map[string]CA)
+	for _, ca := range m.CAs {
+		if err := ca.validate(); err != nil {
+			return fmt.Errorf("invalid CA '%v', err: %v", ca.Name, err)
+		}
+		if _, ok := cas[ca.Name]; ok {
+			return fmt.Errorf("CA name '%v' is used more than once", ca.Name)
+		}
+		cas[ca.Name] = ca
+	}
+	for _, ca := range m.CAs {
+		if ca.Issuer == "" {
+			continue
+		}
+		issuer, ok := cas[ca.Issuer]
+		if !ok {
+			return fmt.Errorf("CA '%v' is issued by unknown CA '%v'", ca.Name, ca.Issuer)
+		}
+		if issuer.MaxPathLen == 0 {
+			return fmt.Errorf("CA '%v' must have a maxPathLen of at least 1 to issue CA '%v'", issuer.Name, ca.Name)
+		}
+	}
+	if _, err := m.orderedCAs(); err != nil {
+		return err
+	}
+
+	for name, p := range m.Profiles {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("invalid profile '%v', err: %v", name, err)
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, c := range m.Certificates {
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("invalid certificate '%v', err: %v", c.Name, err)
+		}
+		if _, ok := cas[c.Issuer]; !ok {
+			return fmt.Errorf("certificate '%v' is issued by unknown CA '%v'", c.Name, c.Issuer)
+		}
+		if _, ok := m.Profiles[c.Profile]; c.Profile != "" && !ok {
+			return fmt.Errorf("certificate '%v' uses unknown profile '%v'", c.Name, c.Profile)
+		}
+		if names[c.Name] {
+			return fmt.Errorf("certificate name '%v' is used more than once", c.Name)
+		}
+		names[c.Name] = true
+	}
+	return nil
+}
+
+// resolve returns the certificate with the defaults of its profile applied,
+// and the profile if it has one.
+func (m Manifest) resolve(c Certificate) (Certificate, *certmanager.Profile) {
+	if c.Profile == "" {
+		return c, nil
+	}
+	p, ok := m.Profiles[c.Profile]
+	if !ok {
+		return c, nil
+	}
+	if c.KeyType == "" {
+		c.KeyType = p.KeyType
+	}
+	if c.Validity == 0 || (p.Validity > 0 && c.Validity > p.Validity) {
+		c.Validity = p.Validity
+	}
+	if p.SANs.IncludeCommonName && c.CommonName != "" && net.ParseIP(c.CommonName) == nil && !contains(c.SANs, c.CommonName) {
+		c.SANs = append([]string{c.CommonName}, c.SANs...)
+	}
+	return c, &p
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// orderedCAs returns the CAs ordered so that every CA follows its issuer.
+func (m Manifest) orderedCAs() ([]CA, error) {
+	var ordered []CA
+	done := make(map[string]bool)
+	for len(ordered) < len(m.CAs) {
+		progress := false
+		for _, ca := range m.CAs {
+			if done[ca.Name] || (ca.Issuer != "" && !done[ca.Issuer]) {
+				continue
+			}
+			ordered = append(ordered, ca)
+			done[ca.Name] = true
+			progress = true
+		}
+		if !progress {
+			return nil, errors.New("CAs issue each other in a cycle")
+		}
+	}
+	return ordered, nil
+}
+
+func (c CA) validate() error {
+	if c.Name == "" {
+		return errors.New("name is required")
+	}
+	if !strings.HasSuffix(c.URL, "/certificates/"+c.Name) {
+		return errors.New("url must be a certificate URL ending with the name, e.g. https://myvault.azure.net/certificates/myca")
+	}
+	if c.KeyType != "" && c.KeyType != KeyTypeRSA {
+		return fmt.Errorf("key type of CAs must be %v", KeyTypeRSA)
+	}
+	if c.Validity < 0 || c.RenewBefore < 0 {
+		return errors.New("validity and renewBefore must not be negative")
+	}
+	if c.MaxPathLen < 0 {
+		return errors.New("maxPathLen must not be negative")
+	}
+	return validateFormat(c.Format)
+}
+
+func (c Certificate) validate() error {
+	if c.Name == "" {
+		return errors.New("name is required")
+	}
+	if c.CommonName == "" && len(c.SANs) == 0 {
+		return errors.New("commonName or sans is required")
+	}
+	for _, san := range c.SANs {
+		if strings.HasPrefix(san, "spiffe://") {
+			if _, err := certmanager.ParseSPIFFEID(san); err != nil {
+				return err
+			}
+		}
+	}
+	if c.KeyType != "" && c.KeyType != KeyTypeRSA && c.KeyType != KeyTypeEC {
+		return fmt.Errorf("key type must be %v or %v", KeyTypeRSA, KeyTypeEC)
+	}
+	if c.Validity < 0 || c.RenewBefore < 0 {
+		return errors.New("validity and renewBefore must not be negative")
+	}
+	if c.URL == "" && c.CertPath == "" {
+		return errors.New("url or certPath is required")
+	}
+	if c.URL != "" && !strings.Contains(c.URL, "/certificates/") {
+		return errors.New("url must be a certificate URL, e.g. https://myvault.azure.net/certificates/mycert")
+	}
+	if c.CertPath != "" && c.KeyPath == "" {
+		return errors.New("keyPath is required with certPath")
+	}
+	if c.CertPath == "" && (c.KeyPath != "" || c.CAPath != "") {
+		return errors.New("keyPath and caPath require certPath")
+	}
+	return validateFormat(c.Format)
+}
+
+func validateFormat(format string) error {
+	if format != "" && format != certmanager.FormatPKCS12 && format != certmanager.FormatPEM {
+		return fmt.Errorf("format must be %v or %v", certmanager.FormatPKCS12, certmanager.FormatPEM)
+	}
+	return nil
+}
+
+// validity returns the configured validity and renewal margin, or their
+// defaults.
+func validity(validity, renewBefore, defaultValidity time.Duration) (time.Duration, time.Duration) {
+	if validity == 0 {
+		validity = defaultValidity
+	}
+	if renewBefore == 0 {
+		renewBefore = validity / 3
+	}
+	return validity, renewBefore
+}
+
+// secretURL returns the secret URL from which a certificate uploaded to the
+// certificate URL is retrieved.
+func secretURL(certURL string) string {
+	return strings.Replace(certURL, "/certificates/", "/secrets/", 1)
+}
+
+// sanList returns the SANs of a certificate in a canonical form.
+func sanList(dnsNames []string, ips []net.IP, uris []string) []string {
+	sans := append([]string{}, dnsNames...)
+	for _, ip := range ips {
+		sans = append(sans, ip.String())
+	}
+	return append(sans, uris...)
+}
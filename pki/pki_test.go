@@ -0,0 +1,222 @@
+package pki
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+)
+
+// fakeStore keeps uploaded certificates in memory, by secret URL.
+type fakeStore struct {
+	mu      sync.Mutex
+	certs   map[string]material
+	uploads []string
+}
+
+func (s *fakeStore) GetCertSigner(ctx context.Context, url string, certPassword string, opts ...certmanager.GetCertOption) (*x509.Certificate, []*x509.Certificate, crypto.Signer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.certs[url]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("secret %v %w", url, certmanager.ErrNotFound)
+	}
+	return m.cert, m.caCerts, m.key, nil
+}
+
+func (s *fakeStore) UploadCert(ctx context.Context, url string, cert *x509.Certificate, caCerts []*x509.Certificate, key crypto.Signer, certPassword string, opts ...certmanager.UploadCertOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.certs == nil {
+		s.certs = make(map[string]material)
+	}
+	s.certs[secretURL(url)] = material{cert: cert, caCerts: caCerts, key: key}
+	s.uploads = append(s.uploads, url[strings.LastIndex(url, "/")+1:])
+	return nil
+}
+
+func testManifest(dir string) Manifest {
+	return Manifest{
+		CAs: []CA{
+			// Listed out of order, issuers are created first
+			{Name: "issuing", URL: "https://test.vault.azure.net/certificates/issuing", Issuer: "root"},
+			{Name: "root", URL: "https://test.vault.azure.net/certificates/root", MaxPathLen: 1, PermittedDNSDomains: []string{"example.com"}},
+		},
+		Certificates: []Certificate{
+			{
+				Name:       "api",
+				Issuer:     "issuing",
+				CommonName: "api.example.com",
+				SANs:       []string{"api.example.com", "10.0.0.1"},
+				KeyType:    KeyTypeEC,
+				URL:        "https://test.vault.azure.net/certificates/api",
+				CertPath:   filepath.Join(dir, "api.crt"),
+				KeyPath:    filepath.Join(dir, "api.key"),
+				CAPath:     filepath.Join(dir, "ca.crt"),
+			},
+			{
+				Name:       "web",
+				Issuer:     "issuing",
+				CommonName: "web.example.com",
+				CertPath:   filepath.Join(dir, "web.crt"),
+				KeyPath:    filepath.Join(dir, "web.key"),
+			},
+		},
+	}
+}
+
+func planActions(t *testing.T, p *Planner) (*Plan, []string) {
+	t.Helper()
+	plan, err := p.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, a := range plan.Actions {
+		actions = append(actions, a.Kind+" "+a.Name)
+	}
+	return plan, actions
+}
+
+func TestPlanner(t *testing.T) {
+	dir := t.TempDir()
+	store := &fakeStore{}
+	m := testManifest(dir)
+	p, err := New(m, WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	apply := func(t *testing.T, want ...string) {
+		t.Helper()
+		plan, got := planActions(t, p)
+		if strings.Join(got, ", ") != strings.Join(want, ", ") {
+			t.Fatalf("want actions %v, got %v", want, got)
+		}
+		if err := p.Apply(ctx, plan); err != nil {
+			t.Fatal(err)
+		}
+		if _, got := planActions(t, p); len(got) > 0 {
+			t.Fatalf("want no actions after apply, got %v", got)
+		}
+	}
+
+	t.Run("create", func(t *testing.T) {
+		apply(t, "create root", "create issuing", "create api", "create web")
+
+		data, err := os.ReadFile(filepath.Join(dir, "api.crt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(string(data), "BEGIN CERTIFICATE"); n != 2 {
+			t.Errorf("want api and issuing in the chain, got %v certificates", n)
+		}
+		issuing := store.certs[secretURL(m.CAs[0].URL)].cert
+		if len(issuing.PermittedDNSDomains) != 1 {
+			t.Errorf("want issuing CA to inherit name constraints, got %v", issuing.PermittedDNSDomains)
+		}
+	})
+
+	t.Run("drift", func(t *testing.T) {
+		p.manifest.Certificates[0].SANs = []string{"api.example.com"}
+		apply(t, "reissue api")
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		if err := os.Remove(filepath.Join(dir, "api.key")); err != nil {
+			t.Fatal(err)
+		}
+		store.uploads = nil
+		apply(t, "write api")
+		if len(store.uploads) > 0 {
+			t.Errorf("want no uploads when writing files, got %v", store.uploads)
+		}
+	})
+
+	t.Run("expiring issuer", func(t *testing.T) {
+		p.now = func() time.Time { return time.Now().AddDate(8, 0, 0) }
+		defer func() { p.now = time.Now }()
+		_, got := planActions(t, p)
+		want := "renew root, reissue issuing, reissue api, reissue web"
+		if strings.Join(got, ", ") != want {
+			t.Errorf("want actions %v, got %v", want, got)
+		}
+	})
+}
+
+func TestManifest_validate(t *testing.T) {
+	valid := testManifest(t.TempDir())
+	for _, tc := range []struct {
+		name    string
+		modify  func(m *Manifest)
+		wantErr string
+	}{
+		{"valid", func(m *Manifest) {}, ""},
+		{"unknown issuer", func(m *Manifest) { m.Certificates[0].Issuer = "other" }, "unknown CA 'other'"},
+		{"max path len", func(m *Manifest) { m.CAs[1].MaxPathLen = 0 }, "maxPathLen of at least 1"},
+		{"cycle", func(m *Manifest) { m.CAs[1].Issuer = "issuing"; m.CAs[0].MaxPathLen = 1 }, "cycle"},
+		{"CA key type", func(m *Manifest) { m.CAs[0].KeyType = KeyTypeEC }, "key type of CAs"},
+		{"URL name", func(m *Manifest) { m.CAs[0].URL = "https://test.vault.azure.net/certificates/other" }, "ending with the name"},
+		{"no outputs", func(m *Manifest) { m.Certificates[1].CertPath = "" }, "url or certPath"},
+		{"duplicate", func(m *Manifest) { m.Certificates[1].Name = "api" }, "more than once"},
+		{"unknown profile", func(m *Manifest) { m.Certificates[0].Profile = "grpc-server" }, "unknown profile"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := valid
+			m.CAs = append([]CA{}, valid.CAs...)
+			m.Certificates = append([]Certificate{}, valid.Certificates...)
+			tc.modify(&m)
+			err := m.validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("want error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pki.yaml")
+	data := `
+cas:
+  - name: root
+    url: https://test.vault.azure.net/certificates/root
+    validity: 87600h
+    maxPathLen: 1
+certificates:
+  - name: api
+    issuer: root
+    commonName: api.example.com
+    sans: [api.example.com]
+    keyType: ec
+    validity: 720h
+    url: https://test.vault.azure.net/certificates/api
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if m.CAs[0].Validity != 87600*time.Hour || m.Certificates[0].Validity != 720*time.Hour {
+		t.Errorf("want validities to be parsed, got %v and %v", m.CAs[0].Validity, m.Certificates[0].Validity)
+	}
+}
@@ -0,0 +1,334 @@
+package pki
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sebnyberg/certmanager"
+)
+
+// Kinds of actions.
+const (
+	// ActionCreate generates a CA or certificate which does not exist.
+	ActionCreate = "create"
+
+	// ActionRenew replaces a CA or certificate which is about to expire.
+	ActionRenew = "renew"
+
+	// ActionReissue replaces a CA or certificate which no longer matches the
+	// manifest, or whose issuer is replaced.
+	ActionReissue = "reissue"
+
+	// ActionWrite writes the files of a certificate which is up to date in
+	// the store, but not on disk.
+	ActionWrite = "write"
+)
+
+// Action is an operation needed for the store and files to match the
+// manifest.
+type Action struct {
+	Kind string
+
+	// CA is true if the action concerns a CA, and false if it concerns a
+	// certificate.
+	CA   bool
+	Name string
+
+	// Reason explains why the action is needed, e.g. "expires at ...".
+	Reason string
+}
+
+func (a Action) String() string {
+	object := "certificate"
+	if a.CA {
+		object = "CA"
+	}
+	return fmt.Sprintf("%v %v %v: %v", a.Kind, object, a.Name, a.Reason)
+}
+
+// Plan lists the actions needed for the store and files to match the
+// manifest, in the order they are applied. A Plan is applied at most once.
+type Plan struct {
+	Actions []Action
+
+	// CAs and certificates found in the store or on disk, by name. Apply
+	// replaces them as it goes, so that issuers are up to date.
+	cas   map[string]*material
+	certs map[string]*material
+}
+
+// material is a certificate, its chain as kept in the store, and its key.
+type material struct {
+	cert    *x509.Certificate
+	caCerts []*x509.Certificate
+	key     crypto.Signer
+}
+
+// Store is the part of *certmanager.Store used by a Planner.
+type Store interface {
+	GetCertSigner(ctx context.Context, url string, certPassword string, opts ...certmanager.GetCertOption) (*x509.Certificate, []*x509.Certificate, crypto.Signer, error)
+	UploadCert(ctx context.Context, url string, cert *x509.Certificate, caCerts []*x509.Certificate, key crypto.Signer, certPassword string, opts ...certmanager.UploadCertOption) error
+}
+
+// defaultStore uses the store shared by the package-level functions of
+// certmanager.
+type defaultStore struct{}
+
+func (defaultStore) GetCertSigner(ctx context.Context, url string, certPassword string, opts ...certmanager.GetCertOption) (*x509.Certificate, []*x509.Certificate, crypto.Signer, error) {
+	return certmanager.GetCertSigner(ctx, url, certPassword, opts...)
+}
+
+func (defaultStore) UploadCert(ctx context.Context, url string, cert *x509.Certificate, caCerts []*x509.Certificate, key crypto.Signer, certPassword string, opts ...certmanager.UploadCertOption) error {
+	return certmanager.UploadCert(ctx, url, cert, caCerts, key, certPassword, opts...)
+}
+
+// Planner plans and applies the changes needed for the store and files to
+// match a manifest.
+type Planner struct {
+	manifest Manifest
+	store    Store
+	now      func() time.Time
+}
+
+// Option configures a Planner.
+type Option func(*Planner)
+
+// WithStore sets the store holding the CAs and certificates. By default, the
+// store shared by the package-level functions of certmanager is used.
+func WithStore(s Store) Option {
+	return func(p *Planner) {
+		p.store = s
+	}
+}
+
+// New creates a planner for the manifest.
+func New(m Manifest, opts ...Option) (*Planner, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	p := &Planner{
+		manifest: m,
+		store:    defaultStore{},
+		now:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p, nil
+}
+
+// Plan compares the manifest with the store and files, and returns the
+// actions needed for them to match. Nothing is changed.
+//
+// When a CA is created, renewed or reissued, everything it issues is
+// reissued as well, since it is signed with a new key.
+func (p *Planner) Plan(ctx context.Context) (*Plan, error) {
+	plan := &Plan{
+		cas:   make(map[string]*material),
+		certs: make(map[string]*material),
+	}
+	replaced := make(map[string]bool)
+
+	cas, err := p.manifest.orderedCAs()
+	if err != nil {
+		return nil, err
+	}
+	for _, ca := range cas {
+		current, err := p.get(ctx, ca.URL, ca.PasswordEnv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get CA '%v', err: %w", ca.Name, err)
+		}
+		if current != nil {
+			plan.cas[ca.Name] = current
+		}
+		kind, reason := p.checkCA(ca, current, plan.cas[ca.Issuer], replaced[ca.Issuer])
+		if kind != "" {
+			plan.Actions = append(plan.Actions, Action{Kind: kind, CA: true, Name: ca.Name, Reason: reason})
+			replaced[ca.Name] = true
+		}
+	}
+
+	for _, c := range p.manifest.Certificates {
+		c, _ := p.manifest.resolve(c)
+		var current *material
+		var err error
+		if c.URL != "" {
+			current, err = p.get(ctx, c.URL, c.PasswordEnv)
+		} else {
+			current, err = readFiles(c)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get certificate '%v', err: %w", c.Name, err)
+		}
+		if current != nil {
+			plan.certs[c.Name] = current
+		}
+		kind, reason := p.checkCert(c, current, plan.cas[c.Issuer], replaced[c.Issuer])
+		if kind == "" && c.URL != "" && c.CertPath != "" {
+			kind, reason = checkFiles(c, current)
+		}
+		if kind != "" {
+			plan.Actions = append(plan.Actions, Action{Kind: kind, Name: c.Name, Reason: reason})
+		}
+	}
+	return plan, nil
+}
+
+// get retrieves a certificate from the store, or returns nil if there is
+// none.
+func (p *Planner) get(ctx context.Context, certURL string, passwordEnv string) (*material, error) {
+	cert, caCerts, key, err := p.store.GetCertSigner(ctx, secretURL(certURL), password(passwordEnv))
+	if errors.Is(err, certmanager.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &material{cert: cert, caCerts: caCerts, key: key}, nil
+}
+
+func (p *Planner) checkCA(ca CA, current *material, issuer *material, issuerReplaced bool) (kind string, reason string) {
+	switch {
+	case current == nil:
+		return ActionCreate, "not found in store"
+	case issuerReplaced:
+		return ActionReissue, fmt.Sprintf("issuer %v is replaced", ca.Issuer)
+	}
+
+	cert := current.cert
+	_, renewBefore := validity(ca.Validity, ca.RenewBefore, defaultCAValidity)
+	if p.now().Add(renewBefore).After(cert.NotAfter) {
+		return ActionRenew, fmt.Sprintf("expires at %v", cert.NotAfter.Format(time.RFC3339))
+	}
+
+	// Intermediates inherit the name constraints of their issuer, see
+	// certmanager.GenIntermediateCA
+	permitted, excluded := ca.PermittedDNSDomains, ca.ExcludedDNSDomains
+	if issuer == nil {
+		if !bytes.Equal(cert.RawIssuer, cert.RawSubject) || cert.CheckSignatureFrom(cert) != nil {
+			return ActionReissue, "not self-signed"
+		}
+	} else {
+		if cert.CheckSignatureFrom(issuer.cert) != nil {
+			return ActionReissue, fmt.Sprintf("not signed by the current %v", ca.Issuer)
+		}
+		if len(permitted) == 0 {
+			permitted = issuer.cert.PermittedDNSDomains
+		}
+		excluded = append(append([]string{}, excluded...), issuer.cert.ExcludedDNSDomains...)
+	}
+
+	switch {
+	case cert.Subject.CommonName != ca.Name:
+		return ActionReissue, fmt.Sprintf("common name is %v, want %v", cert.Subject.CommonName, ca.Name)
+	case cert.MaxPathLen != ca.MaxPathLen:
+		return ActionReissue, fmt.Sprintf("maxPathLen is %v, want %v", cert.MaxPathLen, ca.MaxPathLen)
+	case !sameSet(cert.PermittedDNSDomains, permitted):
+		return ActionReissue, fmt.Sprintf("permitted DNS domains are %v, want %v", cert.PermittedDNSDomains, permitted)
+	case !sameSet(cert.ExcludedDNSDomains, excluded):
+		return ActionReissue, fmt.Sprintf("excluded DNS domains are %v, want %v", cert.ExcludedDNSDomains, excluded)
+	}
+	return "", ""
+}
+
+func (p *Planner) checkCert(c Certificate, current *material, issuer *material, issuerReplaced bool) (kind string, reason string) {
+	switch {
+	case current == nil && c.URL != "":
+		return ActionCreate, "not found in store"
+	case current == nil:
+		return ActionCreate, fmt.Sprintf("%v not found", c.CertPath)
+	case issuerReplaced:
+		return ActionReissue, fmt.Sprintf("issuer %v is replaced", c.Issuer)
+	}
+
+	cert := current.cert
+	_, renewBefore := validity(c.Validity, c.RenewBefore, defaultCertValidity)
+	if p.now().Add(renewBefore).After(cert.NotAfter) {
+		return ActionRenew, fmt.Sprintf("expires at %v", cert.NotAfter.Format(time.RFC3339))
+	}
+
+	var uris []string
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+	sans := sanList(cert.DNSNames, cert.IPAddresses, uris)
+	wantKeyAlgorithm := x509.RSA
+	if c.KeyType == KeyTypeEC {
+		wantKeyAlgorithm = x509.ECDSA
+	}
+
+	switch {
+	case cert.CheckSignatureFrom(issuer.cert) != nil:
+		return ActionReissue, fmt.Sprintf("not signed by the current %v", c.Issuer)
+	case cert.Subject.CommonName != c.CommonName:
+		return ActionReissue, fmt.Sprintf("common name is %v, want %v", cert.Subject.CommonName, c.CommonName)
+	case !sameSet(sans, wantSANs(c.SANs)):
+		return ActionReissue, fmt.Sprintf("SANs are %v, want %v", sans, c.SANs)
+	case cert.PublicKeyAlgorithm != wantKeyAlgorithm:
+		return ActionReissue, fmt.Sprintf("key algorithm is %v, want %v", cert.PublicKeyAlgorithm, wantKeyAlgorithm)
+	}
+	return "", ""
+}
+
+// checkFiles returns a write action if the files of a certificate kept in
+// the store are missing or hold another certificate.
+func checkFiles(c Certificate, current *material) (kind string, reason string) {
+	onDisk, err := readFiles(c)
+	switch {
+	case err != nil:
+		return ActionWrite, err.Error()
+	case onDisk == nil:
+		return ActionWrite, fmt.Sprintf("%v not found", c.CertPath)
+	case !onDisk.cert.Equal(current.cert):
+		return ActionWrite, fmt.Sprintf("%v is out of date", c.CertPath)
+	}
+	for _, path := range []string{c.KeyPath, c.CAPath} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return ActionWrite, fmt.Sprintf("%v not found", path)
+		}
+	}
+	return "", ""
+}
+
+// wantSANs returns the SANs of the manifest in the canonical form of
+// sanList.
+func wantSANs(sans []string) []string {
+	csr, err := newCSRTemplate("", sans)
+	if err != nil {
+		return sans
+	}
+	var uris []string
+	for _, uri := range csr.URIs {
+		uris = append(uris, uri.String())
+	}
+	return sanList(csr.DNSNames, csr.IPAddresses, uris)
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return strings.Join(a, "\n") == strings.Join(b, "\n")
+}
+
+func password(env string) string {
+	if env == "" {
+		return ""
+	}
+	return os.Getenv(env)
+}
@@ -0,0 +1,165 @@
+package certmanager
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Policy restricts which certificates GenSignedCert and SignCSR may sign, see
+// WithPolicy. The zero value allows any certificate.
+//
+// Once any of AllowedNames, AllowedIPRanges or AllowedURIPrefixes is set, the
+// policy is restrictive: every name in a certificate must be allowed by the
+// list for its kind, and names of a kind with an empty list are refused.
+type Policy struct {
+	// AllowedNames are patterns for the common name and the DNS names. A
+	// pattern may start with a wildcard label which matches exactly one
+	// label, e.g. *.example.com matches api.example.com but not example.com.
+	AllowedNames []string
+
+	// AllowedIPRanges are the ranges of allowed IP addresses.
+	AllowedIPRanges []*net.IPNet
+
+	// AllowedURIPrefixes are prefixes of allowed URIs, e.g.
+	// spiffe://example.org/ns/prod/ to allow SPIFFE IDs in a namespace.
+	AllowedURIPrefixes []string
+
+	// DenyWildcards refuses wildcard names such as *.example.com, even if
+	// they are matched by AllowedNames.
+	DenyWildcards bool
+
+	// MaxValidity is the longest time a certificate may be valid for, counted
+	// from when it is signed. Zero means no limit.
+	MaxValidity time.Duration
+}
+
+// SignOption configures the behaviour of GenSignedCert and SignCSR.
+type SignOption func(*signOptions)
+
+type signOptions struct {
+	policy  Policy
+	profile *Profile
+}
+
+// WithPolicy refuses to sign certificates which are not allowed by the
+// policy. The returned error matches ErrPolicyViolation.
+func WithPolicy(p Policy) SignOption {
+	return func(o *signOptions) {
+		o.policy = p
+	}
+}
+
+// WithProfile issues certificates according to the profile: its key
+// usages, subject defaults, SAN rules and validity. Certificates which break
+// the SAN rules are refused with an error matching ErrPolicyViolation.
+func WithProfile(p Profile) SignOption {
+	return func(o *signOptions) {
+		o.profile = &p
+	}
+}
+
+// Check returns an error matching ErrPolicyViolation if the names or the
+// expiry of cert are not allowed by the policy. The expiry is not checked if
+// cert.NotAfter is zero, e.g. when checking requested names in advance.
+func (p Policy) Check(cert *x509.Certificate) error {
+	return p.check(cert, time.Now())
+}
+
+func (p Policy) check(cert *x509.Certificate, now time.Time) error {
+	if p.MaxValidity > 0 && !cert.NotAfter.IsZero() && cert.NotAfter.Sub(now) > p.MaxValidity {
+		return fmt.Errorf("%w: certificate may be valid for at most %v, requested until %v",
+			ErrPolicyViolation, p.MaxValidity, cert.NotAfter.Format(time.RFC3339))
+	}
+
+	for _, name := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+		if strings.HasPrefix(name, "*") && p.DenyWildcards {
+			return fmt.Errorf("%w: wildcard name '%v' is not allowed", ErrPolicyViolation, name)
+		}
+	}
+
+	if !p.restrictive() {
+		return nil
+	}
+	if cn := cert.Subject.CommonName; cn != "" && !p.allowsName(cn) {
+		return fmt.Errorf("%w: common name '%v' is not allowed", ErrPolicyViolation, cn)
+	}
+	for _, name := range cert.DNSNames {
+		if !p.allowsName(name) {
+			return fmt.Errorf("%w: DNS name '%v' is not allowed", ErrPolicyViolation, name)
+		}
+	}
+	for _, ip := range cert.IPAddresses {
+		if !p.allowsIP(ip) {
+			return fmt.Errorf("%w: IP address '%v' is not allowed", ErrPolicyViolation, ip)
+		}
+	}
+	for _, uri := range cert.URIs {
+		if !p.allowsURI(uri.String()) {
+			return fmt.Errorf("%w: URI '%v' is not allowed", ErrPolicyViolation, uri)
+		}
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return fmt.Errorf("%w: email addresses are not allowed", ErrPolicyViolation)
+	}
+	return nil
+}
+
+func (p Policy) restrictive() bool {
+	return len(p.AllowedNames) > 0 || len(p.AllowedIPRanges) > 0 || len(p.AllowedURIPrefixes) > 0
+}
+
+func (p Policy) allowsName(name string) bool {
+	for _, pattern := range p.AllowedNames {
+		if matchDNSPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Policy) allowsIP(ip net.IP) bool {
+	for _, ipNet := range p.AllowedIPRanges {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Policy) allowsURI(uri string) bool {
+	for _, prefix := range p.AllowedURIPrefixes {
+		if strings.HasPrefix(uri, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNameConstraints returns an error matching ErrPolicyViolation if cert
+// is not permitted by the name constraints of the CA which signed it. Such a
+// certificate would be rejected by clients, so it is better not to issue it.
+func checkNameConstraints(caCert *x509.Certificate, cert *x509.Certificate) error {
+	if !hasNameConstraints(caCert) {
+		return nil
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: certificate is not permitted by the name constraints of the CA, err: %v", ErrPolicyViolation, err)
+	}
+	return nil
+}
+
+func hasNameConstraints(cert *x509.Certificate) bool {
+	return len(cert.PermittedDNSDomains) > 0 || len(cert.ExcludedDNSDomains) > 0 ||
+		len(cert.PermittedIPRanges) > 0 || len(cert.ExcludedIPRanges) > 0 ||
+		len(cert.PermittedURIDomains) > 0 || len(cert.ExcludedURIDomains) > 0 ||
+		len(cert.PermittedEmailAddresses) > 0 || len(cert.ExcludedEmailAddresses) > 0
+}
@@ -0,0 +1,182 @@
+package certmanager
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPolicy_check(t *testing.T) {
+	now := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+	_, ipNet, _ := net.ParseCIDR("10.0.0.0/8")
+	restricted := Policy{
+		AllowedNames:       []string{"*.example.com", "client"},
+		AllowedIPRanges:    []*net.IPNet{ipNet},
+		AllowedURIPrefixes: []string{"spiffe://example.org/ns/prod/"},
+	}
+	mustURL := func(s string) *url.URL {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	for _, tc := range []struct {
+		name    string
+		policy  Policy
+		cert    *x509.Certificate
+		wantErr bool
+	}{
+		{"zero policy", Policy{}, &x509.Certificate{
+			Subject:  pkix.Name{CommonName: "*.google.com"},
+			DNSNames: []string{"*.google.com"},
+			NotAfter: now.AddDate(100, 0, 0),
+		}, false},
+		{"allowed", restricted, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "client"},
+			DNSNames:    []string{"api.example.com"},
+			IPAddresses: []net.IP{net.ParseIP("10.1.2.3")},
+			URIs:        []*url.URL{mustURL("spiffe://example.org/ns/prod/sa/api")},
+		}, false},
+		{"common name", restricted, &x509.Certificate{Subject: pkix.Name{CommonName: "other"}}, true},
+		{"dns name", restricted, &x509.Certificate{DNSNames: []string{"www.google.com"}}, true},
+		{"dns name too deep", restricted, &x509.Certificate{DNSNames: []string{"a.b.example.com"}}, true},
+		{"ip address", restricted, &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("192.168.0.1")}}, true},
+		{"uri", restricted, &x509.Certificate{URIs: []*url.URL{mustURL("spiffe://example.org/ns/dev/sa/api")}}, true},
+		{"email", restricted, &x509.Certificate{EmailAddresses: []string{"admin@example.com"}}, true},
+		{"ip without ranges", Policy{AllowedNames: []string{"client"}}, &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.1.2.3")}}, true},
+		{"wildcard", Policy{DenyWildcards: true}, &x509.Certificate{DNSNames: []string{"*.example.com"}}, true},
+		{"wildcard common name", Policy{DenyWildcards: true}, &x509.Certificate{Subject: pkix.Name{CommonName: "*.example.com"}}, true},
+		{"wildcard allowed", restricted, &x509.Certificate{DNSNames: []string{"*.example.com"}}, false},
+		{"validity", Policy{MaxValidity: 24 * time.Hour}, &x509.Certificate{NotAfter: now.Add(24 * time.Hour)}, false},
+		{"validity too long", Policy{MaxValidity: 24 * time.Hour}, &x509.Certificate{NotAfter: now.Add(25 * time.Hour)}, true},
+		{"validity not requested", Policy{MaxValidity: 24 * time.Hour}, &x509.Certificate{}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.policy.check(tc.cert, now)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("want err: %v, got %v", tc.wantErr, err)
+			}
+			if err != nil && !errors.Is(err, ErrPolicyViolation) {
+				t.Errorf("want %v, got %v", ErrPolicyViolation, err)
+			}
+		})
+	}
+}
+
+func TestGenSignedCert_policy(t *testing.T) {
+	caCert, caKey, err := GenSelfSignedCA("test-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := WithPolicy(Policy{AllowedNames: []string{"*.example.com"}, DenyWildcards: true})
+
+	if _, _, err := GenSignedCert(caCert, caKey, "api.example.com", []string{"api.example.com"}, time.Now().Add(time.Hour), policy); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = GenSignedCert(caCert, caKey, "api.example.com", []string{"*.google.com"}, time.Now().Add(time.Hour), policy)
+	if !errors.Is(err, ErrPolicyViolation) {
+		t.Errorf("want %v, got %v", ErrPolicyViolation, err)
+	}
+}
+
+func TestNameConstraints(t *testing.T) {
+	expiry := time.Now().Add(time.Hour)
+	rootCert, rootKey, err := GenSelfSignedCA("test-root", expiry,
+		WithMaxPathLen(1),
+		WithNameConstraints(NameConstraints{
+			PermittedDNSDomains: []string{"example.com"},
+			PermittedURIDomains: []string{"example.org"},
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rootCert.PermittedDNSDomainsCritical {
+		t.Error("want critical name constraints")
+	}
+
+	// A CA which only issues leaf certificates cannot sign intermediates
+	leafCA, leafCAKey, err := GenSelfSignedCA("test-leaf-ca", expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := GenIntermediateCA(leafCA, leafCAKey, "test-intermediate", expiry); err == nil {
+		t.Error("want error for CA with path length zero")
+	}
+
+	intCert, intKey, err := GenIntermediateCA(rootCert, rootKey, "test-intermediate", expiry.Add(time.Hour),
+		WithNameConstraints(NameConstraints{ExcludedDNSDomains: []string{"secret.example.com"}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !intCert.NotAfter.Equal(rootCert.NotAfter) {
+		t.Errorf("want intermediate to expire with the root at %v, got %v", rootCert.NotAfter, intCert.NotAfter)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intCert)
+
+	// GenSignedCert
+	for _, tc := range []struct {
+		name    string
+		sans    []string
+		wantErr bool
+	}{
+		{"permitted", []string{"api.example.com", "spiffe://example.org/api"}, false},
+		{"not permitted", []string{"www.google.com"}, true},
+		{"excluded by intermediate", []string{"db.secret.example.com"}, true},
+		{"uri not permitted", []string{"api.example.com", "spiffe://other.org/api"}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cert, _, err := GenSignedCert(intCert, intKey, "leaf", tc.sans, expiry)
+			if tc.wantErr {
+				if !errors.Is(err, ErrPolicyViolation) {
+					t.Fatalf("want %v, got %v", ErrPolicyViolation, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = cert.Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			})
+			if err != nil {
+				t.Errorf("failed to verify chain, err: %v", err)
+			}
+		})
+	}
+
+	// SignCSR
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: []string{"www.google.com"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SignCSR(intCert, intKey, csr, expiry); !errors.Is(err, ErrPolicyViolation) {
+		t.Errorf("want %v, got %v", ErrPolicyViolation, err)
+	}
+}
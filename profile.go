@@ -0,0 +1,374 @@
+package certmanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	asn1pkix "crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Key types of generated keys.
+const (
+	KeyTypeRSA = "rsa"
+	KeyTypeEC  = "ec"
+)
+
+// Profile is a named template for certificates, e.g. grpc-server, so that
+// certificates for the same purpose are issued alike. Profiles are defined in
+// the config file, see LoadProfiles, and applied with WithProfile.
+type Profile struct {
+	// KeyType of generated keys, KeyTypeRSA (default) or KeyTypeEC.
+	KeyType string `yaml:"keyType"`
+
+	// KeyUsages, e.g. digitalSignature and keyEncipherment. By default,
+	// digitalSignature and keyAgreement, and keyEncipherment and
+	// dataEncipherment for RSA keys.
+	KeyUsages []string `yaml:"keyUsages"`
+
+	// ExtKeyUsages, e.g. serverAuth and clientAuth, which is the default.
+	ExtKeyUsages []string `yaml:"extKeyUsages"`
+
+	// Validity is how long certificates are valid by default, and at most.
+	Validity time.Duration `yaml:"validity"`
+
+	// Subject holds defaults for the subject, which are used for the fields
+	// of the requested subject which are empty.
+	Subject ProfileSubject `yaml:"subject"`
+
+	// SANs restricts and completes the SANs of certificates.
+	SANs SANRules `yaml:"sans"`
+}
+
+// ProfileSubject holds subject defaults of a Profile.
+type ProfileSubject struct {
+	Organization       []string `yaml:"organization"`
+	OrganizationalUnit []string `yaml:"organizationalUnit"`
+	Country            []string `yaml:"country"`
+	Province           []string `yaml:"province"`
+	Locality           []string `yaml:"locality"`
+}
+
+// SANRules restrict and complete the SANs of certificates issued with a
+// Profile. Certificates which break the rules are refused with an error
+// matching ErrPolicyViolation.
+type SANRules struct {
+	// IncludeCommonName adds the common name as a DNS name, since clients
+	// ignore the common name when a certificate has SANs.
+	IncludeCommonName bool `yaml:"includeCommonName"`
+
+	// Required refuses certificates without SANs.
+	Required bool `yaml:"required"`
+
+	// AllowedNames are patterns for the DNS names, see Policy.AllowedNames.
+	// Any DNS name is allowed if empty.
+	AllowedNames []string `yaml:"allowedNames"`
+
+	// AllowIPs and AllowURIs allow IP address and URI SANs, e.g. SPIFFE IDs.
+	AllowIPs  bool `yaml:"allowIps"`
+	AllowURIs bool `yaml:"allowUris"`
+
+	// DenyWildcards refuses wildcard DNS names.
+	DenyWildcards bool `yaml:"denyWildcards"`
+}
+
+var keyUsages = map[string]x509.KeyUsage{
+	"digitalSignature":  x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+	"dataEncipherment":  x509.KeyUsageDataEncipherment,
+	"keyAgreement":      x509.KeyUsageKeyAgreement,
+}
+
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"any":             x509.ExtKeyUsageAny,
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"timeStamping":    x509.ExtKeyUsageTimeStamping,
+	"ocspSigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// Validate returns an error if the profile has an unknown key type or
+// usage.
+func (p Profile) Validate() error {
+	if p.KeyType != "" && p.KeyType != KeyTypeRSA && p.KeyType != KeyTypeEC {
+		return fmt.Errorf("key type must be %v or %v", KeyTypeRSA, KeyTypeEC)
+	}
+	if p.Validity < 0 {
+		return errors.New("validity must not be negative")
+	}
+	if _, err := p.keyUsage(nil); err != nil {
+		return err
+	}
+	if _, err := p.extKeyUsage(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// keyUsage returns the key usage of certificates for pub.
+func (p Profile) keyUsage(pub crypto.PublicKey) (x509.KeyUsage, error) {
+	if len(p.KeyUsages) == 0 {
+		return defaultKeyUsage(pub), nil
+	}
+	var usage x509.KeyUsage
+	for _, name := range p.KeyUsages {
+		u, ok := keyUsages[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown key usage '%v', must be one of %v", name, usageNames(keyUsageNames()...))
+		}
+		usage |= u
+	}
+	return usage, nil
+}
+
+func (p Profile) extKeyUsage() ([]x509.ExtKeyUsage, error) {
+	if len(p.ExtKeyUsages) == 0 {
+		return defaultExtKeyUsage(), nil
+	}
+	var usages []x509.ExtKeyUsage
+	for _, name := range p.ExtKeyUsages {
+		u, ok := extKeyUsages[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown extended key usage '%v', must be one of %v", name, usageNames(extKeyUsageNames()...))
+		}
+		usages = append(usages, u)
+	}
+	return usages, nil
+}
+
+func usageNames(names ...string) string {
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func keyUsageNames() []string {
+	var names []string
+	for name := range keyUsages {
+		names = append(names, name)
+	}
+	return names
+}
+
+func extKeyUsageNames() []string {
+	var names []string
+	for name := range extKeyUsages {
+		names = append(names, name)
+	}
+	return names
+}
+
+func defaultKeyUsage(pub crypto.PublicKey) x509.KeyUsage {
+	usage := x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		usage |= x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment
+	}
+	return usage
+}
+
+func defaultExtKeyUsage() []x509.ExtKeyUsage {
+	return []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+}
+
+// subject returns the subject with the defaults of the profile filled in.
+func (p Profile) subject(s asn1pkix.Name) asn1pkix.Name {
+	fill := func(dst *[]string, def []string) {
+		if len(*dst) == 0 {
+			*dst = def
+		}
+	}
+	fill(&s.Organization, p.Subject.Organization)
+	fill(&s.OrganizationalUnit, p.Subject.OrganizationalUnit)
+	fill(&s.Country, p.Subject.Country)
+	fill(&s.Province, p.Subject.Province)
+	fill(&s.Locality, p.Subject.Locality)
+	return s
+}
+
+// complete adds the common name to the DNS names of tmpl if required.
+func (r SANRules) complete(tmpl *x509.Certificate) {
+	cn := tmpl.Subject.CommonName
+	if !r.IncludeCommonName || cn == "" || net.ParseIP(cn) != nil {
+		return
+	}
+	for _, name := range tmpl.DNSNames {
+		if strings.EqualFold(name, cn) {
+			return
+		}
+	}
+	tmpl.DNSNames = append([]string{cn}, tmpl.DNSNames...)
+}
+
+// check returns an error matching ErrPolicyViolation if cert breaks the
+// rules.
+func (r SANRules) check(cert *x509.Certificate) error {
+	if r.Required && len(cert.DNSNames)+len(cert.IPAddresses)+len(cert.URIs) == 0 {
+		return fmt.Errorf("%w: the profile requires SANs", ErrPolicyViolation)
+	}
+	for _, name := range cert.DNSNames {
+		if r.DenyWildcards && strings.HasPrefix(name, "*") {
+			return fmt.Errorf("%w: wildcard name '%v' is not allowed by the profile", ErrPolicyViolation, name)
+		}
+		if len(r.AllowedNames) > 0 && !(Policy{AllowedNames: r.AllowedNames}).allowsName(name) {
+			return fmt.Errorf("%w: DNS name '%v' is not allowed by the profile", ErrPolicyViolation, name)
+		}
+	}
+	if len(cert.IPAddresses) > 0 && !r.AllowIPs {
+		return fmt.Errorf("%w: IP addresses are not allowed by the profile", ErrPolicyViolation)
+	}
+	if len(cert.URIs) > 0 && !r.AllowURIs {
+		return fmt.Errorf("%w: URIs are not allowed by the profile", ErrPolicyViolation)
+	}
+	return nil
+}
+
+// GenKey generates a key of the given type, KeyTypeRSA (2048 bits) or
+// KeyTypeEC (P-256). An empty type generates an RSA key.
+func GenKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "", KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeEC:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	return nil, fmt.Errorf("key type must be %v or %v", KeyTypeRSA, KeyTypeEC)
+}
+
+// GenSignedCertSigner is like GenSignedCert, but the CA key and the
+// generated key may be of any type supported by crypto/x509. The key is of
+// the type of the profile given with WithProfile, or RSA. SANs may also be IP
+// addresses.
+//
+// If expiry is zero, the certificate is valid for the validity of the
+// profile.
+func GenSignedCertSigner(
+	caCert *x509.Certificate,
+	caKey crypto.Signer,
+	commonName string,
+	sans []string,
+	expiry time.Time,
+	opts ...SignOption,
+) (*x509.Certificate, crypto.Signer, error) {
+	var o signOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var ips []net.IP
+	var names []string
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			names = append(names, san)
+		}
+	}
+	dnsNames, uris, err := splitSANs(names)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var keyType string
+	if o.profile != nil {
+		keyType = o.profile.KeyType
+	}
+	key, err := GenKey(keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     asn1pkix.Name{CommonName: commonName},
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+		URIs:        uris,
+	}, key)
+	if err != nil {
+		return nil, nil, appendErr("failed to create CSR", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := SignCSR(caCert, caKey, csr, expiry, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// ConfigPath returns the path of the certmanager config file: the
+// CERTMANAGER_CONFIG environment variable if set, otherwise
+// $XDG_CONFIG_HOME/certmanager/config.yaml, by default
+// ~/.config/certmanager/config.yaml.
+func ConfigPath() (string, error) {
+	if path := os.Getenv("CERTMANAGER_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", appendErr("failed to find the home directory", err)
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "certmanager", "config.yaml"), nil
+}
+
+// LoadProfiles reads the profiles of a config file, see ConfigPath. The
+// profiles are listed by name under the profiles key:
+//
+//	profiles:
+//	  grpc-server:
+//	    keyType: ec
+//	    extKeyUsages: [serverAuth]
+//	    validity: 720h
+//	    sans:
+//	      includeCommonName: true
+//	      allowedNames: ["*.svc.cluster.local"]
+func LoadProfiles(path string) (map[string]Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config, err: %w", err)
+	}
+	var conf struct {
+		Profiles map[string]Profile `yaml:"profiles"`
+	}
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse config, err: %v", err)
+	}
+	for name, p := range conf.Profiles {
+		if err := p.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid profile '%v', err: %v", name, err)
+		}
+	}
+	return conf.Profiles, nil
+}
+
+// LoadProfile reads the named profile of a config file, see LoadProfiles.
+func LoadProfile(path string, name string) (Profile, error) {
+	profiles, err := LoadProfiles(path)
+	if err != nil {
+		return Profile{}, err
+	}
+	p, ok := profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("profile '%v' %w in %v", name, ErrNotFound, path)
+	}
+	return p, nil
+}
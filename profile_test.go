@@ -0,0 +1,112 @@
+package certmanager
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := `
+profiles:
+  grpc-server:
+    keyType: ec
+    extKeyUsages: [serverAuth]
+    validity: 720h
+    subject:
+      organization: [Example]
+    sans:
+      includeCommonName: true
+      allowedNames: ["*.svc.cluster.local"]
+  kafka-broker:
+    keyUsages: [digitalSignature, keyEncipherment]
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := LoadProfiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := profiles["grpc-server"]
+	if p.KeyType != KeyTypeEC || p.Validity != 720*time.Hour || !p.SANs.IncludeCommonName {
+		t.Errorf("want grpc-server profile to be parsed, got %+v", p)
+	}
+	if len(profiles) != 2 {
+		t.Errorf("want 2 profiles, got %v", len(profiles))
+	}
+
+	if _, err := LoadProfile(path, "other"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want %v, got %v", ErrNotFound, err)
+	}
+
+	invalid := "profiles:\n  bad:\n    extKeyUsages: [serverAuthentication]\n"
+	if err := os.WriteFile(path, []byte(invalid), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadProfiles(path); err == nil || !strings.Contains(err.Error(), "unknown extended key usage") {
+		t.Errorf("want unknown extended key usage error, got %v", err)
+	}
+}
+
+func TestGenSignedCertSigner_profile(t *testing.T) {
+	caCert, caKey, err := GenSelfSignedCA("test-ca", time.Now().Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := Profile{
+		KeyType:      KeyTypeEC,
+		ExtKeyUsages: []string{"serverAuth"},
+		Validity:     time.Hour,
+		Subject:      ProfileSubject{Organization: []string{"Example"}},
+		SANs: SANRules{
+			IncludeCommonName: true,
+			AllowedNames:      []string{"*.svc.cluster.local"},
+			DenyWildcards:     true,
+		},
+	}
+
+	cert, key, err := GenSignedCertSigner(caCert, caKey, "api.svc.cluster.local", nil, time.Time{}, WithProfile(profile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("want EC key, got %T", key)
+	}
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Errorf("want serverAuth only, got %v", cert.ExtKeyUsage)
+	}
+	if cert.KeyUsage&x509.KeyUsageKeyEncipherment != 0 {
+		t.Errorf("want no key encipherment for EC keys, got %v", cert.KeyUsage)
+	}
+	if len(cert.Subject.Organization) != 1 || cert.Subject.Organization[0] != "Example" {
+		t.Errorf("want organization from profile, got %v", cert.Subject.Organization)
+	}
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "api.svc.cluster.local" {
+		t.Errorf("want common name as DNS name, got %v", cert.DNSNames)
+	}
+	if cert.NotAfter.After(time.Now().Add(time.Hour)) {
+		t.Errorf("want validity of at most the profile validity, expires at %v", cert.NotAfter)
+	}
+
+	for _, sans := range [][]string{{"api.example.com"}, {"*.svc.cluster.local"}, {"10.0.0.1"}} {
+		_, _, err := GenSignedCertSigner(caCert, caKey, "api.svc.cluster.local", sans, time.Time{}, WithProfile(profile))
+		if !errors.Is(err, ErrPolicyViolation) {
+			t.Errorf("want %v for SANs %v, got %v", ErrPolicyViolation, sans, err)
+		}
+	}
+
+	if _, _, err := GenSignedCert(caCert, caKey, "api.svc.cluster.local", nil, time.Time{}, WithProfile(profile)); !errors.Is(err, ErrUnsupportedKeyType) {
+		t.Errorf("want %v for RSA-only GenSignedCert, got %v", ErrUnsupportedKeyType, err)
+	}
+	profile.KeyType = KeyTypeRSA
+	if _, _, err := GenSignedCert(caCert, caKey, "api.svc.cluster.local", nil, time.Time{}, WithProfile(profile)); err != nil {
+		t.Fatal(err)
+	}
+}
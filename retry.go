@@ -0,0 +1,94 @@
+package certmanager
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// maxRetryBackoff caps the delay between retries, including delays requested
+// by the Retry-After header.
+const maxRetryBackoff = 30 * time.Second
+
+// doRetry returns a SendDecorator which retries failed requests up to retries
+// times. See WithRetry for which requests are retried.
+//
+// Unlike autorest.DoRetryForStatusCodesWithCap, the delay is capped at
+// maxRetryBackoff also when throttled without a Retry-After header, and
+// requests which are not idempotent are only retried when throttled.
+func doRetry(retries int, backoff time.Duration) autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (resp *http.Response, err error) {
+			rr := autorest.NewRetriableRequest(r)
+			for attempt := 0; ; attempt++ {
+				if err = rr.Prepare(); err != nil {
+					return resp, err
+				}
+				_ = autorest.DrainResponseBody(resp)
+				resp, err = s.Do(rr.Request())
+				if attempt >= retries || !shouldRetry(r.Method, resp, err) {
+					return resp, err
+				}
+
+				t := time.NewTimer(retryDelay(resp, backoff, attempt))
+				select {
+				case <-t.C:
+				case <-r.Context().Done():
+					t.Stop()
+					return resp, r.Context().Err()
+				}
+			}
+		})
+	}
+}
+
+// shouldRetry reports whether a request should be retried. Throttled requests
+// are always retried since they were never processed. Requests which failed
+// with a server error or a network error may have been processed, so they
+// are only retried when idempotent - retrying e.g. a certificate import could
+// otherwise create a duplicate version.
+func shouldRetry(method string, resp *http.Response, err error) bool {
+	idempotent := method != http.MethodPost
+	if err != nil {
+		return idempotent && !autorest.IsTokenRefreshError(err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	case resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode == http.StatusInternalServerError,
+		resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusServiceUnavailable,
+		resp.StatusCode == http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// retryDelay returns the delay before the next attempt: the Retry-After
+// header if present, otherwise exponential backoff, capped at
+// maxRetryBackoff.
+func retryDelay(resp *http.Response, backoff time.Duration, attempt int) time.Duration {
+	delay := -time.Duration(1)
+	if resp != nil {
+		if ra := resp.Header.Get("Retry-After"); ra != "" {
+			if seconds, err := strconv.Atoi(ra); err == nil {
+				delay = time.Duration(seconds) * time.Second
+			} else if t, err := http.ParseTime(ra); err == nil {
+				delay = time.Until(t)
+			}
+		}
+	}
+	if delay < 0 {
+		delay = backoff
+		for i := 0; i < attempt && delay < maxRetryBackoff; i++ {
+			delay *= 2
+		}
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	return delay
+}
@@ -0,0 +1,226 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Phases of a CA rollover, in order.
+const (
+	// RolloverIntroduce publishes the new CA next to the old one. The old CA
+	// keeps issuing while clients are updated to trust both.
+	RolloverIntroduce = "introduce"
+
+	// RolloverMigrate switches issuing to the new CA. Chains issued by the
+	// new CA include its certificate cross-signed by the old CA, so that
+	// clients which only trust the old CA still accept them.
+	RolloverMigrate = "migrate"
+
+	// RolloverRetire stops trusting the old CA, once all certificates it
+	// issued have been replaced.
+	RolloverRetire = "retire"
+)
+
+var rolloverPhases = []string{RolloverIntroduce, RolloverMigrate, RolloverRetire}
+
+// Rollover is the state of the replacement of a CA by a new CA. It is kept in
+// the store next to the old CA, see GetRollover.
+type Rollover struct {
+	Phase string
+
+	// OldCAURL and NewCAURL are the secret URLs of the CAs.
+	OldCAURL string
+	NewCAURL string
+
+	// OldCA and NewCA are the self-signed certificates of the CAs.
+	OldCA *x509.Certificate
+	NewCA *x509.Certificate
+
+	// OldCrossSigned is the old CA signed by the new CA, and NewCrossSigned
+	// the new CA signed by the old CA. Either is nil if the issuing CA does
+	// not allow intermediates, in which case clients must trust both CAs
+	// during the rollover.
+	OldCrossSigned *x509.Certificate
+	NewCrossSigned *x509.Certificate
+
+	UpdatedAt time.Time
+}
+
+// IssuingCAURL returns the secret URL of the CA which should issue new
+// certificates in the current phase.
+func (r *Rollover) IssuingCAURL() string {
+	if r.Phase == RolloverIntroduce {
+		return r.OldCAURL
+	}
+	return r.NewCAURL
+}
+
+// TrustBundle returns the CA certificates clients should trust in the
+// current phase: both CAs until the old CA is retired.
+func (r *Rollover) TrustBundle() []*x509.Certificate {
+	if r.Phase == RolloverRetire {
+		return []*x509.Certificate{r.NewCA}
+	}
+	return []*x509.Certificate{r.OldCA, r.NewCA}
+}
+
+// CrossCerts returns the cross-signed certificates to add to chains issued by
+// issuer in the current phase, so that clients which only trust the other CA
+// accept them.
+func (r *Rollover) CrossCerts(issuer *x509.Certificate) []*x509.Certificate {
+	switch {
+	case r.Phase == RolloverRetire:
+		return nil
+	case issuer.Equal(r.NewCA) && r.NewCrossSigned != nil:
+		return []*x509.Certificate{r.NewCrossSigned}
+	case issuer.Equal(r.OldCA) && r.OldCrossSigned != nil:
+		return []*x509.Certificate{r.OldCrossSigned}
+	}
+	return nil
+}
+
+// Advance moves the rollover to the next phase. Phases may not be skipped.
+//
+// Migrating requires the new CA to be cross-signed by the old CA, which is
+// only possible if the old CA allows intermediates, i.e. has a path length of
+// at least 1. Otherwise Advance fails with ErrNotCrossSigned, unless force is
+// set, since clients which only trust the old CA reject certificates issued
+// by the new CA.
+func (r *Rollover) Advance(phase string, force bool) error {
+	for i, p := range rolloverPhases[:len(rolloverPhases)-1] {
+		if p == r.Phase {
+			if phase != rolloverPhases[i+1] {
+				return fmt.Errorf("rollover is in phase '%v', the next phase is '%v'", r.Phase, rolloverPhases[i+1])
+			}
+			if phase == RolloverMigrate && r.NewCrossSigned == nil && !force {
+				return ErrNotCrossSigned
+			}
+			r.Phase = phase
+			return nil
+		}
+	}
+	return fmt.Errorf("rollover in phase '%v' cannot advance", r.Phase)
+}
+
+// rolloverJSON is how a Rollover is kept in the store.
+type rolloverJSON struct {
+	Phase          string    `json:"phase"`
+	OldCAURL       string    `json:"oldCaUrl"`
+	NewCAURL       string    `json:"newCaUrl"`
+	OldCA          string    `json:"oldCa"`
+	NewCA          string    `json:"newCa"`
+	OldCrossSigned string    `json:"oldCrossSigned,omitempty"`
+	NewCrossSigned string    `json:"newCrossSigned,omitempty"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+func encodeRollover(r *Rollover) ([]byte, error) {
+	if r.OldCA == nil || r.NewCA == nil {
+		return nil, errors.New("rollover requires both CA certificates")
+	}
+	encode := func(cert *x509.Certificate) string {
+		if cert == nil {
+			return ""
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	}
+	return json.Marshal(rolloverJSON{
+		Phase:          r.Phase,
+		OldCAURL:       r.OldCAURL,
+		NewCAURL:       r.NewCAURL,
+		OldCA:          encode(r.OldCA),
+		NewCA:          encode(r.NewCA),
+		OldCrossSigned: encode(r.OldCrossSigned),
+		NewCrossSigned: encode(r.NewCrossSigned),
+		UpdatedAt:      r.UpdatedAt,
+	})
+}
+
+func decodeRollover(data []byte) (*Rollover, error) {
+	var v rolloverJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, appendErr("failed to parse rollover", err)
+	}
+	decode := func(s string) (*x509.Certificate, error) {
+		if s == "" {
+			return nil, nil
+		}
+		block, _ := pem.Decode([]byte(s))
+		if block == nil {
+			return nil, errors.New("invalid certificate in rollover")
+		}
+		return x509.ParseCertificate(block.Bytes)
+	}
+
+	r := &Rollover{
+		Phase:     v.Phase,
+		OldCAURL:  v.OldCAURL,
+		NewCAURL:  v.NewCAURL,
+		UpdatedAt: v.UpdatedAt,
+	}
+	var err error
+	for _, c := range []struct {
+		dst **x509.Certificate
+		src string
+	}{
+		{&r.OldCA, v.OldCA},
+		{&r.NewCA, v.NewCA},
+		{&r.OldCrossSigned, v.OldCrossSigned},
+		{&r.NewCrossSigned, v.NewCrossSigned},
+	} {
+		if *c.dst, err = decode(c.src); err != nil {
+			return nil, err
+		}
+	}
+	if r.OldCA == nil || r.NewCA == nil {
+		return nil, errors.New("rollover is missing a CA certificate")
+	}
+	return r, nil
+}
+
+// Names of the secrets which hold the rollover and the trust bundle of the
+// CA with the given name.
+func rolloverSecretName(caName string) string {
+	return caName + "-rollover"
+}
+
+func trustBundleSecretName(caName string) string {
+	return caName + "-trust-bundle"
+}
+
+// GetRollover retrieves the rollover of the CA at caURL. If the CA is not
+// being rolled over, the returned error matches ErrNotFound.
+func GetRollover(ctx context.Context, caURL string) (*Rollover, error) {
+	s, err := getDefaultStore()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetRollover(ctx, caURL)
+}
+
+// PutRollover stores the rollover next to its old CA, and publishes the trust
+// bundle of the current phase as a PEM secret, see TrustBundleURL.
+func PutRollover(ctx context.Context, r *Rollover) error {
+	s, err := getDefaultStore()
+	if err != nil {
+		return err
+	}
+
+	return s.PutRollover(ctx, r)
+}
+
+// TrustBundleURL returns the URL of the secret holding the trust bundle of
+// the rollover of the CA at caURL.
+func TrustBundleURL(caURL string) (string, error) {
+	baseURL, name, _, err := parseAzureKVURL(caURL)
+	if err != nil {
+		return "", appendErr("failed to parse URL", err)
+	}
+	return baseURL + "/secrets/" + trustBundleSecretName(name), nil
+}
@@ -0,0 +1,189 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRollover returns a rollover in the introduce phase, and the keys of
+// its CAs. Both CAs allow intermediates, so that they can cross-sign.
+func newTestRollover(t *testing.T) (r *Rollover, oldKey, newKey *rsa.PrivateKey) {
+	t.Helper()
+	expiry := time.Now().Add(time.Hour)
+	oldCA, oldKey, err := GenSelfSignedCA("old-ca", expiry, WithMaxPathLen(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCA, newKey, err := GenSelfSignedCA("new-ca", expiry, WithMaxPathLen(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = &Rollover{
+		Phase:    RolloverIntroduce,
+		OldCAURL: "https://test.vault.azure.net/secrets/old-ca",
+		NewCAURL: "https://test.vault.azure.net/secrets/new-ca",
+		OldCA:    oldCA,
+		NewCA:    newCA,
+	}
+	if r.NewCrossSigned, err = CrossSign(oldCA, oldKey, newCA); err != nil {
+		t.Fatal(err)
+	}
+	if r.OldCrossSigned, err = CrossSign(newCA, newKey, oldCA); err != nil {
+		t.Fatal(err)
+	}
+	return r, oldKey, newKey
+}
+
+func TestRollover(t *testing.T) {
+	r, oldKey, newKey := newTestRollover(t)
+
+	// Certificates issued by either CA verify against either root when the
+	// cross-signed certificate of the phase is in the chain
+	verify := func(t *testing.T, issuer *x509.Certificate, root *x509.Certificate) error {
+		t.Helper()
+		key := oldKey
+		if issuer.Equal(r.NewCA) {
+			key = newKey
+		}
+		leaf, _, err := GenSignedCert(issuer, key, "api.example.com", []string{"api.example.com"}, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(root)
+		intermediates := x509.NewCertPool()
+		for _, c := range r.CrossCerts(issuer) {
+			intermediates.AddCert(c)
+		}
+		_, err = leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, DNSName: "api.example.com"})
+		return err
+	}
+
+	for _, tc := range []struct {
+		phase       string
+		wantIssuer  string
+		wantBundle  int
+		wantCrossed bool
+	}{
+		{RolloverIntroduce, r.OldCAURL, 2, true},
+		{RolloverMigrate, r.NewCAURL, 2, true},
+		{RolloverRetire, r.NewCAURL, 1, false},
+	} {
+		t.Run(tc.phase, func(t *testing.T) {
+			if tc.phase != r.Phase {
+				if err := r.Advance(tc.phase, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := r.IssuingCAURL(); got != tc.wantIssuer {
+				t.Errorf("want issuing CA %v, got %v", tc.wantIssuer, got)
+			}
+			if got := len(r.TrustBundle()); got != tc.wantBundle {
+				t.Errorf("want %v CAs in trust bundle, got %v", tc.wantBundle, got)
+			}
+			if !tc.wantCrossed {
+				if len(r.CrossCerts(r.NewCA)) > 0 {
+					t.Error("want no cross-signed certificates")
+				}
+				return
+			}
+			if err := verify(t, r.NewCA, r.OldCA); err != nil {
+				t.Errorf("want certificate from new CA to verify with old root, err: %v", err)
+			}
+			if err := verify(t, r.OldCA, r.NewCA); err != nil {
+				t.Errorf("want certificate from old CA to verify with new root, err: %v", err)
+			}
+		})
+	}
+
+	if err := r.Advance(RolloverIntroduce, false); err == nil {
+		t.Error("want error when advancing a retired rollover")
+	}
+}
+
+func TestRollover_Advance(t *testing.T) {
+	r, _, _ := newTestRollover(t)
+	if err := r.Advance(RolloverRetire, false); err == nil || !strings.Contains(err.Error(), "next phase is 'migrate'") {
+		t.Errorf("want error when skipping a phase, got %v", err)
+	}
+	if err := r.Advance(RolloverMigrate, false); err != nil || r.Phase != RolloverMigrate {
+		t.Errorf("want phase %v, got %v, err: %v", RolloverMigrate, r.Phase, err)
+	}
+}
+
+func TestRollover_Advance_maxPathLenZero(t *testing.T) {
+	// CAs from gen ca-cert have a path length of 0 by default, and cannot
+	// cross-sign the new CA
+	expiry := time.Now().Add(time.Hour)
+	oldCA, oldKey, err := GenSelfSignedCA("old-ca", expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCA, _, err := GenSelfSignedCA("new-ca", expiry, WithMaxPathLen(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Rollover{Phase: RolloverIntroduce, OldCA: oldCA, NewCA: newCA}
+	if r.NewCrossSigned, err = CrossSign(oldCA, oldKey, newCA); err == nil {
+		t.Fatal("want error when cross-signing with a CA with path length 0")
+	}
+
+	if err := r.Advance(RolloverMigrate, false); !errors.Is(err, ErrNotCrossSigned) {
+		t.Fatalf("want err %v, got %v", ErrNotCrossSigned, err)
+	}
+	if r.Phase != RolloverIntroduce {
+		t.Fatalf("want phase %v, got %v", RolloverIntroduce, r.Phase)
+	}
+	if err := r.Advance(RolloverMigrate, true); err != nil || r.Phase != RolloverMigrate {
+		t.Errorf("want phase %v when forced, got %v, err: %v", RolloverMigrate, r.Phase, err)
+	}
+	if err := r.Advance(RolloverRetire, false); err != nil {
+		t.Errorf("want retiring to be allowed, err: %v", err)
+	}
+}
+
+func TestCrossSign_maxPathLenZero(t *testing.T) {
+	oldCA, oldKey, err := GenSelfSignedCA("old-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCA, _, err := GenSelfSignedCA("new-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CrossSign(oldCA, oldKey, newCA); err == nil {
+		t.Error("want error when the issuer does not allow intermediates")
+	}
+}
+
+func TestStore_PutRollover(t *testing.T) {
+	r, _, _ := newTestRollover(t)
+	kv := &fakeKeyVault{permissions: map[string]bool{"secrets/get": true, "secrets/set": true}}
+	s := newFakeKVStore(t, kv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := s.GetRollover(ctx, r.OldCAURL); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want %v before the rollover is stored, got %v", ErrNotFound, err)
+	}
+	if err := s.PutRollover(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetRollover(ctx, r.OldCAURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Phase != r.Phase || got.NewCAURL != r.NewCAURL || !got.NewCA.Equal(r.NewCA) || !got.NewCrossSigned.Equal(r.NewCrossSigned) {
+		t.Errorf("want stored rollover %+v, got %+v", r, got)
+	}
+
+	bundle := kv.secrets[trustBundleSecretName("old-ca")]
+	if bundle.Value == nil || strings.Count(*bundle.Value, "BEGIN CERTIFICATE") != 2 {
+		t.Errorf("want trust bundle with both CAs, got %v", bundle.Value)
+	}
+}
@@ -0,0 +1,157 @@
+package certmanager
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// spiffeScheme is the URI scheme of SPIFFE IDs.
+const spiffeScheme = "spiffe"
+
+// ParseSPIFFEID parses and validates a SPIFFE ID such as
+// spiffe://example.org/ns/prod/sa/api.
+//
+// See https://github.com/spiffe/spiffe/blob/main/standards/SPIFFE-ID.md
+func ParseSPIFFEID(id string) (*url.URL, error) {
+	u, err := url.Parse(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SPIFFE ID '%v', err: %w", id, err)
+	}
+
+	switch {
+	case u.Scheme != spiffeScheme:
+		return nil, fmt.Errorf("invalid SPIFFE ID '%v', scheme must be %v", id, spiffeScheme)
+	case u.Host == "":
+		return nil, fmt.Errorf("invalid SPIFFE ID '%v', trust domain is missing", id)
+	case u.User != nil || u.Port() != "" || u.RawQuery != "" || u.Fragment != "" || u.Opaque != "":
+		return nil, fmt.Errorf("invalid SPIFFE ID '%v', must not contain a user, port, query or fragment", id)
+	case strings.ToLower(u.Host) != u.Host:
+		return nil, fmt.Errorf("invalid SPIFFE ID '%v', trust domain must be lowercase", id)
+	case strings.HasSuffix(u.Path, "/"):
+		return nil, fmt.Errorf("invalid SPIFFE ID '%v', path must not end with a slash", id)
+	}
+	if u.Path == "" {
+		return u, nil
+	}
+	for _, segment := range strings.Split(strings.TrimPrefix(u.Path, "/"), "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return nil, fmt.Errorf("invalid SPIFFE ID '%v', path segments must not be empty, '.' or '..'", id)
+		}
+	}
+	return u, nil
+}
+
+// SPIFFEID returns the SPIFFE ID of an X.509-SVID, i.e. its only URI SAN.
+func SPIFFEID(cert *x509.Certificate) (*url.URL, error) {
+	var id *url.URL
+	for _, uri := range cert.URIs {
+		if uri.Scheme != spiffeScheme {
+			continue
+		}
+		if id != nil {
+			return nil, errors.New("certificate contains more than one SPIFFE ID")
+		}
+		id = uri
+	}
+	if id == nil {
+		return nil, errors.New("certificate contains no SPIFFE ID")
+	}
+	return ParseSPIFFEID(id.String())
+}
+
+// SPIFFEAuthorizer authorizes a peer by its SPIFFE ID.
+type SPIFFEAuthorizer func(id *url.URL) error
+
+// AuthorizeSPIFFEIDs authorizes peers with any of the provided SPIFFE IDs.
+func AuthorizeSPIFFEIDs(ids ...string) SPIFFEAuthorizer {
+	allowed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		allowed[id] = true
+	}
+	return func(id *url.URL) error {
+		if !allowed[id.String()] {
+			return fmt.Errorf("SPIFFE ID %v is not authorized", id)
+		}
+		return nil
+	}
+}
+
+// AuthorizeTrustDomain authorizes all peers in the trust domain, e.g.
+// example.org.
+func AuthorizeTrustDomain(trustDomain string) SPIFFEAuthorizer {
+	return func(id *url.URL) error {
+		if id.Host != trustDomain {
+			return fmt.Errorf("SPIFFE ID %v is not a member of trust domain %v", id, trustDomain)
+		}
+		return nil
+	}
+}
+
+// VerifySVID returns a function, to be used as tls.Config.VerifyPeerCertificate,
+// which verifies that the peer presented an X.509-SVID signed by roots and
+// authorizes its SPIFFE ID. Host names are not verified.
+//
+// keyUsage is the extended key usage required of the peer certificate:
+// x509.ExtKeyUsageServerAuth when verifying servers from a client config, and
+// x509.ExtKeyUsageClientAuth when verifying clients from a server config.
+//
+// When used in a client config, InsecureSkipVerify must be set so that the
+// server certificate is verified by VerifySVID rather than by its host name.
+func VerifySVID(roots *x509.CertPool, keyUsage x509.ExtKeyUsage, authorize SPIFFEAuthorizer) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("peer presented no certificate")
+		}
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return appendErr("failed to parse peer certificate", err)
+			}
+			certs = append(certs, cert)
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   time.Now(),
+			KeyUsages:     []x509.ExtKeyUsage{keyUsage},
+		}); err != nil {
+			return appendErr("failed to verify peer certificate", err)
+		}
+
+		id, err := SPIFFEID(certs[0])
+		if err != nil {
+			return err
+		}
+		return authorize(id)
+	}
+}
+
+// splitSANs splits Subject Alternative Names into DNS names and SPIFFE IDs.
+// An X.509-SVID may contain at most one SPIFFE ID.
+func splitSANs(sans []string) (dnsNames []string, uris []*url.URL, err error) {
+	for _, san := range sans {
+		if !strings.HasPrefix(san, spiffeScheme+"://") {
+			dnsNames = append(dnsNames, san)
+			continue
+		}
+		id, err := ParseSPIFFEID(san)
+		if err != nil {
+			return nil, nil, err
+		}
+		uris = append(uris, id)
+	}
+	if len(uris) > 1 {
+		return nil, nil, errors.New("a certificate may contain at most one SPIFFE ID")
+	}
+	return dnsNames, uris, nil
+}
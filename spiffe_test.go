@@ -0,0 +1,211 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+)
+
+func TestParseSPIFFEID(t *testing.T) {
+	for _, tc := range []struct {
+		id      string
+		wantErr bool
+	}{
+		{"spiffe://example.org", false},
+		{"spiffe://example.org/ns/prod/sa/api", false},
+		{"https://example.org/api", true},
+		{"spiffe:///api", true},
+		{"spiffe://Example.org/api", true},
+		{"spiffe://example.org:443/api", true},
+		{"spiffe://user@example.org/api", true},
+		{"spiffe://example.org/api?x=1", true},
+		{"spiffe://example.org/api#x", true},
+		{"spiffe://example.org/api/", true},
+		{"spiffe://example.org//api", true},
+		{"spiffe://example.org/../api", true},
+	} {
+		t.Run(tc.id, func(t *testing.T) {
+			_, err := ParseSPIFFEID(tc.id)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("want err: %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestGenSignedCert_SPIFFE(t *testing.T) {
+	caCert, caKey, err := GenSelfSignedCA("test-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _, err := GenSignedCert(caCert, caKey, "api", []string{"api.example.org", "spiffe://example.org/api"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "api.example.org" {
+		t.Errorf("want DNS names [api.example.org], got %v", cert.DNSNames)
+	}
+	id, err := SPIFFEID(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.String() != "spiffe://example.org/api" {
+		t.Errorf("want SPIFFE ID spiffe://example.org/api, got %v", id)
+	}
+
+	_, _, err = GenSignedCert(caCert, caKey, "api", []string{"spiffe://example.org/a", "spiffe://example.org/b"}, time.Now().Add(time.Hour))
+	if err == nil {
+		t.Errorf("want error for multiple SPIFFE IDs")
+	}
+}
+
+func TestStore_GetMTLSConfig_SPIFFE(t *testing.T) {
+	caCert, caKey, err := GenSelfSignedCA("test-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBundle, err := encodePEMBundle(caCert, nil, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strPtr := func(s string) *string { return &s }
+	s := newFakeKVStore(t, &fakeKeyVault{
+		permissions: map[string]bool{"secrets/get": true},
+		secrets: map[string]keyvault.SecretBundle{
+			"ca": {Value: strPtr(string(pemBundle)), ContentType: strPtr(contentTypePEM)},
+		},
+	})
+	caURL := "https://test.vault.azure.net/secrets/ca"
+	serverID := "spiffe://example.org/server"
+
+	for _, tc := range []struct {
+		name     string
+		clientID string
+		allowed  SPIFFEAuthorizer
+		wantErr  bool
+	}{
+		{"authorized id", "spiffe://example.org/client", AuthorizeSPIFFEIDs("spiffe://example.org/client"), false},
+		{"authorized trust domain", "spiffe://example.org/client", AuthorizeTrustDomain("example.org"), false},
+		{"unauthorized id", "spiffe://example.org/other", AuthorizeSPIFFEIDs("spiffe://example.org/client"), true},
+		{"other trust domain", "spiffe://other.org/client", AuthorizeTrustDomain("example.org"), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			expiresAt := time.Now().Add(time.Hour)
+			serverConf, err := s.GetMTLSServerConfig(ctx, caURL, "", "server", nil, expiresAt,
+				WithSPIFFEID(serverID), WithSPIFFEAuthorizer(tc.allowed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConf, err := s.GetMTLSClientConfig(ctx, caURL, "", "client", "", expiresAt,
+				WithSPIFFEID(tc.clientID), WithSPIFFEAuthorizer(AuthorizeSPIFFEIDs(serverID)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			serverErr, clientErr := handshake(t, serverConf, clientConf)
+
+			if gotErr := serverErr != nil || clientErr != nil; gotErr != tc.wantErr {
+				t.Fatalf("want err: %v, got server err: %v, client err: %v", tc.wantErr, serverErr, clientErr)
+			}
+		})
+	}
+}
+
+// handshake performs a TLS handshake over a loopback connection and returns
+// the errors on each side.
+func handshake(t *testing.T, serverConf, clientConf *tls.Config) (serverErr, clientErr error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(deadline)
+		tlsConn := tls.Server(conn, serverConf)
+		if err := tlsConn.Handshake(); err != nil {
+			errc <- err
+			return
+		}
+		// With TLS 1.3, the client completes its handshake before the
+		// server has verified the client certificate, so the client only
+		// learns about a rejection when reading
+		errc <- nil
+		_, _ = tlsConn.Write([]byte{0})
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(deadline)
+	tlsConn := tls.Client(conn, clientConf)
+	clientErr = tlsConn.Handshake()
+	if clientErr == nil {
+		// Read the byte written by the server, which fails if the server
+		// rejected the client certificate
+		_, clientErr = tlsConn.Read(make([]byte, 1))
+	}
+	return <-errc, clientErr
+}
+
+func TestVerifySVID_keyUsage(t *testing.T) {
+	caCert, caKey, err := GenSelfSignedCA("test-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	// Issue a client-only SVID
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := ParseSPIFFEID("spiffe://example.org/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		URIs:         []*url.URL{id},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorize := AuthorizeTrustDomain("example.org")
+	if err := VerifySVID(roots, x509.ExtKeyUsageClientAuth, authorize)([][]byte{der}, nil); err != nil {
+		t.Errorf("client SVID was rejected as a client, err: %v", err)
+	}
+	if err := VerifySVID(roots, x509.ExtKeyUsageServerAuth, authorize)([][]byte{der}, nil); err == nil {
+		t.Errorf("client SVID was accepted as a server")
+	}
+}
@@ -0,0 +1,300 @@
+package certmanager
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// Store is a reusable client for a certificate store. Credentials are
+// resolved once and access tokens are cached and refreshed as needed.
+//
+// A Store is safe for concurrent use. Prefer creating a single Store and
+// reusing it over calling the package-level functions when performing many
+// operations, e.g. when issuing many certificates from the same CA.
+type Store struct {
+	kv           keyvault.BaseClient
+	credentials  string
+	cacheTTL     time.Duration
+	retries      int
+	retryBackoff time.Duration
+
+	mu    sync.Mutex
+	cache map[certCacheKey]cachedCert
+}
+
+// StoreOption configures a Store.
+type StoreOption func(*Store)
+
+// WithCacheTTL enables caching of certificates retrieved with GetCert for the
+// provided duration. This is primarily useful for CA certificates which are
+// fetched repeatedly to sign new certificates.
+//
+// Cached certificates and keys are shared between callers and must not be
+// modified.
+func WithCacheTTL(ttl time.Duration) StoreOption {
+	return func(s *Store) {
+		s.cacheTTL = ttl
+	}
+}
+
+// WithRetry configures how many times a request is retried when it fails due
+// to throttling (429), a server error (5xx) or a transient network error.
+// Requests are retried with exponential backoff starting at backoff, or after
+// the delay given by the Retry-After header if present. Delays are capped at
+// 30 seconds.
+//
+// Imports of new certificate versions are only retried when throttled, since
+// a failed import may still have created a version.
+//
+// By default, requests are retried 3 times with a backoff of one second.
+func WithRetry(retries int, backoff time.Duration) StoreOption {
+	return func(s *Store) {
+		s.retries = retries
+		s.retryBackoff = backoff
+	}
+}
+
+// NewStore creates a new Store, resolving credentials from the Azure CLI or
+// from the environment.
+func NewStore(opts ...StoreOption) (*Store, error) {
+	kv, credentials, err := newAzureKVClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return newStore(kv, credentials, opts...), nil
+}
+
+// newStore creates a Store using the provided client and applies options.
+func newStore(kv keyvault.BaseClient, credentials string, opts ...StoreOption) *Store {
+	s := &Store{
+		kv:           kv,
+		credentials:  credentials,
+		retries:      3,
+		retryBackoff: time.Second,
+		cache:        make(map[certCacheKey]cachedCert),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.kv.SendDecorators = []autorest.SendDecorator{
+		doRetry(s.retries, s.retryBackoff),
+	}
+
+	return s
+}
+
+var (
+	defaultStoreMu sync.Mutex
+	defaultStore   *Store
+)
+
+// getDefaultStore returns the Store used by package-level functions. Failures
+// to create the Store are not remembered so that a subsequent call may succeed
+// once credentials are in place.
+func getDefaultStore() (*Store, error) {
+	defaultStoreMu.Lock()
+	defer defaultStoreMu.Unlock()
+
+	if defaultStore == nil {
+		s, err := NewStore()
+		if err != nil {
+			return nil, err
+		}
+		defaultStore = s
+	}
+	return defaultStore, nil
+}
+
+type certCacheKey struct {
+	url          string
+	certPassword string
+	version      string
+}
+
+type cachedCert struct {
+	cert      *x509.Certificate
+	caCerts   []*x509.Certificate
+	key       crypto.Signer
+	expiresAt time.Time
+}
+
+// GetCert retrieves a certificate, its CA chain and its RSA key from the
+// store. See the package-level GetCert for details.
+func (s *Store) GetCert(
+	ctx context.Context,
+	url string,
+	certPassword string,
+	opts ...GetCertOption,
+) (cert *x509.Certificate, caCerts []*x509.Certificate, key *rsa.PrivateKey, err error) {
+	cert, caCerts, signer, err := s.GetCertSigner(ctx, url, certPassword, opts...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, ok := signer.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("key is a %T, expected an RSA key - use GetCertSigner for other key types: %w", signer, ErrUnsupportedKeyType)
+	}
+	return cert, caCerts, key, nil
+}
+
+// GetCertSigner retrieves a certificate, its CA chain and its key from the
+// store. Unlike GetCert, the key may be of any type supported by crypto/x509.
+func (s *Store) GetCertSigner(
+	ctx context.Context,
+	url string,
+	certPassword string,
+	opts ...GetCertOption,
+) (cert *x509.Certificate, caCerts []*x509.Certificate, key crypto.Signer, err error) {
+	if !strings.Contains(url, "vault.azure.net") {
+		return nil, nil, nil, ErrUnsupportedURL
+	}
+
+	var o getCertOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if s.cacheTTL <= 0 {
+		return getAzureKVCert(ctx, s.kv, url, certPassword, o)
+	}
+
+	k := certCacheKey{url: url, certPassword: certPassword, version: o.version}
+	s.mu.Lock()
+	c, ok := s.cache[k]
+	s.mu.Unlock()
+	if ok && time.Now().Before(c.expiresAt) {
+		return c.cert, c.caCerts, c.key, nil
+	}
+
+	cert, caCerts, key, err = getAzureKVCert(ctx, s.kv, url, certPassword, o)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	s.mu.Lock()
+	s.cache[k] = cachedCert{
+		cert:      cert,
+		caCerts:   caCerts,
+		key:       key,
+		expiresAt: time.Now().Add(s.cacheTTL),
+	}
+	s.mu.Unlock()
+
+	return cert, caCerts, key, nil
+}
+
+// UploadCert uploads a certificate, its CA chain and its key to the store.
+// See the package-level UploadCert for details.
+func (s *Store) UploadCert(
+	ctx context.Context,
+	url string,
+	cert *x509.Certificate,
+	caCerts []*x509.Certificate,
+	key crypto.Signer,
+	certPassword string,
+	opts ...UploadCertOption,
+) error {
+	if !strings.Contains(url, "vault.azure.net") {
+		return ErrUnsupportedURL
+	}
+
+	var o uploadCertOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return uploadAzureKVCert(ctx, s.kv, url, cert, caCerts, key, certPassword, o)
+}
+
+// ListCertVersions lists all versions of the certificate found at url,
+// newest first.
+func (s *Store) ListCertVersions(ctx context.Context, url string) ([]CertVersion, error) {
+	if !strings.Contains(url, "vault.azure.net") {
+		return nil, ErrUnsupportedURL
+	}
+
+	return listAzureKVCertVersions(ctx, s.kv, url)
+}
+
+// RollbackCert disables a bad version of a certificate and re-enables a prior
+// one. See the package-level RollbackCert for details.
+func (s *Store) RollbackCert(
+	ctx context.Context,
+	url string,
+	badVersion string,
+	toVersion string,
+) (disabled CertVersion, enabled CertVersion, err error) {
+	if !strings.Contains(url, "vault.azure.net") {
+		return CertVersion{}, CertVersion{}, ErrUnsupportedURL
+	}
+
+	disabled, enabled, err = rollbackAzureKVCert(ctx, s.kv, url, badVersion, toVersion)
+
+	// Cached versions may no longer be the ones selected. The cache is
+	// cleared afterwards so that lookups made during the rollback are not
+	// kept, and regardless of errors since the rollback may be partial.
+	s.ClearCache()
+
+	return disabled, enabled, err
+}
+
+// GetRollover retrieves the rollover of the CA at caURL. See the
+// package-level GetRollover for details.
+func (s *Store) GetRollover(ctx context.Context, caURL string) (*Rollover, error) {
+	if !strings.Contains(caURL, "vault.azure.net") {
+		return nil, ErrUnsupportedURL
+	}
+	baseURL, name, _, err := parseAzureKVURL(caURL)
+	if err != nil {
+		return nil, appendErr("failed to parse URL", err)
+	}
+
+	value, err := getAzureKVSecret(ctx, s.kv, baseURL, rolloverSecretName(name))
+	if err != nil {
+		return nil, appendErr("failed to retrieve rollover", err)
+	}
+	return decodeRollover([]byte(value))
+}
+
+// PutRollover stores the rollover and publishes its trust bundle. See the
+// package-level PutRollover for details.
+func (s *Store) PutRollover(ctx context.Context, r *Rollover) error {
+	if !strings.Contains(r.OldCAURL, "vault.azure.net") {
+		return ErrUnsupportedURL
+	}
+	baseURL, name, _, err := parseAzureKVURL(r.OldCAURL)
+	if err != nil {
+		return appendErr("failed to parse URL", err)
+	}
+	data, err := encodeRollover(r)
+	if err != nil {
+		return err
+	}
+
+	// Publish the bundle first, so that it is never behind the phase
+	bundle := EncodeTrustBundle(r.TrustBundle())
+	if err := setAzureKVSecret(ctx, s.kv, baseURL, trustBundleSecretName(name), string(bundle), contentTypePEM); err != nil {
+		return appendErr("failed to publish trust bundle", err)
+	}
+	if err := setAzureKVSecret(ctx, s.kv, baseURL, rolloverSecretName(name), string(data), "application/json"); err != nil {
+		return appendErr("failed to store rollover", err)
+	}
+	return nil
+}
+
+// ClearCache removes all cached certificates.
+func (s *Store) ClearCache() {
+	s.mu.Lock()
+	s.cache = make(map[certCacheKey]cachedCert)
+	s.mu.Unlock()
+}
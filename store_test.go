@@ -0,0 +1,371 @@
+package certmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/date"
+)
+
+func TestStore_GetCertSigner_cache(t *testing.T) {
+	caCert, caKey, err := GenSelfSignedCA("testca", time.Now().AddDate(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBundle, err := encodePEMBundle(caCert, nil, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strPtr := func(s string) *string { return &s }
+	url := "https://test.vault.azure.net/secrets/ca"
+
+	type get struct {
+		password string
+		version  string
+	}
+	for _, tc := range []struct {
+		name string
+		ttl  time.Duration
+		gets []get
+		// modify is called before the last get
+		modify       func(s *Store)
+		wantRequests int
+	}{
+		{"no cache", 0, []get{{}, {}}, nil, 2},
+		{"hit", time.Hour, []get{{}, {}, {}}, nil, 1},
+		{"keyed by version", time.Hour, []get{{}, {version: "v1"}, {version: "v1"}}, nil, 2},
+		{"keyed by password", time.Hour, []get{{}, {password: "a"}, {password: "a"}}, nil, 2},
+		{"expired", time.Hour, []get{{}, {}}, func(s *Store) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			for k, c := range s.cache {
+				c.expiresAt = time.Now().Add(-time.Second)
+				s.cache[k] = c
+			}
+		}, 2},
+		{"cleared", time.Hour, []get{{}, {}}, func(s *Store) { s.ClearCache() }, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kv := &fakeKeyVault{
+				permissions: map[string]bool{"secrets/get": true},
+				secrets: map[string]keyvault.SecretBundle{
+					"ca": {Value: strPtr(string(pemBundle)), ContentType: strPtr(contentTypePEM)},
+				},
+			}
+			s := newFakeKVStore(t, kv, WithCacheTTL(tc.ttl))
+
+			for i, g := range tc.gets {
+				if i == len(tc.gets)-1 && tc.modify != nil {
+					tc.modify(s)
+				}
+				var opts []GetCertOption
+				if g.version != "" {
+					opts = append(opts, SelectVersion(g.version))
+				}
+				cert, _, _, err := s.GetCertSigner(context.Background(), url, g.password, opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cert.Equal(caCert) {
+					t.Fatal("retrieved certificate did not match")
+				}
+			}
+			if n := kv.requestCount("GET /secrets/"); n != tc.wantRequests {
+				t.Errorf("want %v secret requests, got %v", tc.wantRequests, n)
+			}
+		})
+	}
+}
+
+func TestStore_RollbackCert_cache(t *testing.T) {
+	now := time.Now()
+	strPtr := func(s string) *string { return &s }
+	boolPtr := func(b bool) *bool { return &b }
+	unixPtr := func(t time.Time) *date.UnixTime { u := date.UnixTime(t); return &u }
+
+	kv := &fakeKeyVault{
+		permissions: map[string]bool{
+			"secrets/get":         true,
+			"certificates/get":    true,
+			"certificates/list":   true,
+			"certificates/update": true,
+		},
+		secrets:      make(map[string]keyvault.SecretBundle),
+		certs:        make(map[string]keyvault.CertificateBundle),
+		certVersions: make(map[string][]keyvault.CertificateItem),
+	}
+	for i, version := range []string{"v2", "v1"} {
+		caCert, caKey, err := GenSelfSignedCA("testca-"+version, now.AddDate(1, 0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pemBundle, err := encodePEMBundle(caCert, nil, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := strPtr("https://test.vault.azure.net/certificates/ca/" + version)
+		kv.secrets["ca/"+version] = keyvault.SecretBundle{Value: strPtr(string(pemBundle)), ContentType: strPtr(contentTypePEM)}
+		kv.certs["ca/"+version] = keyvault.CertificateBundle{ID: id, Cer: &caCert.Raw}
+		kv.certVersions["ca"] = append(kv.certVersions["ca"], keyvault.CertificateItem{
+			ID: id,
+			Attributes: &keyvault.CertificateAttributes{
+				Enabled:   boolPtr(true),
+				NotBefore: unixPtr(now.Add(-time.Hour)),
+				Expires:   unixPtr(now.AddDate(1, 0, 0)),
+				Created:   unixPtr(now.Add(-time.Duration(i) * time.Hour)),
+			},
+		})
+	}
+	s := newFakeKVStore(t, kv, WithCacheTTL(time.Hour))
+	url := "https://test.vault.azure.net/secrets/ca"
+	get := func() string {
+		t.Helper()
+		cert, _, _, err := s.GetCertSigner(context.Background(), url, "", SelectVersion(VersionLatestEnabled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Subject.CommonName
+	}
+
+	// Populate the cache while the rollback is in progress, i.e. before any
+	// version has been disabled
+	var populated bool
+	kv.onRequest = func(r *http.Request) {
+		if r.Method == http.MethodPatch && !populated {
+			populated = true
+			if got := get(); got != "testca-v2" {
+				t.Errorf("want testca-v2 during rollback, got %v", got)
+			}
+		}
+	}
+
+	disabled, enabled, err := s.RollbackCert(context.Background(), "https://test.vault.azure.net/certificates/ca", "v2", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disabled.Version != "v2" || enabled.Version != "v1" {
+		t.Fatalf("want v2 disabled and v1 enabled, got %v and %v", disabled.Version, enabled.Version)
+	}
+	if got := get(); got != "testca-v1" {
+		t.Errorf("want testca-v1 after rollback, got %v", got)
+	}
+}
+
+func TestStore_RollbackCert_defaultVersion(t *testing.T) {
+	now := time.Now()
+	strPtr := func(s string) *string { return &s }
+	boolPtr := func(b bool) *bool { return &b }
+	unixPtr := func(t time.Time) *date.UnixTime { u := date.UnixTime(t); return &u }
+
+	kv := &fakeKeyVault{
+		permissions: map[string]bool{
+			"secrets/get":         true,
+			"certificates/get":    true,
+			"certificates/list":   true,
+			"certificates/update": true,
+		},
+		secrets:      make(map[string]keyvault.SecretBundle),
+		certs:        make(map[string]keyvault.CertificateBundle),
+		certVersions: make(map[string][]keyvault.CertificateItem),
+	}
+	for i, version := range []string{"v2", "v1"} {
+		caCert, caKey, err := GenSelfSignedCA("testca-"+version, now.AddDate(1, 0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pemBundle, err := encodePEMBundle(caCert, nil, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bundle := keyvault.SecretBundle{
+			ID:          strPtr("https://test.vault.azure.net/secrets/ca/" + version),
+			Value:       strPtr(string(pemBundle)),
+			ContentType: strPtr(contentTypePEM),
+		}
+		id := strPtr("https://test.vault.azure.net/certificates/ca/" + version)
+		kv.secrets["ca/"+version] = bundle
+		if i == 0 {
+			kv.secrets["ca"] = bundle
+		}
+		kv.certs["ca/"+version] = keyvault.CertificateBundle{ID: id, Cer: &caCert.Raw}
+		kv.certVersions["ca"] = append(kv.certVersions["ca"], keyvault.CertificateItem{
+			ID: id,
+			Attributes: &keyvault.CertificateAttributes{
+				Enabled:   boolPtr(true),
+				NotBefore: unixPtr(now.Add(-time.Hour)),
+				Expires:   unixPtr(now.AddDate(1, 0, 0)),
+				Created:   unixPtr(now.Add(-time.Duration(i) * time.Hour)),
+			},
+		})
+	}
+	s := newFakeKVStore(t, kv)
+	url := "https://test.vault.azure.net/secrets/ca"
+	get := func() string {
+		t.Helper()
+		cert, _, _, err := s.GetCert(context.Background(), url, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Subject.CommonName
+	}
+
+	if got := get(); got != "testca-v2" {
+		t.Fatalf("want testca-v2 before rollback, got %v", got)
+	}
+	if n := kv.requestCount("GET /certificates/ca/versions"); n != 0 {
+		t.Errorf("want no listing while the latest version is enabled, got %v", n)
+	}
+
+	if _, _, err := s.RollbackCert(context.Background(), "https://test.vault.azure.net/certificates/ca", "v2", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(); got != "testca-v1" {
+		t.Errorf("want testca-v1 after rollback, got %v", got)
+	}
+}
+
+func TestStore_retry(t *testing.T) {
+	caCert, caKey, err := GenSelfSignedCA("testca", time.Now().AddDate(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBundle, err := encodePEMBundle(caCert, nil, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strPtr := func(s string) *string { return &s }
+
+	get := func(s *Store) error {
+		_, _, _, err := s.GetCertSigner(context.Background(), "https://test.vault.azure.net/secrets/ca", "")
+		return err
+	}
+	upload := func(s *Store) error {
+		return s.UploadCert(context.Background(), "https://test.vault.azure.net/certificates/ca", caCert, nil, caKey, "", AllowNewVersion())
+	}
+
+	for _, tc := range []struct {
+		name         string
+		do           func(s *Store) error
+		retries      int
+		failures     []int
+		retryAfter   string
+		wantRequests int
+		wantStatus   int
+		wantDelay    time.Duration
+	}{
+		{"server error", get, 3, []int{http.StatusServiceUnavailable}, "", 2, 0, 0},
+		{"throttled", get, 3, []int{http.StatusTooManyRequests}, "1", 2, 0, time.Second},
+		{"retries exhausted", get, 1, []int{http.StatusTooManyRequests, http.StatusTooManyRequests}, "", 2, http.StatusTooManyRequests, 0},
+		{"not retried", get, 3, []int{http.StatusForbidden}, "", 1, http.StatusForbidden, 0},
+		{"import throttled", upload, 3, []int{http.StatusTooManyRequests}, "", 2, 0, 0},
+		{"import server error", upload, 3, []int{http.StatusInternalServerError}, "", 1, http.StatusInternalServerError, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kv := &fakeKeyVault{
+				permissions: map[string]bool{"secrets/get": true, "certificates/import": true},
+				secrets: map[string]keyvault.SecretBundle{
+					"ca": {Value: strPtr(string(pemBundle)), ContentType: strPtr(contentTypePEM)},
+				},
+				failures:   tc.failures,
+				retryAfter: tc.retryAfter,
+			}
+			s := newFakeKVStore(t, kv, WithRetry(tc.retries, time.Millisecond))
+
+			start := time.Now()
+			err := tc.do(s)
+			var storeErr *StoreError
+			switch {
+			case tc.wantStatus == 0 && err != nil:
+				t.Fatal(err)
+			case tc.wantStatus != 0 && (!errors.As(err, &storeErr) || storeErr.StatusCode != tc.wantStatus):
+				t.Fatalf("want status code %v, got err: %v", tc.wantStatus, err)
+			}
+			if elapsed := time.Since(start); elapsed < tc.wantDelay {
+				t.Errorf("want a delay of at least %v, got %v", tc.wantDelay, elapsed)
+			}
+			// Versions are listed when the latest secret is forbidden, as
+			// disabled secrets are, which is not a retry
+			if n := len(kv.requests) - kv.requestCount("GET /certificates/ca/versions"); n != tc.wantRequests {
+				t.Errorf("want %v requests, got %v", tc.wantRequests, n)
+			}
+		})
+	}
+}
+
+func Test_retryDelay(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		retryAfter string
+		attempt    int
+		want       time.Duration
+	}{
+		{"backoff", "", 0, time.Second},
+		{"exponential backoff", "", 2, 4 * time.Second},
+		{"capped backoff", "", 10, maxRetryBackoff},
+		{"retry-after", "5", 0, 5 * time.Second},
+		{"capped retry-after", "120", 0, maxRetryBackoff},
+		{"retry-after date", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), 0, maxRetryBackoff},
+		{"invalid retry-after", "soon", 1, 2 * time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: make(http.Header)}
+			if tc.retryAfter != "" {
+				resp.Header.Set("Retry-After", tc.retryAfter)
+			}
+			if got := retryDelay(resp, time.Second, tc.attempt); got != tc.want {
+				t.Errorf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_azureCLITokenProvider_EnsureFreshWithContext(t *testing.T) {
+	newToken := func(accessToken string, expiresIn time.Duration) adal.Token {
+		return adal.Token{
+			AccessToken: accessToken,
+			ExpiresOn:   json.Number(strconv.FormatInt(time.Now().Add(expiresIn).Unix(), 10)),
+		}
+	}
+
+	for _, tc := range []struct {
+		name      string
+		expiresIn time.Duration
+		want      string
+	}{
+		{"fresh", time.Hour, "old"},
+		{"about to expire", time.Minute, "new"},
+		{"expired", -time.Minute, "new"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int
+			p := &azureCLITokenProvider{
+				getToken: func() (adal.Token, error) {
+					calls++
+					return newToken("new", time.Hour), nil
+				},
+				token: newToken("old", tc.expiresIn),
+			}
+			if err := p.EnsureFreshWithContext(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := p.OAuthToken(); got != tc.want {
+				t.Errorf("want token %v, got %v", tc.want, got)
+			}
+
+			// A refreshed token is not refreshed again
+			if err := p.EnsureFreshWithContext(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if wantCalls := map[string]int{"old": 0, "new": 1}[tc.want]; calls != wantCalls {
+				t.Errorf("want %v refreshes, got %v", wantCalls, calls)
+			}
+		})
+	}
+}
@@ -9,6 +9,77 @@ import (
 	"time"
 )
 
+// MTLSOption configures the TLS configs returned by GetMTLSClientConfig and
+// GetMTLSServerConfig.
+type MTLSOption func(*mtlsOptions)
+
+type mtlsOptions struct {
+	caVersion     string
+	spiffeID      string
+	authorize     SPIFFEAuthorizer
+	trustBundle   []*x509.Certificate
+	bundleSources []string
+}
+
+// WithCAVersion selects which version of the CA to sign with, see
+// SelectVersion. Use VersionLatestEnabled to keep working after the latest
+// version of the CA has been disabled by a rollback.
+func WithCAVersion(version string) MTLSOption {
+	return func(o *mtlsOptions) {
+		o.caVersion = version
+	}
+}
+
+// WithSPIFFEID issues the certificate as an X.509-SVID with the provided
+// SPIFFE ID, e.g. spiffe://example.org/ns/prod/sa/api.
+func WithSPIFFEID(id string) MTLSOption {
+	return func(o *mtlsOptions) {
+		o.spiffeID = id
+	}
+}
+
+// WithSPIFFEAuthorizer requires the peer to present an X.509-SVID signed by
+// the CA and authorizes it by its SPIFFE ID. For clients, the server is no
+// longer verified by its host name.
+func WithSPIFFEAuthorizer(authorize SPIFFEAuthorizer) MTLSOption {
+	return func(o *mtlsOptions) {
+		o.authorize = authorize
+	}
+}
+
+// WithTrustBundle trusts the certificates of the bundle in addition to the
+// issuing CA, e.g. the new CA during a rollover or the CA of a partner. Every
+// certificate in the bundle is trusted as an anchor, including intermediates.
+func WithTrustBundle(certs ...*x509.Certificate) MTLSOption {
+	return func(o *mtlsOptions) {
+		o.trustBundle = append(o.trustBundle, certs...)
+	}
+}
+
+// WithTrustBundleFrom is like WithTrustBundle, but loads the bundle from
+// secret URLs in the store or PEM files, see LoadTrustBundle. PKCS#12 secrets
+// are decrypted with the CA password.
+func WithTrustBundleFrom(sources ...string) MTLSOption {
+	return func(o *mtlsOptions) {
+		o.bundleSources = append(o.bundleSources, sources...)
+	}
+}
+
+// trustPool returns a pool of the issuing CA and the trust bundle.
+func (s *Store) trustPool(ctx context.Context, caCert *x509.Certificate, caPassword string, o mtlsOptions) (*x509.CertPool, error) {
+	bundle := o.trustBundle
+	if len(o.bundleSources) > 0 {
+		loaded, err := s.LoadTrustBundle(ctx, caPassword, o.bundleSources...)
+		if err != nil {
+			return nil, err
+		}
+		bundle = MergeTrustBundles(bundle, loaded)
+	}
+	return newTrustPool(caCert, bundle), nil
+}
+
+// GetMTLSClientConfig returns a client TLS config with a newly issued client
+// certificate signed by the CA found at caURL.
 func GetMTLSClientConfig(
 	ctx context.Context,
 	caURL string,
@@ -16,40 +87,79 @@ func GetMTLSClientConfig(
 	clientName string,
 	serverName string,
 	expiresAt time.Time,
+	opts ...MTLSOption,
 ) (*tls.Config, error) {
-	caCert, caCerts, caKey, err := GetCert(ctx, caURL, caPassword)
+	s, err := getDefaultStore()
 	if err != nil {
 		return nil, err
 	}
 
-	cert, key, err := GenSignedCert(caCert, caKey, clientName, nil, expiresAt)
+	return s.GetMTLSClientConfig(ctx, caURL, caPassword, clientName, serverName, expiresAt, opts...)
+}
+
+// GetMTLSClientConfig returns a client TLS config with a newly issued client
+// certificate signed by the CA found at caURL.
+func (s *Store) GetMTLSClientConfig(
+	ctx context.Context,
+	caURL string,
+	caPassword string,
+	clientName string,
+	serverName string,
+	expiresAt time.Time,
+	opts ...MTLSOption,
+) (*tls.Config, error) {
+	var o mtlsOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	caCert, caCerts, caKey, err := s.GetCert(ctx, caURL, caPassword, SelectVersion(o.caVersion))
 	if err != nil {
 		return nil, err
 	}
 
-	certs := []*x509.Certificate{cert}
-	if len(caCerts) > 0 {
-		certs = append(certs, caCert)
-		certs = append(certs, caCerts[:len(caCerts)-1]...)
+	var sans []string
+	if o.spiffeID != "" {
+		sans = append(sans, o.spiffeID)
 	}
+	cert, key, err := GenSignedCert(caCert, caKey, clientName, sans, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, _, err := BuildPartialChain(caCert, caCerts)
+	if err != nil {
+		return nil, err
+	}
+	certs := append([]*x509.Certificate{cert}, chain...)
 
 	tlsCert, err := TLSCertificate(certs, key)
 	if err != nil {
 		return nil, err
 	}
 
-	caPool := x509.NewCertPool()
-	caPool.AddCert(caCert)
+	caPool, err := s.trustPool(ctx, caCert, caPassword, o)
+	if err != nil {
+		return nil, err
+	}
 
 	tlsConf := tls.Config{
 		ServerName:   serverName,
 		RootCAs:      caPool,
 		Certificates: []tls.Certificate{tlsCert},
 	}
+	if o.authorize != nil {
+		// The server is verified by its SPIFFE ID rather than its host name
+		tlsConf.InsecureSkipVerify = true
+		tlsConf.VerifyPeerCertificate = VerifySVID(caPool, x509.ExtKeyUsageServerAuth, o.authorize)
+	}
 
 	return &tlsConf, nil
 }
 
+// GetMTLSServerConfig returns a server TLS config which requires and verifies
+// client certificates, with a newly issued server certificate signed by the CA
+// found at caURL.
 func GetMTLSServerConfig(
 	ctx context.Context,
 	caURL string,
@@ -57,36 +167,71 @@ func GetMTLSServerConfig(
 	hostname string,
 	altNames []string,
 	expiresAt time.Time,
+	opts ...MTLSOption,
+) (*tls.Config, error) {
+	s, err := getDefaultStore()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetMTLSServerConfig(ctx, caURL, caPassword, hostname, altNames, expiresAt, opts...)
+}
+
+// GetMTLSServerConfig returns a server TLS config which requires and verifies
+// client certificates, with a newly issued server certificate signed by the CA
+// found at caURL.
+func (s *Store) GetMTLSServerConfig(
+	ctx context.Context,
+	caURL string,
+	caPassword string,
+	hostname string,
+	altNames []string,
+	expiresAt time.Time,
+	opts ...MTLSOption,
 ) (*tls.Config, error) {
-	caCert, caCerts, caKey, err := GetCert(ctx, caURL, caPassword)
+	var o mtlsOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	caCert, caCerts, caKey, err := s.GetCert(ctx, caURL, caPassword, SelectVersion(o.caVersion))
 	if err != nil {
 		return nil, err
 	}
 
-	cert, key, err := GenSignedCert(caCert, caKey, hostname, altNames, expiresAt)
+	sans := altNames
+	if o.spiffeID != "" {
+		sans = append(append([]string{}, altNames...), o.spiffeID)
+	}
+	cert, key, err := GenSignedCert(caCert, caKey, hostname, sans, expiresAt)
 	if err != nil {
 		return nil, err
 	}
 
-	certs := []*x509.Certificate{cert}
-	if len(caCerts) > 0 {
-		certs = append(certs, caCert)
-		certs = append(certs, caCerts[:len(caCerts)-1]...)
+	chain, _, err := BuildPartialChain(caCert, caCerts)
+	if err != nil {
+		return nil, err
 	}
+	certs := append([]*x509.Certificate{cert}, chain...)
 
 	tlsCert, err := TLSCertificate(certs, key)
 	if err != nil {
 		return nil, err
 	}
 
-	caPool := x509.NewCertPool()
-	caPool.AddCert(caCert)
+	caPool, err := s.trustPool(ctx, caCert, caPassword, o)
+	if err != nil {
+		return nil, err
+	}
 
 	tlsConf := tls.Config{
 		ClientCAs:    caPool,
 		Certificates: []tls.Certificate{tlsCert},
 		ClientAuth:   tls.RequireAndVerifyClientCert,
 	}
+	if o.authorize != nil {
+		tlsConf.VerifyPeerCertificate = VerifySVID(caPool, x509.ExtKeyUsageClientAuth, o.authorize)
+	}
 
 	return &tlsConf, nil
 }
@@ -0,0 +1,149 @@
+package certmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Version selectors accepted by SelectVersion. Any other non-empty value is
+// treated as a pinned version ID.
+const (
+	// VersionLatest selects the most recently created version, or the most
+	// recently created enabled version if it is disabled, e.g. after a
+	// rollback. This is the default. Unlike VersionLatestEnabled, versions
+	// are only listed if the latest version is disabled.
+	VersionLatest = "latest"
+
+	// VersionLatestEnabled selects the most recently created enabled version.
+	VersionLatestEnabled = "latest-enabled"
+
+	// VersionLatestValid selects the most recently created enabled version
+	// which is currently within its validity period.
+	VersionLatestValid = "latest-valid"
+)
+
+// CertVersion describes a single stored version of a certificate.
+type CertVersion struct {
+	Version      string
+	Enabled      bool
+	CreatedAt    time.Time
+	SerialNumber *big.Int
+	Thumbprint   string
+	Subject      string
+	Issuer       string
+	NotBefore    time.Time
+	NotAfter     time.Time
+}
+
+// Valid returns true if the version is enabled and t is within the validity
+// period of the certificate.
+func (v CertVersion) Valid(t time.Time) bool {
+	return v.Enabled && !t.Before(v.NotBefore) && !t.After(v.NotAfter)
+}
+
+// GetCertOption configures the behaviour of GetCert.
+type GetCertOption func(*getCertOptions)
+
+type getCertOptions struct {
+	version string
+}
+
+// SelectVersion selects which version of the certificate GetCert should
+// retrieve. The version may be one of VersionLatest, VersionLatestEnabled,
+// VersionLatestValid, or a specific version ID.
+func SelectVersion(version string) GetCertOption {
+	return func(o *getCertOptions) {
+		o.version = version
+	}
+}
+
+// ListCertVersions lists all versions of the certificate found at url,
+// newest first. The URL may point to either the secret or the certificate.
+func ListCertVersions(ctx context.Context, url string) ([]CertVersion, error) {
+	s, err := getDefaultStore()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.ListCertVersions(ctx, url)
+}
+
+// RollbackCert disables the version badVersion of the certificate found at
+// url and re-enables the version toVersion.
+//
+// When badVersion is empty, the latest enabled version is disabled. When
+// toVersion is empty, the version created right before badVersion is enabled.
+func RollbackCert(
+	ctx context.Context,
+	url string,
+	badVersion string,
+	toVersion string,
+) (disabled CertVersion, enabled CertVersion, err error) {
+	s, err := getDefaultStore()
+	if err != nil {
+		return CertVersion{}, CertVersion{}, err
+	}
+
+	return s.RollbackCert(ctx, url, badVersion, toVersion)
+}
+
+// selectCertVersion picks a version from versions (sorted newest first)
+// according to the provided selector.
+func selectCertVersion(versions []CertVersion, selector string, now time.Time) (CertVersion, error) {
+	for _, v := range versions {
+		switch selector {
+		case "", VersionLatest, VersionLatestEnabled:
+			if v.Enabled {
+				return v, nil
+			}
+		case VersionLatestValid:
+			if v.Valid(now) {
+				return v, nil
+			}
+		default:
+			if v.Version == selector {
+				return v, nil
+			}
+		}
+	}
+	return CertVersion{}, fmt.Errorf("no version matching '%v' was found", selector)
+}
+
+// planRollback finds the versions to disable and enable for a rollback.
+// Versions must be sorted newest first. now is used to resolve
+// VersionLatestValid.
+func planRollback(versions []CertVersion, badVersion, toVersion string, now time.Time) (bad CertVersion, to CertVersion, err error) {
+	if badVersion == "" {
+		badVersion = VersionLatestEnabled
+	}
+	bad, err = selectCertVersion(versions, badVersion, now)
+	if err != nil {
+		return CertVersion{}, CertVersion{}, appendErr("failed to find version to disable", err)
+	}
+
+	if toVersion != "" {
+		to, err = selectCertVersion(versions, toVersion, now)
+		if err != nil {
+			return CertVersion{}, CertVersion{}, appendErr("failed to find version to enable", err)
+		}
+	} else {
+		for _, v := range versions {
+			if v.CreatedAt.Before(bad.CreatedAt) {
+				to = v
+				break
+			}
+		}
+		if to.Version == "" {
+			return CertVersion{}, CertVersion{}, fmt.Errorf("there is no version prior to %v", bad.Version)
+		}
+	}
+
+	if to.Version == bad.Version {
+		return CertVersion{}, CertVersion{}, errors.New("cannot roll back to the version being disabled")
+	}
+
+	return bad, to, nil
+}
@@ -0,0 +1,74 @@
+package certmanager
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_selectCertVersion(t *testing.T) {
+	now := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+	versions := []CertVersion{
+		{Version: "c", Enabled: false, NotBefore: now.AddDate(0, -1, 0), NotAfter: now.AddDate(1, 0, 0)},
+		{Version: "b", Enabled: true, NotBefore: now.AddDate(0, 0, 1), NotAfter: now.AddDate(1, 0, 0)},
+		{Version: "a", Enabled: true, NotBefore: now.AddDate(-1, 0, 0), NotAfter: now.AddDate(1, 0, 0)},
+	}
+
+	for _, tc := range []struct {
+		selector string
+		want     string
+		wantErr  bool
+	}{
+		{"", "b", false},
+		{VersionLatest, "b", false},
+		{VersionLatestEnabled, "b", false},
+		{VersionLatestValid, "a", false},
+		{"b", "b", false},
+		{"d", "", true},
+	} {
+		t.Run(tc.selector, func(t *testing.T) {
+			got, err := selectCertVersion(versions, tc.selector, now)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if got.Version != tc.want {
+				t.Errorf("expected version %q, got %q", tc.want, got.Version)
+			}
+		})
+	}
+}
+
+func Test_planRollback(t *testing.T) {
+	now := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+	versions := []CertVersion{
+		{Version: "c", Enabled: true, CreatedAt: now, NotBefore: now, NotAfter: now.AddDate(1, 0, 0)},
+		{Version: "b", Enabled: false, CreatedAt: now.AddDate(0, -1, 0), NotBefore: now.AddDate(0, -1, 0), NotAfter: now.AddDate(1, 0, 0)},
+		{Version: "a", Enabled: true, CreatedAt: now.AddDate(0, -2, 0), NotBefore: now.AddDate(0, -2, 0), NotAfter: now.AddDate(1, 0, 0)},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		bad     string
+		to      string
+		wantBad string
+		wantTo  string
+		wantErr bool
+	}{
+		{"defaults", "", "", "c", "b", false},
+		{"explicit target", "", "a", "c", "a", false},
+		{"explicit bad", "b", "", "b", "a", false},
+		{"nothing prior", "a", "", "", "", true},
+		{"same version", "c", "c", "", "", true},
+		{"latest valid target", "", VersionLatestValid, "", "", true},
+		{"latest valid bad", VersionLatestValid, "a", "c", "a", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bad, to, err := planRollback(versions, tc.bad, tc.to, now)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if bad.Version != tc.wantBad || to.Version != tc.wantTo {
+				t.Errorf("expected %q -> %q, got %q -> %q", tc.wantBad, tc.wantTo, bad.Version, to.Version)
+			}
+		})
+	}
+}